@@ -0,0 +1,110 @@
+// Package blobstore keeps message and attachment content on disk, addressed
+// and deduplicated by SHA-256.
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Store is a content-addressed file store. Blobs live at dir/ab/abcdef...
+// where the name is the hex SHA-256 of the content.
+type Store struct {
+	dir string
+}
+
+// New creates a store rooted at dir, creating the directory if needed
+func New(dir string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put streams r to disk and returns its SHA-256 and size. The blob is fsynced
+// before Put returns; content that is already stored is not written twice.
+func (s *Store) Put(r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "blob-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	path := s.Path(sum)
+	if _, err := os.Stat(path); err == nil {
+		return sum, size, nil
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return "", 0, fmt.Errorf("failed to sync blob: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, fmt.Errorf("failed to close blob: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return "", 0, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, fmt.Errorf("failed to store blob: %w", err)
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return "", 0, fmt.Errorf("failed to sync blob directory: %w", err)
+	}
+
+	return sum, size, nil
+}
+
+// Open opens a stored blob for reading
+func (s *Store) Open(sum string) (io.ReadCloser, error) {
+	if !validSum(sum) {
+		return nil, fmt.Errorf("invalid blob hash %q", sum)
+	}
+	f, err := os.Open(s.Path(sum))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+	return f, nil
+}
+
+// Path returns the file path of a blob
+func (s *Store) Path(sum string) string {
+	if len(sum) < 2 {
+		return filepath.Join(s.dir, sum)
+	}
+	return filepath.Join(s.dir, sum[:2], sum)
+}
+
+// validSum reports whether sum is a lowercase hex SHA-256
+func validSum(sum string) bool {
+	if len(sum) != sha256.Size*2 {
+		return false
+	}
+	for _, c := range sum {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// syncDir flushes a directory entry so a rename survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,177 @@
+// Package clamav scans content for malware with a ClamAV daemon, using the
+// clamd INSTREAM protocol over TCP or a Unix socket.
+package clamav
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+// chunkSize is the size of the INSTREAM chunks sent to clamd
+const chunkSize = 64 * 1024
+
+// ErrSizeLimit is returned when content exceeds the scan size limit, either
+// ours or clamd's StreamMaxLength
+var ErrSizeLimit = errors.New("content exceeds the scan size limit")
+
+// Result is the outcome of a scan
+type Result struct {
+	Infected  bool
+	Signature string // Name of the detected malware, e.g. "Eicar-Signature"
+}
+
+// Client talks to a clamd daemon. Each scan uses its own connection.
+type Client struct {
+	network  string
+	address  string
+	timeout  time.Duration
+	maxBytes int64
+}
+
+// NewClient creates a client for the configured daemon address:
+// "tcp://host:port", "unix:///path/to/clamd.ctl", a bare "host:port" or a
+// bare socket path
+func NewClient(cfg *config.ClamAVConfig) (*Client, error) {
+	c := &Client{timeout: cfg.Timeout, maxBytes: cfg.MaxBytes}
+
+	addr := cfg.Address
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		c.network, c.address = "tcp", strings.TrimPrefix(addr, "tcp://")
+	case strings.HasPrefix(addr, "unix://"):
+		c.network, c.address = "unix", strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "/"):
+		c.network, c.address = "unix", addr
+	case addr != "":
+		c.network, c.address = "tcp", addr
+	default:
+		return nil, errors.New("clamav address is not set")
+	}
+	return c, nil
+}
+
+// Ping checks that the daemon is reachable
+func (c *Client) Ping(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+		return fmt.Errorf("failed to send PING: %w", err)
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply: %s", reply)
+	}
+	return nil
+}
+
+// Scan streams content to the daemon and returns its verdict
+func (c *Client) Scan(ctx context.Context, content io.Reader) (*Result, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return nil, fmt.Errorf("failed to start scan: %w", err)
+	}
+
+	// Each chunk is prefixed with its length; a zero length ends the stream
+	buf := make([]byte, 4+chunkSize)
+	var sent int64
+	for {
+		n, readErr := content.Read(buf[4:])
+		if n > 0 {
+			sent += int64(n)
+			if c.maxBytes > 0 && sent > c.maxBytes {
+				return nil, ErrSizeLimit
+			}
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd closes the connection once its own limit is hit
+				if reply, replyErr := readReply(conn); replyErr == nil {
+					return parseScanReply(reply)
+				}
+				return nil, fmt.Errorf("failed to send content: %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read content: %w", readErr)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, fmt.Errorf("failed to end scan: %w", err)
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	return parseScanReply(reply)
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if c.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return conn, nil
+}
+
+// readReply reads a NUL-terminated reply
+func readReply(conn net.Conn) (string, error) {
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !(err == io.EOF && reply != "") {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// parseScanReply interprets "stream: OK", "stream: <name> FOUND" and
+// "<message> ERROR" replies
+func parseScanReply(reply string) (*Result, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &Result{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return nil, ErrSizeLimit
+	case strings.HasSuffix(reply, " ERROR"):
+		return nil, fmt.Errorf("clamd error: %s", strings.TrimSuffix(reply, " ERROR"))
+	}
+	return nil, fmt.Errorf("unexpected clamd reply: %s", reply)
+}
@@ -0,0 +1,260 @@
+package clamav
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+// fakeClamd speaks the clamd INSTREAM and PING commands
+type fakeClamd struct {
+	reply     func(content []byte) string // Verdict for a complete stream
+	maxStream int                         // Like StreamMaxLength; 0 for none
+
+	mu      sync.Mutex
+	chunks  []int
+	content []byte
+}
+
+// serve accepts connections until the listener is closed
+func (f *fakeClamd) serve(t *testing.T, ln net.Listener) {
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+}
+
+func (f *fakeClamd) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+
+	switch cmd {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+	case "zINSTREAM\x00":
+		var content []byte
+		var chunks []int
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			chunks = append(chunks, int(size))
+			content = append(content, chunk...)
+			if f.maxStream > 0 && len(content) > f.maxStream {
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				io.Copy(io.Discard, r) // Let the client finish writing
+				return
+			}
+		}
+		f.mu.Lock()
+		f.chunks, f.content = chunks, content
+		f.mu.Unlock()
+		conn.Write([]byte(f.reply(content) + "\x00"))
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func startFakeClamd(t *testing.T, f *fakeClamd) *Client {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.serve(t, ln)
+
+	c, err := NewClient(&config.ClamAVConfig{Address: "tcp://" + ln.Addr().String(), Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// eicarReply reports content containing "EICAR" as infected
+func eicarReply(content []byte) string {
+	if bytes.Contains(content, []byte("EICAR")) {
+		return "stream: Eicar-Signature FOUND"
+	}
+	return "stream: OK"
+}
+
+func TestScan(t *testing.T) {
+	c := startFakeClamd(t, &fakeClamd{reply: eicarReply})
+
+	res, err := c.Scan(context.Background(), strings.NewReader("harmless"))
+	if err != nil || res.Infected {
+		t.Errorf("clean scan = %+v, %v", res, err)
+	}
+
+	res, err = c.Scan(context.Background(), strings.NewReader("X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*"))
+	if err != nil || !res.Infected || res.Signature != "Eicar-Signature" {
+		t.Errorf("infected scan = %+v, %v", res, err)
+	}
+}
+
+func TestScanChunks(t *testing.T) {
+	fake := &fakeClamd{reply: eicarReply}
+	c := startFakeClamd(t, fake)
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), (2*chunkSize+1000)/16)
+	if _, err := c.Scan(context.Background(), bytes.NewReader(content)); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if !bytes.Equal(fake.content, content) {
+		t.Errorf("clamd received %d bytes, want the %d sent", len(fake.content), len(content))
+	}
+	want := []int{chunkSize, chunkSize, len(content) - 2*chunkSize}
+	if len(fake.chunks) != len(want) {
+		t.Fatalf("chunks = %v, want %v", fake.chunks, want)
+	}
+	for i := range want {
+		if fake.chunks[i] != want[i] {
+			t.Errorf("chunks = %v, want %v", fake.chunks, want)
+			break
+		}
+	}
+}
+
+func TestScanErrorReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   string
+		want    error
+		message string
+	}{
+		{"clamd error", "stream: Can't allocate memory ERROR", nil, "clamd error: Can't allocate memory"},
+		{"size limit", "INSTREAM size limit exceeded. ERROR", ErrSizeLimit, ""},
+		{"unexpected", "stream: MAYBE", nil, "unexpected clamd reply: MAYBE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := startFakeClamd(t, &fakeClamd{reply: func([]byte) string { return tt.reply }})
+			res, err := c.Scan(context.Background(), strings.NewReader("content"))
+			if res != nil || err == nil {
+				t.Fatalf("Scan = %+v, %v; want an error", res, err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if tt.message != "" && err.Error() != tt.message {
+				t.Errorf("err = %q, want %q", err, tt.message)
+			}
+		})
+	}
+}
+
+func TestScanSizeLimits(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 3*chunkSize)
+
+	// Our own limit stops the upload
+	fake := &fakeClamd{reply: eicarReply}
+	c := startFakeClamd(t, fake)
+	c.maxBytes = chunkSize
+	if _, err := c.Scan(context.Background(), bytes.NewReader(content)); !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("Scan over max_bytes = %v, want ErrSizeLimit", err)
+	}
+
+	// clamd's StreamMaxLength rejects the stream part way
+	c = startFakeClamd(t, &fakeClamd{reply: eicarReply, maxStream: chunkSize})
+	if _, err := c.Scan(context.Background(), bytes.NewReader(content)); !errors.Is(err, ErrSizeLimit) {
+		t.Errorf("Scan over StreamMaxLength = %v, want ErrSizeLimit", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	c := startFakeClamd(t, &fakeClamd{reply: eicarReply})
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+
+	// Unix socket address
+	path := filepath.Join(t.TempDir(), "clamd.ctl")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	(&fakeClamd{reply: eicarReply}).serve(t, ln)
+	c, err = NewClient(&config.ClamAVConfig{Address: "unix://" + path, Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Errorf("Ping over unix socket: %v", err)
+	}
+	if res, err := c.Scan(context.Background(), strings.NewReader("EICAR")); err != nil || !res.Infected {
+		t.Errorf("Scan over unix socket = %+v, %v", res, err)
+	}
+}
+
+func TestPingUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	c, err := NewClient(&config.ClamAVConfig{Address: addr, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ping(context.Background()); err == nil {
+		t.Error("Ping of a closed port succeeded")
+	}
+}
+
+func TestNewClientAddress(t *testing.T) {
+	tests := []struct {
+		address, network, addr string
+	}{
+		{"tcp://127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"unix:///run/clamd.ctl", "unix", "/run/clamd.ctl"},
+		{"/run/clamd.ctl", "unix", "/run/clamd.ctl"},
+		{"clamd:3310", "tcp", "clamd:3310"},
+	}
+	for _, tt := range tests {
+		c, err := NewClient(&config.ClamAVConfig{Address: tt.address})
+		if err != nil {
+			t.Errorf("NewClient(%q): %v", tt.address, err)
+			continue
+		}
+		if c.network != tt.network || c.address != tt.addr {
+			t.Errorf("NewClient(%q) = %s %s, want %s %s", tt.address, c.network, c.address, tt.network, tt.addr)
+		}
+	}
+	if _, err := NewClient(&config.ClamAVConfig{}); err == nil {
+		t.Error("NewClient without an address succeeded")
+	}
+}
@@ -1,26 +1,71 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the application configuration
 type Config struct {
-	Server    ServerConfig    `yaml:"server"`
-	SMTP      SMTPOutConfig   `yaml:"smtp"`
-	Database  DatabaseConfig  `yaml:"database"`
-	LLM       LLMConfig       `yaml:"llm"`
-	MCP       MCPConfig       `yaml:"mcp"`
-	Mailboxes []MailboxConfig `yaml:"mailboxes"`
+	Server     ServerConfig     `yaml:"server"`
+	SMTP       SMTPOutConfig    `yaml:"smtp"`
+	Database   DatabaseConfig   `yaml:"database"`
+	LLM        LLMConfig        `yaml:"llm"`
+	MCP        MCPConfig        `yaml:"mcp"`
+	Templates  []TemplateConfig `yaml:"templates"`
+	Spam       SpamConfig       `yaml:"spam"`
+	Extraction ExtractionConfig `yaml:"extraction"`
+	ClamAV     ClamAVConfig     `yaml:"clamav"`
+	SMIME      SMIMEConfig      `yaml:"smime"`
+	PGP        PGPConfig        `yaml:"pgp"`
+	Mailboxes  []MailboxConfig  `yaml:"mailboxes"`
+}
+
+// SpamConfig controls the built-in spam scorer
+type SpamConfig struct {
+	Enabled          bool               `yaml:"enabled"`
+	Rules            map[string]float64 `yaml:"rules"`              // Override rule scores by name (0 disables a rule)
+	BayesWeight      float64            `yaml:"bayes_weight"`       // Points added at 100% spam probability (default: 4)
+	BayesMinTraining int                `yaml:"bayes_min_training"` // Emails needed per class before Bayes is used (default: 20)
+	TrainInterval    time.Duration      `yaml:"train_interval"`     // How often newly labelled emails are learned (default: 10m)
+}
+
+// ExtractionConfig limits attachment text extraction
+type ExtractionConfig struct {
+	MaxBytes int64 `yaml:"max_bytes"` // Larger attachments are not extracted (default: 20MB)
+	MaxChars int   `yaml:"max_chars"` // Extracted text kept per attachment (default: 200000)
+}
+
+// ClamAVConfig controls attachment malware scanning with a clamd daemon
+type ClamAVConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Address  string        `yaml:"address"`   // "tcp://host:port" or "unix:///path/to/clamd.ctl" (default: tcp://127.0.0.1:3310)
+	Timeout  time.Duration `yaml:"timeout"`   // Per attachment (default: 30s)
+	MaxBytes int64         `yaml:"max_bytes"` // Larger attachments are not scanned; keep at or below clamd's StreamMaxLength (default: 25MB)
+}
+
+// SMIMEConfig holds the keys for S/MIME decryption and signature checks
+type SMIMEConfig struct {
+	Certificate string `yaml:"certificate"` // PEM certificate that mail is encrypted to
+	Key         string `yaml:"key"`         // PEM private key of the certificate
+	TrustedCAs  string `yaml:"trusted_cas"` // PEM bundle of CAs signers must chain to (default: system roots)
+}
+
+// PGPConfig holds the keys for PGP decryption and signature checks
+type PGPConfig struct {
+	PrivateKey string `yaml:"private_key"` // Armored private key file that mail is encrypted to
+	Passphrase string `yaml:"passphrase"`  // Passphrase of the private key, if it is protected
+	PublicKeys string `yaml:"public_keys"` // Armored keyring of trusted signers
 }
 
 // SMTPOutConfig holds outbound email settings
 type SMTPOutConfig struct {
-	Provider    string `yaml:"provider"` // "resend", "smtp", or empty for none
+	Provider    string `yaml:"provider"` // "resend", "smtp", "sendgrid", "mailgun", "postmark", "ses", or empty for none
 	ResendKey   string `yaml:"resend_key"`
 	FromAddress string `yaml:"from_address"`
 	FromName    string `yaml:"from_name"`
@@ -29,14 +74,151 @@ type SMTPOutConfig struct {
 	Port     int    `yaml:"port"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+	// DKIM signing for mail sent through SMTP
+	DKIM DKIMConfig `yaml:"dkim"`
+	// HTTP API provider settings
+	SendGrid SendGridConfig `yaml:"sendgrid"`
+	Mailgun  MailgunConfig  `yaml:"mailgun"`
+	Postmark PostmarkConfig `yaml:"postmark"`
+	SES      SESConfig      `yaml:"ses"`
+}
+
+// DKIMConfig holds DKIM signing settings for outbound SMTP mail
+type DKIMConfig struct {
+	Domain   string   `yaml:"domain"`
+	Selector string   `yaml:"selector"`
+	KeyFile  string   `yaml:"key_file"` // PEM encoded RSA or Ed25519 private key; empty disables signing
+	Headers  []string `yaml:"headers"`  // Header fields to sign (default: common fields)
+}
+
+// SendGridConfig holds SendGrid API settings
+type SendGridConfig struct {
+	APIKey   string `yaml:"api_key"`
+	Endpoint string `yaml:"endpoint"` // Override API base URL (default: https://api.sendgrid.com)
+}
+
+// MailgunConfig holds Mailgun API settings
+type MailgunConfig struct {
+	APIKey   string `yaml:"api_key"`
+	Domain   string `yaml:"domain"`
+	Region   string `yaml:"region"`   // "us" (default) or "eu"
+	Endpoint string `yaml:"endpoint"` // Override API base URL
+}
+
+// PostmarkConfig holds Postmark API settings
+type PostmarkConfig struct {
+	ServerToken   string `yaml:"server_token"`
+	MessageStream string `yaml:"message_stream"` // Default: "outbound"
+	Endpoint      string `yaml:"endpoint"`       // Override API base URL (default: https://api.postmarkapp.com)
+}
+
+// SESConfig holds Amazon SES (v2 API) settings
+type SESConfig struct {
+	Region           string `yaml:"region"`
+	AccessKeyID      string `yaml:"access_key_id"`     // Falls back to AWS_ACCESS_KEY_ID
+	SecretAccessKey  string `yaml:"secret_access_key"` // Falls back to AWS_SECRET_ACCESS_KEY
+	SessionToken     string `yaml:"session_token"`     // Falls back to AWS_SESSION_TOKEN
+	ConfigurationSet string `yaml:"configuration_set"`
+	Endpoint         string `yaml:"endpoint"` // Override API base URL (default: https://email.<region>.amazonaws.com)
 }
 
 // ServerConfig holds SMTP server settings
 type ServerConfig struct {
-	SMTPPort       int        `yaml:"smtp_port"`
-	SMTPHost       string     `yaml:"smtp_host"`
-	TLS            TLSConfig  `yaml:"tls"`
-	AllowedDomains []string   `yaml:"allowed_domains"`
+	SMTPPort       int               `yaml:"smtp_port"`
+	SMTPHost       string            `yaml:"smtp_host"`
+	TLS            TLSConfig         `yaml:"tls"`
+	AllowedDomains []string          `yaml:"allowed_domains"`
+	RequireAuth    bool              `yaml:"require_auth"` // Require SMTP AUTH on the main listener
+	Submission     SubmissionConfig  `yaml:"submission"`
+	Listeners      []ListenerConfig  `yaml:"listeners"` // Replaces smtp_host/smtp_port/submission when set
+	SMTPAuth       SMTPAuthConfig    `yaml:"smtp_auth"`
+	Authentication InboundAuthConfig `yaml:"authentication"`
+	// Protocol limits (listeners inherit the size limits unless they set their own)
+	Hostname        string        `yaml:"hostname"`          // EHLO/banner name (default: system hostname)
+	ReadTimeout     time.Duration `yaml:"read_timeout"`      // Default: 60s
+	WriteTimeout    time.Duration `yaml:"write_timeout"`     // Default: 60s
+	MaxMessageBytes int64         `yaml:"max_message_bytes"` // Default: 25MB
+	MaxRecipients   int           `yaml:"max_recipients"`    // Default: 100
+	// Message bytes held in memory across all sessions; larger loads wait (default: 256MB)
+	MemoryLimit int64 `yaml:"memory_limit"`
+	// Route and process each envelope recipient of a delivery separately
+	SplitRecipients bool `yaml:"split_recipients"`
+	// Reject recipients at RCPT time that no mailbox rule could match
+	RejectUnknownRecipients bool             `yaml:"reject_unknown_recipients"`
+	Protection              ProtectionConfig `yaml:"protection"`
+	DNSBL                   DNSBLConfig      `yaml:"dnsbl"`
+}
+
+// DNSBLConfig defines DNS blocklist checks on connecting clients. Listeners
+// that require AUTH and allow_cidrs clients are not checked.
+type DNSBLConfig struct {
+	Zones   []string      `yaml:"zones"`   // e.g. "zen.spamhaus.org"
+	Action  string        `yaml:"action"`  // "tag" (default) adds an X-DNSBL header, "reject" refuses the session
+	Timeout time.Duration `yaml:"timeout"` // Default: 2s
+}
+
+// ProtectionConfig defines connection-level abuse controls. Zero limits are unlimited.
+type ProtectionConfig struct {
+	AllowCIDRs                   []string       `yaml:"allow_cidrs"` // Trusted clients, exempt from limits, deny list and greylisting
+	DenyCIDRs                    []string       `yaml:"deny_cidrs"`
+	MaxSessions                  int            `yaml:"max_sessions"`        // Concurrent sessions across all clients
+	MaxSessionsPerIP             int            `yaml:"max_sessions_per_ip"` // Concurrent sessions per client IP
+	MaxConnectionsPerIPPerMinute int            `yaml:"max_connections_per_ip_per_minute"`
+	MaxMessagesPerIPPerHour      int            `yaml:"max_messages_per_ip_per_hour"`
+	Greylisting                  GreylistConfig `yaml:"greylisting"`
+}
+
+// GreylistConfig defines greylisting of unknown (client network, sender, recipient) triplets
+type GreylistConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Delay    time.Duration `yaml:"delay"`    // Minimum wait before a retry is accepted (default: 5m)
+	Window   time.Duration `yaml:"window"`   // Retries after this are greylisted again (default: 4h)
+	Lifetime time.Duration `yaml:"lifetime"` // How long a passed triplet is remembered (default: 36 days)
+}
+
+// SubmissionConfig defines an optional listener for authenticated message submission
+type SubmissionConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	SMTPHost string `yaml:"smtp_host"` // Default: server smtp_host
+	SMTPPort int    `yaml:"smtp_port"` // Default: 587
+}
+
+// ListenerConfig defines one SMTP endpoint
+type ListenerConfig struct {
+	Name            string   `yaml:"name"`
+	Host            string   `yaml:"host"` // Default: server smtp_host
+	Port            int      `yaml:"port"`
+	TLSMode         string   `yaml:"tls_mode"` // "none", "starttls" or "implicit" (default: starttls if tls is enabled)
+	RequireAuth     bool     `yaml:"require_auth"`
+	AllowedDomains  []string `yaml:"allowed_domains"`   // Default: server allowed_domains
+	MaxMessageBytes int64    `yaml:"max_message_bytes"` // Default: server max_message_bytes
+	MaxRecipients   int      `yaml:"max_recipients"`    // Default: server max_recipients
+}
+
+// TLS modes for listeners
+const (
+	TLSModeNone     = "none"
+	TLSModeSTARTTLS = "starttls"
+	TLSModeImplicit = "implicit"
+)
+
+// SMTPAuthConfig defines how SMTP AUTH credentials are checked
+type SMTPAuthConfig struct {
+	Backend       string           `yaml:"backend"`        // "config" (default) or "sqlite"
+	Users         []SMTPUserConfig `yaml:"users"`          // Used by the config backend
+	AllowInsecure bool             `yaml:"allow_insecure"` // Offer AUTH without TLS (testing only)
+}
+
+// SMTPUserConfig is a submission account for the config backend
+type SMTPUserConfig struct {
+	Username     string `yaml:"username"`
+	PasswordHash string `yaml:"password_hash"` // bcrypt hash
+}
+
+// InboundAuthConfig controls SPF, DKIM, DMARC and ARC checks on received mail
+type InboundAuthConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"` // DNS time budget per message (default: 10s)
 }
 
 // TLSConfig holds TLS settings
@@ -73,6 +255,18 @@ type MCPServerConfig struct {
 	Env     []string `yaml:"env"`
 }
 
+// TemplateConfig defines a named outbound email template. Subject and Text
+// are Go text/template sources, HTML is an html/template source; each may
+// instead be loaded from a file.
+type TemplateConfig struct {
+	Name     string `yaml:"name"`
+	Subject  string `yaml:"subject"`
+	Text     string `yaml:"text"`
+	HTML     string `yaml:"html"`
+	TextFile string `yaml:"text_file"`
+	HTMLFile string `yaml:"html_file"`
+}
+
 // MailboxConfig defines a routing rule and processor
 type MailboxConfig struct {
 	Name      string          `yaml:"name"`
@@ -82,42 +276,102 @@ type MailboxConfig struct {
 
 // MatchConfig defines email matching criteria
 type MatchConfig struct {
-	From    string `yaml:"from"`
-	To      string `yaml:"to"`
-	Subject string `yaml:"subject"`
+	From     string `yaml:"from"`
+	To       string `yaml:"to"`
+	Subject  string `yaml:"subject"`
+	AuthUser string `yaml:"auth_user"` // SMTP AUTH identity of the submitting client
+	// Spam score bounds (unscored mail never matches min_spam_score and always matches max_spam_score)
+	MinSpamScore *float64 `yaml:"min_spam_score"`
+	MaxSpamScore *float64 `yaml:"max_spam_score"`
+	// Header values by name, e.g. {"X-DNSBL": "spamhaus"} (missing headers match as empty)
+	Headers map[string]string `yaml:"headers"`
+	// Sender authentication results (pass, fail, softfail, neutral, none, temperror, permerror)
+	SPF   string `yaml:"spf"`
+	DKIM  string `yaml:"dkim"`
+	DMARC string `yaml:"dmarc"`
+	ARC   string `yaml:"arc"`
+	// Attachment filenames, including files decoded from winmail.dat and those of attached messages
+	Attachment string `yaml:"attachment"`
+	// From address and subject of any attached message (message/rfc822)
+	AttachedFrom    string `yaml:"attached_from"`
+	AttachedSubject string `yaml:"attached_subject"`
+	// S/MIME or PGP signature status (valid, invalid, untrusted, partial, none) and the
+	// address of a valid signature's signer
+	Signature string `yaml:"signature"`
+	Signer    string `yaml:"signer"`
+	// Virus scan result: true matches mail with an infected attachment, false only mail without one
+	Infected *bool `yaml:"infected"`
 }
 
 // CompiledMatch holds compiled regex patterns for matching
 type CompiledMatch struct {
-	From    *regexp.Regexp
-	To      *regexp.Regexp
-	Subject *regexp.Regexp
+	From     *regexp.Regexp
+	To       *regexp.Regexp
+	Subject  *regexp.Regexp
+	AuthUser *regexp.Regexp
+	Headers  map[string]*regexp.Regexp
+	MinSpam  *float64
+	MaxSpam  *float64
+	SPF      *regexp.Regexp
+	DKIM     *regexp.Regexp
+	DMARC    *regexp.Regexp
+	ARC      *regexp.Regexp
+
+	Attachment      *regexp.Regexp
+	AttachedFrom    *regexp.Regexp
+	AttachedSubject *regexp.Regexp
+	Signature       *regexp.Regexp
+	Signer          *regexp.Regexp
+	Infected        *bool
 }
 
 // Compile compiles the match patterns into regex
 func (m *MatchConfig) Compile() (*CompiledMatch, error) {
-	cm := &CompiledMatch{}
-	var err error
+	cm := &CompiledMatch{
+		MinSpam:  m.MinSpamScore,
+		MaxSpam:  m.MaxSpamScore,
+		Infected: m.Infected,
+	}
 
-	if m.From != "" {
-		cm.From, err = regexp.Compile(m.From)
-		if err != nil {
-			return nil, err
-		}
+	patterns := []struct {
+		src string
+		dst **regexp.Regexp
+	}{
+		{m.From, &cm.From},
+		{m.To, &cm.To},
+		{m.Subject, &cm.Subject},
+		{m.AuthUser, &cm.AuthUser},
+		{m.SPF, &cm.SPF},
+		{m.DKIM, &cm.DKIM},
+		{m.DMARC, &cm.DMARC},
+		{m.ARC, &cm.ARC},
+		{m.Attachment, &cm.Attachment},
+		{m.AttachedFrom, &cm.AttachedFrom},
+		{m.AttachedSubject, &cm.AttachedSubject},
+		{m.Signature, &cm.Signature},
+		{m.Signer, &cm.Signer},
 	}
 
-	if m.To != "" {
-		cm.To, err = regexp.Compile(m.To)
+	for _, p := range patterns {
+		if p.src == "" {
+			continue
+		}
+		re, err := regexp.Compile(p.src)
 		if err != nil {
 			return nil, err
 		}
+		*p.dst = re
 	}
 
-	if m.Subject != "" {
-		cm.Subject, err = regexp.Compile(m.Subject)
+	for name, pattern := range m.Headers {
+		re, err := regexp.Compile(pattern)
 		if err != nil {
 			return nil, err
 		}
+		if cm.Headers == nil {
+			cm.Headers = make(map[string]*regexp.Regexp)
+		}
+		cm.Headers[name] = re
 	}
 
 	return cm, nil
@@ -125,11 +379,47 @@ func (m *MatchConfig) Compile() (*CompiledMatch, error) {
 
 // ProcessorConfig defines how to process matched emails
 type ProcessorConfig struct {
-	Type         string   `yaml:"type"` // "llm", "forward", "webhook"
-	SystemPrompt string   `yaml:"system_prompt"`
-	Tools        []string `yaml:"tools"`
-	ForwardTo    string   `yaml:"forward_to"`
-	WebhookURL   string   `yaml:"webhook_url"`
+	Type         string         `yaml:"type"` // "llm", "forward", "webhook", "quarantine"
+	SystemPrompt string         `yaml:"system_prompt"`
+	Tools        []string       `yaml:"tools"`
+	ForwardTo    string         `yaml:"forward_to"`
+	WebhookURL   string         `yaml:"webhook_url"`
+	Template     string         `yaml:"template"` // Default outbound template for mail sent from this mailbox
+	Outbound     OutboundConfig `yaml:"outbound"`
+	// Headers shown to the LLM and webhooks; "*" includes all (default: common list headers and X-DNSBL)
+	Headers []string `yaml:"headers"`
+	// Include extracted attachment text in the LLM input
+	AttachmentText      bool `yaml:"attachment_text"`
+	AttachmentTextChars int  `yaml:"attachment_text_chars"` // Per attachment (default: 8000)
+	// Pass image attachments to the model as image inputs (the model must support vision)
+	Images ImageInputConfig `yaml:"images"`
+	// Show the LLM earlier messages of the conversation
+	Thread ThreadConfig `yaml:"thread"`
+}
+
+// ThreadConfig defines the conversation history given to the LLM
+type ThreadConfig struct {
+	History     bool `yaml:"history"`      // Include earlier inbound and outbound messages of the thread
+	LLMOutputs  bool `yaml:"llm_outputs"`  // Include the LLM's output for each earlier inbound message
+	MaxMessages int  `yaml:"max_messages"` // Most recent messages included (default: 10)
+	MaxChars    int  `yaml:"max_chars"`    // Body characters per message (default: 2000)
+}
+
+// ImageInputConfig limits the images given to the LLM for a mailbox
+type ImageInputConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	MaxImages    int    `yaml:"max_images"`    // Default: 4
+	MaxBytes     int64  `yaml:"max_bytes"`     // Larger image attachments are skipped (default: 10MB)
+	MaxDimension int    `yaml:"max_dimension"` // Longer side in pixels; larger images are downscaled (default: 2048)
+	Detail       string `yaml:"detail"`        // "low", "high" or "auto" (default)
+}
+
+// OutboundConfig defines the outbound safety policy for a mailbox
+type OutboundConfig struct {
+	AllowRecipients        []string `yaml:"allow_recipients"` // Regex patterns; empty allows all
+	DenyRecipients         []string `yaml:"deny_recipients"`  // Regex patterns checked before the allowlist
+	MaxPerHour             int      `yaml:"max_per_hour"`     // Total sends per hour for the mailbox (0 = unlimited)
+	MaxPerRecipientPerHour int      `yaml:"max_per_recipient_per_hour"`
 }
 
 // Load reads and parses the configuration file
@@ -171,6 +461,120 @@ func (c *Config) setDefaults() {
 	if c.Server.SMTPHost == "" {
 		c.Server.SMTPHost = "0.0.0.0"
 	}
+	if c.Server.Hostname == "" {
+		c.Server.Hostname = "localhost"
+		if h, err := os.Hostname(); err == nil && h != "" {
+			c.Server.Hostname = h
+		}
+	}
+	if c.Server.ReadTimeout == 0 {
+		c.Server.ReadTimeout = 60 * time.Second
+	}
+	if c.Server.WriteTimeout == 0 {
+		c.Server.WriteTimeout = 60 * time.Second
+	}
+	if c.Server.MaxMessageBytes == 0 {
+		c.Server.MaxMessageBytes = 25 * 1024 * 1024 // 25MB
+	}
+	if c.Server.MaxRecipients == 0 {
+		c.Server.MaxRecipients = 100
+	}
+	if c.Server.MemoryLimit == 0 {
+		c.Server.MemoryLimit = 256 * 1024 * 1024 // 256MB
+	}
+	if c.Server.Protection.Greylisting.Delay == 0 {
+		c.Server.Protection.Greylisting.Delay = 5 * time.Minute
+	}
+	if c.Server.Protection.Greylisting.Window == 0 {
+		c.Server.Protection.Greylisting.Window = 4 * time.Hour
+	}
+	if c.Server.Protection.Greylisting.Lifetime == 0 {
+		c.Server.Protection.Greylisting.Lifetime = 36 * 24 * time.Hour
+	}
+	if c.Server.DNSBL.Action == "" {
+		c.Server.DNSBL.Action = "tag"
+	}
+	if c.Server.DNSBL.Timeout == 0 {
+		c.Server.DNSBL.Timeout = 2 * time.Second
+	}
+	if c.Server.Submission.SMTPHost == "" {
+		c.Server.Submission.SMTPHost = c.Server.SMTPHost
+	}
+	if c.Server.Submission.SMTPPort == 0 {
+		c.Server.Submission.SMTPPort = 587
+	}
+	if len(c.Server.Listeners) == 0 {
+		// Derive listeners from the single-listener settings
+		c.Server.Listeners = append(c.Server.Listeners, ListenerConfig{
+			Name:        "smtp",
+			Host:        c.Server.SMTPHost,
+			Port:        c.Server.SMTPPort,
+			RequireAuth: c.Server.RequireAuth,
+		})
+		if c.Server.Submission.Enabled {
+			c.Server.Listeners = append(c.Server.Listeners, ListenerConfig{
+				Name:        "submission",
+				Host:        c.Server.Submission.SMTPHost,
+				Port:        c.Server.Submission.SMTPPort,
+				RequireAuth: true,
+			})
+		}
+	}
+	for i := range c.Server.Listeners {
+		l := &c.Server.Listeners[i]
+		if l.Host == "" {
+			l.Host = c.Server.SMTPHost
+		}
+		if l.Name == "" {
+			l.Name = fmt.Sprintf("%s:%d", l.Host, l.Port)
+		}
+		l.TLSMode = strings.ToLower(l.TLSMode)
+		if l.TLSMode == "" {
+			l.TLSMode = TLSModeNone
+			if c.Server.TLS.Enabled {
+				l.TLSMode = TLSModeSTARTTLS
+			}
+		}
+		if l.AllowedDomains == nil {
+			l.AllowedDomains = c.Server.AllowedDomains
+		}
+		if l.MaxMessageBytes == 0 {
+			l.MaxMessageBytes = c.Server.MaxMessageBytes
+		}
+		if l.MaxRecipients == 0 {
+			l.MaxRecipients = c.Server.MaxRecipients
+		}
+	}
+	if c.Server.SMTPAuth.Backend == "" {
+		c.Server.SMTPAuth.Backend = "config"
+	}
+	if c.Server.Authentication.Timeout == 0 {
+		c.Server.Authentication.Timeout = 10 * time.Second
+	}
+	if c.Spam.BayesWeight == 0 {
+		c.Spam.BayesWeight = 4
+	}
+	if c.Spam.BayesMinTraining == 0 {
+		c.Spam.BayesMinTraining = 20
+	}
+	if c.Spam.TrainInterval == 0 {
+		c.Spam.TrainInterval = 10 * time.Minute
+	}
+	if c.Extraction.MaxBytes == 0 {
+		c.Extraction.MaxBytes = 20 * 1024 * 1024 // 20MB
+	}
+	if c.Extraction.MaxChars == 0 {
+		c.Extraction.MaxChars = 200000
+	}
+	if c.ClamAV.Address == "" {
+		c.ClamAV.Address = "tcp://127.0.0.1:3310"
+	}
+	if c.ClamAV.Timeout == 0 {
+		c.ClamAV.Timeout = 30 * time.Second
+	}
+	if c.ClamAV.MaxBytes == 0 {
+		c.ClamAV.MaxBytes = 25 * 1024 * 1024 // 25MB
+	}
 	if c.Database.Path == "" {
 		c.Database.Path = "./emitt.db"
 	}
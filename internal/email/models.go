@@ -1,6 +1,13 @@
 package email
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -18,17 +25,36 @@ func (a Address) String() string {
 	return a.Address
 }
 
+// BlobStore keeps message and attachment content on disk by SHA-256.
+// *blobstore.Store satisfies it.
+type BlobStore interface {
+	Put(r io.Reader) (sum string, size int64, err error)
+	Open(sum string) (io.ReadCloser, error)
+}
+
 // Attachment represents an email attachment
 type Attachment struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
 	ContentID   string `json:"content_id,omitempty"`
+	Inline      bool   `json:"inline,omitempty"` // Shown in the body, e.g. an embedded image
 	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256,omitempty"` // Blob holding the content when Data is not loaded
 	Data        []byte `json:"-"`
+	Virus       string `json:"virus,omitempty"`       // Malware signature, when a virus scan found one
+	ScanResult  string `json:"scan_result,omitempty"` // Virus scan result: clean, infected, skipped or error
+
+	blobs BlobStore
+}
+
+// Open returns a reader for the attachment content
+func (a *Attachment) Open() (io.ReadCloser, error) {
+	return openContent(a.blobs, a.SHA256, a.Data)
 }
 
 // InboundEmail represents a parsed inbound email
 type InboundEmail struct {
+	ID          int64             `json:"-"` // Storage row ID once the message has been spooled
 	MessageID   string            `json:"message_id"`
 	From        Address           `json:"from"`
 	To          []Address         `json:"to"`
@@ -39,10 +65,144 @@ type InboundEmail struct {
 	Date        time.Time         `json:"date"`
 	TextBody    string            `json:"text_body"`
 	HTMLBody    string            `json:"html_body"`
-	Headers     map[string]string `json:"headers"`
+	Headers     map[string]string `json:"headers"` // First value of each header, keyed by canonical name
 	Attachments []Attachment      `json:"attachments"`
 	RawMessage  []byte            `json:"-"`
+	RawSHA256   string            `json:"-"` // Blob holding the raw message when RawMessage is not loaded
 	ReceivedAt  time.Time         `json:"received_at"`
+	Auth        *AuthResults      `json:"auth,omitempty"`
+	AuthUser    string            `json:"auth_user,omitempty"` // SMTP AUTH identity, empty if unauthenticated
+	Envelope    *Envelope         `json:"envelope,omitempty"`
+	Recipient   string            `json:"recipient,omitempty"` // Envelope recipient of a per-recipient run
+	Spam        *SpamResult       `json:"spam,omitempty"`
+	Security    *Security         `json:"security,omitempty"` // S/MIME or PGP encryption and signature
+
+	HeaderFields []HeaderField `json:"header_fields,omitempty"` // Every header in message order, including repeats
+	TextParts    []TextPart    `json:"text_parts,omitempty"`    // Every inline text part in message order
+
+	// Messages attached as message/rfc822 parts, e.g. forwarded as attachment
+	AttachedMessages []*InboundEmail `json:"attached_messages,omitempty"`
+
+	blobs  BlobStore
+	signed signScope
+}
+
+// HeaderField is a single header line of a message
+type HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// TextPart is an inline text part of a message body
+type TextPart struct {
+	ContentType string `json:"content_type"`
+	Content     string `json:"content"`
+}
+
+// Header returns the value of a header by case-insensitive name
+func (e *InboundEmail) Header(name string) string {
+	if v, ok := e.Headers[name]; ok {
+		return v
+	}
+	for k, v := range e.Headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// SetHeader sets a header, replacing any value under another spelling of the
+// name. The server uses it so its own headers override sender-supplied ones.
+func (e *InboundEmail) SetHeader(name, value string) {
+	if e.Headers == nil {
+		e.Headers = make(map[string]string)
+	}
+	e.DelHeader(name)
+	e.Headers[name] = value
+}
+
+// DelHeader removes every spelling of a header
+func (e *InboundEmail) DelHeader(name string) {
+	for k := range e.Headers {
+		if strings.EqualFold(k, name) {
+			delete(e.Headers, k)
+		}
+	}
+}
+
+// OpenRaw returns a reader for the raw message
+func (e *InboundEmail) OpenRaw() (io.ReadCloser, error) {
+	return openContent(e.blobs, e.RawSHA256, e.RawMessage)
+}
+
+// AttachmentByContentID resolves a Content-ID or cid: URL (RFC 2392) to the
+// attachment it names, or nil
+func (e *InboundEmail) AttachmentByContentID(ref string) *Attachment {
+	if len(ref) > 4 && strings.EqualFold(ref[:4], "cid:") {
+		ref = ref[4:]
+	}
+	if unescaped, err := url.PathUnescape(ref); err == nil {
+		ref = unescaped
+	}
+	ref = strings.Trim(ref, "<>")
+	if ref == "" {
+		return nil
+	}
+	for i := range e.Attachments {
+		if e.Attachments[i].ContentID == ref {
+			return &e.Attachments[i]
+		}
+	}
+	return nil
+}
+
+// openContent reads a blob reference, falling back to inline data
+func openContent(blobs BlobStore, sum string, data []byte) (io.ReadCloser, error) {
+	if sum == "" || data != nil {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if blobs == nil {
+		return nil, fmt.Errorf("blob %s referenced but no blob store is set", sum)
+	}
+	return blobs.Open(sum)
+}
+
+// Envelope is the SMTP transaction a message was received in
+type Envelope struct {
+	MailFrom   string   `json:"mail_from"`
+	RcptTo     []string `json:"rcpt_to"`
+	RemoteIP   string   `json:"remote_ip,omitempty"`
+	Helo       string   `json:"helo,omitempty"`
+	TLSVersion string   `json:"tls_version,omitempty"` // e.g. "TLS 1.3", empty for plaintext sessions
+	TLSCipher  string   `json:"tls_cipher,omitempty"`
+}
+
+// SpamResult is the outcome of the built-in spam scorer
+type SpamResult struct {
+	Score float64    `json:"score"`
+	Bayes *float64   `json:"bayes,omitempty"` // Spam probability from the Bayes model, if trained
+	Rules []SpamRule `json:"rules,omitempty"` // Rules that contributed to the score
+}
+
+// SpamRule is a scoring rule that matched a message
+type SpamRule struct {
+	Name        string  `json:"name"`
+	Score       float64 `json:"score"`
+	Description string  `json:"description"`
+}
+
+// AuthResults holds the outcome of inbound sender authentication checks.
+// Result values follow RFC 8601: pass, fail, softfail, neutral, none,
+// temperror or permerror.
+type AuthResults struct {
+	SPF         string   `json:"spf"`
+	SPFDomain   string   `json:"spf_domain,omitempty"`
+	DKIM        string   `json:"dkim"`
+	DKIMDomains []string `json:"dkim_domains,omitempty"` // Domains with a valid signature
+	DMARC       string   `json:"dmarc"`
+	DMARCPolicy string   `json:"dmarc_policy,omitempty"`
+	ARC         string   `json:"arc"`
 }
 
 // GetToAddresses returns just the email addresses from To
@@ -63,12 +223,44 @@ func (e *InboundEmail) GetCcAddresses() []string {
 	return addrs
 }
 
-// Body returns the best available body (text preferred for LLM)
+// Body returns the best available body as plain text (the text part, or the
+// HTML part converted to text)
 func (e *InboundEmail) Body() string {
-	if e.TextBody != "" {
+	if strings.TrimSpace(e.TextBody) != "" {
 		return e.TextBody
 	}
-	return e.HTMLBody
+	if e.HTMLBody != "" {
+		return htmlToText(e.HTMLBody, false, e.imageLabel)
+	}
+	return ""
+}
+
+// NewContent returns the body without quoted history and signatures. For
+// HTML-only mail the quote markup of Gmail, Outlook and Apple Mail is used too.
+func (e *InboundEmail) NewContent() string {
+	if strings.TrimSpace(e.TextBody) == "" && e.HTMLBody != "" {
+		return StripReply(htmlToText(e.HTMLBody, true, e.imageLabel))
+	}
+	return StripReply(e.TextBody)
+}
+
+// imageLabel names an embedded image in converted HTML, resolving cid:
+// references to the inline attachment
+func (e *InboundEmail) imageLabel(src, alt string) string {
+	if att := e.AttachmentByContentID(src); att != nil && strings.HasPrefix(strings.ToLower(src), "cid:") {
+		name := att.Filename
+		if name == "" {
+			name = att.ContentID
+		}
+		if alt != "" {
+			return "[image: " + name + " - " + alt + "]"
+		}
+		return "[image: " + name + "]"
+	}
+	if alt != "" {
+		return "[" + alt + "]"
+	}
+	return ""
 }
 
 // HasAttachments returns true if the email has attachments
@@ -76,19 +268,70 @@ func (e *InboundEmail) HasAttachments() bool {
 	return len(e.Attachments) > 0
 }
 
+// Infected returns true if a virus scan found malware in an attachment
+func (e *InboundEmail) Infected() bool {
+	for _, att := range e.Attachments {
+		if att.Virus != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// AutoSubmittedReason returns why the email looks machine-generated
+// (RFC 3834 Auto-Submitted, bulk/list precedence, or one of our own
+// outbound messages coming back), or "" if it looks human-sent
+func (e *InboundEmail) AutoSubmittedReason() string {
+	if IsOutboundMessageID(e.MessageID) {
+		return "message was sent by eMitt"
+	}
+	if v := strings.ToLower(strings.TrimSpace(e.Headers["Auto-Submitted"])); v != "" && v != "no" {
+		return "Auto-Submitted: " + v
+	}
+	switch v := strings.ToLower(strings.TrimSpace(e.Headers["Precedence"])); v {
+	case "bulk", "list", "junk", "auto_reply":
+		return "Precedence: " + v
+	}
+	if e.Headers["List-Id"] != "" {
+		return "mailing list message"
+	}
+	return ""
+}
+
 // OutboundEmail represents an email to be sent
 type OutboundEmail struct {
-	From        Address      `json:"from"`
-	To          []Address    `json:"to"`
-	Cc          []Address    `json:"cc"`
-	Bcc         []Address    `json:"bcc"`
-	ReplyTo     *Address     `json:"reply_to,omitempty"`
-	Subject     string       `json:"subject"`
-	TextBody    string       `json:"text_body"`
-	HTMLBody    string       `json:"html_body"`
-	Attachments []Attachment `json:"attachments"`
-	InReplyTo   string       `json:"in_reply_to,omitempty"`
-	References  []string     `json:"references,omitempty"`
+	From        Address           `json:"from"`
+	To          []Address         `json:"to"`
+	Cc          []Address         `json:"cc"`
+	Bcc         []Address         `json:"bcc"`
+	ReplyTo     *Address          `json:"reply_to,omitempty"`
+	Subject     string            `json:"subject"`
+	TextBody    string            `json:"text_body"`
+	HTMLBody    string            `json:"html_body"`
+	Attachments []Attachment      `json:"attachments"`
+	InReplyTo   string            `json:"in_reply_to,omitempty"`
+	References  []string          `json:"references,omitempty"`
+	MessageID   string            `json:"message_id,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// outboundMessageIDPrefix marks Message-IDs generated for mail we send
+const outboundMessageIDPrefix = "<emitt-out."
+
+// NewOutboundMessageID generates a Message-ID for an outgoing email
+func NewOutboundMessageID(fromAddress string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(fromAddress, "@"); i >= 0 && i < len(fromAddress)-1 {
+		domain = fromAddress[i+1:]
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("%s%d.%s@%s>", outboundMessageIDPrefix, time.Now().UnixNano(), hex.EncodeToString(b), domain)
+}
+
+// IsOutboundMessageID reports whether a Message-ID was generated by eMitt for outbound mail
+func IsOutboundMessageID(id string) bool {
+	return strings.HasPrefix(strings.TrimSpace(id), outboundMessageIDPrefix)
 }
 
 // EmailContext provides email information to the LLM
@@ -97,11 +340,63 @@ type EmailContext struct {
 	To          []string          `json:"to"`
 	Cc          []string          `json:"cc"`
 	Subject     string            `json:"subject"`
-	Body        string            `json:"body"`
+	Body        string            `json:"body"`                  // Full body, including quoted history
+	NewContent  string            `json:"new_content,omitempty"` // Body without quoted replies and signature, when they differ
 	Date        string            `json:"date"`
 	HasHTML     bool              `json:"has_html"`
 	Attachments []AttachmentInfo  `json:"attachments,omitempty"`
 	Headers     map[string]string `json:"headers,omitempty"`
+	// Authentication tells the model whether the From address can be trusted
+	Authentication *AuthResults `json:"authentication,omitempty"`
+	AuthUser       string       `json:"auth_user,omitempty"`
+	Spam           *SpamResult  `json:"spam,omitempty"`
+	// Security tells the model whether the message was encrypted and who signed it
+	Security *Security `json:"security,omitempty"`
+	// DeliveredTo lists the envelope recipients, which include Bcc addresses
+	DeliveredTo []string `json:"delivered_to,omitempty"`
+	// AttachedMessages are emails attached to this one, e.g. forwarded as attachment
+	AttachedMessages []EmailContext `json:"attached_messages,omitempty"`
+	// Thread lists earlier messages of the conversation, oldest first
+	Thread []ThreadEntry `json:"thread,omitempty"`
+}
+
+// contextHeaders returns the headers named in an allowlist
+func (e *InboundEmail) contextHeaders(allow []string) map[string]string {
+	if allow == nil {
+		allow = DefaultContextHeaders
+	}
+
+	headers := make(map[string]string)
+	for _, name := range allow {
+		if name == "*" {
+			for k, v := range e.Headers {
+				headers[k] = v
+			}
+			continue
+		}
+		if v := e.Header(name); v != "" {
+			headers[name] = e.repeatedHeader(name, v)
+		}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// repeatedHeader joins every value of a header that appears more than once in
+// the message, unless the server replaced the sender's value
+func (e *InboundEmail) repeatedHeader(name, value string) string {
+	var values []string
+	for _, f := range e.HeaderFields {
+		if strings.EqualFold(f.Name, name) {
+			values = append(values, f.Value)
+		}
+	}
+	if len(values) < 2 || values[0] != value {
+		return value
+	}
+	return strings.Join(values, "\n")
 }
 
 // AttachmentInfo provides attachment metadata for LLM context
@@ -109,19 +404,49 @@ type AttachmentInfo struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
 	Size        int64  `json:"size"`
+	ContentID   string `json:"content_id,omitempty"` // Referenced from the HTML body as cid:<content_id>
+	Inline      bool   `json:"inline,omitempty"`
+	Virus       string `json:"virus,omitempty"`       // Malware found by the virus scan; the content is withheld
+	ScanResult  string `json:"scan_result,omitempty"` // Content is withheld unless clean or not scanned
+	// Extracted text, when the mailbox includes attachment text
+	Text          string `json:"text,omitempty"`
+	TextTruncated bool   `json:"text_truncated,omitempty"`
+	TextError     string `json:"text_error,omitempty"`
 }
 
-// ToContext converts an InboundEmail to EmailContext for LLM
-func (e *InboundEmail) ToContext() EmailContext {
+// DefaultContextHeaders are the headers shown to the LLM when a mailbox does
+// not configure its own list
+var DefaultContextHeaders = []string{
+	"X-Priority", "X-Mailer", "X-Spam-Status", "X-Spam-Score",
+	"List-Unsubscribe", "List-Id", "Precedence", "Auto-Submitted",
+	"X-DNSBL",
+}
+
+// ToContext converts an InboundEmail to EmailContext for LLM. Only the headers
+// named in allow are included; nil uses DefaultContextHeaders and "*" includes
+// every header.
+func (e *InboundEmail) ToContext(allow []string) EmailContext {
 	ctx := EmailContext{
-		From:    e.From.String(),
-		To:      e.GetToAddresses(),
-		Cc:      e.GetCcAddresses(),
-		Subject: e.Subject,
-		Body:    e.Body(),
-		Date:    e.Date.Format(time.RFC1123),
-		HasHTML: e.HTMLBody != "",
-		Headers: e.Headers,
+		From:           e.From.String(),
+		To:             e.GetToAddresses(),
+		Cc:             e.GetCcAddresses(),
+		Subject:        e.Subject,
+		Body:           e.Body(),
+		Date:           e.Date.Format(time.RFC1123),
+		HasHTML:        e.HTMLBody != "",
+		Headers:        e.contextHeaders(allow),
+		Authentication: e.Auth,
+		AuthUser:       e.AuthUser,
+		Spam:           e.Spam,
+		Security:       e.Security,
+	}
+	if newContent := e.NewContent(); newContent != "" && newContent != strings.TrimSpace(ctx.Body) {
+		ctx.NewContent = newContent
+	}
+	if e.Recipient != "" {
+		ctx.DeliveredTo = []string{e.Recipient}
+	} else if e.Envelope != nil {
+		ctx.DeliveredTo = e.Envelope.RcptTo
 	}
 
 	for _, att := range e.Attachments {
@@ -129,8 +454,15 @@ func (e *InboundEmail) ToContext() EmailContext {
 			Filename:    att.Filename,
 			ContentType: att.ContentType,
 			Size:        att.Size,
+			ContentID:   att.ContentID,
+			Inline:      att.Inline,
+			Virus:       att.Virus,
+			ScanResult:  att.ScanResult,
 		})
 	}
+	for _, attached := range e.AttachedMessages {
+		ctx.AttachedMessages = append(ctx.AttachedMessages, attached.ToContext(allow))
+	}
 
 	return ctx
 }
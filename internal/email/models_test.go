@@ -0,0 +1,87 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAttachmentByContentID(t *testing.T) {
+	e := &InboundEmail{Attachments: []Attachment{
+		{Filename: "logo.png", ContentID: "logo@example.com"},
+		{Filename: "a b.png", ContentID: "a b@example.com"},
+		{Filename: "unnamed.png"},
+	}}
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"cid:logo@example.com", "logo.png"},
+		{"CID:logo@example.com", "logo.png"},
+		{"cid:<logo@example.com>", "logo.png"},
+		{"<logo@example.com>", "logo.png"},
+		{"logo@example.com", "logo.png"},
+		{"cid:a%20b@example.com", "a b.png"},
+		{"cid:other@example.com", ""},
+		// An attachment without a Content-ID is never matched
+		{"cid:", ""},
+		{"<>", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if att := e.AttachmentByContentID(tt.ref); att != nil {
+			got = att.Filename
+		}
+		if got != tt.want {
+			t.Errorf("AttachmentByContentID(%q) = %q, want %q", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestImageLabels(t *testing.T) {
+	e := &InboundEmail{
+		HTMLBody: `<p>Chart: <img src="cid:chart@example.org" alt="Sales"></p>` +
+			`<p><img src="cid:noname@example.org"></p>` +
+			`<p><img src="https://example.org/pixel.gif"></p>` +
+			`<p><img src="cid:missing@example.org" alt="Gone"></p>`,
+		Attachments: []Attachment{
+			{Filename: "chart.png", ContentID: "chart@example.org", Inline: true},
+			{ContentID: "noname@example.org", Inline: true},
+		},
+	}
+	want := "Chart: [image: chart.png - Sales]\n\n[image: noname@example.org]\n\n[Gone]"
+	if got := e.Body(); got != want {
+		t.Errorf("Body() = %q, want %q", got, want)
+	}
+}
+
+func TestContextRepeatedHeaders(t *testing.T) {
+	e := &InboundEmail{
+		Headers: map[string]string{"Received": "by mx2", "X-Spam-Status": "No", "List-Id": "<server.example.com>"},
+		HeaderFields: []HeaderField{
+			{Name: "Received", Value: "by mx2"},
+			{Name: "Received", Value: "by mx1"},
+			{Name: "X-Spam-Status", Value: "Yes, sender's verdict"},
+			{Name: "X-Spam-Status", Value: "Yes, relay's verdict"},
+			{Name: "List-Id", Value: "<one.example.com>"},
+		},
+	}
+
+	headers := e.ToContext([]string{"received", "X-Spam-Status", "List-Id"})
+	if got := headers.Headers["received"]; got != "by mx2\nby mx1" {
+		t.Errorf("Received = %q, want every value", got)
+	}
+	// The server replaced these; the sender's values must not come back
+	if got := headers.Headers["X-Spam-Status"]; got != "No" {
+		t.Errorf("X-Spam-Status = %q, want the server's value only", got)
+	}
+	if got := headers.Headers["List-Id"]; got != "<server.example.com>" {
+		t.Errorf("List-Id = %q", got)
+	}
+
+	all := e.ToContext([]string{"*"}).Headers
+	if len(all) != 3 || strings.Contains(all["Received"], "mx1") {
+		t.Errorf("wildcard headers = %q, want the map values", all)
+	}
+}
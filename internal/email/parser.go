@@ -13,27 +13,78 @@ import (
 	_ "github.com/emersion/go-message/charset"
 )
 
+// maxMessageDepth limits how deeply attached messages are parsed
+const maxMessageDepth = 5
+
+// maxBodyText caps the text read into memory from one body part when a blob
+// store is set; longer parts are kept whole as attachments
+const maxBodyText = 1 << 20
+
 // Parser parses raw email messages
-type Parser struct{}
+type Parser struct {
+	blobs  BlobStore
+	secure SecureMail
+}
 
 // NewParser creates a new email parser
 func NewParser() *Parser {
 	return &Parser{}
 }
 
+// SetBlobStore streams attachment content to a blob store instead of keeping
+// it in memory, and enables ParseBlob
+func (p *Parser) SetBlobStore(blobs BlobStore) {
+	p.blobs = blobs
+}
+
+// SetSecureMail decrypts S/MIME and PGP encrypted parts and verifies
+// signatures while parsing
+func (p *Parser) SetSecureMail(secure SecureMail) {
+	p.secure = secure
+}
+
 // Parse parses a raw email message
 func (p *Parser) Parse(rawMessage []byte) (*InboundEmail, error) {
-	reader := bytes.NewReader(rawMessage)
+	email, err := p.parse(bytes.NewReader(rawMessage), 0)
+	if err != nil {
+		return nil, err
+	}
+	email.RawMessage = rawMessage
+	return email, nil
+}
+
+// ParseBlob parses a raw message held in the blob store without loading it
+// into memory
+func (p *Parser) ParseBlob(sum string) (*InboundEmail, error) {
+	if p.blobs == nil {
+		return nil, fmt.Errorf("no blob store set")
+	}
+	r, err := p.blobs.Open(sum)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	email, err := p.parse(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	email.RawSHA256 = sum
+	return email, nil
+}
 
-	entity, err := message.Read(reader)
+// parse reads a message, streaming its parts. depth counts the attached
+// messages it is nested in.
+func (p *Parser) parse(r io.Reader, depth int) (*InboundEmail, error) {
+	entity, err := message.Read(r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read message: %w", err)
 	}
 
 	email := &InboundEmail{
-		RawMessage: rawMessage,
 		ReceivedAt: time.Now(),
 		Headers:    make(map[string]string),
+		blobs:      p.blobs,
 	}
 
 	// Parse headers
@@ -53,29 +104,10 @@ func (p *Parser) Parse(rawMessage []byte) (*InboundEmail, error) {
 		}
 	}
 
-	// To
-	if to := header.Get("To"); to != "" {
-		addrs, err := parseAddressList(to)
-		if err == nil {
-			email.To = addrs
-		}
-	}
-
-	// Cc
-	if cc := header.Get("Cc"); cc != "" {
-		addrs, err := parseAddressList(cc)
-		if err == nil {
-			email.Cc = addrs
-		}
-	}
-
-	// Bcc
-	if bcc := header.Get("Bcc"); bcc != "" {
-		addrs, err := parseAddressList(bcc)
-		if err == nil {
-			email.Bcc = addrs
-		}
-	}
+	// To, Cc and Bcc; some clients split long lists over repeated fields
+	email.To = parseAddressHeaders(header.Values("To"))
+	email.Cc = parseAddressHeaders(header.Values("Cc"))
+	email.Bcc = parseAddressHeaders(header.Values("Bcc"))
 
 	// Reply-To
 	if replyTo := header.Get("Reply-To"); replyTo != "" {
@@ -98,87 +130,269 @@ func (p *Parser) Parse(rawMessage []byte) (*InboundEmail, error) {
 		email.Date = time.Now()
 	}
 
-	// Store common headers
-	commonHeaders := []string{
-		"X-Priority", "X-Mailer", "X-Spam-Status", "X-Spam-Score",
-		"List-Unsubscribe", "List-Id", "Precedence", "Auto-Submitted",
-	}
-	for _, h := range commonHeaders {
-		if val := header.Get(h); val != "" {
-			email.Headers[h] = val
+	// Keep every header in order; the map holds the topmost value of each
+	fields := header.Fields()
+	for fields.Next() {
+		name := fields.Key()
+		value := decodeHeader(fields.Value())
+		email.HeaderFields = append(email.HeaderFields, HeaderField{Name: name, Value: value})
+		if _, ok := email.Headers[name]; !ok {
+			email.Headers[name] = value
 		}
 	}
 
 	// Parse body
-	if err := p.parseBody(entity, email); err != nil {
+	if err := p.parseBody(entity, email, depth); err != nil {
 		return nil, fmt.Errorf("failed to parse body: %w", err)
 	}
+	email.checkSignedParts()
 
 	return email, nil
 }
 
 // parseBody recursively parses the message body and attachments
-func (p *Parser) parseBody(entity *message.Entity, email *InboundEmail) error {
+func (p *Parser) parseBody(entity *message.Entity, email *InboundEmail, depth int) error {
 	mediaType, params, err := entity.Header.ContentType()
 	if err != nil {
 		mediaType = "text/plain"
 	}
 
-	if strings.HasPrefix(mediaType, "multipart/") {
-		mr := entity.MultipartReader()
-		for {
-			part, err := mr.NextPart()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return err
-			}
-			if err := p.parseBody(part, email); err != nil {
-				return err
-			}
+	if p.secure != nil {
+		if handled, err := p.parseSecure(entity, email, mediaType, params, depth); handled {
+			return err
 		}
-		return nil
 	}
 
-	// Read the body
-	body, err := io.ReadAll(entity.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read body: %w", err)
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return p.parseParts(entity, email, depth)
+	}
+	return p.parsePart(entity, email, mediaType, params, depth)
+}
+
+// parseParts parses each part of a multipart entity
+func (p *Parser) parseParts(entity *message.Entity, email *InboundEmail, depth int) error {
+	mr := entity.MultipartReader()
+	if mr == nil {
+		return fmt.Errorf("not a multipart entity")
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := p.parseBody(part, email, depth); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Check if it's an attachment
+// parsePart parses a single part into the body or an attachment
+func (p *Parser) parsePart(entity *message.Entity, email *InboundEmail, mediaType string, params map[string]string, depth int) error {
+	// Check if it's an attachment. Only unnamed text parts form the body;
+	// inline images and files are kept as attachments flagged inline.
 	disposition, dispParams, _ := entity.Header.ContentDisposition()
 	filename := dispParams["filename"]
 	if filename == "" {
 		filename = params["name"]
 	}
+	contentID := strings.Trim(strings.TrimSpace(entity.Header.Get("Content-ID")), "<>")
+	bodyPart := strings.HasPrefix(mediaType, "text/") && filename == ""
 
-	if disposition == "attachment" || (filename != "" && disposition != "inline") {
+	if disposition == "attachment" || !bodyPart {
+		email.addPart()
 		att := Attachment{
 			Filename:    decodeHeader(filename),
 			ContentType: mediaType,
-			Data:        body,
-			Size:        int64(len(body)),
+			ContentID:   contentID,
+			Inline:      disposition == "inline" || (disposition == "" && (contentID != "" || filename == "")),
+			blobs:       p.blobs,
 		}
-		if contentID := entity.Header.Get("Content-ID"); contentID != "" {
-			att.ContentID = strings.Trim(contentID, "<>")
+		if err := p.readAttachment(&att, entity.Body); err != nil {
+			return err
+		}
+
+		switch {
+		case mediaType == "message/rfc822" && depth < maxMessageDepth:
+			// Forwarded as attachment; the original stays attached as well
+			if attached, err := p.parseAttached(&att, depth+1); err == nil {
+				email.AttachedMessages = append(email.AttachedMessages, attached)
+				if att.Filename == "" {
+					att.Filename = attachedFilename(attached.Subject)
+				}
+			}
+		case isTNEF(mediaType, att.Filename):
+			// Outlook's winmail.dat is replaced by the files it wraps
+			if p.expandTNEF(email, &att) == nil {
+				return nil
+			}
 		}
 		email.Attachments = append(email.Attachments, att)
 		return nil
 	}
 
-	// It's a body part
-	switch {
-	case strings.HasPrefix(mediaType, "text/plain"):
-		email.TextBody = string(body)
-	case strings.HasPrefix(mediaType, "text/html"):
-		email.HTMLBody = string(body)
+	// Read the body
+	text, err := p.readBody(entity.Body, email, mediaType)
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+
+	signed := false
+	if p.secure != nil && mediaType == "text/plain" {
+		text, signed = p.openInlinePGP(email, text)
+	}
+	if signed {
+		email.enterSigned()()
+	} else if strings.TrimSpace(text) != "" {
+		email.addPart()
+	}
+
+	// It's a body part. Messages can carry several inline text parts (e.g. text
+	// around an inline image), so parts of the same type are joined.
+	email.TextParts = append(email.TextParts, TextPart{ContentType: mediaType, Content: text})
+	switch mediaType {
+	case "text/plain":
+		email.TextBody = joinPart(email.TextBody, text, "\n\n")
+	case "text/html":
+		email.HTMLBody = joinPart(email.HTMLBody, text, "\n")
+	}
+
+	return nil
+}
+
+// readAttachment stores attachment content in the blob store, or in memory
+// without one
+func (p *Parser) readAttachment(att *Attachment, r io.Reader) error {
+	if p.blobs != nil {
+		sum, size, err := p.blobs.Put(r)
+		if err != nil {
+			return fmt.Errorf("failed to store attachment: %w", err)
+		}
+		att.SHA256, att.Size = sum, size
+		return nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+	att.Data, att.Size = data, int64(len(data))
+	return nil
+}
+
+// readBody reads a text body part. With a blob store, a part longer than
+// maxBodyText is streamed to the store as an attachment and only its start is
+// returned, so a large text part is never fully buffered.
+func (p *Parser) readBody(r io.Reader, email *InboundEmail, mediaType string) (string, error) {
+	if p.blobs == nil {
+		body, err := io.ReadAll(r)
+		return string(body), err
+	}
+
+	head, err := io.ReadAll(io.LimitReader(r, maxBodyText+1))
+	if err != nil {
+		return "", err
+	}
+	if len(head) <= maxBodyText {
+		return string(head), nil
+	}
+
+	att := Attachment{
+		Filename:    "body.txt",
+		ContentType: mediaType,
+		blobs:       p.blobs,
+	}
+	if mediaType == "text/html" {
+		att.Filename = "body.html"
+	}
+	if err := p.readAttachment(&att, io.MultiReader(bytes.NewReader(head), r)); err != nil {
+		return "", err
+	}
+	email.Attachments = append(email.Attachments, att)
+
+	// Drop a rune cut in half by the limit
+	return strings.ToValidUTF8(string(head[:maxBodyText]), ""), nil
+}
+
+// attachedFilename names an unnamed attached message after its subject
+func attachedFilename(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(subject))
+	if name == "" {
+		name = "attached"
+	}
+	return name + ".eml"
+}
+
+// parseAttached parses an attached message/rfc822 part
+func (p *Parser) parseAttached(att *Attachment, depth int) (*InboundEmail, error) {
+	r, err := att.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return p.parse(r, depth)
+}
+
+// expandTNEF decodes a winmail.dat into attachments, filling in the body if
+// the message has none of its own
+func (p *Parser) expandTNEF(email *InboundEmail, att *Attachment) error {
+	r, err := att.Open()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	msg, err := decodeTNEF(data)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range msg.Attachments {
+		decoded := Attachment{
+			Filename:    file.Filename,
+			ContentType: file.ContentType,
+			ContentID:   file.ContentID,
+			blobs:       p.blobs,
+		}
+		if err := p.readAttachment(&decoded, bytes.NewReader(file.Data)); err != nil {
+			return err
+		}
+		email.Attachments = append(email.Attachments, decoded)
 	}
 
+	if strings.TrimSpace(email.TextBody) == "" && strings.TrimSpace(msg.TextBody) != "" {
+		email.TextBody = msg.TextBody
+		email.TextParts = append(email.TextParts, TextPart{ContentType: "text/plain", Content: msg.TextBody})
+	}
+	if strings.TrimSpace(email.HTMLBody) == "" && strings.TrimSpace(msg.HTMLBody) != "" {
+		email.HTMLBody = msg.HTMLBody
+		email.TextParts = append(email.TextParts, TextPart{ContentType: "text/html", Content: msg.HTMLBody})
+	}
 	return nil
 }
 
+// joinPart appends a body part to the body collected so far
+func joinPart(body, part, sep string) string {
+	if strings.TrimSpace(body) == "" {
+		return part
+	}
+	if strings.TrimSpace(part) == "" {
+		return body
+	}
+	return strings.TrimRight(body, "\r\n") + sep + part
+}
+
 // parseAddress parses a single email address
 func parseAddress(s string) (Address, error) {
 	addr, err := mail.ParseAddress(s)
@@ -196,6 +410,18 @@ func parseAddress(s string) (Address, error) {
 	}, nil
 }
 
+// parseAddressHeaders parses every instance of an address list header,
+// skipping those that cannot be parsed
+func parseAddressHeaders(values []string) []Address {
+	var addrs []Address
+	for _, v := range values {
+		if list, err := parseAddressList(v); err == nil {
+			addrs = append(addrs, list...)
+		}
+	}
+	return addrs
+}
+
 // parseAddressList parses a comma-separated list of email addresses
 func parseAddressList(s string) ([]Address, error) {
 	addrs, err := mail.ParseAddressList(s)
@@ -0,0 +1,197 @@
+package email
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emitt/emitt/internal/blobstore"
+)
+
+func TestParseLargeTextBodyWithBlobStore(t *testing.T) {
+	blobs, err := blobstore.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewParser()
+	p.SetBlobStore(blobs)
+
+	// A multi-byte rune straddles the limit
+	body := strings.Repeat("a", maxBodyText-1) + "é" + strings.Repeat("b", 1000)
+	raw := "From: a@example.org\r\nTo: b@example.com\r\nSubject: big\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" + body
+	sum, _, err := blobs.Put(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := p.ParseBlob(sum)
+	if err != nil {
+		t.Fatalf("ParseBlob: %v", err)
+	}
+	if len(e.TextBody) > maxBodyText {
+		t.Errorf("text body is %d bytes, want at most %d", len(e.TextBody), maxBodyText)
+	}
+	if want := strings.Repeat("a", maxBodyText-1); e.TextBody != want {
+		t.Errorf("text body was not cut before the split rune")
+	}
+
+	if len(e.Attachments) != 1 {
+		t.Fatalf("got %d attachments, want the full body as one", len(e.Attachments))
+	}
+	att := e.Attachments[0]
+	if att.Filename != "body.txt" || att.ContentType != "text/plain" || att.Data != nil {
+		t.Errorf("attachment = %q %q, in memory %v", att.Filename, att.ContentType, att.Data != nil)
+	}
+	r, err := att.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	full, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(full) != body {
+		t.Errorf("attachment holds %d bytes, want the %d byte body", len(full), len(body))
+	}
+}
+
+func TestParseSmallTextBodyWithBlobStore(t *testing.T) {
+	blobs, err := blobstore.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewParser()
+	p.SetBlobStore(blobs)
+
+	e, err := p.Parse([]byte("From: a@example.org\r\nSubject: small\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if e.TextBody != "hello\r\n" || len(e.Attachments) != 0 {
+		t.Errorf("body = %q with %d attachments", e.TextBody, len(e.Attachments))
+	}
+}
+
+func TestParseRepeatedHeaders(t *testing.T) {
+	raw := "Received: from mx2.example.com by mx.example.com; Mon, 1 Jan 2024 10:00:02 +0000\r\n" +
+		"Received: from client.example.org by mx2.example.com; Mon, 1 Jan 2024 10:00:01 +0000\r\n" +
+		"From: alice@example.org\r\n" +
+		"To: Bob <bob@example.com>, carol@example.com\r\n" +
+		"To: dave@example.com\r\n" +
+		"Cc: \r\n" +
+		"Cc: erin@example.com\r\n" +
+		"Subject: =?utf-8?q?Caf=C3=A9?=\r\n" +
+		"\r\n" +
+		"Hi\r\n"
+
+	e, err := NewParser().Parse([]byte(raw))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if got := strings.Join(e.GetToAddresses(), ","); got != "bob@example.com,carol@example.com,dave@example.com" {
+		t.Errorf("To = %s, want the addresses of both To fields", got)
+	}
+	if got := strings.Join(e.GetCcAddresses(), ","); got != "erin@example.com" {
+		t.Errorf("Cc = %s, want the empty field skipped", got)
+	}
+
+	// The map holds the topmost value, the fields every value in order
+	if got := e.Header("received"); !strings.HasPrefix(got, "from mx2.example.com") {
+		t.Errorf("Received = %q, want the topmost", got)
+	}
+	var received []string
+	for _, f := range e.HeaderFields {
+		if f.Name == "Received" {
+			received = append(received, f.Value)
+		}
+	}
+	if len(received) != 2 || !strings.HasPrefix(received[1], "from client.example.org") {
+		t.Errorf("Received fields = %q", received)
+	}
+	if e.Subject != "Café" || e.Header("Subject") != "Café" {
+		t.Errorf("subject = %q, header %q, want both decoded", e.Subject, e.Header("Subject"))
+	}
+}
+
+func TestParseTextParts(t *testing.T) {
+	raw := "From: alice@example.org\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"Before the image\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-ID: <chart@example.org>\r\n" +
+		"\r\n" +
+		"PNG\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"After the image\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>One</p>\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html\r\n" +
+		"\r\n" +
+		"<p>Two</p>\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; name=notes.txt\r\n" +
+		"\r\n" +
+		"A named text part is a file\r\n" +
+		"--b\r\n" +
+		"Content-Type: image/gif\r\n" +
+		"\r\n" +
+		"GIF\r\n" +
+		"--b--\r\n"
+
+	e, err := NewParser().Parse([]byte(raw))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	if want := "Before the image\n\nAfter the image"; e.TextBody != want {
+		t.Errorf("text body = %q, want %q", e.TextBody, want)
+	}
+	if want := "<p>One</p>\n<p>Two</p>"; e.HTMLBody != want {
+		t.Errorf("html body = %q, want %q", e.HTMLBody, want)
+	}
+	var types []string
+	for _, part := range e.TextParts {
+		types = append(types, part.ContentType)
+	}
+	if got := strings.Join(types, ","); got != "text/plain,text/plain,text/plain,text/html,text/html" {
+		t.Errorf("text parts = %s, want every body part in order", got)
+	}
+
+	want := []struct {
+		filename, contentType, contentID string
+		inline                           bool
+	}{
+		{"", "image/png", "chart@example.org", true},
+		{"notes.txt", "text/plain", "", false},
+		// An unnamed part with no disposition is shown in the body
+		{"", "image/gif", "", true},
+	}
+	if len(e.Attachments) != len(want) {
+		t.Fatalf("got %d attachments, want %d", len(e.Attachments), len(want))
+	}
+	for i, w := range want {
+		att := e.Attachments[i]
+		if att.Filename != w.filename || att.ContentType != w.contentType || att.ContentID != w.contentID || att.Inline != w.inline {
+			t.Errorf("attachment %d = %q %q %q inline %v, want %q %q %q inline %v", i,
+				att.Filename, att.ContentType, att.ContentID, att.Inline,
+				w.filename, w.contentType, w.contentID, w.inline)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+)
+
+// Secure mail formats
+const (
+	FormatSMIME = "smime"
+	FormatPGP   = "pgp"
+)
+
+// Signature statuses
+const (
+	SignatureValid     = "valid"     // Intact, by a trusted signer who is the From address
+	SignatureInvalid   = "invalid"   // The content does not match the signature
+	SignatureUntrusted = "untrusted" // Intact, but the signer is unknown, untrusted or not the From address
+	SignaturePartial   = "partial"   // Only part of the message is covered by the signature
+	SignatureNone      = "none"      // Not signed
+)
+
+// SecureMail decrypts and verifies S/MIME and PGP message parts. The parser
+// uses it when one is set with SetSecureMail.
+type SecureMail interface {
+	// Open decrypts an encrypted part or unwraps opaque signed content
+	// (application/pkcs7-mime, a PGP message, or clear-signed text)
+	Open(format string, data []byte, from string) (*Opened, error)
+	// Verify checks the detached signature of a multipart/signed part over
+	// the canonical (CRLF) bytes of the signed part
+	Verify(format string, signed, signature []byte, from string) *Signature
+}
+
+// Opened is the content of an encrypted or opaque signed part
+type Opened struct {
+	Content   []byte     // A MIME entity, or plain text for inline PGP
+	Encrypted bool       // False for signed-only content
+	Signature *Signature // Signature over the content, if it was signed
+}
+
+// Security describes the encryption and signature of a message
+type Security struct {
+	Encrypted    bool       `json:"encrypted,omitempty"`
+	Format       string     `json:"format,omitempty"`        // Encryption format, "smime" or "pgp"
+	DecryptError string     `json:"decrypt_error,omitempty"` // The encrypted part is kept as an attachment
+	Signature    *Signature `json:"signature,omitempty"`
+}
+
+// Signature is the result of verifying a message signature
+type Signature struct {
+	Format      string `json:"format"`                // "smime" or "pgp"
+	Status      string `json:"status"`                // "valid", "invalid", "untrusted" or "partial"
+	Signer      string `json:"signer,omitempty"`      // Email address of the signing certificate or key
+	SignerName  string `json:"signer_name,omitempty"` // Certificate common name or key user ID name
+	Fingerprint string `json:"fingerprint,omitempty"` // SHA-256 of the certificate, or the PGP key fingerprint
+	Error       string `json:"error,omitempty"`       // Why the signature is not valid
+}
+
+// SignatureStatus returns the status of the message signature, or "none" if
+// it is not signed
+func (e *InboundEmail) SignatureStatus() string {
+	if e.Security == nil || e.Security.Signature == nil {
+		return SignatureNone
+	}
+	return e.Security.Signature.Status
+}
+
+// ValidSigner returns the signer of a valid signature, or "" if the message
+// has none
+func (e *InboundEmail) ValidSigner() string {
+	if e.SignatureStatus() != SignatureValid {
+		return ""
+	}
+	return e.Security.Signature.Signer
+}
+
+// signScope tracks which parts of a message are covered by a signature
+// while it is parsed
+type signScope struct {
+	depth    int  // Signed entities enclosing the part being parsed
+	entities int  // Outermost signed entities seen
+	unsigned bool // A part outside any signed entity was seen
+}
+
+// addSignature records the outermost signature of a message
+func (e *InboundEmail) addSignature(sig *Signature) {
+	if sig == nil {
+		return
+	}
+	if e.Security == nil {
+		e.Security = &Security{}
+	}
+	if e.Security.Signature == nil {
+		e.Security.Signature = sig
+	}
+}
+
+// enterSigned marks the start of a signed entity's content; the returned
+// func marks its end
+func (e *InboundEmail) enterSigned() func() {
+	if e.signed.depth == 0 {
+		e.signed.entities++
+	}
+	e.signed.depth++
+	return func() { e.signed.depth-- }
+}
+
+// addPart records a body part or attachment, noting whether a signature
+// covers it
+func (e *InboundEmail) addPart() {
+	if e.signed.depth == 0 {
+		e.signed.unsigned = true
+	}
+}
+
+// checkSignedParts demotes the signature of a message that is only partly
+// signed. A signature covers the message only when the signed entity is the
+// root or its only part; otherwise unsigned text could be placed next to a
+// genuinely signed part.
+func (e *InboundEmail) checkSignedParts() {
+	if e.Security == nil || e.Security.Signature == nil {
+		return
+	}
+	if !e.signed.unsigned && e.signed.entities == 1 {
+		return
+	}
+	sig := e.Security.Signature
+	if sig.Status != SignatureInvalid {
+		sig.Status = SignaturePartial
+		sig.Error = "only part of the message is signed"
+	}
+}
+
+// addEncryption records that a message was encrypted
+func (e *InboundEmail) addEncryption(format string, err error) {
+	if e.Security == nil {
+		e.Security = &Security{}
+	}
+	e.Security.Encrypted = true
+	e.Security.Format = format
+	if err != nil && e.Security.DecryptError == "" {
+		e.Security.DecryptError = err.Error()
+	}
+}
+
+// parseSecure handles signed and encrypted parts. It reports false for
+// parts that are not S/MIME or PGP/MIME.
+func (p *Parser) parseSecure(entity *message.Entity, email *InboundEmail, mediaType string, params map[string]string, depth int) (bool, error) {
+	protocol := strings.ToLower(params["protocol"])
+	switch {
+	case mediaType == "multipart/signed":
+		return true, p.parseSigned(entity, email, params["boundary"], protocol, depth)
+	case mediaType == "multipart/encrypted" && protocol == "application/pgp-encrypted":
+		return true, p.parsePGPEncrypted(entity, email, params["boundary"], depth)
+	case isPKCS7MIME(mediaType, params):
+		return true, p.parsePKCS7(entity, email, mediaType, params, depth)
+	}
+	return false, nil
+}
+
+// parseSigned verifies a multipart/signed part and parses the content it
+// signs. Unknown signature protocols are parsed as plain multipart.
+func (p *Parser) parseSigned(entity *message.Entity, email *InboundEmail, boundary, protocol string, depth int) error {
+	raw, err := io.ReadAll(entity.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read signed part: %w", err)
+	}
+
+	format := ""
+	switch protocol {
+	case "application/pkcs7-signature", "application/x-pkcs7-signature":
+		format = FormatSMIME
+	case "application/pgp-signature":
+		format = FormatPGP
+	}
+	parts := splitMultipart(raw, boundary)
+	if format == "" || len(parts) != 2 {
+		return p.parseRawMultipart(entity.Header, raw, email, depth)
+	}
+
+	sigEntity, err := message.Read(bytes.NewReader(parts[1]))
+	if err != nil {
+		return p.parseRawMultipart(entity.Header, raw, email, depth)
+	}
+	signature, err := io.ReadAll(sigEntity.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+	email.addSignature(p.secure.Verify(format, canonicalLines(parts[0]), signature, email.From.Address))
+
+	content, err := message.Read(bytes.NewReader(parts[0]))
+	if err != nil {
+		return fmt.Errorf("failed to read signed content: %w", err)
+	}
+	defer email.enterSigned()()
+	return p.parseBody(content, email, depth)
+}
+
+// parsePGPEncrypted decrypts a PGP/MIME multipart/encrypted part. If it
+// cannot be decrypted its parts are kept as attachments.
+func (p *Parser) parsePGPEncrypted(entity *message.Entity, email *InboundEmail, boundary string, depth int) error {
+	raw, err := io.ReadAll(entity.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read encrypted part: %w", err)
+	}
+
+	// The second part holds the encrypted message
+	parts := splitMultipart(raw, boundary)
+	if len(parts) != 2 {
+		return p.parseRawMultipart(entity.Header, raw, email, depth)
+	}
+	part, err := message.Read(bytes.NewReader(parts[1]))
+	if err != nil {
+		return p.parseRawMultipart(entity.Header, raw, email, depth)
+	}
+	data, err := io.ReadAll(part.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read encrypted part: %w", err)
+	}
+
+	opened, err := p.secure.Open(FormatPGP, data, email.From.Address)
+	if err != nil {
+		email.addEncryption(FormatPGP, err)
+		return p.parseRawMultipart(entity.Header, raw, email, depth)
+	}
+	return p.parseOpened(opened, FormatPGP, email, depth)
+}
+
+// parsePKCS7 decrypts or unwraps an S/MIME application/pkcs7-mime part. If
+// it cannot be opened it is kept as an attachment.
+func (p *Parser) parsePKCS7(entity *message.Entity, email *InboundEmail, mediaType string, params map[string]string, depth int) error {
+	data, err := io.ReadAll(entity.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read S/MIME part: %w", err)
+	}
+
+	opened, err := p.secure.Open(FormatSMIME, data, email.From.Address)
+	if err == nil {
+		err = p.parseOpened(opened, FormatSMIME, email, depth)
+	}
+	if err == nil {
+		return nil
+	}
+	if strings.ToLower(params["smime-type"]) != "signed-data" {
+		email.addEncryption(FormatSMIME, err)
+	}
+
+	// The body has been decoded, so the copy must not be decoded again
+	header := entity.Header.Copy()
+	header.Del("Content-Transfer-Encoding")
+	copied, err := message.New(header, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return p.parsePart(copied, email, mediaType, params, depth)
+}
+
+// parseOpened parses the MIME entity of a decrypted or unwrapped part
+func (p *Parser) parseOpened(opened *Opened, format string, email *InboundEmail, depth int) error {
+	content, err := message.Read(bytes.NewReader(opened.Content))
+	if err != nil {
+		return fmt.Errorf("failed to read decrypted content: %w", err)
+	}
+	if opened.Encrypted {
+		email.addEncryption(format, nil)
+	}
+	if opened.Signature != nil {
+		email.addSignature(opened.Signature)
+		defer email.enterSigned()()
+	}
+	return p.parseBody(content, email, depth)
+}
+
+// openInlinePGP decrypts or verifies a plain text body that is an inline
+// PGP message or clear-signed text, returning the text it holds and whether
+// it was signed
+func (p *Parser) openInlinePGP(email *InboundEmail, text string) (string, bool) {
+	trimmed := strings.TrimSpace(text)
+	if !strings.HasPrefix(trimmed, "-----BEGIN PGP MESSAGE-----") &&
+		!strings.HasPrefix(trimmed, "-----BEGIN PGP SIGNED MESSAGE-----") {
+		return text, false
+	}
+
+	opened, err := p.secure.Open(FormatPGP, []byte(trimmed), email.From.Address)
+	if err != nil {
+		if strings.HasPrefix(trimmed, "-----BEGIN PGP MESSAGE-----") {
+			email.addEncryption(FormatPGP, err)
+		}
+		return text, false
+	}
+	if opened.Encrypted {
+		email.addEncryption(FormatPGP, nil)
+	}
+	email.addSignature(opened.Signature)
+	return string(opened.Content), opened.Signature != nil
+}
+
+// parseRawMultipart parses a multipart body that has already been read
+func (p *Parser) parseRawMultipart(header message.Header, raw []byte, email *InboundEmail, depth int) error {
+	entity, err := message.New(header, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	return p.parseParts(entity, email, depth)
+}
+
+// isPKCS7MIME reports whether a part is S/MIME encrypted or opaque signed
+// content
+func isPKCS7MIME(mediaType string, params map[string]string) bool {
+	switch mediaType {
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	case "application/octet-stream":
+		name := strings.ToLower(params["name"])
+		return strings.HasSuffix(name, ".p7m")
+	}
+	return false
+}
+
+// splitMultipart returns the raw parts of a multipart body, each with its
+// headers. Line endings are normalized to CRLF.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	if boundary == "" {
+		return nil
+	}
+	delimiter := []byte("\r\n--" + boundary)
+	chunks := bytes.Split(append([]byte("\r\n"), canonicalLines(body)...), delimiter)
+
+	var parts [][]byte
+	for _, chunk := range chunks[1:] {
+		if bytes.HasPrefix(chunk, []byte("--")) {
+			break // Close delimiter
+		}
+		// The rest of the delimiter line may hold transport padding
+		i := bytes.Index(chunk, []byte("\r\n"))
+		if i < 0 {
+			break
+		}
+		parts = append(parts, chunk[i+2:])
+	}
+	return parts
+}
+
+// canonicalLines converts line endings to CRLF, the form signatures are
+// computed over
+func canonicalLines(b []byte) []byte {
+	b = bytes.ReplaceAll(b, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))
+}
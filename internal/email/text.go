@@ -0,0 +1,361 @@
+package email
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// HTMLToText converts an HTML body to readable plain text. Scripts, styles
+// and markup are dropped; block elements become line breaks, list items are
+// bulleted, blockquotes are prefixed with "> " and links keep their target.
+func HTMLToText(body string) string {
+	return htmlToText(body, false, nil)
+}
+
+// htmlToText converts HTML to text, leaving out quoted history and
+// signatures when newOnly is set. images labels <img> elements by src and
+// alt; nil shows the alt text.
+func htmlToText(body string, newOnly bool, images func(src, alt string) string) string {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return body
+	}
+	w := &textWriter{newOnly: newOnly, images: images}
+	w.node(doc)
+	return cleanText(w.b.String())
+}
+
+// textWriter renders an HTML tree as plain text
+type textWriter struct {
+	b       strings.Builder
+	newOnly bool
+	quote   int  // Blockquote depth
+	pre     bool // Inside <pre>, whitespace is kept
+	done    bool // The rest of the document is quoted history
+	images  func(src, alt string) string
+}
+
+// blockElements start and end on their own line
+var blockElements = map[atom.Atom]bool{
+	atom.Div: true, atom.Section: true, atom.Article: true, atom.Header: true,
+	atom.Footer: true, atom.Tr: true, atom.Li: true, atom.Dt: true, atom.Dd: true,
+	atom.Address: true, atom.Center: true, atom.Form: true,
+}
+
+// paragraphElements are also separated from their neighbours by a blank line
+var paragraphElements = map[atom.Atom]bool{
+	atom.P: true, atom.Table: true, atom.Ul: true, atom.Ol: true, atom.Dl: true,
+	atom.Blockquote: true, atom.Pre: true, atom.H1: true, atom.H2: true,
+	atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+}
+
+// skippedElements never contain readable text
+var skippedElements = map[atom.Atom]bool{
+	atom.Head: true, atom.Script: true, atom.Style: true, atom.Title: true,
+	atom.Noscript: true, atom.Template: true, atom.Svg: true,
+}
+
+func (w *textWriter) node(n *html.Node) {
+	if w.done {
+		return
+	}
+
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			w.node(c)
+		}
+		return
+	}
+
+	if skippedElements[n.DataAtom] || hiddenElement(n) {
+		return
+	}
+	if w.newOnly {
+		switch quotedElement(n) {
+		case quoteSkip:
+			return
+		case quoteStop:
+			w.done = true
+			w.dropRule()
+			return
+		}
+	}
+
+	switch n.DataAtom {
+	case atom.Br:
+		w.newline()
+		return
+	case atom.Hr:
+		w.lineBreak()
+		w.write("---")
+		w.lineBreak()
+		return
+	case atom.Img:
+		alt := strings.TrimSpace(attr(n, "alt"))
+		label := ""
+		if w.images != nil {
+			label = w.images(strings.TrimSpace(attr(n, "src")), alt)
+		} else if alt != "" {
+			label = "[" + alt + "]"
+		}
+		if label != "" {
+			w.text(label)
+		}
+		return
+	case atom.Td, atom.Th:
+		w.write(" ")
+	}
+
+	paragraph := paragraphElements[n.DataAtom]
+	block := paragraph || blockElements[n.DataAtom]
+	if paragraph {
+		w.paragraph()
+	} else if block {
+		w.lineBreak()
+	}
+	switch n.DataAtom {
+	case atom.Li:
+		w.write("- ")
+	case atom.Blockquote:
+		w.quote++
+		defer func() { w.quote-- }()
+	case atom.Pre:
+		w.pre = true
+		defer func() { w.pre = false }()
+	}
+
+	start := w.b.Len()
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.node(c)
+	}
+
+	// Keep link targets the reader would otherwise lose
+	if n.DataAtom == atom.A {
+		href := strings.TrimSpace(attr(n, "href"))
+		label := strings.TrimSpace(w.b.String()[start:])
+		if (strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://")) && href != label {
+			w.write(" (" + href + ")")
+		}
+	}
+
+	if paragraph {
+		w.paragraph()
+	} else if block {
+		w.lineBreak()
+	}
+}
+
+// text writes character data, collapsing whitespace outside <pre>
+func (w *textWriter) text(s string) {
+	if w.pre {
+		for i, line := range strings.Split(s, "\n") {
+			if i > 0 {
+				w.newline()
+			}
+			w.write(line)
+		}
+		return
+	}
+
+	words := strings.Join(strings.Fields(s), " ")
+	if words == "" {
+		w.space()
+		return
+	}
+	if s[0] == ' ' || s[0] == '\t' || s[0] == '\n' || s[0] == '\r' {
+		w.space()
+	}
+	w.write(words)
+	if last := s[len(s)-1]; last == ' ' || last == '\t' || last == '\n' || last == '\r' {
+		w.space()
+	}
+}
+
+// space separates words, once
+func (w *textWriter) space() {
+	if out := w.b.String(); out != "" && !strings.HasSuffix(out, " ") && !strings.HasSuffix(out, "\n") {
+		w.b.WriteString(" ")
+	}
+}
+
+// write appends s, starting quoted lines with their prefix
+func (w *textWriter) write(s string) {
+	if w.b.Len() == 0 || strings.HasSuffix(w.b.String(), "\n") {
+		if !w.pre {
+			s = strings.TrimLeft(s, " ")
+		}
+		if s == "" {
+			return
+		}
+		w.b.WriteString(strings.Repeat("> ", w.quote))
+	}
+	w.b.WriteString(s)
+}
+
+func (w *textWriter) newline() {
+	w.b.WriteString("\n")
+}
+
+// lineBreak starts a new line unless one was just started
+func (w *textWriter) lineBreak() {
+	if out := w.b.String(); out != "" && !strings.HasSuffix(out, "\n") {
+		w.newline()
+	}
+}
+
+// dropRule removes a trailing horizontal rule, which Outlook puts above the
+// header of the quoted history
+func (w *textWriter) dropRule() {
+	out := strings.TrimRight(w.b.String(), "\n")
+	if strings.HasSuffix(out, "---") {
+		w.b.Reset()
+		w.b.WriteString(strings.TrimSuffix(out, "---"))
+	}
+}
+
+// paragraph leaves a blank line before the next text
+func (w *textWriter) paragraph() {
+	w.lineBreak()
+	if out := w.b.String(); out != "" && !strings.HasSuffix(out, "\n\n") {
+		w.newline()
+	}
+}
+
+// cleanText trims lines and collapses runs of blank lines
+func cleanText(s string) string {
+	lines := strings.Split(s, "\n")
+	out := make([]string, 0, len(lines))
+	blank := false
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t")
+		if strings.Trim(line, "> ") == "" {
+			if !blank && len(out) > 0 {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		blank = false
+		out = append(out, line)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// hiddenElement reports whether an element is styled invisible, as preheader
+// text often is
+func hiddenElement(n *html.Node) bool {
+	style := strings.ReplaceAll(strings.ToLower(attr(n, "style")), " ", "")
+	return strings.Contains(style, "display:none") || strings.Contains(style, "visibility:hidden")
+}
+
+// How quoted history is marked up by common clients
+const (
+	quoteNone = iota
+	quoteSkip // Quoted block; replies may continue after it
+	quoteStop // Start of the quoted history; nothing after it is new
+)
+
+// quotedElement classifies Gmail, Outlook and Apple Mail quote and signature
+// containers
+func quotedElement(n *html.Node) int {
+	id := attr(n, "id")
+	class := " " + attr(n, "class") + " "
+	switch {
+	case id == "divRplyFwdMsg", id == "appendonsend":
+		return quoteStop // Outlook: reply header, followed by the original
+	case strings.Contains(class, " gmail_quote "), strings.Contains(class, " gmail_quote_container "):
+		return quoteSkip
+	case strings.Contains(class, " gmail_signature "), id == "Signature", id == "AppleMailSignature":
+		return quoteSkip
+	case n.DataAtom == atom.Blockquote && attr(n, "type") == "cite":
+		return quoteSkip // Apple Mail and Thunderbird
+	case strings.Contains(class, " moz-cite-prefix "), strings.Contains(class, " moz-signature "):
+		return quoteSkip
+	}
+	return quoteNone
+}
+
+var (
+	// "On Mon, 1 Jan 2024 at 10:00, Jane <jane@example.com> wrote:", which
+	// Gmail and Apple Mail may wrap over two lines
+	replyHeaderPattern = regexp.MustCompile(`(?m)^[ \t]*On [^\n]{1,200}(\n[^\n]{1,200})?\bwrote:[ \t]*$`)
+	// Outlook: a separator or "From:" followed by "Sent:" or "Date:" lines
+	outlookHeaderPattern = regexp.MustCompile(`(?m)^[ \t]*(-{2,}\s*Original Message\s*-{2,}|_{10,})[ \t]*$|^[ \t]*\*?From:\*?[^\n]+\n[ \t]*\*?(Sent|Date):\*?[ \t]`)
+	// Mobile and desktop client taglines
+	taglinePattern = regexp.MustCompile(`(?im)^[ \t]*(Sent from my \w+|Sent from (Outlook|Mail|Yahoo Mail)\b|Get Outlook for \w+)[^\n]*$`)
+)
+
+// isReplyHeader rules out prose that matches replyHeaderPattern: headers
+// always carry a date, and a wrapped header does not end a sentence on its
+// first line
+func isReplyHeader(match string) bool {
+	if !strings.ContainsAny(match, "0123456789") {
+		return false
+	}
+	if first, _, wrapped := strings.Cut(match, "\n"); wrapped {
+		first = strings.TrimRight(first, " \t")
+		if strings.ContainsAny(first[len(first)-1:], ".!?") {
+			return false
+		}
+	}
+	return true
+}
+
+// StripReply returns the new content of a plain-text reply: the text before
+// the quoted history, without trailing quoted lines or signature
+func StripReply(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	cut := len(text)
+	for _, loc := range replyHeaderPattern.FindAllStringIndex(text, -1) {
+		if isReplyHeader(text[loc[0]:loc[1]]) {
+			cut = loc[0]
+			break
+		}
+	}
+	for _, re := range []*regexp.Regexp{outlookHeaderPattern, taglinePattern} {
+		if loc := re.FindStringIndex(text); loc != nil && loc[0] < cut {
+			cut = loc[0]
+		}
+	}
+	text = text[:cut]
+
+	// RFC 3676 signature delimiter
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line == "-- " || line == "--" {
+			lines = lines[:i]
+			break
+		}
+	}
+
+	// Quoted lines at the end belong to the history; inline quotes between
+	// new paragraphs are kept for context
+	end := len(lines)
+	for end > 0 {
+		line := strings.TrimSpace(lines[end-1])
+		if line != "" && !strings.HasPrefix(line, ">") {
+			break
+		}
+		end--
+	}
+
+	return strings.TrimSpace(strings.Join(lines[:end], "\n"))
+}
@@ -0,0 +1,225 @@
+package email
+
+import "testing"
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{"paragraphs", "<p>Hello</p><p>World</p>", "Hello\n\nWorld"},
+		{"line breaks", "Hello<br>World<br/>", "Hello\nWorld"},
+		{"whitespace", "<div>  Hello \n\t <b>big</b>\n world </div>", "Hello big world"},
+		{"list", "<ul><li>One</li><li>Two</li></ul>", "- One\n- Two"},
+		{"link", `<a href="https://example.com/a">the docs</a>`, "the docs (https://example.com/a)"},
+		{"bare link", `<a href="https://example.com/a">https://example.com/a</a>`, "https://example.com/a"},
+		{"mailto link", `<a href="mailto:a@example.com">Alice</a>`, "Alice"},
+		{"blockquote", "<p>Yes</p><blockquote><p>Ready?</p><blockquote>Now</blockquote></blockquote>", "Yes\n\n> Ready?\n\n> > Now"},
+		{"pre", "<pre>a  b\n  c</pre>", "a  b\n  c"},
+		{"table", "<table><tr><td>Name</td><td>Qty</td></tr><tr><td>Bolt</td><td>4</td></tr></table>", "Name Qty\nBolt 4"},
+		{"skipped", "<head><title>T</title><style>p{}</style></head><script>x()</script><p>Body</p>", "Body"},
+		{"hidden preheader", `<span style="display: none">Preview text</span><p>Body</p>`, "Body"},
+		{"image alt", `<p>Logo: <img src="x.png" alt="ACME"></p>`, "Logo: [ACME]"},
+		{"hr", "<p>Above</p><hr><p>Below</p>", "Above\n\n---\n\nBelow"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HTMLToText(tt.html); got != tt.want {
+				t.Errorf("HTMLToText(%q) = %q, want %q", tt.html, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestHTMLNewContent covers the quote and signature markup of common clients,
+// which is left out of the new content
+func TestHTMLNewContent(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			"gmail quote",
+			`<div dir="ltr">Sounds good.</div><br><div class="gmail_quote"><div class="gmail_attr">On Mon, 1 Jan 2024 at 10:00, Jane &lt;jane@example.com&gt; wrote:<br></div><blockquote class="gmail_quote">Lunch?</blockquote></div>`,
+			"Sounds good.",
+		},
+		{
+			"gmail quote container",
+			`<div>Yes</div><div class="gmail_quote gmail_quote_container"><blockquote>Lunch?</blockquote></div>`,
+			"Yes",
+		},
+		{
+			"gmail signature",
+			`<div>Thanks</div><div><br></div>-- <br><div dir="ltr" class="gmail_signature">Jane Doe<br>ACME Corp</div>`,
+			"Thanks",
+		},
+		{
+			"gmail inline reply",
+			`<div>See below.</div><div class="gmail_quote"><blockquote>Does it work?</blockquote></div><div>It does now.</div>`,
+			"See below.\nIt does now.",
+		},
+		{
+			"outlook reply header",
+			`<div>Approved.</div><hr style="display:inline-block;width:98%"><div id="divRplyFwdMsg"><b>From:</b> Jane<br><b>Sent:</b> Monday</div><div>Please approve.</div>`,
+			"Approved.",
+		},
+		{
+			"outlook appendonsend",
+			`<div>Approved.</div><div id="appendonsend"></div><p>Original text</p>`,
+			"Approved.",
+		},
+		{
+			"outlook signature",
+			`<p>Done.</p><div id="Signature"><p>Jane Doe | ACME</p></div>`,
+			"Done.",
+		},
+		{
+			"apple mail",
+			`<div>On my way.</div><div><br><div id="AppleMailSignature">Sent from my iPhone</div><blockquote type="cite">Where are you?</blockquote></div>`,
+			"On my way.",
+		},
+		{
+			"thunderbird",
+			`<p>Fixed.</p><div class="moz-cite-prefix">On 01/01/2024 10:00, Jane wrote:<br></div><blockquote type="cite">Broken</blockquote><div class="moz-signature">-- <br>Jane</div>`,
+			"Fixed.",
+		},
+		{
+			// A plain blockquote is the sender quoting something, not history
+			"plain blockquote",
+			`<p>The manual says</p><blockquote>Restart it.</blockquote><p>Did that.</p>`,
+			"The manual says\n\n> Restart it.\n\nDid that.",
+		},
+		{
+			"class name prefix",
+			`<div class="gmail_quote_like">Kept</div>`,
+			"Kept",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &InboundEmail{HTMLBody: tt.html}
+			if got := e.NewContent(); got != tt.want {
+				t.Errorf("NewContent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripReply(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			"gmail tagline",
+			"Sounds good.\n\nOn Mon, 1 Jan 2024 at 10:00, Jane <jane@example.com> wrote:\n> Lunch?\n",
+			"Sounds good.",
+		},
+		{
+			"wrapped tagline",
+			"Sounds good.\n\nOn Mon, Jan 1, 2024 at 10:00 AM Jane Doe <\njane@example.com> wrote:\n\n> Lunch?",
+			"Sounds good.",
+		},
+		{
+			"apple tagline",
+			"Yes.\r\n\r\nOn Jan 1, 2024, at 10:00, Jane Doe <jane@example.com> wrote:\r\n\r\n> Ready?\r\n",
+			"Yes.",
+		},
+		{
+			"outlook original message",
+			"Approved.\n\n-----Original Message-----\nFrom: Jane\nSent: Monday\n\nPlease approve.",
+			"Approved.",
+		},
+		{
+			"outlook from sent",
+			"Approved.\n\nFrom: Jane Doe <jane@example.com>\nSent: Monday, January 1, 2024 10:00 AM\nTo: Support\n\nPlease approve.",
+			"Approved.",
+		},
+		{
+			"outlook bold header",
+			"Approved.\n________________________________\n*From:* Jane\n*Sent:* Monday",
+			"Approved.",
+		},
+		{
+			"signature",
+			"Thanks,\nBob\n-- \nBob Smith\nACME Corp",
+			"Thanks,\nBob",
+		},
+		{
+			"signature without trailing space",
+			"Thanks\n--\nBob",
+			"Thanks",
+		},
+		{
+			"mobile tagline",
+			"On my way.\n\nSent from my iPhone",
+			"On my way.",
+		},
+		{
+			"get outlook",
+			"Done.\n\nGet Outlook for Android\n",
+			"Done.",
+		},
+		{
+			"trailing quote",
+			"Agreed.\n\n> Shall we ship?\n> \n",
+			"Agreed.",
+		},
+		{
+			"inline quotes",
+			"> Is it fixed?\nYes.\n> And deployed?\nNot yet.",
+			"> Is it fixed?\nYes.\n> And deployed?\nNot yet.",
+		},
+		// False positives: new content that looks like reply markup
+		{
+			"line starting with On",
+			"On Monday the deploy failed.\nOn Tuesday it worked.",
+			"On Monday the deploy failed.\nOn Tuesday it worked.",
+		},
+		{
+			"On with wrote mid-line",
+			"On second thought, what Jane wrote: is fine.\nShip it.",
+			"On second thought, what Jane wrote: is fine.\nShip it.",
+		},
+		{
+			"On line followed by wrote",
+			"On Monday the deploy failed.\nThis is what I wrote:\n\nrestart the worker",
+			"On Monday the deploy failed.\nThis is what I wrote:\n\nrestart the worker",
+		},
+		{
+			"On line with a time followed by wrote",
+			"On Monday at 10 the deploy failed.\nThis is what I wrote:\n\nrestart the worker",
+			"On Monday at 10 the deploy failed.\nThis is what I wrote:\n\nrestart the worker",
+		},
+		{
+			"tagline after a false positive",
+			"On Monday the deploy failed.\nThis is what I wrote:\nrestart it\n\nOn 1/1/24, Jane wrote:\n> Status?",
+			"On Monday the deploy failed.\nThis is what I wrote:\nrestart it",
+		},
+		{
+			"dashes in text",
+			"Step one -- unplug it.\n---\nStep two",
+			"Step one -- unplug it.\n---\nStep two",
+		},
+		{
+			"from in text",
+			"From: the team\nThanks for waiting.",
+			"From: the team\nThanks for waiting.",
+		},
+		{
+			"sent from in text",
+			"The invoice was sent from our billing system.",
+			"The invoice was sent from our billing system.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StripReply(tt.text); got != tt.want {
+				t.Errorf("StripReply(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
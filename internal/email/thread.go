@@ -0,0 +1,86 @@
+package email
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+	// Reply and forward prefixes, including localized ones such as "AW:" and "SV:"
+	subjectPrefix = regexp.MustCompile(`(?i)^\s*(re|fw|fwd|aw|wg|sv|vs|antw|rif|tr|r)\s*(\[\d+\]|\(\d+\))?\s*:\s*`)
+)
+
+// ThreadEntry is an earlier message of a conversation, shown to the LLM
+type ThreadEntry struct {
+	Direction string   `json:"direction"` // "inbound" or "outbound" (sent by eMitt)
+	From      string   `json:"from"`
+	To        []string `json:"to,omitempty"`
+	Subject   string   `json:"subject"`
+	Date      string   `json:"date"`
+	Body      string   `json:"body"`                 // Without quoted replies
+	LLMOutput string   `json:"llm_output,omitempty"` // What the LLM concluded when it processed the message
+}
+
+// ParseMessageIDs returns the <id> tokens of a Message-ID, In-Reply-To or
+// References header value. A bare value without brackets is returned
+// bracketed.
+func ParseMessageIDs(value string) []string {
+	ids := messageIDPattern.FindAllString(value, -1)
+	if len(ids) == 0 {
+		if v := strings.TrimSpace(value); v != "" && !strings.ContainsAny(v, " \t") {
+			ids = []string{"<" + strings.Trim(v, "<>") + ">"}
+		}
+	}
+	return ids
+}
+
+// ThreadReferences returns the Message-IDs this email replies to, oldest
+// first: its References followed by In-Reply-To
+func (e *InboundEmail) ThreadReferences() []string {
+	refs := ParseMessageIDs(e.Header("References"))
+	for _, id := range ParseMessageIDs(e.Header("In-Reply-To")) {
+		if !containsID(refs, id) {
+			refs = append(refs, id)
+		}
+	}
+	return refs
+}
+
+// ReplyReferences returns the References of a reply to this email
+func (e *InboundEmail) ReplyReferences() []string {
+	refs := e.ThreadReferences()
+	for _, id := range ParseMessageIDs(e.MessageID) {
+		if !containsID(refs, id) {
+			refs = append(refs, id)
+		}
+	}
+	return refs
+}
+
+func containsID(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeSubject strips reply and forward prefixes and folds case and
+// whitespace, so the subjects of one conversation compare equal
+func NormalizeSubject(subject string) string {
+	for {
+		stripped := subjectPrefix.ReplaceAllString(subject, "")
+		if stripped == subject {
+			break
+		}
+		subject = stripped
+	}
+	return strings.ToLower(strings.Join(strings.Fields(subject), " "))
+}
+
+// IsReplySubject reports whether a subject starts with a reply or forward prefix
+func IsReplySubject(subject string) bool {
+	return subjectPrefix.MatchString(subject)
+}
@@ -0,0 +1,300 @@
+package email
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"mime"
+	"path"
+	"strings"
+	"unicode/utf16"
+)
+
+// TNEF (Transport Neutral Encapsulation Format) is how Outlook wraps rich
+// text mail and its attachments in winmail.dat ([MS-OXTNEF])
+
+const tnefSignature = 0x223E9F78
+
+// TNEF attribute levels and IDs
+const (
+	tnefLevelMessage    = 0x01
+	tnefLevelAttachment = 0x02
+
+	attBody           = 0x800C
+	attAttachRendData = 0x9002
+	attAttachTitle    = 0x8010
+	attAttachData     = 0x800F
+	attAttachment     = 0x9005
+	attMsgProps       = 0x9003
+)
+
+// MAPI properties read from attribute property lists
+const (
+	prBody             = 0x1000
+	prBodyHTML         = 0x1013
+	prAttachDataObj    = 0x3701
+	prAttachFilename   = 0x3704
+	prAttachLongName   = 0x3707
+	prAttachMimeTag    = 0x370E
+	prAttachContentID  = 0x3712
+	mapiMultiValueFlag = 0x1000
+)
+
+// MAPI property types
+const (
+	ptI2       = 0x0002
+	ptLong     = 0x0003
+	ptR4       = 0x0004
+	ptDouble   = 0x0005
+	ptCurrency = 0x0006
+	ptAppTime  = 0x0007
+	ptError    = 0x000A
+	ptBoolean  = 0x000B
+	ptObject   = 0x000D
+	ptI8       = 0x0014
+	ptString8  = 0x001E
+	ptUnicode  = 0x001F
+	ptSysTime  = 0x0040
+	ptCLSID    = 0x0048
+	ptBinary   = 0x0102
+)
+
+var errTNEFTruncated = errors.New("tnef: truncated data")
+
+// tnefMessage is the decoded content of a winmail.dat
+type tnefMessage struct {
+	TextBody    string
+	HTMLBody    string
+	Attachments []tnefAttachment
+}
+
+// tnefAttachment is a file embedded in a winmail.dat
+type tnefAttachment struct {
+	Filename    string
+	ContentType string
+	ContentID   string
+	Data        []byte
+}
+
+// isTNEF reports whether an attachment is a winmail.dat
+func isTNEF(contentType, filename string) bool {
+	return contentType == "application/ms-tnef" ||
+		contentType == "application/vnd.ms-tnef" ||
+		strings.EqualFold(filename, "winmail.dat")
+}
+
+// decodeTNEF extracts the body and attachments from a winmail.dat
+func decodeTNEF(data []byte) (*tnefMessage, error) {
+	if len(data) < 6 || binary.LittleEndian.Uint32(data) != tnefSignature {
+		return nil, errors.New("tnef: bad signature")
+	}
+	data = data[6:] // Signature and legacy key
+
+	msg := &tnefMessage{}
+	var att *tnefAttachment
+	for len(data) > 0 {
+		if len(data) < 9 {
+			return nil, errTNEFTruncated
+		}
+		level := data[0]
+		id := binary.LittleEndian.Uint32(data[1:]) & 0xFFFF
+		length := binary.LittleEndian.Uint32(data[5:])
+		if uint64(len(data)) < 9+uint64(length)+2 {
+			return nil, errTNEFTruncated
+		}
+		value := data[9 : 9+length]
+		data = data[9+length+2:] // Value and checksum
+
+		switch {
+		case level == tnefLevelMessage && id == attBody:
+			msg.TextBody = strings.TrimRight(string(value), "\x00")
+		case level == tnefLevelMessage && id == attMsgProps:
+			// Properties read before a decoding error are still used
+			props, _ := decodeMAPIProps(value)
+			if v, ok := props[prBodyHTML]; ok {
+				msg.HTMLBody = string(v)
+			}
+			if v, ok := props[prBody]; ok && msg.TextBody == "" {
+				msg.TextBody = string(v)
+			}
+		case level == tnefLevelAttachment && id == attAttachRendData:
+			msg.Attachments = append(msg.Attachments, tnefAttachment{})
+			att = &msg.Attachments[len(msg.Attachments)-1]
+		case level == tnefLevelAttachment && att != nil:
+			switch id {
+			case attAttachTitle:
+				att.Filename = strings.TrimRight(string(value), "\x00")
+			case attAttachData:
+				att.Data = value
+			case attAttachment:
+				props, _ := decodeMAPIProps(value)
+				if v := props[prAttachLongName]; len(v) > 0 {
+					att.Filename = string(v)
+				} else if v := props[prAttachFilename]; len(v) > 0 && att.Filename == "" {
+					att.Filename = string(v)
+				}
+				if v := props[prAttachMimeTag]; len(v) > 0 {
+					att.ContentType = string(v)
+				}
+				if v := props[prAttachContentID]; len(v) > 0 {
+					att.ContentID = strings.Trim(string(v), "<>")
+				}
+				if v := props[prAttachDataObj]; len(v) > 0 && att.Data == nil {
+					att.Data = v
+				}
+			}
+		}
+	}
+
+	// Attachments without data are OLE objects or links we cannot render
+	files := msg.Attachments[:0]
+	for _, a := range msg.Attachments {
+		if a.Data == nil {
+			continue
+		}
+		if a.ContentType == "" {
+			a.ContentType = mime.TypeByExtension(path.Ext(a.Filename))
+			if i := strings.Index(a.ContentType, ";"); i >= 0 {
+				a.ContentType = a.ContentType[:i]
+			}
+			if a.ContentType == "" {
+				a.ContentType = "application/octet-stream"
+			}
+		}
+		files = append(files, a)
+	}
+	msg.Attachments = files
+
+	return msg, nil
+}
+
+// decodeMAPIProps reads a MAPI property list, returning the first value of
+// each string, binary and object property keyed by property ID. Strings are
+// returned as UTF-8 without their terminator.
+func decodeMAPIProps(data []byte) (map[uint16][]byte, error) {
+	r := &tnefReader{data: data}
+	count := r.uint32()
+	props := make(map[uint16][]byte)
+
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		typ := r.uint16()
+		id := r.uint16()
+
+		// Named properties carry a GUID and a number or name
+		if id >= 0x8000 {
+			r.skip(16)
+			if r.uint32() == 0 {
+				r.skip(4)
+			} else {
+				r.skip(pad4(r.uint32()))
+			}
+		}
+
+		multi := typ&mapiMultiValueFlag != 0
+		typ &^= mapiMultiValueFlag
+
+		switch typ {
+		case ptString8, ptUnicode, ptBinary, ptObject:
+			n := r.uint32()
+			for j := uint32(0); j < n && r.err == nil; j++ {
+				size := r.uint32()
+				value := r.bytes(size)
+				r.skip(pad4(size) - size)
+				if j > 0 || r.err != nil {
+					continue
+				}
+				switch typ {
+				case ptString8:
+					value = bytes.TrimRight(value, "\x00")
+				case ptUnicode:
+					value = []byte(decodeUTF16(value))
+				case ptObject:
+					if len(value) >= 16 {
+						value = value[16:] // Interface GUID
+					}
+				}
+				props[id] = value
+			}
+		default:
+			size, ok := mapiFixedSize(typ)
+			if !ok {
+				return props, errors.New("tnef: unknown property type")
+			}
+			n := uint32(1)
+			if multi {
+				n = r.uint32()
+			}
+			r.skip(n * size)
+		}
+	}
+	return props, r.err
+}
+
+// mapiFixedSize returns the padded size of a fixed-width property value
+func mapiFixedSize(typ uint16) (uint32, bool) {
+	switch typ {
+	case ptI2, ptLong, ptR4, ptError, ptBoolean:
+		return 4, true
+	case ptDouble, ptCurrency, ptAppTime, ptI8, ptSysTime:
+		return 8, true
+	case ptCLSID:
+		return 16, true
+	}
+	return 0, false
+}
+
+func pad4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+// decodeUTF16 converts a little-endian, NUL-terminated UTF-16 string
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// tnefReader reads little-endian values, remembering the first error
+type tnefReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tnefReader) bytes(n uint32) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if uint64(n) > uint64(len(r.data)) {
+		r.err = errTNEFTruncated
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tnefReader) skip(n uint32) {
+	r.bytes(n)
+}
+
+func (r *tnefReader) uint16() uint16 {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (r *tnefReader) uint32() uint32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
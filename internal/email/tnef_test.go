@@ -0,0 +1,303 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// tnefFixture builds a winmail.dat the way Outlook lays it out
+type tnefFixture struct {
+	buf bytes.Buffer
+}
+
+func newTNEFFixture() *tnefFixture {
+	f := &tnefFixture{}
+	binary.Write(&f.buf, binary.LittleEndian, uint32(tnefSignature))
+	binary.Write(&f.buf, binary.LittleEndian, uint16(0x0001)) // Legacy key
+	return f
+}
+
+// attr appends an attribute with its checksum. The attribute type in the
+// high word of the ID is ignored by the decoder.
+func (f *tnefFixture) attr(level byte, id uint32, value []byte) *tnefFixture {
+	f.buf.WriteByte(level)
+	binary.Write(&f.buf, binary.LittleEndian, id|0x00060000)
+	binary.Write(&f.buf, binary.LittleEndian, uint32(len(value)))
+	f.buf.Write(value)
+	var sum uint16
+	for _, b := range value {
+		sum += uint16(b)
+	}
+	binary.Write(&f.buf, binary.LittleEndian, sum)
+	return f
+}
+
+func (f *tnefFixture) bytes() []byte {
+	return f.buf.Bytes()
+}
+
+// mapiProp is one property of a MAPI property list
+type mapiProp struct {
+	typ   uint16
+	id    uint16
+	value []byte // Raw value; padded for variable-length types
+	named bool   // Write a named property header with a numeric name
+}
+
+// mapiProps encodes a MAPI property list
+func mapiProps(props ...mapiProp) []byte {
+	var b bytes.Buffer
+	le := func(v interface{}) { binary.Write(&b, binary.LittleEndian, v) }
+	le(uint32(len(props)))
+	for _, p := range props {
+		le(p.typ)
+		le(p.id)
+		if p.named {
+			b.Write(make([]byte, 16)) // Property set GUID
+			le(uint32(0))             // Numeric name
+			le(uint32(0x8513))
+		}
+		switch p.typ &^ mapiMultiValueFlag {
+		case ptString8, ptUnicode, ptBinary, ptObject:
+			le(uint32(1))
+			le(uint32(len(p.value)))
+			b.Write(p.value)
+			b.Write(make([]byte, pad4(uint32(len(p.value)))-uint32(len(p.value))))
+		default:
+			b.Write(p.value)
+		}
+	}
+	return b.Bytes()
+}
+
+func string8Prop(id uint16, s string) mapiProp {
+	return mapiProp{typ: ptString8, id: id, value: []byte(s + "\x00")}
+}
+
+func unicodeProp(id uint16, s string) mapiProp {
+	var b bytes.Buffer
+	for _, c := range utf16.Encode([]rune(s)) {
+		binary.Write(&b, binary.LittleEndian, c)
+	}
+	b.Write([]byte{0, 0})
+	return mapiProp{typ: ptUnicode, id: id, value: b.Bytes()}
+}
+
+const prRTFCompressed = 0x1009
+
+// outlookTNEF is a rich text message with a PDF, an inline image and an
+// embedded OLE object, as sent by Outlook
+func outlookTNEF() []byte {
+	msgProps := mapiProps(
+		mapiProp{typ: ptLong, id: 0x0E07, value: []byte{1, 0, 0, 0}},                 // PR_MESSAGE_FLAGS
+		mapiProp{typ: ptBoolean, id: 0x8000, value: []byte{1, 0, 0, 0}, named: true}, // Named flag
+		mapiProp{typ: ptBinary, id: prRTFCompressed, value: []byte("\x2d\x00\x00\x00LZFu{\\rtf1 Hello}")},
+		unicodeProp(prBody, "Hello from Outlook, ça va?"),
+		mapiProp{typ: ptBinary, id: prBodyHTML, value: []byte("<p>Hello from Outlook</p>")},
+		mapiProp{typ: ptSysTime | mapiMultiValueFlag, id: 0x3007, value: append([]byte{2, 0, 0, 0}, make([]byte, 16)...)},
+	)
+
+	object := append(make([]byte, 16), []byte("\x89PNG logo")...) // Interface GUID, then data
+
+	return newTNEFFixture().
+		attr(tnefLevelMessage, attMsgProps, msgProps).
+		// A PDF with a short 8.3 title and its long name in the properties
+		attr(tnefLevelAttachment, attAttachRendData, make([]byte, 14)).
+		attr(tnefLevelAttachment, attAttachTitle, []byte("QUARTE~1.PDF\x00")).
+		attr(tnefLevelAttachment, attAttachData, []byte("%PDF-1.4 report")).
+		attr(tnefLevelAttachment, attAttachment, mapiProps(
+			unicodeProp(prAttachLongName, "Quarterly report.pdf"),
+			string8Prop(prAttachMimeTag, "application/pdf"),
+		)).
+		// An inline image stored as an object, typed by its extension
+		attr(tnefLevelAttachment, attAttachRendData, make([]byte, 14)).
+		attr(tnefLevelAttachment, attAttachment, mapiProps(
+			string8Prop(prAttachFilename, "logo.png"),
+			string8Prop(prAttachContentID, "<logo@example.com>"),
+			mapiProp{typ: ptObject, id: prAttachDataObj, value: object},
+		)).
+		// An OLE object with no file data
+		attr(tnefLevelAttachment, attAttachRendData, make([]byte, 14)).
+		attr(tnefLevelAttachment, attAttachTitle, []byte("Picture (Device Independent Bitmap)\x00")).
+		bytes()
+}
+
+func TestDecodeTNEF(t *testing.T) {
+	msg, err := decodeTNEF(outlookTNEF())
+	if err != nil {
+		t.Fatalf("decodeTNEF: %v", err)
+	}
+	if msg.TextBody != "Hello from Outlook, ça va?" {
+		t.Errorf("text body = %q", msg.TextBody)
+	}
+	if msg.HTMLBody != "<p>Hello from Outlook</p>" {
+		t.Errorf("html body = %q", msg.HTMLBody)
+	}
+
+	want := []tnefAttachment{
+		{Filename: "Quarterly report.pdf", ContentType: "application/pdf", Data: []byte("%PDF-1.4 report")},
+		{Filename: "logo.png", ContentType: "image/png", ContentID: "logo@example.com", Data: []byte("\x89PNG logo")},
+	}
+	if len(msg.Attachments) != len(want) {
+		t.Fatalf("got %d attachments, want %d: %+v", len(msg.Attachments), len(want), msg.Attachments)
+	}
+	for i, w := range want {
+		got := msg.Attachments[i]
+		if got.Filename != w.Filename || got.ContentType != w.ContentType || got.ContentID != w.ContentID || !bytes.Equal(got.Data, w.Data) {
+			t.Errorf("attachment %d = %q %q %q %q, want %q %q %q %q", i,
+				got.Filename, got.ContentType, got.ContentID, got.Data,
+				w.Filename, w.ContentType, w.ContentID, w.Data)
+		}
+	}
+}
+
+func TestDecodeTNEFBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		wantText string
+		wantHTML string
+	}{
+		{
+			"attBody wins over PR_BODY",
+			newTNEFFixture().
+				attr(tnefLevelMessage, attBody, []byte("Legacy body\x00")).
+				attr(tnefLevelMessage, attMsgProps, mapiProps(string8Prop(prBody, "Property body"))).
+				bytes(),
+			"Legacy body", "",
+		},
+		{
+			// The compressed RTF is not a body we can show
+			"rtf only",
+			newTNEFFixture().
+				attr(tnefLevelMessage, attMsgProps, mapiProps(
+					mapiProp{typ: ptBinary, id: prRTFCompressed, value: []byte("LZFu{\\rtf1 Hi}")},
+				)).
+				bytes(),
+			"", "",
+		},
+		{
+			// Properties before an unknown type are still used
+			"unknown property type",
+			newTNEFFixture().
+				attr(tnefLevelMessage, attMsgProps, mapiProps(
+					string8Prop(prBodyHTML, "<b>kept</b>"),
+					mapiProp{typ: 0x0FFF, id: 0x0001},
+					string8Prop(prBody, "lost"),
+				)).
+				bytes(),
+			"", "<b>kept</b>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := decodeTNEF(tt.data)
+			if err != nil {
+				t.Fatalf("decodeTNEF: %v", err)
+			}
+			if msg.TextBody != tt.wantText || msg.HTMLBody != tt.wantHTML {
+				t.Errorf("body = %q / %q, want %q / %q", msg.TextBody, msg.HTMLBody, tt.wantText, tt.wantHTML)
+			}
+		})
+	}
+}
+
+func TestDecodeTNEFErrors(t *testing.T) {
+	full := outlookTNEF()
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "bad signature"},
+		{"not tnef", []byte("PK\x03\x04 zip file"), "bad signature"},
+		{"short attribute header", full[:10], "truncated"},
+		{"truncated value", full[:len(full)-20], "truncated"},
+		// An attribute claiming a 4GB value
+		{"huge length", append(newTNEFFixture().bytes(), 0x01, 0x0C, 0x80, 0x06, 0x00, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0), "truncated"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeTNEF(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("decodeTNEF = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExpandsTNEF(t *testing.T) {
+	raw := "From: alice@example.org\r\n" +
+		"To: support@example.com\r\n" +
+		"Subject: Report\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/ms-tnef; name=winmail.dat\r\n" +
+		"Content-Disposition: attachment; filename=winmail.dat\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(outlookTNEF()) + "\r\n" +
+		"--b--\r\n"
+
+	e, err := NewParser().Parse([]byte(raw))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if e.TextBody != "Hello from Outlook, ça va?" || e.HTMLBody != "<p>Hello from Outlook</p>" {
+		t.Errorf("body = %q / %q, want the TNEF body", e.TextBody, e.HTMLBody)
+	}
+	var names []string
+	for _, att := range e.Attachments {
+		names = append(names, att.Filename)
+	}
+	if strings.Join(names, ",") != "Quarterly report.pdf,logo.png" {
+		t.Errorf("attachments = %v, want winmail.dat replaced by its files", names)
+	}
+	if att := e.AttachmentByContentID("<logo@example.com>"); att == nil || att.ContentType != "image/png" {
+		t.Errorf("inline image by Content-ID = %+v", att)
+	}
+
+	// A damaged winmail.dat is kept as it is
+	damaged := strings.Replace(raw, base64.StdEncoding.EncodeToString(outlookTNEF()),
+		base64.StdEncoding.EncodeToString(outlookTNEF()[:40]), 1)
+	e, err = NewParser().Parse([]byte(damaged))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if len(e.Attachments) != 1 || e.Attachments[0].Filename != "winmail.dat" {
+		t.Errorf("attachments = %+v, want the damaged winmail.dat kept", e.Attachments)
+	}
+}
+
+func FuzzDecodeTNEF(f *testing.F) {
+	f.Add(outlookTNEF())
+	f.Add(newTNEFFixture().attr(tnefLevelMessage, attBody, []byte("Hi\x00")).bytes())
+	f.Add(newTNEFFixture().attr(tnefLevelMessage, attMsgProps, mapiProps(
+		mapiProp{typ: ptUnicode | mapiMultiValueFlag, id: prBody, value: []byte{'a', 0}},
+		mapiProp{typ: ptLong, id: 0x8001, value: []byte{0, 0, 0, 0}, named: true},
+	)).bytes())
+	f.Add(newTNEFFixture().attr(tnefLevelAttachment, attAttachData, []byte("orphan")).bytes())
+	f.Add([]byte("\x78\x9f\x3e\x22"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, err := decodeTNEF(data)
+		if err != nil {
+			return
+		}
+		for _, att := range msg.Attachments {
+			if att.Data == nil || att.ContentType == "" {
+				t.Errorf("attachment %q decoded without data or type", att.Filename)
+			}
+		}
+	})
+}
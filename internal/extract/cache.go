@@ -0,0 +1,38 @@
+package extract
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// ExtractAttachment fills in the text of a stored attachment, extracting it
+// on first use and caching the result on its row. Extraction failures are
+// recorded in ExtractError; content types without an extractor are cached
+// as empty. The returned error is only for reading or updating the store.
+func (r *Registry) ExtractAttachment(ctx context.Context, store *storage.Store, att *storage.Attachment) error {
+	if att.ExtractedAt != nil {
+		return nil
+	}
+
+	rc, err := store.OpenAttachment(att)
+	if err != nil {
+		return err
+	}
+	text, err := r.Extract(att.ContentType, att.Filename, att.Size, rc)
+	rc.Close()
+
+	errMsg := ""
+	if err != nil && !errors.Is(err, ErrUnsupported) {
+		errMsg = err.Error()
+	}
+	if err := store.UpdateAttachmentText(ctx, att.ID, text, errMsg); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	att.ExtractedText, att.ExtractError, att.ExtractedAt = text, errMsg, &now
+	return nil
+}
@@ -0,0 +1,144 @@
+// Package extract turns attachment content into plain text for the LLM,
+// with extractors registered by content type.
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+// ErrUnsupported is returned for content types without an extractor
+var ErrUnsupported = errors.New("no text extractor for content type")
+
+// Extractor returns the text of a document
+type Extractor func(data []byte) (string, error)
+
+// Registry maps content types to extractors
+type Registry struct {
+	cfg *config.ExtractionConfig
+
+	mu         sync.RWMutex
+	extractors map[string]Extractor
+}
+
+// NewRegistry creates a registry with the built-in extractors for plain
+// text, CSV, JSON, HTML, PDF, DOCX, XLSX and images
+func NewRegistry(cfg *config.ExtractionConfig) *Registry {
+	r := &Registry{
+		cfg:        cfg,
+		extractors: make(map[string]Extractor),
+	}
+
+	r.Register("text/plain", extractText)
+	r.Register("text/markdown", extractText)
+	r.Register("text/csv", extractCSV)
+	r.Register("text/tab-separated-values", extractTSV)
+	r.Register("application/json", extractJSON)
+	r.Register("text/html", extractHTML)
+	r.Register("application/pdf", extractPDF)
+	r.Register("application/vnd.openxmlformats-officedocument.wordprocessingml.document", extractDOCX)
+	r.Register("application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", extractXLSX)
+	r.Register("image/png", extractImage)
+	r.Register("image/jpeg", extractImage)
+	r.Register("image/gif", extractImage)
+	return r
+}
+
+// Register sets the extractor for a content type, replacing any existing
+// one. "text/*" style wildcards match every subtype.
+func (r *Registry) Register(contentType string, ex Extractor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.extractors[strings.ToLower(contentType)] = ex
+}
+
+// Lookup returns the extractor for an attachment. Generic content types such
+// as application/octet-stream fall back to the type of the file extension.
+func (r *Registry) Lookup(contentType, filename string) Extractor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, ct := range []string{mediaType(contentType), mediaType(mime.TypeByExtension(strings.ToLower(path.Ext(filename))))} {
+		if ct == "" {
+			continue
+		}
+		if ex, ok := r.extractors[ct]; ok {
+			return ex
+		}
+		if i := strings.Index(ct, "/"); i > 0 {
+			if ex, ok := r.extractors[ct[:i]+"/*"]; ok {
+				return ex
+			}
+		}
+		// Structured text types such as application/ld+json
+		if strings.HasSuffix(ct, "+json") {
+			if ex, ok := r.extractors["application/json"]; ok {
+				return ex
+			}
+		}
+	}
+	return nil
+}
+
+// Extract reads up to the configured size limit from r and returns its text,
+// cut to the configured character limit
+func (r *Registry) Extract(contentType, filename string, size int64, content io.Reader) (string, error) {
+	ex := r.Lookup(contentType, filename)
+	if ex == nil {
+		return "", ErrUnsupported
+	}
+	if r.cfg.MaxBytes > 0 && size > r.cfg.MaxBytes {
+		return "", fmt.Errorf("attachment is larger than the %d byte extraction limit", r.cfg.MaxBytes)
+	}
+
+	limit := r.cfg.MaxBytes
+	if limit <= 0 {
+		limit = size
+	}
+	data, err := io.ReadAll(io.LimitReader(content, limit+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read attachment: %w", err)
+	}
+	if int64(len(data)) > limit && r.cfg.MaxBytes > 0 {
+		return "", fmt.Errorf("attachment is larger than the %d byte extraction limit", r.cfg.MaxBytes)
+	}
+
+	text, err := ex(data)
+	if err != nil {
+		return "", err
+	}
+	text, _ = Truncate(strings.TrimSpace(text), r.cfg.MaxChars)
+	return text, nil
+}
+
+// Truncate cuts text to at most n characters, reporting whether it was cut.
+// n <= 0 leaves the text whole.
+func Truncate(text string, n int) (string, bool) {
+	if n <= 0 || utf8.RuneCountInString(text) <= n {
+		return text, false
+	}
+	i := 0
+	for j := range text {
+		if i == n {
+			return text[:j], true
+		}
+		i++
+	}
+	return text, false
+}
+
+// mediaType lowercases a content type and drops its parameters
+func mediaType(ct string) string {
+	if i := strings.Index(ct, ";"); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(ct))
+}
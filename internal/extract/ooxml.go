@@ -0,0 +1,228 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxZipEntry caps the uncompressed size of a document part, so a zip bomb
+// cannot exhaust memory
+const maxZipEntry = 64 * 1024 * 1024
+
+// extractDOCX returns the paragraphs of a Word document
+func extractDOCX(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("failed to open document: %w", err)
+	}
+	doc, err := readZipEntry(zr, "word/document.xml")
+	if err != nil {
+		return "", err
+	}
+
+	// Table rows become one line with " | " between cells
+	var b strings.Builder
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	inText := false
+	cellDepth, cells := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to parse document: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				b.WriteString("\t")
+			case "br", "cr":
+				b.WriteString("\n")
+			case "tr":
+				cells = 0
+			case "tc":
+				if cells > 0 {
+					b.WriteString("| ")
+				}
+				cells++
+				cellDepth++
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				if cellDepth > 0 {
+					b.WriteString(" ")
+				} else {
+					b.WriteString("\n")
+				}
+			case "tc":
+				cellDepth--
+			case "tr":
+				b.WriteString("\n")
+			}
+		case xml.CharData:
+			if inText {
+				b.Write(t)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// extractXLSX returns every sheet of a workbook, one row per line with
+// " | " between cells
+func extractXLSX(data []byte) (string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("failed to open workbook: %w", err)
+	}
+
+	var shared []string
+	if sst, err := readZipEntry(zr, "xl/sharedStrings.xml"); err == nil {
+		if shared, err = parseSharedStrings(sst); err != nil {
+			return "", err
+		}
+	}
+
+	// Sheet names in workbook order; sheetN.xml files follow that order
+	var names []string
+	if wb, err := readZipEntry(zr, "xl/workbook.xml"); err == nil {
+		var workbook struct {
+			Sheets []struct {
+				Name string `xml:"name,attr"`
+			} `xml:"sheets>sheet"`
+		}
+		if xml.Unmarshal(wb, &workbook) == nil {
+			for _, s := range workbook.Sheets {
+				names = append(names, s.Name)
+			}
+		}
+	}
+
+	var sheets []*zip.File
+	for _, f := range zr.File {
+		if strings.HasPrefix(f.Name, "xl/worksheets/sheet") && strings.HasSuffix(f.Name, ".xml") {
+			sheets = append(sheets, f)
+		}
+	}
+	sort.Slice(sheets, func(i, j int) bool { return sheetNumber(sheets[i].Name) < sheetNumber(sheets[j].Name) })
+
+	var b strings.Builder
+	for i, f := range sheets {
+		content, err := readZipFile(f)
+		if err != nil {
+			return "", err
+		}
+		name := fmt.Sprintf("Sheet%d", sheetNumber(f.Name))
+		if i < len(names) && len(names) == len(sheets) {
+			name = names[i]
+		}
+		fmt.Fprintf(&b, "## %s\n", name)
+		if err := writeSheet(&b, content, shared); err != nil {
+			return "", err
+		}
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// writeSheet renders the rows of a worksheet
+func writeSheet(b *strings.Builder, content []byte, shared []string) error {
+	var sheet struct {
+		Rows []struct {
+			Cells []struct {
+				Type   string `xml:"t,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.Unmarshal(content, &sheet); err != nil {
+		return fmt.Errorf("failed to parse worksheet: %w", err)
+	}
+
+	for _, row := range sheet.Rows {
+		cells := make([]string, 0, len(row.Cells))
+		for _, c := range row.Cells {
+			value := c.Value
+			switch c.Type {
+			case "s":
+				if i, err := strconv.Atoi(value); err == nil && i >= 0 && i < len(shared) {
+					value = shared[i]
+				}
+			case "inlineStr":
+				value = c.Inline
+			}
+			cells = append(cells, strings.TrimSpace(value))
+		}
+		line := strings.TrimRight(strings.Join(cells, " | "), " |")
+		if line != "" {
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+	}
+	return nil
+}
+
+// parseSharedStrings reads the workbook's string table. Rich text entries
+// are made of several runs.
+func parseSharedStrings(data []byte) ([]string, error) {
+	var sst struct {
+		Items []struct {
+			Text string   `xml:"t"`
+			Runs []string `xml:"r>t"`
+		} `xml:"si"`
+	}
+	if err := xml.Unmarshal(data, &sst); err != nil {
+		return nil, fmt.Errorf("failed to parse shared strings: %w", err)
+	}
+	strs := make([]string, len(sst.Items))
+	for i, item := range sst.Items {
+		strs[i] = item.Text + strings.Join(item.Runs, "")
+	}
+	return strs, nil
+}
+
+// sheetNumber returns N from xl/worksheets/sheetN.xml
+func sheetNumber(name string) int {
+	n, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "xl/worksheets/sheet"), ".xml"))
+	return n
+}
+
+func readZipEntry(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name == name {
+			return readZipFile(f)
+		}
+	}
+	return nil, fmt.Errorf("%s not found", name)
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", f.Name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxZipEntry+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+	}
+	if len(data) > maxZipEntry {
+		return nil, fmt.Errorf("%s is too large", f.Name)
+	}
+	return data, nil
+}
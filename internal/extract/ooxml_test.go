@@ -0,0 +1,175 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// zipFiles builds a zip archive from name/content pairs, keeping their order
+func zipFiles(t testing.TB, files ...string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for i := 0; i+1 < len(files); i += 2 {
+		w, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(files[i+1]))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+const wordNS = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"`
+
+func docx(t testing.TB, body string) []byte {
+	return zipFiles(t,
+		"[Content_Types].xml", `<Types/>`,
+		"word/document.xml", `<?xml version="1.0" encoding="UTF-8"?><w:document `+wordNS+`><w:body>`+body+`</w:body></w:document>`,
+	)
+}
+
+func TestExtractDOCX(t *testing.T) {
+	body := `<w:p><w:r><w:t>Dear customer,</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t xml:space="preserve">Order </w:t></w:r><w:r><w:rPr><w:b/></w:rPr><w:t>1234</w:t></w:r></w:p>` +
+		`<w:p><w:r><w:t>Qty</w:t><w:tab/><w:t>3</w:t><w:br/><w:t>Next line</w:t></w:r></w:p>` +
+		`<w:tbl>` +
+		`<w:tr><w:tc><w:p><w:r><w:t>Item</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>Price</w:t></w:r></w:p></w:tc></w:tr>` +
+		`<w:tr><w:tc><w:p><w:r><w:t>Widget</w:t></w:r></w:p></w:tc><w:tc><w:p><w:r><w:t>9.99</w:t></w:r></w:p></w:tc></w:tr>` +
+		`</w:tbl>` +
+		`<w:p><w:r><w:instrText>PAGE</w:instrText><w:t>&lt;end&gt; &amp; more</w:t></w:r></w:p>`
+
+	got, err := extractDOCX(docx(t, body))
+	if err != nil {
+		t.Fatalf("extractDOCX: %v", err)
+	}
+	want := "Dear customer,\nOrder 1234\nQty\t3\nNext line\nItem | Price \nWidget | 9.99 \n<end> & more\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtractDOCXErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not a zip", []byte("plain text"), "failed to open document"},
+		{"no document part", zipFiles(t, "word/styles.xml", "<styles/>"), "word/document.xml not found"},
+		{"malformed xml", zipFiles(t, "word/document.xml", "<w:document><w:body><w:p>"), "failed to parse document"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := extractDOCX(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadZipEntryLimit(t *testing.T) {
+	data := zipFiles(t, "word/document.xml", strings.Repeat(" ", maxZipEntry+1))
+	if _, err := extractDOCX(data); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("err = %v, want the entry size limit", err)
+	}
+}
+
+const sheetNS = `xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"`
+
+func sheet(rows string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?><worksheet ` + sheetNS + `><sheetData>` + rows + `</sheetData></worksheet>`
+}
+
+func TestExtractXLSX(t *testing.T) {
+	data := zipFiles(t,
+		"xl/workbook.xml", `<workbook `+sheetNS+`><sheets><sheet name="Orders" sheetId="1"/><sheet name="Totals" sheetId="2"/></sheets></workbook>`,
+		"xl/sharedStrings.xml", `<sst `+sheetNS+`><si><t>Item</t></si><si><t>Price</t></si><si><r><t>Wid</t></r><r><t>get</t></r></si></sst>`,
+		// Stored out of order; sheet2 must follow sheet1
+		"xl/worksheets/sheet2.xml", sheet(`<row><c t="inlineStr"><is><t>Sum</t></is></c><c><v>19.98</v></c></row>`),
+		"xl/worksheets/sheet1.xml", sheet(
+			`<row><c t="s"><v>0</v></c><c t="s"><v>1</v></c></row>`+
+				`<row><c t="s"><v>2</v></c><c><v>9.99</v></c><c/><c/></row>`+
+				`<row><c/></row>`+
+				`<row><c t="s"><v>7</v></c><c t="b"><v>1</v></c></row>`),
+	)
+
+	got, err := extractXLSX(data)
+	if err != nil {
+		t.Fatalf("extractXLSX: %v", err)
+	}
+	// Out of range shared string indexes are kept as the raw value
+	want := "## Orders\nItem | Price\nWidget | 9.99\n7 | 1\n\n## Totals\nSum | 19.98\n\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtractXLSXSheetNames(t *testing.T) {
+	// Without a matching workbook, sheets are named after their part
+	data := zipFiles(t,
+		"xl/workbook.xml", `<workbook `+sheetNS+`><sheets><sheet name="Only"/></sheets></workbook>`,
+		"xl/worksheets/sheet10.xml", sheet(`<row><c><v>10</v></c></row>`),
+		"xl/worksheets/sheet2.xml", sheet(`<row><c><v>2</v></c></row>`),
+	)
+
+	got, err := extractXLSX(data)
+	if err != nil {
+		t.Fatalf("extractXLSX: %v", err)
+	}
+	if want := "## Sheet2\n2\n\n## Sheet10\n10\n\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtractXLSXErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not a zip", []byte("a,b,c"), "failed to open workbook"},
+		{"bad shared strings", zipFiles(t, "xl/sharedStrings.xml", "<sst><si>"), "failed to parse shared strings"},
+		{"bad worksheet", zipFiles(t, "xl/worksheets/sheet1.xml", "<worksheet><sheetData><row>"), "failed to parse worksheet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := extractXLSX(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzExtractDOCX(f *testing.F) {
+	f.Add(docx(f, `<w:p><w:r><w:t>Hello</w:t><w:tab/><w:br/></w:r></w:p>`))
+	f.Add(docx(f, `<w:tbl><w:tr><w:tc><w:p><w:r><w:t>a</w:t></w:r></w:p></w:tc><w:tc><w:tc></w:tc></w:tc></w:tr></w:tbl>`))
+	f.Add(docx(f, `</w:tc></w:tc><w:p>`))
+	f.Add(zipFiles(f, "word/document.xml", ""))
+	f.Add([]byte("PK\x03\x04"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		extractDOCX(data)
+	})
+}
+
+func FuzzExtractXLSX(f *testing.F) {
+	f.Add(zipFiles(f,
+		"xl/workbook.xml", `<workbook><sheets><sheet name="A"/></sheets></workbook>`,
+		"xl/sharedStrings.xml", `<sst><si><t>x</t></si><si><r><t>y</t></r></si></sst>`,
+		"xl/worksheets/sheet1.xml", sheet(`<row><c t="s"><v>0</v></c><c t="s"><v>-1</v></c><c t="inlineStr"><is><t>z</t></is></c></row>`),
+	))
+	f.Add(zipFiles(f, "xl/worksheets/sheet.xml", sheet(""), "xl/worksheets/sheetx.xml", ""))
+	f.Add([]byte("PK\x05\x06"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		extractXLSX(data)
+	})
+}
@@ -0,0 +1,1029 @@
+package extract
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// The PDF extractor reads the text drawn by each page's content stream. It
+// understands compressed object streams, Flate filters, ToUnicode maps and
+// form XObjects, which covers the invoices and reports generated by common
+// software. Scanned pages have no text and encrypted files are rejected.
+
+// maxStreamSize caps a decompressed stream
+const maxStreamSize = 64 * 1024 * 1024
+
+// maxDecodedSize caps the bytes decompressed from one file, as streams can be
+// decoded once per page that draws them
+const maxDecodedSize = 256 * 1024 * 1024
+
+// maxCMapRange caps the codes a CMap maps through bfrange entries
+const maxCMapRange = 1 << 17
+
+// maxFormDepth limits nested form XObjects
+const maxFormDepth = 8
+
+var objPattern = regexp.MustCompile(`(\d+)\s+(\d+)\s+obj\b`)
+
+// PDF object values
+type (
+	pdfName  string
+	pdfRef   struct{ num, gen int }
+	pdfDict  map[pdfName]interface{}
+	pdfArray []interface{}
+	pdfOp    string // Content stream operator or unknown keyword
+)
+
+// pdfStream is a stream object's dictionary and raw data
+type pdfStream struct {
+	dict pdfDict
+	data []byte
+}
+
+// pdfFile holds every object of a document by number
+type pdfFile struct {
+	objects map[int]interface{}
+	trailer pdfDict
+	fonts   map[pdfRef]*pdfFont
+	decoded int64 // Bytes decompressed so far
+}
+
+// extractPDF returns the text of every page
+func extractPDF(data []byte) (string, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("%PDF")) {
+		return "", errors.New("not a PDF file")
+	}
+
+	f := parsePDF(data)
+	if _, ok := f.trailer["Encrypt"]; ok {
+		return "", errors.New("PDF is encrypted")
+	}
+
+	pages := f.pages()
+	if len(pages) == 0 {
+		return "", errors.New("PDF has no pages")
+	}
+
+	var b strings.Builder
+	for i, page := range pages {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		resources, _ := f.resolve(f.inherited(page, "Resources")).(pdfDict)
+		drawn := make(map[*pdfStream]bool)
+		for _, content := range f.contents(page) {
+			data, err := f.decode(content)
+			if err != nil {
+				continue
+			}
+			w := &pdfText{file: f, drawn: drawn}
+			w.run(data, resources, 0)
+			b.WriteString(w.String())
+		}
+	}
+
+	text := strings.TrimSpace(b.String())
+	if text == "" {
+		return "", errors.New("PDF has no extractable text (it may be scanned)")
+	}
+	return text, nil
+}
+
+// parsePDF indexes the objects of a file, including those packed in object
+// streams. Objects are found by scanning rather than through the xref
+// table, so damaged or incrementally updated files still read.
+func parsePDF(data []byte) *pdfFile {
+	f := &pdfFile{objects: make(map[int]interface{}), trailer: pdfDict{}, fonts: make(map[pdfRef]*pdfFont)}
+
+	// Each object is parsed up to the next one, so unterminated objects
+	// cannot make the scan quadratic; stream data may run past that point
+	matches := objPattern.FindAllSubmatchIndex(data, -1)
+	endstreams := bytesIndexAll(data, []byte("endstream"))
+	for i, m := range matches {
+		num, _ := strconv.Atoi(string(data[m[2]:m[3]]))
+		end := len(data)
+		if i+1 < len(matches) {
+			end = matches[i+1][0]
+		}
+		p := &pdfParser{data: data[:end], pos: m[1], endstreams: endstreams}
+		obj, err := p.object()
+		if err != nil {
+			continue
+		}
+		if dict, ok := obj.(pdfDict); ok {
+			p.data = data
+			if stream, ok := p.stream(dict); ok {
+				obj = stream
+			}
+			// Cross-reference streams carry the trailer entries
+			if dict["Type"] == pdfName("XRef") {
+				mergeTrailer(f.trailer, dict)
+			}
+		}
+		f.objects[num] = obj // Later definitions replace earlier ones
+	}
+
+	trailers := bytesIndexAll(data, []byte("trailer"))
+	for i, start := range trailers {
+		end := len(data)
+		if i+1 < len(trailers) {
+			end = trailers[i+1]
+		}
+		p := &pdfParser{data: data[:end], pos: start + len("trailer")}
+		if dict, ok := mustObject(p).(pdfDict); ok {
+			mergeTrailer(f.trailer, dict)
+		}
+	}
+
+	// Unpack object streams
+	for _, obj := range f.objects {
+		stream, ok := obj.(*pdfStream)
+		if !ok || stream.dict["Type"] != pdfName("ObjStm") {
+			continue
+		}
+		f.unpackObjectStream(stream)
+	}
+	return f
+}
+
+func mergeTrailer(trailer, dict pdfDict) {
+	for _, key := range []pdfName{"Root", "Encrypt", "Info"} {
+		if v, ok := dict[key]; ok {
+			trailer[key] = v
+		}
+	}
+}
+
+// unpackObjectStream adds the objects compressed in an object stream
+func (f *pdfFile) unpackObjectStream(stream *pdfStream) {
+	data, err := f.decode(stream)
+	if err != nil {
+		return
+	}
+	n, _ := f.resolve(stream.dict["N"]).(float64)
+	first, _ := f.resolve(stream.dict["First"]).(float64)
+	if int(first) > len(data) {
+		return
+	}
+
+	type entry struct{ num, pos int }
+	var entries []entry
+	header := &pdfParser{data: data[:int(first)]}
+	for i := 0; i < int(n); i++ {
+		num, ok1 := mustObject(header).(float64)
+		offset, ok2 := mustObject(header).(float64)
+		if !ok1 || !ok2 {
+			break
+		}
+		pos := int(first) + int(offset)
+		if pos < 0 || pos >= len(data) {
+			continue
+		}
+		entries = append(entries, entry{int(num), pos})
+	}
+
+	// As in parsePDF, each object is parsed up to the next one
+	sort.Slice(entries, func(i, j int) bool { return entries[i].pos < entries[j].pos })
+	for i, e := range entries {
+		if _, exists := f.objects[e.num]; exists {
+			continue
+		}
+		end := len(data)
+		if i+1 < len(entries) {
+			end = entries[i+1].pos
+		}
+		p := &pdfParser{data: data[:end], pos: e.pos}
+		if obj, err := p.object(); err == nil {
+			f.objects[e.num] = obj
+		}
+	}
+}
+
+// resolve follows indirect references
+func (f *pdfFile) resolve(v interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = f.objects[ref.num]
+	}
+	return nil
+}
+
+// dict resolves v to a dictionary, taking a stream's dictionary
+func (f *pdfFile) dict(v interface{}) pdfDict {
+	switch v := f.resolve(v).(type) {
+	case pdfDict:
+		return v
+	case *pdfStream:
+		return v.dict
+	}
+	return nil
+}
+
+// pages returns the page dictionaries in document order. Each referenced
+// node is visited once, so a page tree with cycles cannot loop.
+func (f *pdfFile) pages() []pdfDict {
+	var pages []pdfDict
+	seen := make(map[pdfRef]bool)
+	var walk func(node pdfDict, depth int)
+	walk = func(node pdfDict, depth int) {
+		if node == nil || depth > 64 {
+			return
+		}
+		switch node["Type"] {
+		case pdfName("Page"):
+			pages = append(pages, node)
+		default:
+			kids, _ := f.resolve(node["Kids"]).(pdfArray)
+			for _, kid := range kids {
+				if ref, ok := kid.(pdfRef); ok {
+					if seen[ref] {
+						continue
+					}
+					seen[ref] = true
+				}
+				walk(f.dict(kid), depth+1)
+			}
+		}
+	}
+	if root := f.dict(f.trailer["Root"]); root != nil {
+		walk(f.dict(root["Pages"]), 0)
+	}
+	if len(pages) > 0 {
+		return pages
+	}
+
+	// No usable page tree: take page objects in object order
+	var nums []int
+	for num, obj := range f.objects {
+		if d, ok := obj.(pdfDict); ok && d["Type"] == pdfName("Page") {
+			nums = append(nums, num)
+		}
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		pages = append(pages, f.objects[num].(pdfDict))
+	}
+	return pages
+}
+
+// inherited looks up a page attribute, following the page tree upwards
+func (f *pdfFile) inherited(page pdfDict, key pdfName) interface{} {
+	for node, depth := page, 0; node != nil && depth < 64; node, depth = f.dict(node["Parent"]), depth+1 {
+		if v, ok := node[key]; ok {
+			return v
+		}
+	}
+	return nil
+}
+
+// contents returns the content streams of a page
+func (f *pdfFile) contents(page pdfDict) []*pdfStream {
+	var streams []*pdfStream
+	switch v := f.resolve(page["Contents"]).(type) {
+	case *pdfStream:
+		streams = append(streams, v)
+	case pdfArray:
+		for _, item := range v {
+			if s, ok := f.resolve(item).(*pdfStream); ok {
+				streams = append(streams, s)
+			}
+		}
+	}
+	return streams
+}
+
+// decode applies a stream's filters
+func (f *pdfFile) decode(s *pdfStream) ([]byte, error) {
+	var filters []pdfName
+	switch v := f.resolve(s.dict["Filter"]).(type) {
+	case pdfName:
+		filters = []pdfName{v}
+	case pdfArray:
+		for _, item := range v {
+			if name, ok := f.resolve(item).(pdfName); ok {
+				filters = append(filters, name)
+			}
+		}
+	}
+
+	data := s.data
+	for _, filter := range filters {
+		switch filter {
+		case "FlateDecode", "Fl":
+			limit := min(int64(maxStreamSize), maxDecodedSize-f.decoded)
+			if limit <= 0 {
+				return nil, errors.New("PDF decompresses to too much data")
+			}
+			out, err := inflate(data, limit)
+			if err != nil {
+				return nil, err
+			}
+			f.decoded += int64(len(out))
+			data = out
+		default:
+			return nil, fmt.Errorf("unsupported PDF filter %s", filter)
+		}
+	}
+	return data, nil
+}
+
+// inflate decompresses up to limit bytes of zlib data, tolerating a missing
+// header or a truncated tail as PDF readers do
+func inflate(data []byte, limit int64) ([]byte, error) {
+	var r io.ReadCloser
+	if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+		r = zr
+	} else {
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if int64(len(out)) > limit {
+		return nil, errors.New("PDF stream is too large")
+	}
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("failed to inflate PDF stream: %w", err)
+	}
+	return out, nil
+}
+
+// pdfFont decodes the strings drawn with a font
+type pdfFont struct {
+	cmap    map[uint32]string // From /ToUnicode
+	codeLen int               // Bytes per character code
+	cid     bool              // Composite font without a ToUnicode map
+}
+
+// font loads a font resource. Fonts shared by reference are loaded once.
+func (f *pdfFile) font(v interface{}) *pdfFont {
+	if ref, ok := v.(pdfRef); ok {
+		if font, ok := f.fonts[ref]; ok {
+			return font
+		}
+		font := f.loadFont(v)
+		f.fonts[ref] = font
+		return font
+	}
+	return f.loadFont(v)
+}
+
+func (f *pdfFile) loadFont(v interface{}) *pdfFont {
+	dict := f.dict(v)
+	font := &pdfFont{codeLen: 1}
+	if dict == nil {
+		return font
+	}
+	if dict["Subtype"] == pdfName("Type0") {
+		font.codeLen = 2
+		font.cid = true
+	}
+	if s, ok := f.resolve(dict["ToUnicode"]).(*pdfStream); ok {
+		if data, err := f.decode(s); err == nil {
+			font.cmap, font.codeLen = parseCMap(data, font.codeLen)
+			font.cid = false
+		}
+	}
+	return font
+}
+
+// text decodes a string shown with the font
+func (font *pdfFont) text(s []byte) string {
+	if font.cmap == nil {
+		if font.cid {
+			return "" // Glyph IDs without a map to Unicode
+		}
+		return decodeWinAnsi(s)
+	}
+
+	var b strings.Builder
+	for i := 0; i+font.codeLen <= len(s); i += font.codeLen {
+		var code uint32
+		for _, c := range s[i : i+font.codeLen] {
+			code = code<<8 | uint32(c)
+		}
+		if t, ok := font.cmap[code]; ok {
+			b.WriteString(t)
+		} else if font.codeLen == 1 {
+			b.WriteString(decodeWinAnsi(s[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// parseCMap reads the bfchar and bfrange mappings of a ToUnicode CMap. Ranges
+// past maxCMapRange codes in total are ignored.
+func parseCMap(data []byte, codeLen int) (map[uint32]string, int) {
+	cmap := make(map[uint32]string)
+	budget := uint32(maxCMapRange)
+	p := &pdfParser{data: data}
+	var operands []interface{}
+
+	for {
+		obj, err := p.object()
+		if err != nil {
+			break
+		}
+		op, ok := obj.(pdfOp)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch op {
+		case "endcodespacerange":
+			if len(operands) >= 1 {
+				if lo, ok := operands[0].(pdfHexString); ok && len(lo) > 0 {
+					codeLen = len(lo)
+				}
+			}
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				src, ok1 := operands[i].(pdfHexString)
+				dst, ok2 := operands[i+1].(pdfHexString)
+				if ok1 && ok2 {
+					cmap[codeValue(src)] = decodeUTF16BE(dst)
+				}
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				lo, ok1 := operands[i].(pdfHexString)
+				hi, ok2 := operands[i+1].(pdfHexString)
+				if !ok1 || !ok2 {
+					continue
+				}
+				start, end := codeValue(lo), codeValue(hi)
+				if end < start || end-start >= budget {
+					continue
+				}
+				budget -= end - start + 1
+				switch dst := operands[i+2].(type) {
+				case pdfHexString:
+					base := []rune(decodeUTF16BE(dst))
+					if len(base) == 0 {
+						continue
+					}
+					for code := start; code <= end; code++ {
+						r := append([]rune(nil), base...)
+						r[len(r)-1] += rune(code - start)
+						cmap[code] = string(r)
+					}
+				case pdfArray:
+					for j, item := range dst {
+						if s, ok := item.(pdfHexString); ok && start+uint32(j) <= end {
+							cmap[start+uint32(j)] = decodeUTF16BE(s)
+						}
+					}
+				}
+			}
+		}
+		operands = operands[:0]
+	}
+	return cmap, codeLen
+}
+
+func codeValue(b []byte) uint32 {
+	var v uint32
+	for _, c := range b {
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+func decodeUTF16BE(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(u))
+}
+
+// winAnsiHigh maps the Windows-1252 characters that differ from Latin-1
+var winAnsiHigh = map[byte]rune{
+	0x80: '€', 0x82: '‚', 0x83: 'ƒ', 0x84: '„', 0x85: '…', 0x86: '†', 0x87: '‡',
+	0x88: 'ˆ', 0x89: '‰', 0x8A: 'Š', 0x8B: '‹', 0x8C: 'Œ', 0x8E: 'Ž', 0x91: '‘',
+	0x92: '’', 0x93: '“', 0x94: '”', 0x95: '•', 0x96: '–', 0x97: '—', 0x98: '˜',
+	0x99: '™', 0x9A: 'š', 0x9B: '›', 0x9C: 'œ', 0x9E: 'ž', 0x9F: 'Ÿ',
+}
+
+// decodeWinAnsi decodes a simple font string as WinAnsiEncoding, the
+// encoding most generators use
+func decodeWinAnsi(s []byte) string {
+	r := make([]rune, 0, len(s))
+	for _, c := range s {
+		if w, ok := winAnsiHigh[c]; ok {
+			r = append(r, w)
+		} else if c >= 0x20 || c == '\t' {
+			r = append(r, rune(c))
+		}
+	}
+	return string(r)
+}
+
+// pdfText renders a content stream as lines of text
+type pdfText struct {
+	file  *pdfFile
+	b     strings.Builder
+	fonts map[pdfName]*pdfFont
+	lineY float64
+	drawn map[*pdfStream]bool // Form XObjects already drawn on the page
+}
+
+func (w *pdfText) String() string {
+	lines := strings.Split(w.b.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// run interprets the text operators of a content stream
+func (w *pdfText) run(data []byte, resources pdfDict, depth int) {
+	fontDict := w.file.dict(resources["Font"])
+	xobjects := w.file.dict(resources["XObject"])
+	fonts := make(map[pdfName]*pdfFont)
+	var font *pdfFont
+
+	p := &pdfParser{data: data}
+	var operands []interface{}
+	for {
+		obj, err := p.object()
+		if err != nil {
+			break
+		}
+		op, ok := obj.(pdfOp)
+		if !ok {
+			operands = append(operands, obj)
+			continue
+		}
+
+		switch op {
+		case "Tf":
+			if len(operands) >= 2 {
+				if name, ok := operands[len(operands)-2].(pdfName); ok {
+					if fonts[name] == nil && fontDict != nil {
+						fonts[name] = w.file.font(fontDict[name])
+					}
+					font = fonts[name]
+				}
+			}
+		case "Tj":
+			if len(operands) >= 1 {
+				w.show(font, operands[len(operands)-1])
+			}
+		case "'", "\"":
+			w.newline()
+			if len(operands) >= 1 {
+				w.show(font, operands[len(operands)-1])
+			}
+		case "TJ":
+			if len(operands) >= 1 {
+				items, _ := operands[len(operands)-1].(pdfArray)
+				for _, item := range items {
+					if n, ok := item.(float64); ok {
+						if n < -200 {
+							w.b.WriteString(" ")
+						}
+						continue
+					}
+					w.show(font, item)
+				}
+			}
+		case "Td", "TD":
+			if len(operands) >= 2 {
+				tx, _ := operands[len(operands)-2].(float64)
+				ty, _ := operands[len(operands)-1].(float64)
+				if math.Abs(ty) > 0.5 {
+					w.newline()
+				} else if tx != 0 {
+					w.b.WriteString(" ")
+				}
+			}
+		case "Tm":
+			if len(operands) >= 6 {
+				y, _ := operands[len(operands)-1].(float64)
+				if math.Abs(y-w.lineY) > 0.5 {
+					w.newline()
+				} else {
+					w.b.WriteString(" ")
+				}
+				w.lineY = y
+			}
+		case "T*":
+			w.newline()
+		case "Do":
+			if len(operands) >= 1 && depth < maxFormDepth && xobjects != nil {
+				name, _ := operands[len(operands)-1].(pdfName)
+				// Each form is drawn once, so forms that draw each other
+				// many times cannot multiply the work
+				form, ok := w.file.resolve(xobjects[name]).(*pdfStream)
+				if ok && form.dict["Subtype"] == pdfName("Form") && !w.drawn[form] {
+					w.drawn[form] = true
+					if data, err := w.file.decode(form); err == nil {
+						formResources := w.file.dict(form.dict["Resources"])
+						if formResources == nil {
+							formResources = resources
+						}
+						w.newline()
+						w.run(data, formResources, depth+1)
+						w.newline()
+					}
+				}
+			}
+		case "BI":
+			p.skipInlineImage()
+		}
+		operands = operands[:0]
+	}
+}
+
+func (w *pdfText) show(font *pdfFont, v interface{}) {
+	var s []byte
+	switch v := v.(type) {
+	case pdfString:
+		s = v
+	case pdfHexString:
+		s = v
+	default:
+		return
+	}
+	if font == nil {
+		font = &pdfFont{codeLen: 1}
+	}
+	w.b.WriteString(font.text(s))
+}
+
+func (w *pdfText) newline() {
+	if w.b.Len() > 0 {
+		w.b.WriteString("\n")
+	}
+}
+
+// String values, kept apart because CMaps treat hex strings as codes
+type (
+	pdfString    []byte
+	pdfHexString []byte
+)
+
+// pdfParser reads PDF objects and content stream tokens
+type pdfParser struct {
+	data       []byte
+	pos        int
+	depth      int
+	endstreams []int // Offsets of every "endstream", for reading streams
+}
+
+var errPDFEnd = errors.New("end of PDF data")
+
+func mustObject(p *pdfParser) interface{} {
+	obj, _ := p.object()
+	return obj
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (p *pdfParser) skipSpace() {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '%' {
+			for p.pos < len(p.data) && p.data[p.pos] != '\n' && p.data[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		p.pos++
+	}
+}
+
+// object reads the next value or operator
+func (p *pdfParser) object() (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return nil, errPDFEnd
+	}
+	if p.depth > 64 {
+		return nil, errors.New("PDF object nested too deeply")
+	}
+
+	c := p.data[p.pos]
+	switch {
+	case c == '<' && p.pos+1 < len(p.data) && p.data[p.pos+1] == '<':
+		p.pos += 2
+		return p.dictionary()
+	case c == '<':
+		p.pos++
+		return p.hexString(), nil
+	case c == '(':
+		p.pos++
+		return p.literalString(), nil
+	case c == '[':
+		p.pos++
+		return p.array()
+	case c == '/':
+		p.pos++
+		return pdfName(p.name()), nil
+	case c == ']' || c == '>' || c == ')' || c == '{' || c == '}':
+		p.pos++
+		return pdfOp(string(c)), nil
+	}
+
+	// Number, reference or keyword
+	start := p.pos
+	for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+		p.pos++
+	}
+	word := string(p.data[start:p.pos])
+	if word == "" {
+		p.pos++
+		return pdfOp(string(c)), nil
+	}
+	if n, err := strconv.ParseFloat(word, 64); err == nil {
+		if ref, ok := p.reference(n); ok {
+			return ref, nil
+		}
+		return n, nil
+	}
+	switch word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	return pdfOp(word), nil
+}
+
+// reference reads "gen R" after an object number, if present
+func (p *pdfParser) reference(num float64) (pdfRef, bool) {
+	if num != math.Trunc(num) || num < 0 {
+		return pdfRef{}, false
+	}
+	save := p.pos
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos > start {
+		gen, _ := strconv.Atoi(string(p.data[start:p.pos]))
+		p.skipSpace()
+		if p.pos < len(p.data) && p.data[p.pos] == 'R' &&
+			(p.pos+1 == len(p.data) || isPDFSpace(p.data[p.pos+1]) || isPDFDelimiter(p.data[p.pos+1])) {
+			p.pos++
+			return pdfRef{num: int(num), gen: gen}, true
+		}
+	}
+	p.pos = save
+	return pdfRef{}, false
+}
+
+func (p *pdfParser) dictionary() (pdfDict, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	dict := pdfDict{}
+	for {
+		p.skipSpace()
+		if p.pos+1 < len(p.data) && p.data[p.pos] == '>' && p.data[p.pos+1] == '>' {
+			p.pos += 2
+			return dict, nil
+		}
+		key, err := p.object()
+		if err != nil {
+			return dict, err
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			continue
+		}
+		value, err := p.object()
+		if err != nil {
+			return dict, err
+		}
+		dict[name] = value
+	}
+}
+
+func (p *pdfParser) array() (pdfArray, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+
+	var arr pdfArray
+	for {
+		p.skipSpace()
+		if p.pos < len(p.data) && p.data[p.pos] == ']' {
+			p.pos++
+			return arr, nil
+		}
+		obj, err := p.object()
+		if err != nil {
+			return arr, err
+		}
+		arr = append(arr, obj)
+	}
+}
+
+func (p *pdfParser) name() string {
+	var b strings.Builder
+	for p.pos < len(p.data) && !isPDFSpace(p.data[p.pos]) && !isPDFDelimiter(p.data[p.pos]) {
+		c := p.data[p.pos]
+		if c == '#' && p.pos+2 < len(p.data) {
+			if v, err := strconv.ParseUint(string(p.data[p.pos+1:p.pos+3]), 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				p.pos += 3
+				continue
+			}
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	return b.String()
+}
+
+func (p *pdfParser) hexString() pdfHexString {
+	var out []byte
+	var hi byte
+	odd := false
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		if c == '>' {
+			break
+		}
+		var v byte
+		switch {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		if odd {
+			out = append(out, hi<<4|v)
+		} else {
+			hi = v
+		}
+		odd = !odd
+	}
+	if odd {
+		out = append(out, hi<<4)
+	}
+	return out
+}
+
+func (p *pdfParser) literalString() pdfString {
+	var out []byte
+	depth := 1
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return out
+			}
+		case '\\':
+			if p.pos >= len(p.data) {
+				return out
+			}
+			e := p.data[p.pos]
+			p.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+					p.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '7'; i++ {
+						v = v*8 + int(p.data[p.pos]-'0')
+						p.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// stream reads the data following a stream dictionary, if any
+func (p *pdfParser) stream(dict pdfDict) (*pdfStream, bool) {
+	p.skipSpace()
+	if !bytes.HasPrefix(p.data[p.pos:], []byte("stream")) {
+		return nil, false
+	}
+	start := p.pos + len("stream")
+	if start < len(p.data) && p.data[start] == '\r' {
+		start++
+	}
+	if start < len(p.data) && p.data[start] == '\n' {
+		start++
+	}
+
+	// Trust /Length when it is direct and lands on endstream
+	if n, ok := dict["Length"].(float64); ok && n >= 0 && start+int(n) <= len(p.data) {
+		end := start + int(n)
+		rest := bytes.TrimLeft(p.data[end:], " \t\r\n")
+		if bytes.HasPrefix(rest, []byte("endstream")) {
+			return &pdfStream{dict: dict, data: p.data[start:end]}, true
+		}
+	}
+
+	end := p.endstream(start)
+	if end < 0 {
+		return nil, false
+	}
+	data := bytes.TrimRight(p.data[start:end], "\r\n")
+	return &pdfStream{dict: dict, data: data}, true
+}
+
+// endstream returns the offset of the first "endstream" at or after start
+func (p *pdfParser) endstream(start int) int {
+	i := sort.SearchInts(p.endstreams, start)
+	if i == len(p.endstreams) {
+		return -1
+	}
+	return p.endstreams[i]
+}
+
+// skipInlineImage skips the binary data of an inline image
+func (p *pdfParser) skipInlineImage() {
+	i := bytes.Index(p.data[p.pos:], []byte("ID"))
+	if i < 0 {
+		p.pos = len(p.data)
+		return
+	}
+	p.pos += i + 2
+	for p.pos < len(p.data) {
+		j := bytes.Index(p.data[p.pos:], []byte("EI"))
+		if j < 0 {
+			p.pos = len(p.data)
+			return
+		}
+		p.pos += j + 2
+		if p.pos >= len(p.data) || isPDFSpace(p.data[p.pos]) {
+			if p.pos-3 >= 0 && isPDFSpace(p.data[p.pos-3]) {
+				return
+			}
+		}
+	}
+}
+
+func bytesIndexAll(data, sep []byte) []int {
+	var idx []int
+	for start := 0; ; {
+		i := bytes.Index(data[start:], sep)
+		if i < 0 {
+			return idx
+		}
+		idx = append(idx, start+i)
+		start += i + len(sep)
+	}
+}
@@ -0,0 +1,365 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPDF assembles a PDF from numbered object bodies. Objects are found by
+// scanning, so no xref table is written.
+type testPDF struct {
+	objects []string
+	trailer string
+}
+
+func (p *testPDF) add(body string) {
+	p.objects = append(p.objects, body)
+}
+
+func (p *testPDF) bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.7\n")
+	for i, body := range p.objects {
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, body)
+	}
+	if p.trailer != "" {
+		fmt.Fprintf(&b, "trailer\n%s\n", p.trailer)
+	}
+	b.WriteString("%%EOF\n")
+	return b.Bytes()
+}
+
+// streamObj returns a stream object body with a direct /Length
+func streamObj(dict string, data []byte) string {
+	return fmt.Sprintf("<< %s /Length %d >>\nstream\n%s\nendstream", dict, len(data), data)
+}
+
+func deflate(data string) []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte(data))
+	w.Close()
+	return b.Bytes()
+}
+
+// simplePDF returns a one page document drawing content with /F1 as Helvetica
+func simplePDF(content string) []byte {
+	p := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	p.add("<< /Type /Catalog /Pages 2 0 R >>")
+	p.add("<< /Type /Pages /Kids [3 0 R] /Count 1 /Resources << /Font << /F1 4 0 R >> >> >>")
+	p.add("<< /Type /Page /Parent 2 0 R /Contents 5 0 R >>")
+	p.add("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>")
+	p.add(streamObj("", []byte(content)))
+	return p.bytes()
+}
+
+func TestExtractPDF(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"lines", "BT /F1 12 Tf 72 720 Td (Hello, World) Tj 0 -14 Td (Second line) Tj ET", "Hello, World\nSecond line"},
+		{"kerning", "BT /F1 12 Tf [(Hel) -20 (lo) -500 (World)] TJ ET", "Hello World"},
+		{"escapes", `BT /F1 12 Tf (A \(nested\) \101\102 (ok)) Tj ET`, "A (nested) AB (ok)"},
+		{"win ansi", `BT /F1 12 Tf (\200 5 \226 caf\351) Tj ET`, "€ 5 – café"},
+		{"hex string", "BT /F1 12 Tf <48656C6C6F> Tj ET", "Hello"},
+		{"next line", "BT /F1 12 Tf 14 TL (one) Tj T* (two) Tj (three) ' ET", "one\ntwo\nthree"},
+		{"text matrix", "BT /F1 12 Tf 1 0 0 1 72 700 Tm (left) Tj 1 0 0 1 300 700 Tm (right) Tj 1 0 0 1 72 680 Tm (below) Tj ET", "left right\nbelow"},
+		{"inline image", "BT /F1 12 Tf (before) Tj ET BI /W 2 /H 1 /BPC 8 /CS /G ID \x00\xff EI BT (after) Tj ET", "beforeafter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := extractPDF(simplePDF(tt.content))
+			if err != nil {
+				t.Fatalf("extractPDF: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractPDFPagesInOrder(t *testing.T) {
+	p := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	p.add("<< /Type /Catalog /Pages 2 0 R >>")
+	p.add("<< /Type /Pages /Kids [4 0 R 3 0 R] /Count 2 >>")
+	p.add("<< /Type /Page /Parent 2 0 R /Contents 5 0 R >>")
+	p.add("<< /Type /Page /Parent 2 0 R /Contents [6 0 R 7 0 R] >>")
+	p.add(streamObj("", []byte("BT (second page) Tj ET")))
+	p.add(streamObj("", []byte("BT (first page,) Tj ET")))
+	p.add(streamObj("", []byte("BT (two streams) Tj ET")))
+
+	got, err := extractPDF(p.bytes())
+	if err != nil {
+		t.Fatalf("extractPDF: %v", err)
+	}
+	if want := "first page,two streams\n\nsecond page"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtractPDFFlateAndObjectStreams(t *testing.T) {
+	// The page and font live in a compressed object stream and the trailer
+	// entries in a cross-reference stream, as in PDF 1.5+ files
+	page := "<< /Type /Page /Parent 2 0 R /Contents 4 0 R /Resources << /Font << /F1 7 0 R >> >> >>"
+	font := "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>"
+	header := fmt.Sprintf("6 0 7 %d ", len(page)+1)
+	packed := deflate(header + page + " " + font)
+
+	p := &testPDF{}
+	p.add("<< /Type /Catalog /Pages 2 0 R >>")
+	p.add("<< /Type /Pages /Kids [6 0 R] /Count 1 >>")
+	p.add(streamObj(fmt.Sprintf("/Type /ObjStm /N 2 /First %d /Filter /FlateDecode", len(header)), packed))
+	p.add(streamObj("/Filter [/FlateDecode]", deflate("BT /F1 12 Tf (Compressed text) Tj ET")))
+	p.add(streamObj("/Type /XRef /Root 1 0 R /Size 8", nil))
+
+	got, err := extractPDF(p.bytes())
+	if err != nil {
+		t.Fatalf("extractPDF: %v", err)
+	}
+	if got != "Compressed text" {
+		t.Errorf("got %q, want %q", got, "Compressed text")
+	}
+}
+
+func TestExtractPDFToUnicode(t *testing.T) {
+	cmap := `/CIDInit /ProcSet findresource begin
+12 dict begin
+begincmap
+1 begincodespacerange <0000> <FFFF> endcodespacerange
+2 beginbfchar <0001> <0048> <0002> <0069> endbfchar
+2 beginbfrange <0010> <0012> <0061> <0020> <0021> [<00E9> <20AC>] endbfrange
+endcmap
+end end`
+
+	p := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	p.add("<< /Type /Catalog /Pages 2 0 R >>")
+	p.add("<< /Type /Pages /Kids [3 0 R] /Count 1 >>")
+	p.add("<< /Type /Page /Parent 2 0 R /Contents 5 0 R /Resources << /Font << /F2 4 0 R /F3 7 0 R >> >> >>")
+	p.add("<< /Type /Font /Subtype /Type0 /BaseFont /Embedded /ToUnicode 6 0 R >>")
+	p.add(streamObj("", []byte("BT /F2 12 Tf <00010002> Tj 0 -14 Td <001000110012> Tj <00200021> Tj /F3 12 Tf <00010002> Tj ET")))
+	p.add(streamObj("/Filter /FlateDecode", deflate(cmap)))
+	p.add("<< /Type /Font /Subtype /Type0 /BaseFont /NoMap >>")
+
+	got, err := extractPDF(p.bytes())
+	if err != nil {
+		t.Fatalf("extractPDF: %v", err)
+	}
+	// Glyph IDs of a composite font without a ToUnicode map are dropped
+	if want := "Hi\nabcé€"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtractPDFFormXObject(t *testing.T) {
+	p := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	p.add("<< /Type /Catalog /Pages 2 0 R >>")
+	p.add("<< /Type /Pages /Kids [3 0 R] /Count 1 >>")
+	p.add("<< /Type /Page /Parent 2 0 R /Contents 4 0 R /Resources << /XObject << /Fm1 5 0 R /Fm2 6 0 R >> >> >>")
+	p.add(streamObj("", []byte("BT (Before) Tj ET /Fm1 Do /Fm2 Do /Fm1 Do")))
+	p.add(streamObj("/Type /XObject /Subtype /Form", []byte("BT (In a form) Tj ET")))
+	// A form drawing itself is drawn once
+	p.add(streamObj("/Type /XObject /Subtype /Form /Resources << /XObject << /Fm2 6 0 R >> >>", []byte("BT (Loop) Tj ET /Fm2 Do /Fm2 Do")))
+
+	got, err := extractPDF(p.bytes())
+	if err != nil {
+		t.Fatalf("extractPDF: %v", err)
+	}
+	lines := strings.Split(got, "\n")
+	if len(lines) < 2 || lines[0] != "Before" || lines[1] != "In a form" {
+		t.Errorf("got %q, want the page text followed by the form text", got)
+	}
+	if n := strings.Count(got, "In a form"); n != 1 {
+		t.Errorf("repeated form drawn %d times, want once", n)
+	}
+	if n := strings.Count(got, "Loop"); n != 1 {
+		t.Errorf("recursive form drawn %d times, want once", n)
+	}
+}
+
+func TestExtractPDFWithoutPageTree(t *testing.T) {
+	// A damaged file with no catalog still yields its pages in object order
+	p := &testPDF{}
+	p.add("<< /Type /Page /Contents 3 0 R >>")
+	p.add("<< /Type /Page /Contents 4 0 R >>")
+	p.add(streamObj("", []byte("BT (one) Tj ET")))
+	// A wrong /Length falls back to the endstream keyword
+	p.add("<< /Length 999 >>\nstream\nBT (two) Tj ET\nendstream")
+
+	got, err := extractPDF(p.bytes())
+	if err != nil {
+		t.Fatalf("extractPDF: %v", err)
+	}
+	if want := "one\n\ntwo"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExtractPDFErrors(t *testing.T) {
+	encrypted := &testPDF{trailer: "<< /Root 1 0 R /Encrypt 3 0 R >>"}
+	encrypted.add("<< /Type /Catalog /Pages 2 0 R >>")
+	encrypted.add("<< /Type /Pages /Kids [] /Count 0 >>")
+	encrypted.add("<< /Filter /Standard >>")
+
+	noPages := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	noPages.add("<< /Type /Catalog /Pages 2 0 R >>")
+	noPages.add("<< /Type /Pages /Kids [] /Count 0 >>")
+
+	lzw := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	lzw.add("<< /Type /Catalog /Pages 2 0 R >>")
+	lzw.add("<< /Type /Pages /Kids [3 0 R] /Count 1 >>")
+	lzw.add("<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>")
+	lzw.add(streamObj("/Filter /LZWDecode", []byte("BT (text) Tj ET")))
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not a pdf", []byte("hello"), "not a PDF file"},
+		{"encrypted", encrypted.bytes(), "PDF is encrypted"},
+		{"no pages", noPages.bytes(), "PDF has no pages"},
+		{"scanned", simplePDF("q 100 0 0 100 0 0 cm /Im1 Do Q"), "no extractable text"},
+		{"unsupported filter", lzw.bytes(), "no extractable text"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := extractPDF(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractPDFHostileInput(t *testing.T) {
+	pageLoop := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	pageLoop.add("<< /Type /Catalog /Pages 2 0 R >>")
+	pageLoop.add("<< /Type /Pages /Kids [2 0 R 2 0 R 3 0 R] /Parent 2 0 R >>")
+	pageLoop.add("<< /Type /Page /Parent 2 0 R /Contents 4 0 R >>")
+	pageLoop.add(streamObj("", []byte("BT (x) Tj ET")))
+
+	formFanout := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	formFanout.add("<< /Type /Catalog /Pages 2 0 R >>")
+	formFanout.add("<< /Type /Pages /Kids [3 0 R] >>")
+	formFanout.add("<< /Type /Page /Contents 4 0 R /Resources << /XObject << /F 4 0 R >> >> >>")
+	formFanout.add(streamObj("/Subtype /Form", []byte("BT (x) Tj ET "+strings.Repeat("/F Do ", 50))))
+
+	cmapRanges := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	cmapRanges.add("<< /Type /Catalog /Pages 2 0 R >>")
+	cmapRanges.add("<< /Type /Pages /Kids [3 0 R] >>")
+	cmapRanges.add("<< /Type /Page /Contents 4 0 R /Resources << /Font << /F 5 0 R >> >> >>")
+	cmapRanges.add(streamObj("", []byte("BT /F 1 Tf <0001> Tj ET")))
+	cmapRanges.add("<< /Subtype /Type0 /ToUnicode 6 0 R >>")
+	cmapRanges.add(streamObj("", []byte(strings.Repeat("<0000> <FFFF> <0041> ", 5000)+"endbfrange")))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"page tree cycle", pageLoop.bytes()},
+		{"form fan-out", formFanout.bytes()},
+		{"cmap ranges", cmapRanges.bytes()},
+		{"unterminated objects", []byte("%PDF-1.4\n" + strings.Repeat("1 0 obj << /A [ (x", 50000))},
+		{"streams without endstream", []byte("%PDF-1.4\n" + strings.Repeat("1 0 obj << >> stream\nabc ", 50000))},
+		{"unterminated trailers", []byte("%PDF-1.4\n" + strings.Repeat("trailer << /A [ ", 50000))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				extractPDF(tt.data)
+			}()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("extraction did not finish")
+			}
+		})
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	bomb := deflate(strings.Repeat("a", 1<<20))
+	if _, err := inflate(bomb, 1<<20-1); err == nil {
+		t.Error("inflate accepted a stream above the size limit")
+	}
+	if out, err := inflate(bomb, 1<<20); err != nil || len(out) != 1<<20 {
+		t.Errorf("inflate at the limit = %d bytes, %v", len(out), err)
+	}
+	// Raw deflate data without a zlib header
+	if out, err := inflate(deflate("abc")[2:], 10); err != nil || string(out) != "abc" {
+		t.Errorf("inflate of raw deflate = %q, %v", out, err)
+	}
+}
+
+func TestExtractPDFDecodedLimit(t *testing.T) {
+	// Every page draws the same 1MB stream; decoding stops at the file budget
+	pages := maxDecodedSize/(1<<20) + 2
+	p := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	p.add("<< /Type /Catalog /Pages 2 0 R >>")
+	var kids strings.Builder
+	for i := 0; i < pages; i++ {
+		fmt.Fprintf(&kids, "%d 0 R ", i+4)
+	}
+	p.add("<< /Type /Pages /Kids [" + kids.String() + "] >>")
+	p.add(streamObj("/Filter /FlateDecode", deflate("BT (x) Tj ET"+strings.Repeat(" ", 1<<20))))
+	for i := 0; i < pages; i++ {
+		p.add("<< /Type /Page /Contents 3 0 R >>")
+	}
+
+	f := parsePDF(p.bytes())
+	decoded := 0
+	for _, page := range f.pages() {
+		for _, content := range f.contents(page) {
+			if _, err := f.decode(content); err == nil {
+				decoded++
+			}
+		}
+	}
+	if decoded >= pages {
+		t.Errorf("decoded %d pages, want the budget to stop before %d", decoded, pages)
+	}
+	if f.decoded > maxDecodedSize {
+		t.Errorf("decoded %d bytes, above the %d byte budget", f.decoded, maxDecodedSize)
+	}
+}
+
+func FuzzExtractPDF(f *testing.F) {
+	f.Add(simplePDF("BT /F1 12 Tf 72 720 Td (Hello, World) Tj 0 -14 Td [(A) -500 (B)] TJ ET"))
+	f.Add(simplePDF(`BT (\(\101\) <>) Tj <48 65 6> Tj ET BI /W 1 ID x EI`))
+	f.Add(simplePDF("BT /F1 Tf Tj TJ Td Tm ' \" T* Do ET"))
+	f.Add(simplePDF("[[[[[[[[<<<<<<<<"))
+
+	objStm := &testPDF{}
+	objStm.add("<< /Type /Catalog /Pages 2 0 R >>")
+	objStm.add("<< /Type /Pages /Kids [3 0 R] >>")
+	objStm.add(streamObj("/Type /ObjStm /N 5 /First 4 /Filter /FlateDecode", deflate("3 0 <</Type/Page/Contents 4 0 R>>")))
+	objStm.add(streamObj("/Filter /Fl", deflate("BT (x) Tj ET")))
+	objStm.add(streamObj("/Type /XRef /Root 1 0 R", nil))
+	f.Add(objStm.bytes())
+
+	loop := &testPDF{trailer: "<< /Root 1 0 R >>"}
+	loop.add("<< /Type /Catalog /Pages 2 0 R >>")
+	loop.add("<< /Type /Pages /Kids [2 0 R 3 0 R] /Parent 2 0 R >>")
+	loop.add("<< /Type /Page /Parent 3 0 R /Contents 3 0 R /Resources 4 0 R >>")
+	loop.add("4 0 R")
+	f.Add(loop.bytes())
+
+	f.Add([]byte("%PDF-1.4\n1 0 obj << /Length 5 >> stream\nab"))
+	f.Add([]byte("%PDF-1.4\ntrailer << /Root 1 0 R"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		text, err := extractPDF(data)
+		if err == nil && strings.TrimSpace(text) == "" {
+			t.Error("extractPDF returned no text without an error")
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"  // Registers the GIF decoder for extractImage
+	_ "image/jpeg" // Registers the JPEG decoder for extractImage
+	_ "image/png"  // Registers the PNG decoder for extractImage
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emitt/emitt/internal/email"
+)
+
+// extractText returns text content, replacing invalid UTF-8
+func extractText(data []byte) (string, error) {
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")) // Byte order mark
+	if utf8.Valid(data) {
+		return string(data), nil
+	}
+	return strings.ToValidUTF8(string(data), "�"), nil
+}
+
+// extractCSV renders comma-separated rows with " | " between cells
+func extractCSV(data []byte) (string, error) {
+	return extractDelimited(data, ',')
+}
+
+// extractTSV renders tab-separated rows with " | " between cells
+func extractTSV(data []byte) (string, error) {
+	return extractDelimited(data, '\t')
+}
+
+func extractDelimited(data []byte, comma rune) (string, error) {
+	text, _ := extractText(data)
+	r := csv.NewReader(strings.NewReader(text))
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+
+	var b strings.Builder
+	for {
+		record, err := r.Read()
+		if err != nil {
+			if b.Len() == 0 && err != io.EOF {
+				// Not parseable as CSV; the raw text is still useful
+				return text, nil
+			}
+			break
+		}
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		b.WriteString(strings.Join(record, " | "))
+		b.WriteString("\n")
+	}
+	return b.String(), nil
+}
+
+// extractJSON returns indented JSON, or the raw text if it does not parse
+func extractJSON(data []byte) (string, error) {
+	var out bytes.Buffer
+	if err := json.Indent(&out, bytes.TrimSpace(data), "", "  "); err != nil {
+		return extractText(data)
+	}
+	return out.String(), nil
+}
+
+// extractHTML converts an HTML document to readable text
+func extractHTML(data []byte) (string, error) {
+	text, _ := extractText(data)
+	return email.HTMLToText(text), nil
+}
+
+// extractImage describes an image, since its pixels are not text
+func extractImage(data []byte) (string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+	return fmt.Sprintf("[%s image, %dx%d pixels]", strings.ToUpper(format), cfg.Width, cfg.Height), nil
+}
@@ -0,0 +1,359 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxARCInstances is the highest ARC instance allowed (RFC 8617 section 4.2.1)
+const maxARCInstances = 50
+
+// rawHeader is a header field exactly as it appeared in the message
+type rawHeader struct {
+	name string // As written, without the colon
+	raw  string // Full field including folding and the trailing CRLF
+}
+
+// value returns the unparsed field value
+func (h rawHeader) value() string {
+	return h.raw[strings.IndexByte(h.raw, ':')+1:]
+}
+
+// arcSet is one instance of ARC-Seal, ARC-Message-Signature and ARC-Authentication-Results
+type arcSet struct {
+	seal, ams, aar *rawHeader
+}
+
+// CheckARC validates the ARC chain of a message (RFC 8617 section 5.2)
+func (v *Verifier) CheckARC(ctx context.Context, raw []byte) string {
+	headers, body := splitMessage(raw)
+
+	sets := make(map[int]*arcSet)
+	maxInstance := 0
+	for i := range headers {
+		h := &headers[i]
+		name := strings.ToLower(h.name)
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+
+		instance, ok := arcInstance(h)
+		if !ok {
+			return ResultFail
+		}
+		set := sets[instance]
+		if set == nil {
+			set = &arcSet{}
+			sets[instance] = set
+		}
+
+		var slot **rawHeader
+		switch name {
+		case "arc-seal":
+			slot = &set.seal
+		case "arc-message-signature":
+			slot = &set.ams
+		default:
+			slot = &set.aar
+		}
+		if *slot != nil {
+			return ResultFail // Duplicate instance
+		}
+		*slot = h
+
+		if instance > maxInstance {
+			maxInstance = instance
+		}
+	}
+
+	if maxInstance == 0 {
+		return ResultNone
+	}
+	if maxInstance > maxARCInstances || len(sets) != maxInstance {
+		return ResultFail
+	}
+	for i := 1; i <= maxInstance; i++ {
+		s := sets[i]
+		if s == nil || s.seal == nil || s.ams == nil || s.aar == nil {
+			return ResultFail
+		}
+	}
+
+	// The most recent seal must not already report a broken chain
+	latestSeal := parseTags(sets[maxInstance].seal.value())
+	if latestSeal["cv"] == "fail" {
+		return ResultFail
+	}
+
+	// Only the most recent message signature needs to validate
+	if err := v.verifyAMS(ctx, headers, body, sets[maxInstance].ams); err != nil {
+		return ResultFail
+	}
+
+	for i := maxInstance; i >= 1; i-- {
+		tags := parseTags(sets[i].seal.value())
+		wantCV := "pass"
+		if i == 1 {
+			wantCV = "none"
+		}
+		if tags["cv"] != wantCV {
+			return ResultFail
+		}
+		if err := v.verifySeal(ctx, sets, i); err != nil {
+			return ResultFail
+		}
+	}
+
+	return ResultPass
+}
+
+// arcInstance extracts the i= tag of an ARC header field
+func arcInstance(h *rawHeader) (int, bool) {
+	var value string
+	if strings.EqualFold(h.name, "arc-authentication-results") {
+		// AAR is "i=N; authserv-id; results", not a tag list
+		value = strings.SplitN(h.value(), ";", 2)[0]
+		value = strings.TrimSpace(value)
+		if !strings.HasPrefix(value, "i=") {
+			return 0, false
+		}
+		value = strings.TrimSpace(value[2:])
+	} else {
+		value = parseTags(h.value())["i"]
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// verifyAMS verifies an ARC-Message-Signature like a DKIM signature
+func (v *Verifier) verifyAMS(ctx context.Context, headers []rawHeader, body []byte, ams *rawHeader) error {
+	tags := parseTags(ams.value())
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := tags["c"]; c != "" {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+
+	// Body hash
+	canonBody := canonicalizeBody(body, bodyCanon)
+	if l := tags["l"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n > len(canonBody) {
+			return fmt.Errorf("invalid body length")
+		}
+		canonBody = canonBody[:n]
+	}
+	bodyHash := sha256.Sum256(canonBody)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return fmt.Errorf("body hash mismatch")
+	}
+
+	// Signed header fields are taken from the bottom up
+	var input strings.Builder
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headers[i].name, name) {
+				continue
+			}
+			used[i] = true
+			input.WriteString(canonicalizeHeader(headers[i], headerCanon))
+			break
+		}
+	}
+	input.WriteString(strings.TrimSuffix(canonicalizeHeader(stripSignature(*ams), headerCanon), "\r\n"))
+
+	return v.verifySignature(ctx, tags, input.String())
+}
+
+// verifySeal verifies the ARC-Seal of instance i over all sets up to i
+func (v *Verifier) verifySeal(ctx context.Context, sets map[int]*arcSet, i int) error {
+	var input strings.Builder
+	for j := 1; j <= i; j++ {
+		s := sets[j]
+		input.WriteString(canonicalizeHeader(*s.aar, "relaxed"))
+		input.WriteString(canonicalizeHeader(*s.ams, "relaxed"))
+		if j < i {
+			input.WriteString(canonicalizeHeader(*s.seal, "relaxed"))
+		}
+	}
+	input.WriteString(strings.TrimSuffix(canonicalizeHeader(stripSignature(*sets[i].seal), "relaxed"), "\r\n"))
+
+	return v.verifySignature(ctx, parseTags(sets[i].seal.value()), input.String())
+}
+
+// verifySignature checks the b= signature of a tag list over the signing input
+func (v *Verifier) verifySignature(ctx context.Context, tags map[string]string, input string) error {
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding")
+	}
+	if tags["d"] == "" || tags["s"] == "" {
+		return fmt.Errorf("missing d= or s=")
+	}
+
+	txts, err := v.resolver.LookupTXT(ctx, tags["s"]+"._domainkey."+tags["d"])
+	if err != nil {
+		return err
+	}
+	keyTags := parseTags(strings.Join(txts, ""))
+	keyData, err := base64.StdEncoding.DecodeString(keyTags["p"])
+	if err != nil || len(keyData) == 0 {
+		return fmt.Errorf("invalid or revoked key")
+	}
+
+	hash := sha256.Sum256([]byte(input))
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		pub, err := x509.ParsePKIXPublicKey(keyData)
+		if err != nil {
+			if pub, err = x509.ParsePKCS1PublicKey(keyData); err != nil {
+				return fmt.Errorf("invalid RSA key: %w", err)
+			}
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key is not RSA")
+		}
+		return rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hash[:], sig)
+	case "ed25519-sha256":
+		if len(keyData) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid Ed25519 key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(keyData), hash[:], sig) {
+			return fmt.Errorf("signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", tags["a"])
+	}
+}
+
+// splitMessage splits a raw message into header fields and body, normalizing line endings to CRLF
+func splitMessage(raw []byte) ([]rawHeader, []byte) {
+	normalized := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	normalized = bytes.ReplaceAll(normalized, []byte("\n"), []byte("\r\n"))
+
+	headerBlock, body := normalized, []byte(nil)
+	if i := bytes.Index(normalized, []byte("\r\n\r\n")); i >= 0 {
+		headerBlock, body = normalized[:i+2], normalized[i+4:]
+	}
+
+	var headers []rawHeader
+	for _, line := range strings.SplitAfter(string(headerBlock), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1].raw += line
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		headers = append(headers, rawHeader{
+			name: strings.TrimSpace(line[:colon]),
+			raw:  line,
+		})
+	}
+
+	return headers, body
+}
+
+var (
+	wspRun     = regexp.MustCompile(`[ \t]+`)
+	bTagValue  = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+	foldingWSP = regexp.MustCompile(`\r\n([ \t])`)
+)
+
+// stripSignature returns the header with the b= tag value emptied
+func stripSignature(h rawHeader) rawHeader {
+	colon := strings.IndexByte(h.raw, ':')
+	value := bTagValue.ReplaceAllString(h.raw[colon+1:], "$1$2")
+	if !strings.HasSuffix(value, "\r\n") {
+		value += "\r\n"
+	}
+	return rawHeader{name: h.name, raw: h.raw[:colon+1] + value}
+}
+
+// canonicalizeHeader applies "simple" or "relaxed" header canonicalization (RFC 6376 section 3.4)
+func canonicalizeHeader(h rawHeader, canon string) string {
+	if canon != "relaxed" {
+		return h.raw
+	}
+	value := foldingWSP.ReplaceAllString(h.value(), "$1")
+	value = strings.TrimSuffix(value, "\r\n")
+	value = strings.TrimSpace(wspRun.ReplaceAllString(value, " "))
+	return strings.ToLower(h.name) + ":" + value + "\r\n"
+}
+
+// canonicalizeBody applies "simple" or "relaxed" body canonicalization (RFC 6376 section 3.4)
+func canonicalizeBody(body []byte, canon string) []byte {
+	lines := strings.SplitAfter(string(body), "\r\n")
+	var out strings.Builder
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if canon == "relaxed" {
+			content := strings.TrimSuffix(line, "\r\n")
+			content = strings.TrimRight(wspRun.ReplaceAllString(content, " "), " ")
+			line = content + "\r\n"
+		} else if !strings.HasSuffix(line, "\r\n") {
+			line += "\r\n"
+		}
+		out.WriteString(line)
+	}
+
+	result := out.String()
+	for strings.HasSuffix(result, "\r\n\r\n") {
+		result = strings.TrimSuffix(result, "\r\n")
+	}
+	if result == "\r\n" && canon == "relaxed" {
+		result = ""
+	}
+	if result == "" && canon != "relaxed" {
+		result = "\r\n"
+	}
+	return []byte(result)
+}
+
+// parseTags parses a DKIM-style tag list ("a=b; c=d"), removing whitespace from values
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			continue
+		}
+		name := strings.TrimSpace(part[:eq])
+		value := strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, part[eq+1:])
+		tags[name] = value
+	}
+	return tags
+}
@@ -0,0 +1,208 @@
+package mailauth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testSealer adds ARC sets to a message with an Ed25519 key published at
+// arc._domainkey.forwarder.example
+type testSealer struct {
+	key ed25519.PrivateKey
+}
+
+func newTestSealer(t *testing.T) (*testSealer, *fakeResolver) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeResolver{txt: map[string][]string{
+		"arc._domainkey.forwarder.example": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}}
+	return &testSealer{key: key}, r
+}
+
+// testMessage is a message as a list of header fields and a body
+type testMessage struct {
+	headers [][2]string // Top to bottom
+	body    string
+}
+
+func (m *testMessage) raw() []byte {
+	var b strings.Builder
+	for _, h := range m.headers {
+		b.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	b.WriteString("\r\n" + m.body)
+	return []byte(b.String())
+}
+
+func (m *testMessage) get(name string) string {
+	for _, h := range m.headers {
+		if strings.EqualFold(h[0], name) {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+// relaxedHeader canonicalizes an unfolded header field (RFC 6376 section 3.4.2)
+func relaxedHeader(name, value string) string {
+	return strings.ToLower(name) + ":" + strings.Join(strings.Fields(value), " ") + "\r\n"
+}
+
+func (s *testSealer) sign(input string) string {
+	sum := sha256.Sum256([]byte(input))
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, sum[:]))
+}
+
+// seal adds ARC set i with the given chain validation status
+func (s *testSealer) seal(m *testMessage, i int, cv string) {
+	aar := fmt.Sprintf("i=%d; forwarder.example; spf=pass smtp.mailfrom=sender.example", i)
+
+	bodyHash := sha256.Sum256([]byte(m.body))
+	ams := fmt.Sprintf("i=%d; a=ed25519-sha256; c=relaxed/simple; d=forwarder.example; s=arc; h=from:subject; bh=%s; b=",
+		i, base64.StdEncoding.EncodeToString(bodyHash[:]))
+	amsInput := relaxedHeader("From", m.get("From")) + relaxedHeader("Subject", m.get("Subject")) +
+		strings.TrimSuffix(relaxedHeader("ARC-Message-Signature", ams), "\r\n")
+	ams += s.sign(amsInput)
+
+	seal := fmt.Sprintf("i=%d; a=ed25519-sha256; cv=%s; d=forwarder.example; s=arc; b=", i, cv)
+	var sealInput strings.Builder
+	for j := 1; j < i; j++ {
+		sealInput.WriteString(relaxedHeader("ARC-Authentication-Results", instanceHeader(m, "ARC-Authentication-Results", j)))
+		sealInput.WriteString(relaxedHeader("ARC-Message-Signature", instanceHeader(m, "ARC-Message-Signature", j)))
+		sealInput.WriteString(relaxedHeader("ARC-Seal", instanceHeader(m, "ARC-Seal", j)))
+	}
+	sealInput.WriteString(relaxedHeader("ARC-Authentication-Results", aar))
+	sealInput.WriteString(relaxedHeader("ARC-Message-Signature", ams))
+	sealInput.WriteString(strings.TrimSuffix(relaxedHeader("ARC-Seal", seal), "\r\n"))
+	seal += s.sign(sealInput.String())
+
+	m.headers = append([][2]string{
+		{"ARC-Seal", seal},
+		{"ARC-Message-Signature", ams},
+		{"ARC-Authentication-Results", aar},
+	}, m.headers...)
+}
+
+func instanceHeader(m *testMessage, name string, i int) string {
+	prefix := fmt.Sprintf("i=%d;", i)
+	for _, h := range m.headers {
+		if strings.EqualFold(h[0], name) && strings.HasPrefix(h[1], prefix) {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+func newTestMessage() *testMessage {
+	return &testMessage{
+		headers: [][2]string{
+			{"From", "Alice <alice@sender.example>"},
+			{"To", "list@forwarder.example"},
+			{"Subject", "Quarterly report"},
+		},
+		body: "Numbers attached.\r\n",
+	}
+}
+
+func TestCheckARC(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func(s *testSealer) *testMessage
+		want  string
+	}{
+		{"no ARC headers", func(s *testSealer) *testMessage {
+			return newTestMessage()
+		}, ResultNone},
+		{"single hop", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "none")
+			return m
+		}, ResultPass},
+		{"two hops", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "none")
+			s.seal(m, 2, "pass")
+			return m
+		}, ResultPass},
+		{"body modified after sealing", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "none")
+			m.body = "Numbers changed.\r\n"
+			return m
+		}, ResultFail},
+		{"signed header modified after sealing", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "none")
+			m.headers[len(m.headers)-1][1] = "Urgent: wire transfer"
+			return m
+		}, ResultFail},
+		{"earlier seal tampered", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "none")
+			for i, h := range m.headers {
+				if h[0] == "ARC-Authentication-Results" {
+					m.headers[i][1] = "i=1; forwarder.example; spf=fail"
+				}
+			}
+			s.seal(m, 2, "pass")
+			return m
+		}, ResultFail},
+		{"latest seal reports failure", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "none")
+			s.seal(m, 2, "fail")
+			return m
+		}, ResultFail},
+		{"first seal claims pass", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "pass")
+			return m
+		}, ResultFail},
+		{"missing instance", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 2, "pass")
+			return m
+		}, ResultFail},
+		{"incomplete set", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "none")
+			m.headers = m.headers[1:] // Drop the ARC-Seal
+			return m
+		}, ResultFail},
+		{"duplicate instance", func(s *testSealer) *testMessage {
+			m := newTestMessage()
+			s.seal(m, 1, "none")
+			s.seal(m, 1, "none")
+			return m
+		}, ResultFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, r := newTestSealer(t)
+			m := tt.build(s)
+			if got := NewVerifier(r).CheckARC(context.Background(), m.raw()); got != tt.want {
+				t.Errorf("CheckARC = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckARCUnknownKey(t *testing.T) {
+	s, _ := newTestSealer(t)
+	m := newTestMessage()
+	s.seal(m, 1, "none")
+
+	// The selector is not published
+	if got := NewVerifier(&fakeResolver{}).CheckARC(context.Background(), m.raw()); got != ResultFail {
+		t.Errorf("CheckARC = %s, want %s", got, ResultFail)
+	}
+}
@@ -0,0 +1,81 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+
+	"github.com/emitt/emitt/internal/email"
+)
+
+// checkDMARC evaluates DMARC (RFC 7489) for the From domain using the SPF and
+// DKIM results, returning the result and the policy the domain requests
+func (v *Verifier) checkDMARC(ctx context.Context, fromDomain string, results *email.AuthResults) (string, string) {
+	fromDomain = strings.TrimSuffix(strings.ToLower(fromDomain), ".")
+	if fromDomain == "" {
+		// A missing or unparseable From cannot be aligned with anything, and
+		// RFC 7489 section 6.6.1 has such messages fail rather than pass
+		// unchecked
+		return ResultPermError, ""
+	}
+
+	orgDomain := OrganizationalDomain(fromDomain)
+	opts := &dmarc.LookupOptions{LookupTXT: v.lookupTXTFunc(ctx)}
+
+	record, err := dmarc.LookupWithOptions(fromDomain, opts)
+	policy := ""
+	if errors.Is(err, dmarc.ErrNoPolicy) && orgDomain != fromDomain {
+		// Fall back to the organizational domain's record and subdomain policy
+		record, err = dmarc.LookupWithOptions(orgDomain, opts)
+		if err == nil && record.SubdomainPolicy != "" {
+			policy = string(record.SubdomainPolicy)
+		}
+	}
+	if err != nil {
+		if errors.Is(err, dmarc.ErrNoPolicy) {
+			return ResultNone, ""
+		}
+		if dmarc.IsTempFail(err) {
+			return ResultTempError, ""
+		}
+		return ResultPermError, ""
+	}
+	if policy == "" {
+		policy = string(record.Policy)
+	}
+
+	if results.SPF == ResultPass && aligned(results.SPFDomain, fromDomain, record.SPFAlignment) {
+		return ResultPass, policy
+	}
+	for _, d := range results.DKIMDomains {
+		if aligned(d, fromDomain, record.DKIMAlignment) {
+			return ResultPass, policy
+		}
+	}
+
+	return ResultFail, policy
+}
+
+// aligned reports whether an authenticated domain aligns with the From domain
+func aligned(authDomain, fromDomain string, mode dmarc.AlignmentMode) bool {
+	authDomain = strings.TrimSuffix(strings.ToLower(authDomain), ".")
+	if authDomain == "" {
+		return false
+	}
+	if mode == dmarc.AlignmentStrict {
+		return authDomain == fromDomain
+	}
+	return OrganizationalDomain(authDomain) == OrganizationalDomain(fromDomain)
+}
+
+// OrganizationalDomain returns the registrable domain (public suffix plus one label)
+func OrganizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
@@ -0,0 +1,82 @@
+package mailauth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/emitt/emitt/internal/email"
+)
+
+func TestCheckDMARC(t *testing.T) {
+	r := &fakeResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com":    {"v=DMARC1; p=reject; sp=quarantine"},
+			"_dmarc.strict.example": {"v=DMARC1; p=quarantine; adkim=s; aspf=s"},
+			"_dmarc.broken.example": {"v=DMARC1; p=sometimes"},
+			"_dmarc.other.example":  {"not a DMARC record"},
+		},
+		fail: map[string]bool{"_dmarc.down.example": true},
+	}
+	v := NewVerifier(r)
+
+	spf := func(result, domain string) *email.AuthResults {
+		return &email.AuthResults{SPF: result, SPFDomain: domain}
+	}
+	dkim := func(domains ...string) *email.AuthResults {
+		return &email.AuthResults{SPF: ResultNone, DKIM: ResultPass, DKIMDomains: domains}
+	}
+
+	tests := []struct {
+		name       string
+		fromDomain string
+		results    *email.AuthResults
+		want       string
+		wantPolicy string
+	}{
+		{"aligned spf", "example.com", spf(ResultPass, "example.com"), ResultPass, "reject"},
+		{"relaxed spf subdomain", "example.com", spf(ResultPass, "bounces.example.com"), ResultPass, "reject"},
+		{"unaligned spf", "example.com", spf(ResultPass, "esp.example"), ResultFail, "reject"},
+		{"aligned spf that failed", "example.com", spf(ResultFail, "example.com"), ResultFail, "reject"},
+		{"aligned dkim", "example.com", dkim("esp.example", "mail.example.com"), ResultPass, "reject"},
+		{"unaligned dkim", "example.com", dkim("esp.example"), ResultFail, "reject"},
+		{"case and trailing dot", "Example.COM.", spf(ResultPass, "example.com"), ResultPass, "reject"},
+		// Subdomains without a record use the organizational domain's sp=
+		{"subdomain policy", "news.example.com", spf(ResultPass, "example.com"), ResultPass, "quarantine"},
+		{"subdomain fail", "news.example.com", dkim("esp.example"), ResultFail, "quarantine"},
+		{"strict spf", "strict.example", spf(ResultPass, "mail.strict.example"), ResultFail, "quarantine"},
+		{"strict dkim", "strict.example", dkim("mail.strict.example"), ResultFail, "quarantine"},
+		{"strict exact match", "strict.example", dkim("strict.example"), ResultPass, "quarantine"},
+		{"subdomain without sp", "mail.strict.example", dkim("mail.strict.example"), ResultPass, "quarantine"},
+		{"no record", "nodmarc.example", spf(ResultPass, "nodmarc.example"), ResultNone, ""},
+		{"not a DMARC record", "other.example", spf(ResultPass, "other.example"), ResultNone, ""},
+		{"temporary failure", "down.example", spf(ResultPass, "down.example"), ResultTempError, ""},
+		{"invalid record", "broken.example", spf(ResultPass, "broken.example"), ResultPermError, ""},
+		// Without a From domain nothing can be aligned, whatever passed
+		{"no from domain", "", spf(ResultPass, "example.com"), ResultPermError, ""},
+		{"no from domain with dkim", "", dkim("example.com"), ResultPermError, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, policy := v.checkDMARC(context.Background(), tt.fromDomain, tt.results)
+			if got != tt.want || policy != tt.wantPolicy {
+				t.Errorf("checkDMARC(%q) = %s, %q, want %s, %q", tt.fromDomain, got, policy, tt.want, tt.wantPolicy)
+			}
+		})
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := map[string]string{
+		"example.com":         "example.com",
+		"mail.example.com":    "example.com",
+		"a.b.example.co.uk":   "example.co.uk",
+		"user.github.io":      "user.github.io",
+		"deep.user.github.io": "user.github.io",
+		"com":                 "com",
+	}
+	for domain, want := range tests {
+		if got := OrganizationalDomain(domain); got != want {
+			t.Errorf("OrganizationalDomain(%q) = %q, want %q", domain, got, want)
+		}
+	}
+}
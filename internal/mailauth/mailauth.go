@@ -0,0 +1,131 @@
+// Package mailauth verifies the authenticity of inbound mail (SPF, DKIM,
+// DMARC and ARC).
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+
+	"github.com/emitt/emitt/internal/email"
+)
+
+// Result values as used in Authentication-Results (RFC 8601)
+const (
+	ResultPass      = "pass"
+	ResultFail      = "fail"
+	ResultSoftFail  = "softfail"
+	ResultNeutral   = "neutral"
+	ResultNone      = "none"
+	ResultTempError = "temperror"
+	ResultPermError = "permerror"
+)
+
+// Resolver is the DNS interface used by the checks. *net.Resolver satisfies
+// it; tests can substitute a fake to run offline.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Input describes a received message and its SMTP envelope
+type Input struct {
+	RemoteIP   net.IP
+	Helo       string
+	MailFrom   string
+	FromDomain string // Domain of the RFC5322.From header; empty if missing or unparseable
+	Raw        []byte
+}
+
+// Verifier runs the inbound authentication checks
+type Verifier struct {
+	resolver Resolver
+}
+
+// NewVerifier creates a verifier using the given resolver (nil for the system resolver)
+func NewVerifier(resolver Resolver) *Verifier {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Verifier{resolver: resolver}
+}
+
+// Verify runs SPF, DKIM, DMARC and ARC checks on a message
+func (v *Verifier) Verify(ctx context.Context, in *Input) *email.AuthResults {
+	results := &email.AuthResults{}
+
+	// SPF checks the MAIL FROM domain, or the HELO name for null senders
+	spfDomain := domainOf(in.MailFrom)
+	spfSender := in.MailFrom
+	if spfDomain == "" {
+		spfDomain = in.Helo
+		spfSender = "postmaster@" + in.Helo
+	}
+	results.SPFDomain = strings.ToLower(spfDomain)
+	if in.RemoteIP == nil || spfDomain == "" {
+		results.SPF = ResultNone
+	} else {
+		results.SPF = v.CheckSPF(ctx, in.RemoteIP, spfDomain, spfSender, in.Helo)
+	}
+
+	results.DKIM, results.DKIMDomains = v.checkDKIM(ctx, in.Raw)
+	results.DMARC, results.DMARCPolicy = v.checkDMARC(ctx, in.FromDomain, results)
+	results.ARC = v.CheckARC(ctx, in.Raw)
+
+	return results
+}
+
+// checkDKIM verifies all DKIM signatures and returns the overall result and passing domains
+func (v *Verifier) checkDKIM(ctx context.Context, raw []byte) (string, []string) {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT:        v.lookupTXTFunc(ctx),
+		MaxVerifications: 5,
+	})
+	if err != nil && !errors.Is(err, dkim.ErrTooManySignatures) {
+		return ResultPermError, nil
+	}
+	if len(verifications) == 0 {
+		return ResultNone, nil
+	}
+
+	var domains []string
+	result := ResultFail
+	for _, ver := range verifications {
+		switch {
+		case ver.Err == nil:
+			domains = append(domains, strings.ToLower(ver.Domain))
+			result = ResultPass
+		case dkim.IsTempFail(ver.Err) && result != ResultPass:
+			result = ResultTempError
+		}
+	}
+	return result, domains
+}
+
+// lookupTXTFunc adapts the resolver to the callback signature used by go-msgauth
+func (v *Verifier) lookupTXTFunc(ctx context.Context) func(string) ([]string, error) {
+	return func(domain string) ([]string, error) {
+		return v.resolver.LookupTXT(ctx, domain)
+	}
+}
+
+// domainOf returns the lowercased domain part of an address
+func domainOf(addr string) string {
+	addr = strings.Trim(addr, "<>")
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(addr[i+1:])
+}
+
+// isNotFound reports whether a DNS error means the name has no records
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
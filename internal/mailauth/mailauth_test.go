@@ -0,0 +1,195 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// fakeResolver answers from fixed records. Names it has no records for are
+// NXDOMAIN; names in fail return a temporary error.
+type fakeResolver struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	fail map[string]bool
+}
+
+// lookup returns the key the records of a name are stored under
+func (r *fakeResolver) lookup(name string) (string, error) {
+	key := strings.TrimSuffix(strings.ToLower(name), ".")
+	if r.fail[key] {
+		return "", &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return key, nil
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	key, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	txts, ok := r.txt[key]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return txts, nil
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	key, err := r.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	ips, ok := r.ip[key]
+	if !ok {
+		return nil, notFound(host)
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	key, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	hosts, ok := r.mx[key]
+	if !ok {
+		return nil, notFound(name)
+	}
+	mxs := make([]*net.MX, len(hosts))
+	for i, host := range hosts {
+		mxs[i] = &net.MX{Host: host, Pref: uint16(10 * (i + 1))}
+	}
+	return mxs, nil
+}
+
+// dkimKey returns a signing key and the TXT record publishing it
+func dkimKey(t *testing.T) (ed25519.PrivateKey, string) {
+	t.Helper()
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+// signDKIM adds a DKIM signature by domain with selector s1
+func signDKIM(t *testing.T, raw []byte, domain string, key ed25519.PrivateKey) []byte {
+	t.Helper()
+	var signed bytes.Buffer
+	err := dkim.Sign(&signed, bytes.NewReader(raw), &dkim.SignOptions{
+		Domain:   domain,
+		Selector: "s1",
+		Signer:   key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed.Bytes()
+}
+
+func TestCheckDKIM(t *testing.T) {
+	key, record := dkimKey(t)
+	otherKey, _ := dkimKey(t)
+	r := &fakeResolver{
+		txt: map[string][]string{
+			"s1._domainkey.example.com":     {record},
+			"s1._domainkey.esp.example":     {record},
+			"s1._domainkey.revoked.example": {"v=DKIM1; k=ed25519; p="},
+		},
+		fail: map[string]bool{"s1._domainkey.down.example": true},
+	}
+	v := NewVerifier(r)
+	raw := newTestMessage().raw()
+
+	tests := []struct {
+		name        string
+		raw         []byte
+		want        string
+		wantDomains []string
+	}{
+		{"unsigned", raw, ResultNone, nil},
+		{"valid", signDKIM(t, raw, "example.com", key), ResultPass, []string{"example.com"}},
+		{"body changed", bytes.Replace(signDKIM(t, raw, "example.com", key), []byte("Numbers"), []byte("Invoice"), 1), ResultFail, nil},
+		{"wrong key", signDKIM(t, raw, "example.com", otherKey), ResultFail, nil},
+		{"revoked key", signDKIM(t, raw, "revoked.example", key), ResultFail, nil},
+		{"no key record", signDKIM(t, raw, "nokey.example", key), ResultFail, nil},
+		{"temporary failure", signDKIM(t, raw, "down.example", key), ResultTempError, nil},
+		// One valid signature is enough, and every passing domain is kept
+		{"one of two valid", signDKIM(t, signDKIM(t, raw, "example.com", otherKey), "esp.example", key), ResultPass, []string{"esp.example"}},
+		{"both valid", signDKIM(t, signDKIM(t, raw, "example.com", key), "esp.example", key), ResultPass, []string{"esp.example", "example.com"}},
+		{"valid and temporary failure", signDKIM(t, signDKIM(t, raw, "down.example", key), "example.com", key), ResultPass, []string{"example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, domains := v.checkDKIM(context.Background(), tt.raw)
+			if got != tt.want || strings.Join(domains, ",") != strings.Join(tt.wantDomains, ",") {
+				t.Errorf("checkDKIM = %s, %v, want %s, %v", got, domains, tt.want, tt.wantDomains)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	key, record := dkimKey(t)
+	r := &fakeResolver{
+		txt: map[string][]string{
+			"sender.example":               {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"esp.example":                  {"v=spf1 ip4:198.51.100.0/24 -all"},
+			"_dmarc.sender.example":        {"v=DMARC1; p=reject"},
+			"s1._domainkey.sender.example": {record},
+			"s1._domainkey.esp.example":    {record},
+		},
+	}
+	v := NewVerifier(r)
+	raw := newTestMessage().raw()
+
+	tests := []struct {
+		name     string
+		in       *Input
+		wantSPF  string
+		wantDKIM string
+		want     string
+	}{
+		{"spf aligned", &Input{
+			RemoteIP: net.ParseIP("192.0.2.10"), MailFrom: "alice@sender.example", FromDomain: "sender.example", Raw: raw,
+		}, ResultPass, ResultNone, ResultPass},
+		{"dkim aligned through an esp", &Input{
+			RemoteIP: net.ParseIP("198.51.100.10"), MailFrom: "bounce@esp.example", FromDomain: "sender.example",
+			Raw: signDKIM(t, raw, "sender.example", key),
+		}, ResultPass, ResultPass, ResultPass},
+		{"esp without alignment", &Input{
+			RemoteIP: net.ParseIP("198.51.100.10"), MailFrom: "bounce@esp.example", FromDomain: "sender.example",
+			Raw: signDKIM(t, raw, "esp.example", key),
+		}, ResultPass, ResultPass, ResultFail},
+		{"spoofed", &Input{
+			RemoteIP: net.ParseIP("203.0.113.5"), MailFrom: "alice@sender.example", FromDomain: "sender.example", Raw: raw,
+		}, ResultFail, ResultNone, ResultFail},
+		{"unparseable from", &Input{
+			RemoteIP: net.ParseIP("192.0.2.10"), MailFrom: "alice@sender.example", Raw: signDKIM(t, raw, "sender.example", key),
+		}, ResultPass, ResultPass, ResultPermError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := v.Verify(context.Background(), tt.in)
+			if got.SPF != tt.wantSPF || got.DKIM != tt.wantDKIM || got.DMARC != tt.want {
+				t.Errorf("Verify = spf %s, dkim %s, dmarc %s, want %s, %s, %s", got.SPF, got.DKIM, got.DMARC, tt.wantSPF, tt.wantDKIM, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package mailauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DNS limits from RFC 7208 section 4.6.4
+const (
+	maxSPFLookups  = 10 // Mechanisms and modifiers that query DNS
+	maxVoidLookups = 2  // Queries that find no records
+)
+
+// spfCheck holds the state of a single SPF evaluation
+type spfCheck struct {
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+	voids    int
+}
+
+// CheckSPF evaluates the SPF policy of domain for a message from ip (RFC 7208 check_host)
+func (v *Verifier) CheckSPF(ctx context.Context, ip net.IP, domain, sender, helo string) string {
+	c := &spfCheck{
+		resolver: v.resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	return c.checkHost(ctx, strings.TrimSuffix(strings.ToLower(domain), "."))
+}
+
+func (c *spfCheck) checkHost(ctx context.Context, domain string) string {
+	record, result := c.lookupRecord(ctx, domain)
+	if record == "" {
+		return result
+	}
+
+	terms := strings.Fields(record)[1:]
+	var redirect string
+
+	for _, term := range terms {
+		// Modifiers are name=value; only redirect affects the result
+		if eq := strings.IndexByte(term, '='); eq > 0 && !strings.ContainsAny(term[:eq], ":/") {
+			if strings.EqualFold(term[:eq], "redirect") {
+				redirect = term[eq+1:]
+			}
+			continue
+		}
+
+		qualifier := ResultPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = ResultFail, term[1:]
+		case '~':
+			qualifier, term = ResultSoftFail, term[1:]
+		case '?':
+			qualifier, term = ResultNeutral, term[1:]
+		}
+
+		matched, err := c.evalMechanism(ctx, domain, term)
+		if err != "" {
+			return err
+		}
+		if matched {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return ResultPermError
+		}
+		target, ok := c.expand(redirect, domain)
+		if !ok {
+			return ResultPermError
+		}
+		result := c.checkHost(ctx, target)
+		if result == ResultNone {
+			return ResultPermError
+		}
+		return result
+	}
+
+	return ResultNeutral
+}
+
+// lookupRecord returns the single v=spf1 record for a domain, or "" and the result to use
+func (c *spfCheck) lookupRecord(ctx context.Context, domain string) (string, string) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			if c.void() {
+				return "", ResultPermError
+			}
+			return "", ResultNone
+		}
+		return "", ResultTempError
+	}
+
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", ResultNone
+	case 1:
+		return records[0], ""
+	default:
+		return "", ResultPermError
+	}
+}
+
+// evalMechanism reports whether a mechanism matches, or a non-empty error result
+func (c *spfCheck) evalMechanism(ctx context.Context, domain, term string) (bool, string) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, ""
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, ResultPermError
+		}
+		network := arg[1:]
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return false, ResultPermError
+		}
+		return ipNet.Contains(c.ip), ""
+
+	case "a", "mx":
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return false, ResultPermError
+		}
+		target, cidr4, cidr6, ok := c.parseDomainSpec(arg, domain)
+		if !ok {
+			return false, ResultPermError
+		}
+
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := c.resolver.LookupMX(ctx, target)
+			if err != nil && !isNotFound(err) {
+				return false, ResultTempError
+			}
+			if len(mxs) == 0 && c.void() {
+				return false, ResultPermError
+			}
+			hosts = hosts[:0]
+			for i, mx := range mxs {
+				if i >= maxSPFLookups {
+					return false, ResultPermError
+				}
+				hosts = append(hosts, mx.Host)
+			}
+		}
+
+		for _, host := range hosts {
+			addrs, err := c.resolver.LookupIPAddr(ctx, host)
+			if err != nil && !isNotFound(err) {
+				return false, ResultTempError
+			}
+			if len(addrs) == 0 && name == "a" && c.void() {
+				return false, ResultPermError
+			}
+			for _, addr := range addrs {
+				if matchCIDR(c.ip, addr.IP, cidr4, cidr6) {
+					return true, ""
+				}
+			}
+		}
+		return false, ""
+
+	case "include":
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return false, ResultPermError
+		}
+		if !strings.HasPrefix(arg, ":") {
+			return false, ResultPermError
+		}
+		target, ok := c.expand(arg[1:], domain)
+		if !ok {
+			return false, ResultPermError
+		}
+		switch c.checkHost(ctx, target) {
+		case ResultPass:
+			return true, ""
+		case ResultFail, ResultSoftFail, ResultNeutral:
+			return false, ""
+		case ResultTempError:
+			return false, ResultTempError
+		default:
+			return false, ResultPermError
+		}
+
+	case "exists":
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return false, ResultPermError
+		}
+		if !strings.HasPrefix(arg, ":") {
+			return false, ResultPermError
+		}
+		target, ok := c.expand(arg[1:], domain)
+		if !ok {
+			return false, ResultPermError
+		}
+		addrs, err := c.resolver.LookupIPAddr(ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, ResultTempError
+		}
+		if len(addrs) == 0 && c.void() {
+			return false, ResultPermError
+		}
+		for _, addr := range addrs {
+			if addr.IP.To4() != nil {
+				return true, ""
+			}
+		}
+		return false, ""
+
+	case "ptr":
+		// ptr is deprecated (RFC 7208 section 5.5); count it but never match
+		if c.lookups++; c.lookups > maxSPFLookups {
+			return false, ResultPermError
+		}
+		return false, ""
+
+	default:
+		return false, ResultPermError
+	}
+}
+
+// void counts a lookup that found no records and reports whether the limit
+// is exceeded
+func (c *spfCheck) void() bool {
+	c.voids++
+	return c.voids > maxVoidLookups
+}
+
+// parseDomainSpec parses the [":" domain-spec] [dual-cidr-length] argument of a and mx
+func (c *spfCheck) parseDomainSpec(arg, domain string) (string, int, int, bool) {
+	cidr4, cidr6 := 32, 128
+	target := domain
+
+	spec := arg
+	if i := strings.Index(spec, "/"); i >= 0 {
+		lengths := spec[i:]
+		spec = spec[:i]
+
+		var ok bool
+		if cidr4, cidr6, ok = parseDualCIDR(lengths); !ok {
+			return "", 0, 0, false
+		}
+	}
+
+	if strings.HasPrefix(spec, ":") {
+		expanded, ok := c.expand(spec[1:], domain)
+		if !ok || expanded == "" {
+			return "", 0, 0, false
+		}
+		target = expanded
+	} else if spec != "" {
+		return "", 0, 0, false
+	}
+
+	return target, cidr4, cidr6, true
+}
+
+// parseDualCIDR parses "/n", "//n" or "/n//m"
+func parseDualCIDR(s string) (int, int, bool) {
+	cidr4, cidr6 := 32, 128
+	v4, v6 := s, ""
+	if i := strings.Index(s, "//"); i >= 0 {
+		v4, v6 = s[:i], s[i+2:]
+	}
+	if v4 != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(v4, "/"))
+		if err != nil || n < 0 || n > 32 {
+			return 0, 0, false
+		}
+		cidr4 = n
+	}
+	if v6 != "" {
+		n, err := strconv.Atoi(v6)
+		if err != nil || n < 0 || n > 128 {
+			return 0, 0, false
+		}
+		cidr6 = n
+	}
+	return cidr4, cidr6, true
+}
+
+// matchCIDR reports whether ip and candidate share a prefix of the family's length
+func matchCIDR(ip, candidate net.IP, cidr4, cidr6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		cand4 := candidate.To4()
+		if cand4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(cidr4, 32)
+		return ip4.Mask(mask).Equal(cand4.Mask(mask))
+	}
+	if candidate.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(cidr6, 128)
+	return ip.Mask(mask).Equal(candidate.Mask(mask))
+}
+
+// expand expands SPF macros (RFC 7208 section 7) in a domain-spec
+func (c *spfCheck) expand(spec, domain string) (string, bool) {
+	if !strings.Contains(spec, "%") {
+		return strings.ToLower(spec), true
+	}
+
+	local, senderDomain := "postmaster", domain
+	if i := strings.LastIndex(c.sender, "@"); i >= 0 {
+		if i > 0 {
+			local = c.sender[:i]
+		}
+		senderDomain = c.sender[i+1:]
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", false
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", false
+		}
+
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", false
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		var value string
+		switch strings.ToLower(macro[:1]) {
+		case "s":
+			value = c.sender
+		case "l":
+			value = local
+		case "o":
+			value = senderDomain
+		case "d":
+			value = domain
+		case "i":
+			value = macroIP(c.ip)
+		case "h":
+			value = c.helo
+		case "v":
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		default:
+			return "", false
+		}
+
+		transformed, ok := transformMacro(value, macro[1:])
+		if !ok {
+			return "", false
+		}
+		out.WriteString(transformed)
+	}
+
+	return strings.ToLower(out.String()), true
+}
+
+// transformMacro applies the digits, "r" and delimiter transformers of a macro
+func transformMacro(value, transformers string) (string, bool) {
+	digits := 0
+	i := 0
+	for i < len(transformers) && transformers[i] >= '0' && transformers[i] <= '9' {
+		digits = digits*10 + int(transformers[i]-'0')
+		i++
+	}
+	reverse := false
+	if i < len(transformers) && (transformers[i] == 'r' || transformers[i] == 'R') {
+		reverse = true
+		i++
+	}
+	delims := transformers[i:]
+	if strings.Trim(delims, ".-+,/_=") != "" {
+		return "", false
+	}
+	if delims == "" {
+		delims = "."
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delims, r)
+	})
+	if reverse {
+		for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+			parts[l], parts[r] = parts[r], parts[l]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	return strings.Join(parts, "."), true
+}
+
+// macroIP formats an IP for the %{i} macro (dotted nibbles for IPv6)
+func macroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	var nibbles []string
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(nibbles, ".")
+}
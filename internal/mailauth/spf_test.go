@@ -0,0 +1,174 @@
+package mailauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestCheckSPF(t *testing.T) {
+	r := &fakeResolver{
+		txt: map[string][]string{
+			"example.com":           {"v=spf1 ip4:192.0.2.0/24 include:_spf.example.net -all", "google-site-verification=abc"},
+			"_spf.example.net":      {"v=spf1 ip4:198.51.100.7 ip6:2001:db8::/32 ~all"},
+			"soft.example":          {"v=spf1 ~all"},
+			"neutral.example":       {"v=spf1 ?all"},
+			"open.example":          {"v=spf1"},
+			"redirect.example":      {"v=spf1 redirect=example.com"},
+			"redirect-none.example": {"v=spf1 redirect=missing.example"},
+			"include-none.example":  {"v=spf1 include:missing.example -all"},
+			"include-temp.example":  {"v=spf1 include:broken.example -all"},
+			"two.example":           {"v=spf1 -all", "v=spf1 +all"},
+			"bad.example":           {"v=spf1 foo:bar -all"},
+			"hosts.example":         {"v=spf1 a mx/24 -all"},
+			"macro.example":         {"v=spf1 exists:%{i}._spf.%{d} -all"},
+			"local.example":         {"v=spf1 exists:%{l}.%{o}.users.example -all"},
+			"notspf.example":        {"some other record"},
+		},
+		ip: map[string][]string{
+			"hosts.example":                     {"203.0.113.5"},
+			"mail.hosts.example":                {"203.0.113.200"},
+			"192.0.2.10._spf.macro.example":     {"127.0.0.2"},
+			"alice.local.example.users.example": {"127.0.0.2"},
+		},
+		mx: map[string][]string{
+			"hosts.example": {"mail.hosts.example."},
+		},
+		fail: map[string]bool{"broken.example": true, "down.example": true},
+	}
+	v := NewVerifier(r)
+
+	tests := []struct {
+		name   string
+		ip     string
+		domain string
+		sender string
+		want   string
+	}{
+		{"ip4 match", "192.0.2.44", "example.com", "", ResultPass},
+		{"include pass", "198.51.100.7", "example.com", "", ResultPass},
+		{"include ip6 pass", "2001:db8::25", "example.com", "", ResultPass},
+		{"include softfail falls through to -all", "198.51.100.8", "example.com", "", ResultFail},
+		{"softfail", "192.0.2.1", "soft.example", "", ResultSoftFail},
+		{"neutral", "192.0.2.1", "neutral.example", "", ResultNeutral},
+		{"no mechanism matched", "192.0.2.1", "open.example", "", ResultNeutral},
+		{"redirect pass", "192.0.2.44", "redirect.example", "", ResultPass},
+		{"redirect fail", "203.0.113.1", "redirect.example", "", ResultFail},
+		{"redirect to domain without a record", "192.0.2.1", "redirect-none.example", "", ResultPermError},
+		{"include of domain without a record", "192.0.2.1", "include-none.example", "", ResultPermError},
+		{"include temperror", "192.0.2.1", "include-temp.example", "", ResultTempError},
+		{"no record", "192.0.2.1", "nothing.example", "", ResultNone},
+		{"only other TXT records", "192.0.2.1", "notspf.example", "", ResultNone},
+		{"two records", "192.0.2.1", "two.example", "", ResultPermError},
+		{"unknown mechanism", "192.0.2.1", "bad.example", "", ResultPermError},
+		{"dns failure", "192.0.2.1", "down.example", "", ResultTempError},
+		{"a match", "203.0.113.5", "hosts.example", "", ResultPass},
+		{"mx cidr match", "203.0.113.9", "hosts.example", "", ResultPass},
+		{"a and mx miss", "203.0.114.9", "hosts.example", "", ResultFail},
+		{"exists with ip macro", "192.0.2.10", "macro.example", "", ResultPass},
+		{"exists with ip macro miss", "192.0.2.11", "macro.example", "", ResultFail},
+		{"sender macros", "192.0.2.1", "local.example", "alice@local.example", ResultPass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := tt.sender
+			if sender == "" {
+				sender = "bounce@" + tt.domain
+			}
+			got := v.CheckSPF(context.Background(), net.ParseIP(tt.ip), tt.domain, sender, "mx.sender.example")
+			if got != tt.want {
+				t.Errorf("CheckSPF(%s, %s) = %s, want %s", tt.ip, tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+// includeChain returns records where each domain includes the next, n
+// includes deep, ending in a record that passes 192.0.2.1
+func includeChain(n int) map[string][]string {
+	txt := make(map[string][]string)
+	for i := 0; i < n; i++ {
+		txt[fmt.Sprintf("l%d.example", i)] = []string{fmt.Sprintf("v=spf1 include:l%d.example -all", i+1)}
+	}
+	txt[fmt.Sprintf("l%d.example", n)] = []string{"v=spf1 ip4:192.0.2.1 -all"}
+	return txt
+}
+
+func TestCheckSPFLookupLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		txt  map[string][]string
+		want string
+	}{
+		{"ten includes", includeChain(10), ResultPass},
+		{"eleven includes", includeChain(11), ResultPermError},
+		{"eleven mechanisms in one record", map[string][]string{
+			"l0.example": {"v=spf1 a:h1.example a:h2.example a:h3.example a:h4.example a:h5.example " +
+				"a:h6.example a:h7.example a:h8.example a:h9.example a:h10.example a:h11.example ip4:192.0.2.1 -all"},
+		}, ResultPermError},
+		{"ip mechanisms do not count", map[string][]string{
+			"l0.example": {"v=spf1 ip4:10.0.0.1 ip4:10.0.0.2 ip4:10.0.0.3 ip4:10.0.0.4 ip4:10.0.0.5 ip4:10.0.0.6 " +
+				"ip4:10.0.0.7 ip4:10.0.0.8 ip4:10.0.0.9 ip4:10.0.0.10 ip4:10.0.0.11 ip4:192.0.2.1 -all"},
+		}, ResultPass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := make(map[string][]string)
+			for i := 1; i <= 11; i++ {
+				ip[fmt.Sprintf("h%d.example", i)] = []string{"203.0.113.1"}
+			}
+			v := NewVerifier(&fakeResolver{txt: tt.txt, ip: ip})
+			got := v.CheckSPF(context.Background(), net.ParseIP("192.0.2.1"), "l0.example", "a@l0.example", "")
+			if got != tt.want {
+				t.Errorf("CheckSPF = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckSPFVoidLookups(t *testing.T) {
+	tests := []struct {
+		name   string
+		record string
+		want   string
+	}{
+		{"two void a lookups", "v=spf1 a:void1.example a:void2.example ip4:192.0.2.1 -all", ResultPass},
+		{"three void a lookups", "v=spf1 a:void1.example a:void2.example a:void3.example ip4:192.0.2.1 -all", ResultPermError},
+		{"void mx and exists", "v=spf1 mx:void1.example exists:void2.example a:void3.example ip4:192.0.2.1 -all", ResultPermError},
+		{"resolving lookups are not void", "v=spf1 a:host.example a:host.example a:host.example ip4:192.0.2.1 -all", ResultPass},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeResolver{
+				txt: map[string][]string{"void.example": {tt.record}},
+				ip:  map[string][]string{"host.example": {"203.0.113.1"}},
+			}
+			got := NewVerifier(r).CheckSPF(context.Background(), net.ParseIP("192.0.2.1"), "void.example", "a@void.example", "")
+			if got != tt.want {
+				t.Errorf("CheckSPF = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransformMacro(t *testing.T) {
+	tests := []struct {
+		value, transformers, want string
+	}{
+		{"mail.example.com", "", "mail.example.com"},
+		{"mail.example.com", "2", "example.com"},
+		{"mail.example.com", "r", "com.example.mail"},
+		{"mail.example.com", "1r", "mail"},
+		{"first-last", "r-", "last.first"},
+	}
+	for _, tt := range tests {
+		got, ok := transformMacro(tt.value, tt.transformers)
+		if !ok || got != tt.want {
+			t.Errorf("transformMacro(%q, %q) = %q, %v; want %q", tt.value, tt.transformers, got, ok, tt.want)
+		}
+	}
+	if _, ok := transformMacro("a.b", "x"); ok {
+		t.Error("invalid delimiter accepted")
+	}
+}
@@ -0,0 +1,71 @@
+package processor
+
+import (
+	"context"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/extract"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// defaultAttachmentTextChars is the text included per attachment when a
+// mailbox does not set attachment_text_chars
+const defaultAttachmentTextChars = 8000
+
+// SetExtractor enables attachment text extraction for mailboxes that set
+// attachment_text
+func (p *Processor) SetExtractor(extractor *extract.Registry) {
+	p.extractor = extractor
+}
+
+// addAttachmentText fills in the extracted text of each attachment in an
+// email context
+func (p *Processor) addAttachmentText(ctx context.Context, emailID int64, emailCtx *email.EmailContext, cfg *config.ProcessorConfig) {
+	if p.extractor == nil || !cfg.AttachmentText || len(emailCtx.Attachments) == 0 {
+		return
+	}
+
+	rows, err := p.store.GetAttachments(ctx, emailID)
+	if err != nil {
+		p.logger.Warn().Err(err).Int64("email_id", emailID).Msg("Failed to load attachments for extraction")
+		return
+	}
+
+	limit := cfg.AttachmentTextChars
+	if limit == 0 {
+		limit = defaultAttachmentTextChars
+	}
+
+	for i := range emailCtx.Attachments {
+		info := &emailCtx.Attachments[i]
+		row := matchAttachment(rows, i, info.Filename, info.Size, info.ContentID)
+		if row == nil {
+			continue
+		}
+		if row.Withheld() != "" {
+			info.TextError = withheldError(row)
+			continue
+		}
+		if err := p.extractor.ExtractAttachment(ctx, p.store, row); err != nil {
+			p.logger.Warn().Err(err).Str("filename", row.Filename).Msg("Failed to extract attachment text")
+			continue
+		}
+		info.Text, info.TextTruncated = extract.Truncate(row.ExtractedText, limit)
+		info.TextError = row.ExtractError
+	}
+}
+
+// matchAttachment finds the stored row of the i-th attachment. Rows are
+// saved in message order, but one may be missing if saving it failed.
+func matchAttachment(rows []*storage.Attachment, i int, filename string, size int64, contentID string) *storage.Attachment {
+	if i < len(rows) && rows[i].Filename == filename && rows[i].Size == size {
+		return rows[i]
+	}
+	for _, row := range rows {
+		if row.Filename == filename && row.Size == size && row.ContentID == contentID {
+			return row
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // Registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // Registers the WebP decoder
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// Image input defaults for mailboxes that leave them unset
+const (
+	defaultMaxImages     = 4
+	defaultMaxImageBytes = 10 * 1024 * 1024 // 10MB
+	defaultMaxImageSide  = 2048
+)
+
+const (
+	minImageSide          = 16               // Smaller images are spacers and tracking pixels
+	maxImageDecodeBytes   = 64 * 1024 * 1024 // Images needing more memory to decode are skipped
+	maxImageUploadBytes   = 8 * 1024 * 1024  // Larger files are re-encoded even if they fit
+	downscaledJPEGQuality = 85
+)
+
+// imageFormats are the formats the model accepts as they are
+var imageFormats = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+}
+
+var errImageSkipped = errors.New("image skipped")
+
+// imageInputs loads the email's image attachments, including inline images,
+// as image inputs for the model
+func (p *Processor) imageInputs(ctx context.Context, emailID int64, cfg *config.ProcessorConfig) []ImageInput {
+	if !cfg.Images.Enabled {
+		return nil
+	}
+
+	rows, err := p.store.GetAttachments(ctx, emailID)
+	if err != nil {
+		p.logger.Warn().Err(err).Int64("email_id", emailID).Msg("Failed to load attachments for image input")
+		return nil
+	}
+
+	limits := cfg.Images
+	if limits.MaxImages == 0 {
+		limits.MaxImages = defaultMaxImages
+	}
+	if limits.MaxBytes == 0 {
+		limits.MaxBytes = defaultMaxImageBytes
+	}
+	if limits.MaxDimension == 0 {
+		limits.MaxDimension = defaultMaxImageSide
+	}
+
+	var images []ImageInput
+	skipped := 0
+	for _, att := range rows {
+		if !isImageAttachment(att) || att.Withheld() != "" {
+			continue
+		}
+		if len(images) == limits.MaxImages || att.Size > limits.MaxBytes {
+			skipped++
+			continue
+		}
+
+		url, err := p.loadImage(att, &limits)
+		if err != nil {
+			if !errors.Is(err, errImageSkipped) {
+				skipped++
+				p.logger.Debug().Err(err).Str("filename", att.Filename).Msg("Image not passed to the model")
+			}
+			continue
+		}
+
+		label := "Attached image: " + att.Filename
+		if att.Inline {
+			label = "Inline image: " + att.Filename
+			if att.ContentID != "" {
+				label += " (cid:" + att.ContentID + ")"
+			}
+		}
+		images = append(images, ImageInput{Label: label, URL: url, Detail: limits.Detail})
+	}
+
+	if skipped > 0 {
+		p.logger.Info().
+			Int64("email_id", emailID).
+			Int("images", len(images)).
+			Int("skipped", skipped).
+			Msg("Some images were not passed to the model")
+	}
+	return images
+}
+
+// isImageAttachment reports whether an attachment is an image, going by its
+// extension when the content type is generic
+func isImageAttachment(att *storage.Attachment) bool {
+	ct := strings.ToLower(att.ContentType)
+	if ct == "" || strings.HasPrefix(ct, "application/octet-stream") {
+		ct = mime.TypeByExtension(strings.ToLower(path.Ext(att.Filename)))
+	}
+	return strings.HasPrefix(ct, "image/")
+}
+
+// loadImage reads an image attachment and returns it as a data URL,
+// downscaled if it exceeds the mailbox's size limits
+func (p *Processor) loadImage(att *storage.Attachment, limits *config.ImageInputConfig) (string, error) {
+	rc, err := p.store.OpenAttachment(att)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(rc, limits.MaxBytes+1))
+	rc.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return "", fmt.Errorf("image is larger than %d bytes", limits.MaxBytes)
+	}
+
+	data, contentType, err := prepareImage(data, limits.MaxDimension)
+	if err != nil {
+		return "", err
+	}
+	return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// prepareImage returns an image the model accepts, no larger than maxSide
+// pixels on its longer side. Images that already fit are passed through.
+func prepareImage(data []byte, maxSide int) ([]byte, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read image: %w", err)
+	}
+	if cfg.Width < minImageSide || cfg.Height < minImageSide {
+		return nil, "", errImageSkipped
+	}
+	if decodedSize(cfg) > maxImageDecodeBytes {
+		return nil, "", fmt.Errorf("image is too large to decode (%dx%d)", cfg.Width, cfg.Height)
+	}
+
+	contentType, accepted := imageFormats[format]
+	if accepted && cfg.Width <= maxSide && cfg.Height <= maxSide && len(data) <= maxImageUploadBytes {
+		return data, contentType, nil
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
+	}
+	dst := downscale(src, maxSide)
+
+	// PNG keeps screenshots legible; photos are smaller as JPEG
+	var out bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&out, dst)
+		contentType = "image/png"
+	}
+	if format != "png" || out.Len() > maxImageUploadBytes {
+		out.Reset()
+		err = jpeg.Encode(&out, flatten(dst), &jpeg.Options{Quality: downscaledJPEGQuality})
+		contentType = "image/jpeg"
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode image: %w", err)
+	}
+	return out.Bytes(), contentType, nil
+}
+
+// decodedSize estimates the memory image.Decode needs for an image, going by
+// its color model. JPEG chroma subsampling is not known from the header, so
+// YCbCr counts as unsubsampled.
+func decodedSize(cfg image.Config) int64 {
+	bytesPerPixel := int64(4)
+	switch cfg.ColorModel {
+	case color.GrayModel, color.AlphaModel:
+		bytesPerPixel = 1
+	case color.Gray16Model, color.Alpha16Model:
+		bytesPerPixel = 2
+	case color.YCbCrModel:
+		bytesPerPixel = 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		bytesPerPixel = 8
+	default:
+		if _, ok := cfg.ColorModel.(color.Palette); ok {
+			bytesPerPixel = 1
+		}
+	}
+	return int64(cfg.Width) * int64(cfg.Height) * bytesPerPixel
+}
+
+// downscale shrinks an image so its longer side is at most maxSide
+func downscale(src image.Image, maxSide int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSide && h <= maxSide {
+		return src
+	}
+	if w >= h {
+		h = max(1, h*maxSide/w)
+		w = maxSide
+	} else {
+		w = max(1, w*maxSide/h)
+		h = maxSide
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	return dst
+}
+
+// flatten draws an image over white, since JPEG has no transparency
+func flatten(src image.Image) image.Image {
+	dst := image.NewRGBA(src.Bounds())
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Over)
+	return dst
+}
@@ -0,0 +1,144 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeader returns the signature and header chunk of a PNG, without any
+// image data: enough for image.DecodeConfig but not for image.Decode
+func pngHeader(width, height uint32, bitDepth, colorType byte) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8], ihdr[9] = bitDepth, colorType
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestPrepareImage(t *testing.T) {
+	photo := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		photo.Set(x, x%200, color.RGBA{R: uint8(x), G: 100, B: 200, A: 255})
+	}
+	small := encodePNG(t, photo)
+	smallJPEG := encodeJPEG(t, photo)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		maxSide  int
+		wantType string
+		wantSize image.Point // Zero to expect the input unchanged
+	}{
+		{"png that fits", small, 2048, "image/png", image.Point{}},
+		{"jpeg that fits", smallJPEG, 2048, "image/jpeg", image.Point{}},
+		{"wide png", encodePNG(t, image.NewNRGBA(image.Rect(0, 0, 3000, 100))), 2048, "image/png", image.Pt(2048, 68)},
+		{"tall jpeg", encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 100, 3000))), 1000, "image/jpeg", image.Pt(33, 1000)},
+		{"small limit", small, 150, "image/png", image.Pt(150, 100)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, contentType, err := prepareImage(tt.data, tt.maxSide)
+			if err != nil {
+				t.Fatalf("prepareImage: %v", err)
+			}
+			if contentType != tt.wantType {
+				t.Errorf("content type = %s, want %s", contentType, tt.wantType)
+			}
+			if tt.wantSize == (image.Point{}) {
+				if !bytes.Equal(out, tt.data) {
+					t.Error("image that fits was re-encoded")
+				}
+				return
+			}
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("output does not decode: %v", err)
+			}
+			if got := image.Pt(cfg.Width, cfg.Height); got != tt.wantSize {
+				t.Errorf("size = %v, want %v", got, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestPrepareImageRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"tracking pixel", encodePNG(t, image.NewRGBA(image.Rect(0, 0, 1, 1))), "image skipped"},
+		{"spacer", encodePNG(t, image.NewRGBA(image.Rect(0, 0, 600, 8))), "image skipped"},
+		{"not an image", []byte("Hello, this is text"), "failed to read image"},
+		{"truncated jpeg", []byte("\xff\xd8\xff\xe0"), "failed to read image"},
+		{"unknown format", []byte("BM\x00\x00 bitmap"), "failed to read image"},
+		// Headers alone claim sizes whose decoding would exhaust memory
+		{"huge rgba", pngHeader(5000, 5000, 8, 6), "too large to decode"},
+		{"huge 16-bit", pngHeader(3000, 3000, 16, 6), "too large to decode"},
+		{"huge gray", pngHeader(9000, 9000, 8, 0), "too large to decode"},
+		{"huge gif screen", []byte("GIF89a\xff\xff\xff\xff\x00\x00\x00"), "too large to decode"},
+		{"overflowing", pngHeader(1<<31-1, 1<<31-1, 8, 6), "failed to read image"},
+		// Within the budget but truncated after the header
+		{"corrupt", pngHeader(3000, 3000, 8, 6), "failed to decode image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := prepareImage(tt.data, 2048)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("prepareImage = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodedSize(t *testing.T) {
+	tests := []struct {
+		model color.Model
+		want  int64
+	}{
+		{color.GrayModel, 100},
+		{color.Palette{color.Black, color.White}, 100},
+		{color.Gray16Model, 200},
+		{color.YCbCrModel, 300},
+		{color.RGBAModel, 400},
+		{color.NRGBA64Model, 800},
+	}
+	for _, tt := range tests {
+		if got := decodedSize(image.Config{ColorModel: tt.model, Width: 10, Height: 10}); got != tt.want {
+			t.Errorf("decodedSize(%T) = %d, want %d", tt.model, got, tt.want)
+		}
+	}
+}
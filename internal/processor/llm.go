@@ -104,6 +104,32 @@ type InputMessage struct {
 	Content string `json:"content"`
 }
 
+// InputContentMessage represents an input message made of content parts
+type InputContentMessage struct {
+	Role    string        `json:"role"`
+	Content []interface{} `json:"content"`
+}
+
+// InputText is a text part of an input message
+type InputText struct {
+	Type string `json:"type"` // "input_text"
+	Text string `json:"text"`
+}
+
+// InputImage is an image part of an input message
+type InputImage struct {
+	Type     string `json:"type"`      // "input_image"
+	ImageURL string `json:"image_url"` // https or data: URL
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ImageInput is an image given to the model with the user message
+type ImageInput struct {
+	Label  string // Shown before the image, e.g. its filename
+	URL    string
+	Detail string // "low", "high" or "auto"
+}
+
 // FunctionCallInput represents a function call result input
 type FunctionCallInput struct {
 	Type   string `json:"type"`
@@ -182,6 +208,7 @@ func (c *LLMClient) ProcessWithTools(
 	ctx context.Context,
 	systemPrompt string,
 	userMessage string,
+	images []ImageInput,
 	registry *tools.Registry,
 	toolNames []string,
 	maxIterations int,
@@ -195,7 +222,7 @@ func (c *LLMClient) ProcessWithTools(
 
 	// Start with user message
 	input := []interface{}{
-		InputMessage{Role: "user", Content: userMessage},
+		userInput(userMessage, images),
 	}
 
 	for i := 0; i < maxIterations; i++ {
@@ -275,6 +302,22 @@ func (c *LLMClient) ProcessWithTools(
 	return "", fmt.Errorf("max iterations reached without completion")
 }
 
+// userInput builds the first user message, with any images as content parts
+func userInput(text string, images []ImageInput) interface{} {
+	if len(images) == 0 {
+		return InputMessage{Role: "user", Content: text}
+	}
+
+	content := []interface{}{InputText{Type: "input_text", Text: text}}
+	for _, img := range images {
+		if img.Label != "" {
+			content = append(content, InputText{Type: "input_text", Text: img.Label})
+		}
+		content = append(content, InputImage{Type: "input_image", ImageURL: img.URL, Detail: img.Detail})
+	}
+	return InputContentMessage{Role: "user", Content: content}
+}
+
 // convertTools converts registry tools to API tool format
 func (c *LLMClient) convertTools(registry *tools.Registry, names []string) []Tool {
 	var regTools []tools.Tool
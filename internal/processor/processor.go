@@ -3,14 +3,19 @@ package processor
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
 
+	"github.com/emitt/emitt/internal/clamav"
 	"github.com/emitt/emitt/internal/config"
 	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/extract"
 	"github.com/emitt/emitt/internal/router"
+	"github.com/emitt/emitt/internal/spam"
 	"github.com/emitt/emitt/internal/storage"
 	"github.com/emitt/emitt/internal/tools"
 )
@@ -22,9 +27,23 @@ type Processor struct {
 	llm      *LLMClient
 	registry *tools.Registry
 	emailTool *tools.EmailTool
+	spam     *spam.Scorer
 	logger   zerolog.Logger
+
+	splitRecipients bool
+	extractor       *extract.Registry
+	virusScanner    *clamav.Client
+	secureMail      email.SecureMail
+
+	// started marks this process; rows claimed before it belong to a
+	// previous run that never finished them
+	started time.Time
 }
 
+// processingLease is how long a claimed email may stay processing before
+// ProcessPending treats the claim as abandoned
+const processingLease = time.Hour
+
 // NewProcessor creates a new email processor
 func NewProcessor(
 	store *storage.Store,
@@ -34,21 +53,44 @@ func NewProcessor(
 	emailTool *tools.EmailTool,
 	logger zerolog.Logger,
 ) *Processor {
-	return &Processor{
+	p := &Processor{
 		store:    store,
 		router:   router,
 		llm:      llm,
 		registry: registry,
 		emailTool: emailTool,
 		logger:   logger.With().Str("component", "processor").Logger(),
+		started:  time.Now(),
 	}
+
+	// Thread the mail we send with the conversations it belongs to
+	if emailTool != nil {
+		emailTool.SetRecorder(p)
+	}
+	return p
 }
 
-// Process handles an incoming email
-func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) error {
-	start := time.Now()
+// SetSpamScorer enables spam scoring of inbound mail before it is stored and routed
+func (p *Processor) SetSpamScorer(scorer *spam.Scorer) {
+	p.spam = scorer
+}
+
+// SetSecureMail decrypts and verifies S/MIME and PGP mail when pending
+// emails are parsed again. Set the same handler on the SMTP server.
+func (p *Processor) SetSecureMail(secure email.SecureMail) {
+	p.secureMail = secure
+}
+
+// SetSplitRecipients enables processing a delivery once per envelope recipient
+func (p *Processor) SetSplitRecipients(enabled bool) {
+	p.splitRecipients = enabled
+}
 
-	// Store the email
+// Spool durably stores a received email as a pending row, setting inbound.ID.
+// The SMTP server calls it before acknowledging DATA; pending or processing
+// rows left behind by a crash are picked up by ProcessPending. A redelivered
+// message returns storage.ErrDuplicateEmail.
+func (p *Processor) Spool(ctx context.Context, inbound *email.InboundEmail) error {
 	dbEmail := &storage.Email{
 		MessageID:   inbound.MessageID,
 		From:        inbound.From.Address,
@@ -58,8 +100,19 @@ func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) er
 		TextBody:    inbound.TextBody,
 		HTMLBody:    inbound.HTMLBody,
 		RawMessage:  inbound.RawMessage,
+		RawSHA256:   inbound.RawSHA256,
 		ReceivedAt:  inbound.ReceivedAt,
 		Status:      storage.EmailStatusPending,
+		AuthUser:    inbound.AuthUser,
+	}
+
+	if env := inbound.Envelope; env != nil {
+		dbEmail.EnvelopeFrom = env.MailFrom
+		dbEmail.EnvelopeTo = env.RcptTo
+		dbEmail.RemoteIP = env.RemoteIP
+		dbEmail.Helo = env.Helo
+		dbEmail.TLSVersion = env.TLSVersion
+		dbEmail.TLSCipher = env.TLSCipher
 	}
 
 	// Store headers as JSON
@@ -68,6 +121,22 @@ func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) er
 		dbEmail.Headers = headersJSON
 	}
 
+	// Store sender authentication results as JSON
+	if inbound.Auth != nil {
+		authJSON, _ := json.Marshal(inbound.Auth)
+		dbEmail.AuthResults = authJSON
+	}
+
+	// Store the encryption and signature found by the parser
+	if inbound.Security != nil {
+		securityJSON, _ := json.Marshal(inbound.Security)
+		dbEmail.Security = securityJSON
+	}
+	dbEmail.SignatureStatus = inbound.SignatureStatus()
+	if sig := inbound.Security; sig != nil && sig.Signature != nil {
+		dbEmail.Signer = sig.Signature.Signer
+	}
+
 	// Store attachments metadata
 	if len(inbound.Attachments) > 0 {
 		attInfo := make([]storage.Attachment, len(inbound.Attachments))
@@ -76,6 +145,8 @@ func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) er
 				Filename:    att.Filename,
 				ContentType: att.ContentType,
 				Size:        att.Size,
+				ContentID:   att.ContentID,
+				Inline:      att.Inline,
 			}
 		}
 		attJSON, _ := json.Marshal(attInfo)
@@ -85,6 +156,7 @@ func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) er
 	if err := p.store.SaveEmail(ctx, dbEmail); err != nil {
 		return fmt.Errorf("failed to save email: %w", err)
 	}
+	inbound.ID = dbEmail.ID
 
 	// Save attachments data
 	for _, att := range inbound.Attachments {
@@ -92,24 +164,84 @@ func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) er
 			Filename:    att.Filename,
 			ContentType: att.ContentType,
 			Size:        att.Size,
+			ContentID:   att.ContentID,
+			Inline:      att.Inline,
+			SHA256:      att.SHA256,
 			Data:        att.Data,
 		}); err != nil {
 			p.logger.Warn().Err(err).Str("filename", att.Filename).Msg("Failed to save attachment")
 		}
 	}
 
+	return nil
+}
+
+// Process handles an incoming email, storing it first unless it was spooled
+func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) error {
+	start := time.Now()
+
+	if inbound.ID == 0 {
+		if err := p.Spool(ctx, inbound); err != nil {
+			if errors.Is(err, storage.ErrDuplicateEmail) {
+				p.logger.Info().Str("message_id", inbound.MessageID).Msg("Email already stored, skipping")
+				return nil
+			}
+			return err
+		}
+	}
+	dbEmail := &storage.Email{ID: inbound.ID}
+
+	// Claim the row so a concurrent ProcessPending run does not handle it twice
+	claimed, err := p.store.ClaimEmail(ctx, dbEmail.ID)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		p.logger.Debug().Int64("email_id", dbEmail.ID).Msg("Email already claimed, skipping")
+		return nil
+	}
+
+	// Score spam before routing so rules can match on the score. Runs split
+	// from a delivery inherit the score of the whole message.
+	if p.spam != nil && inbound.Spam == nil {
+		inbound.Spam = p.spam.Score(ctx, inbound)
+		reportJSON, _ := json.Marshal(inbound.Spam)
+		if err := p.store.UpdateEmailSpam(ctx, dbEmail.ID, inbound.Spam.Score, reportJSON); err != nil {
+			p.logger.Warn().Err(err).Int64("email_id", dbEmail.ID).Msg("Failed to store spam score")
+		}
+		p.logger.Debug().
+			Int64("email_id", dbEmail.ID).
+			Float64("spam_score", inbound.Spam.Score).
+			Msg("Spam scored")
+	}
+
+	// Scan attachments before routing so rules can quarantine infected mail
+	if p.virusScanner != nil && inbound.HasAttachments() {
+		p.scanAttachments(ctx, dbEmail.ID, inbound)
+	}
+
+	if rcpts := p.splitTargets(inbound); len(rcpts) > 1 {
+		return p.processSplit(ctx, inbound, rcpts)
+	}
+
 	// Route the email
 	routeResult, err := p.router.Route(ctx, inbound)
 	if err != nil {
+		p.store.UpdateEmailStatus(ctx, dbEmail.ID, storage.EmailStatusFailed)
 		return fmt.Errorf("failed to route email: %w", err)
 	}
 
 	dbEmail.MailboxName = routeResult.MailboxName
-
-	// Update status to processing
-	if err := p.store.UpdateEmailStatus(ctx, dbEmail.ID, storage.EmailStatusProcessing); err != nil {
-		return fmt.Errorf("failed to update email status: %w", err)
+	p.threadInbound(ctx, dbEmail.ID, inbound, routeResult.MailboxName)
+
+	// Apply the mailbox's outbound policy and template to any mail sent while
+	// processing. The run travels with the context because tools are shared by
+	// concurrent emails.
+	run := &tools.Run{Email: inbound, Mailbox: routeResult.MailboxName, Policy: routeResult.Policy}
+	if routeResult.Config != nil {
+		run.Template = routeResult.Config.Template
 	}
+	ctx = tools.WithRun(ctx, run)
 
 	// Process based on type
 	var processErr error
@@ -122,10 +254,15 @@ func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) er
 		processErr = p.processWebhook(ctx, dbEmail.ID, inbound, routeResult.Config)
 	case router.ProcessorTypeNoop:
 		p.logger.Info().Int64("email_id", dbEmail.ID).Msg("No-op processor, email stored only")
+	case router.ProcessorTypeQuarantine:
+		p.logger.Warn().Int64("email_id", dbEmail.ID).Bool("infected", inbound.Infected()).Msg("Email quarantined")
 	}
 
 	// Update final status
 	finalStatus := storage.EmailStatusCompleted
+	if routeResult.ProcessorType == router.ProcessorTypeQuarantine {
+		finalStatus = storage.EmailStatusQuarantined
+	}
 	if processErr != nil {
 		finalStatus = storage.EmailStatusFailed
 		p.logger.Error().Err(processErr).Int64("email_id", dbEmail.ID).Msg("Processing failed")
@@ -146,17 +283,59 @@ func (p *Processor) Process(ctx context.Context, inbound *email.InboundEmail) er
 	return processErr
 }
 
+// splitTargets returns the distinct envelope recipients a delivery should be
+// split into, or nil if it is processed as a whole
+func (p *Processor) splitTargets(inbound *email.InboundEmail) []string {
+	if !p.splitRecipients || inbound.Recipient != "" || inbound.Envelope == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var rcpts []string
+	for _, rcpt := range inbound.Envelope.RcptTo {
+		key := strings.ToLower(rcpt)
+		if !seen[key] {
+			seen[key] = true
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	return rcpts
+}
+
+// processSplit stores a pending run per recipient, linked to the delivery's
+// row and raw message, and processes each one independently
+func (p *Processor) processSplit(ctx context.Context, inbound *email.InboundEmail, rcpts []string) error {
+	ids, err := p.store.SplitEmail(ctx, inbound.ID, rcpts)
+	if err != nil {
+		p.store.UpdateEmailStatus(ctx, inbound.ID, storage.EmailStatusFailed)
+		return err
+	}
+
+	p.logger.Info().
+		Int64("email_id", inbound.ID).
+		Int("recipients", len(rcpts)).
+		Msg("Delivery split by recipient")
+
+	var errs []error
+	for i, id := range ids {
+		run := *inbound
+		run.ID = id
+		run.Recipient = rcpts[i]
+		if err := p.Process(ctx, &run); err != nil {
+			errs = append(errs, fmt.Errorf("recipient %s: %w", rcpts[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // processWithLLM processes an email using the LLM
 func (p *Processor) processWithLLM(ctx context.Context, emailID int64, inbound *email.InboundEmail, cfg *config.ProcessorConfig) error {
 	startTime := time.Now()
 
-	// Set current email context for the email tool
-	if p.emailTool != nil {
-		p.emailTool.SetCurrentEmail(inbound)
-	}
-
 	// Build email context message
-	emailCtx := inbound.ToContext()
+	emailCtx := inbound.ToContext(cfg.Headers)
+	p.addAttachmentText(ctx, emailID, &emailCtx, cfg)
+	p.addThreadHistory(ctx, emailID, inbound, &emailCtx, cfg)
 	emailJSON, _ := json.MarshalIndent(emailCtx, "", "  ")
 
 	userMessage := fmt.Sprintf(`Process the following email:
@@ -165,11 +344,17 @@ func (p *Processor) processWithLLM(ctx context.Context, emailID int64, inbound *
 
 Analyze the email and take appropriate actions using the available tools.`, string(emailJSON))
 
-	// Log processing start
+	images := p.imageInputs(ctx, emailID, cfg)
+
+	// Log processing start, naming the images rather than storing their data
+	logInput := userMessage
+	for _, img := range images {
+		logInput += "\n\n[" + img.Label + "]"
+	}
 	p.store.SaveProcessingLog(ctx, &storage.ProcessingLog{
 		EmailID:   emailID,
 		Step:      "llm_start",
-		Input:     userMessage,
+		Input:     logInput,
 		CreatedAt: time.Now(),
 	})
 
@@ -178,6 +363,7 @@ Analyze the email and take appropriate actions using the available tools.`, stri
 		ctx,
 		cfg.SystemPrompt,
 		userMessage,
+		images,
 		p.registry,
 		cfg.Tools,
 		10, // max iterations
@@ -211,8 +397,6 @@ func (p *Processor) processForward(ctx context.Context, emailID int64, inbound *
 		return fmt.Errorf("email tool not configured")
 	}
 
-	p.emailTool.SetCurrentEmail(inbound)
-
 	args := map[string]interface{}{
 		"action": "forward",
 		"to":     []string{cfg.ForwardTo},
@@ -221,8 +405,17 @@ func (p *Processor) processForward(ctx context.Context, emailID int64, inbound *
 	}
 	argsJSON, _ := json.Marshal(args)
 
-	_, err := p.emailTool.Execute(ctx, argsJSON)
-	return err
+	resultJSON, err := p.emailTool.Execute(ctx, argsJSON)
+	if err != nil {
+		return err
+	}
+
+	// Tool failures (policy, template, sender errors) are reported in the result
+	var result tools.ToolResult
+	if err := json.Unmarshal(resultJSON, &result); err == nil && !result.Success {
+		return fmt.Errorf("forward failed: %s", result.Error)
+	}
+	return nil
 }
 
 // processWebhook sends the email to a webhook URL
@@ -233,7 +426,7 @@ func (p *Processor) processWebhook(ctx context.Context, emailID int64, inbound *
 
 	httpTool := tools.NewHTTPTool()
 
-	emailCtx := inbound.ToContext()
+	emailCtx := inbound.ToContext(cfg.Headers)
 	payload := map[string]interface{}{
 		"event":    "email.received",
 		"email_id": emailID,
@@ -252,8 +445,23 @@ func (p *Processor) processWebhook(ctx context.Context, emailID int64, inbound *
 	return err
 }
 
-// ProcessPending processes all pending emails
+// ProcessPending processes pending emails, including mail spooled by the SMTP
+// server that was not handled before a restart. Emails left processing by a
+// previous run, or claimed longer ago than the processing lease, are requeued
+// first.
 func (p *Processor) ProcessPending(ctx context.Context, limit int) error {
+	cutoff := time.Now().Add(-processingLease)
+	if cutoff.Before(p.started) {
+		cutoff = p.started
+	}
+	requeued, err := p.store.RequeueStaleEmails(ctx, cutoff)
+	if err != nil {
+		return fmt.Errorf("failed to requeue stale emails: %w", err)
+	}
+	if requeued > 0 {
+		p.logger.Warn().Int64("count", requeued).Msg("Requeued emails left processing")
+	}
+
 	emails, err := p.store.GetPendingEmails(ctx, limit)
 	if err != nil {
 		return fmt.Errorf("failed to get pending emails: %w", err)
@@ -261,16 +469,65 @@ func (p *Processor) ProcessPending(ctx context.Context, limit int) error {
 
 	p.logger.Info().Int("count", len(emails)).Msg("Processing pending emails")
 
-	for _, dbEmail := range emails {
+	for _, pending := range emails {
+		// ListEmails omits the raw message; load the full row
+		dbEmail, err := p.store.GetEmail(ctx, pending.ID)
+		if err != nil || dbEmail == nil {
+			p.logger.Error().Err(err).Int64("email_id", pending.ID).Msg("Failed to load pending email")
+			continue
+		}
+
 		// Re-parse the email from raw message
 		parser := email.NewParser()
-		inbound, err := parser.Parse(dbEmail.RawMessage)
+		if blobs := p.store.Blobs(); blobs != nil {
+			parser.SetBlobStore(blobs)
+		}
+		if p.secureMail != nil {
+			parser.SetSecureMail(p.secureMail)
+		}
+		var inbound *email.InboundEmail
+		if dbEmail.RawSHA256 != "" {
+			inbound, err = parser.ParseBlob(dbEmail.RawSHA256)
+		} else {
+			inbound, err = parser.Parse(dbEmail.RawMessage)
+		}
 		if err != nil {
 			p.logger.Error().Err(err).Int64("email_id", dbEmail.ID).Msg("Failed to parse stored email")
 			p.store.UpdateEmailStatus(ctx, dbEmail.ID, storage.EmailStatusFailed)
 			continue
 		}
 
+		// Restore what the SMTP session added on top of the raw message
+		inbound.ID = dbEmail.ID
+		inbound.ReceivedAt = dbEmail.ReceivedAt
+		inbound.AuthUser = dbEmail.AuthUser
+		inbound.Recipient = dbEmail.Recipient
+		if dbEmail.EnvelopeFrom != "" || len(dbEmail.EnvelopeTo) > 0 {
+			inbound.Envelope = &email.Envelope{
+				MailFrom:   dbEmail.EnvelopeFrom,
+				RcptTo:     dbEmail.EnvelopeTo,
+				RemoteIP:   dbEmail.RemoteIP,
+				Helo:       dbEmail.Helo,
+				TLSVersion: dbEmail.TLSVersion,
+				TLSCipher:  dbEmail.TLSCipher,
+			}
+		}
+		if len(dbEmail.Headers) > 0 {
+			json.Unmarshal(dbEmail.Headers, &inbound.Headers)
+		}
+		if len(dbEmail.AuthResults) > 0 {
+			var auth email.AuthResults
+			if json.Unmarshal(dbEmail.AuthResults, &auth) == nil {
+				inbound.Auth = &auth
+			}
+		}
+		if len(dbEmail.SpamReport) > 0 {
+			var result email.SpamResult
+			if json.Unmarshal(dbEmail.SpamReport, &result) == nil {
+				inbound.Spam = &result
+			}
+		}
+
 		if err := p.Process(ctx, inbound); err != nil {
 			p.logger.Error().Err(err).Int64("email_id", dbEmail.ID).Msg("Failed to process pending email")
 		}
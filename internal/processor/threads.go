@@ -0,0 +1,140 @@
+package processor
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/extract"
+	"github.com/emitt/emitt/internal/storage"
+	"github.com/emitt/emitt/internal/tools"
+)
+
+// Thread history defaults for mailboxes that leave them unset
+const (
+	defaultThreadMessages = 10
+	defaultThreadChars    = 2000
+)
+
+// threadInbound adds an inbound email to its conversation thread within the
+// mailbox it was routed to. Replies whose references are unknown join a
+// recent thread with the same subject and sender.
+func (p *Processor) threadInbound(ctx context.Context, emailID int64, inbound *email.InboundEmail, mailbox string) {
+	msg := &storage.ThreadMessage{
+		EmailID:      &emailID,
+		Direction:    storage.ThreadDirectionInbound,
+		MessageID:    firstMessageID(inbound.MessageID),
+		From:         inbound.From.Address,
+		To:           inbound.GetToAddresses(),
+		Subject:      inbound.Subject,
+		CreatedAt:    inbound.ReceivedAt,
+		References:   inbound.ThreadReferences(),
+		SubjectKey:   email.NormalizeSubject(inbound.Subject),
+		MatchSubject: email.IsReplySubject(inbound.Subject),
+		Mailbox:      mailbox,
+	}
+	if err := p.store.AddThreadMessage(ctx, msg); err != nil {
+		p.logger.Warn().Err(err).Int64("email_id", emailID).Msg("Failed to thread email")
+		return
+	}
+	p.logger.Debug().Int64("email_id", emailID).Int64("thread_id", msg.ThreadID).Msg("Email threaded")
+}
+
+// RecordSent adds mail sent by the send_email tool to its thread in the
+// run's mailbox, so replies to it and later history include it
+func (p *Processor) RecordSent(ctx context.Context, outbound *email.OutboundEmail) {
+	var refs []string
+	for _, ref := range outbound.References {
+		refs = append(refs, email.ParseMessageIDs(ref)...)
+	}
+	refs = append(refs, email.ParseMessageIDs(outbound.InReplyTo)...)
+
+	var to []string
+	for _, addr := range append(append([]email.Address{}, outbound.To...), outbound.Cc...) {
+		to = append(to, addr.Address)
+	}
+
+	msg := &storage.ThreadMessage{
+		Direction:  storage.ThreadDirectionOutbound,
+		MessageID:  firstMessageID(outbound.MessageID),
+		From:       outbound.From.Address,
+		To:         to,
+		Subject:    outbound.Subject,
+		TextBody:   outbound.TextBody,
+		HTMLBody:   outbound.HTMLBody,
+		References: refs,
+		SubjectKey: email.NormalizeSubject(outbound.Subject),
+		Mailbox:    tools.RunFrom(ctx).Mailbox,
+	}
+	if err := p.store.AddThreadMessage(ctx, msg); err != nil {
+		p.logger.Warn().Err(err).Str("message_id", outbound.MessageID).Msg("Failed to thread sent email")
+	}
+}
+
+// addThreadHistory fills in the earlier messages of the email's thread
+func (p *Processor) addThreadHistory(ctx context.Context, emailID int64, inbound *email.InboundEmail, emailCtx *email.EmailContext, cfg *config.ProcessorConfig) {
+	if !cfg.Thread.History {
+		return
+	}
+
+	limit := cfg.Thread.MaxMessages
+	if limit == 0 {
+		limit = defaultThreadMessages
+	}
+	maxChars := cfg.Thread.MaxChars
+	if maxChars == 0 {
+		maxChars = defaultThreadChars
+	}
+
+	history, err := p.store.GetThreadHistory(ctx, emailID, limit)
+	if err != nil {
+		p.logger.Warn().Err(err).Int64("email_id", emailID).Msg("Failed to load thread history")
+		return
+	}
+
+	// Runs split from one delivery and redeliveries share a Message-ID
+	current := firstMessageID(inbound.MessageID)
+	seen := make(map[string]int)
+	for _, msg := range history {
+		if msg.MessageID != "" && msg.MessageID == current {
+			continue
+		}
+		output := ""
+		if cfg.Thread.LLMOutputs && msg.Direction == storage.ThreadDirectionInbound {
+			output, _ = extract.Truncate(strings.TrimSpace(msg.LLMOutput), maxChars)
+		}
+		if i, ok := seen[msg.MessageID]; ok && msg.MessageID != "" {
+			if emailCtx.Thread[i].LLMOutput == "" {
+				emailCtx.Thread[i].LLMOutput = output
+			}
+			continue
+		}
+
+		body := msg.TextBody
+		if strings.TrimSpace(body) == "" {
+			body = email.HTMLToText(msg.HTMLBody)
+		}
+		body, _ = extract.Truncate(strings.TrimSpace(email.StripReply(body)), maxChars)
+
+		seen[msg.MessageID] = len(emailCtx.Thread)
+		emailCtx.Thread = append(emailCtx.Thread, email.ThreadEntry{
+			Direction: msg.Direction,
+			From:      msg.From,
+			To:        msg.To,
+			Subject:   msg.Subject,
+			Date:      msg.CreatedAt.Format(time.RFC1123),
+			Body:      body,
+			LLMOutput: output,
+		})
+	}
+}
+
+// firstMessageID returns the bracketed Message-ID of a header value
+func firstMessageID(value string) string {
+	if ids := email.ParseMessageIDs(value); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
@@ -0,0 +1,81 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/emitt/emitt/internal/clamav"
+	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// SetVirusScanner enables scanning attachments for malware before routing
+func (p *Processor) SetVirusScanner(scanner *clamav.Client) {
+	p.virusScanner = scanner
+}
+
+// scanAttachments scans the email's stored attachments that have not been
+// scanned yet, or whose last scan failed, and tags each with its result. Runs
+// split from a delivery inherit the results of the whole message.
+func (p *Processor) scanAttachments(ctx context.Context, emailID int64, inbound *email.InboundEmail) {
+	rows, err := p.store.GetAttachments(ctx, emailID)
+	if err != nil {
+		p.logger.Warn().Err(err).Int64("email_id", emailID).Msg("Failed to load attachments for virus scan")
+		return
+	}
+
+	for _, row := range rows {
+		if row.ScanResult != "" && row.ScanResult != storage.ScanResultError {
+			continue
+		}
+		result, virus := p.scanAttachment(ctx, row)
+		if err := p.store.UpdateAttachmentScan(ctx, row.ID, result, virus); err != nil {
+			p.logger.Warn().Err(err).Str("filename", row.Filename).Msg("Failed to store virus scan result")
+		}
+		row.ScanResult, row.Virus = result, virus
+	}
+
+	for i := range inbound.Attachments {
+		att := &inbound.Attachments[i]
+		if row := matchAttachment(rows, i, att.Filename, att.Size, att.ContentID); row != nil {
+			att.Virus, att.ScanResult = row.Virus, row.ScanResult
+		}
+	}
+	if inbound.Infected() {
+		p.logger.Warn().
+			Int64("email_id", emailID).
+			Str("from", inbound.From.Address).
+			Msg("Infected attachment found")
+	}
+}
+
+// scanAttachment scans one attachment and returns its scan result and, when
+// infected, the malware signature
+func (p *Processor) scanAttachment(ctx context.Context, att *storage.Attachment) (string, string) {
+	rc, err := p.store.OpenAttachment(att)
+	if err != nil {
+		p.logger.Warn().Err(err).Str("filename", att.Filename).Msg("Failed to open attachment for virus scan")
+		return storage.ScanResultError, ""
+	}
+	defer rc.Close()
+
+	result, err := p.virusScanner.Scan(ctx, rc)
+	switch {
+	case errors.Is(err, clamav.ErrSizeLimit):
+		p.logger.Info().Str("filename", att.Filename).Int64("size", att.Size).Msg("Attachment too large to scan")
+		return storage.ScanResultSkipped, ""
+	case err != nil:
+		p.logger.Warn().Err(err).Str("filename", att.Filename).Msg("Virus scan failed")
+		return storage.ScanResultError, ""
+	case result.Infected:
+		p.logger.Warn().Str("filename", att.Filename).Str("virus", result.Signature).Msg("Attachment is infected")
+		return storage.ScanResultInfected, result.Signature
+	}
+	return storage.ScanResultClean, ""
+}
+
+// withheldError describes why an attachment's content is withheld
+func withheldError(att *storage.Attachment) string {
+	return fmt.Sprintf("withheld: %s", att.Withheld())
+}
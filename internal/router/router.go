@@ -8,16 +8,18 @@ import (
 
 	"github.com/emitt/emitt/internal/config"
 	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/tools"
 )
 
 // ProcessorType defines how an email should be processed
 type ProcessorType string
 
 const (
-	ProcessorTypeLLM     ProcessorType = "llm"
-	ProcessorTypeForward ProcessorType = "forward"
-	ProcessorTypeWebhook ProcessorType = "webhook"
-	ProcessorTypeNoop    ProcessorType = "noop"
+	ProcessorTypeLLM        ProcessorType = "llm"
+	ProcessorTypeForward    ProcessorType = "forward"
+	ProcessorTypeWebhook    ProcessorType = "webhook"
+	ProcessorTypeNoop       ProcessorType = "noop"
+	ProcessorTypeQuarantine ProcessorType = "quarantine" // Stored as quarantined and not processed
 )
 
 // RouteResult contains the routing decision for an email
@@ -25,6 +27,7 @@ type RouteResult struct {
 	MailboxName  string
 	ProcessorType ProcessorType
 	Config       *config.ProcessorConfig
+	Policy       *tools.OutboundPolicy
 }
 
 // Router routes incoming emails to the appropriate processor
@@ -79,9 +82,21 @@ func (r *Router) Route(ctx context.Context, e *email.InboundEmail) (*RouteResult
 		MailboxName:   rule.Name,
 		ProcessorType: procType,
 		Config:        rule.Processor,
+		Policy:        rule.Policy,
 	}, nil
 }
 
+// AcceptsRecipient reports whether any mailbox rule could match mail for rcpt.
+// It has the signature of smtp.RecipientValidator.
+func (r *Router) AcceptsRecipient(rcpt, authUser string) bool {
+	for _, rule := range r.rules.Rules() {
+		if rule.MayMatchRecipient(rcpt, authUser) {
+			return true
+		}
+	}
+	return false
+}
+
 // GetMailboxNames returns all configured mailbox names
 func (r *Router) GetMailboxNames() []string {
 	rules := r.rules.Rules()
@@ -0,0 +1,73 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+func newTestRouter(t *testing.T, mailboxes ...config.MailboxConfig) *Router {
+	t.Helper()
+	r, err := NewRouter(mailboxes, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	return r
+}
+
+func TestAcceptsRecipient(t *testing.T) {
+	r := newTestRouter(t,
+		config.MailboxConfig{Name: "support", Match: config.MatchConfig{To: `^support@example\.com$`}},
+		// Other conditions are unknown at RCPT time and do not reject
+		config.MailboxConfig{Name: "billing", Match: config.MatchConfig{To: `^billing@example\.com$`, Subject: "^Invoice"}},
+		config.MailboxConfig{Name: "relay", Match: config.MatchConfig{To: `@partner\.example$`, AuthUser: "^app$"}},
+	)
+
+	tests := []struct {
+		rcpt     string
+		authUser string
+		want     bool
+	}{
+		{"support@example.com", "", true},
+		{"billing@example.com", "", true},
+		{"sales@example.com", "", false},
+		{"ops@partner.example", "app", true},
+		{"ops@partner.example", "", false},
+		{"ops@partner.example", "other", false},
+	}
+	for _, tt := range tests {
+		if got := r.AcceptsRecipient(tt.rcpt, tt.authUser); got != tt.want {
+			t.Errorf("AcceptsRecipient(%q, %q) = %v, want %v", tt.rcpt, tt.authUser, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptsRecipientCatchAll(t *testing.T) {
+	tests := []struct {
+		name  string
+		match config.MatchConfig
+		want  bool
+	}{
+		{"no conditions", config.MatchConfig{}, true},
+		{"from only", config.MatchConfig{From: `@example\.org$`}, true},
+		{"domain", config.MatchConfig{To: `@example\.com$`}, true},
+		{"authenticated only", config.MatchConfig{AuthUser: ".+"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(t,
+				config.MailboxConfig{Name: "support", Match: config.MatchConfig{To: `^support@example\.com$`}},
+				config.MailboxConfig{Name: "catchall", Match: tt.match},
+			)
+			if got := r.AcceptsRecipient("anyone@example.com", ""); got != tt.want {
+				t.Errorf("AcceptsRecipient = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if r := newTestRouter(t); r.AcceptsRecipient("support@example.com", "") {
+		t.Error("a router without mailboxes accepted a recipient")
+	}
+}
@@ -1,8 +1,13 @@
 package router
 
 import (
+	"fmt"
+	"regexp"
+	"strings"
+
 	"github.com/emitt/emitt/internal/config"
 	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/tools"
 )
 
 // Rule represents a compiled routing rule
@@ -10,6 +15,7 @@ type Rule struct {
 	Name      string
 	Match     *config.CompiledMatch
 	Processor *config.ProcessorConfig
+	Policy    *tools.OutboundPolicy
 	Priority  int
 }
 
@@ -22,13 +28,18 @@ func (r *Rule) Matches(e *email.InboundEmail) bool {
 		}
 	}
 
-	// Check To pattern (match any recipient)
+	// Check To pattern (match any recipient, or only the envelope
+	// recipient of a per-recipient run)
 	if r.Match.To != nil {
 		matched := false
-		for _, to := range e.To {
-			if r.Match.To.MatchString(to.Address) {
-				matched = true
-				break
+		if e.Recipient != "" {
+			matched = r.Match.To.MatchString(e.Recipient)
+		} else {
+			for _, to := range e.To {
+				if r.Match.To.MatchString(to.Address) {
+					matched = true
+					break
+				}
 			}
 		}
 		if !matched {
@@ -43,6 +54,132 @@ func (r *Rule) Matches(e *email.InboundEmail) bool {
 		}
 	}
 
+	// Check the SMTP AUTH identity (unauthenticated mail has an empty identity)
+	if r.Match.AuthUser != nil {
+		if !r.Match.AuthUser.MatchString(e.AuthUser) {
+			return false
+		}
+	}
+
+	// Check spam score bounds
+	if r.Match.MinSpam != nil && (e.Spam == nil || e.Spam.Score < *r.Match.MinSpam) {
+		return false
+	}
+	if r.Match.MaxSpam != nil && e.Spam != nil && e.Spam.Score > *r.Match.MaxSpam {
+		return false
+	}
+
+	// Check header patterns (header names are case-insensitive)
+	for name, pattern := range r.Match.Headers {
+		if !pattern.MatchString(headerValue(e.Headers, name)) {
+			return false
+		}
+	}
+
+	// Check sender authentication results (unchecked mail matches nothing)
+	auth := e.Auth
+	if auth == nil {
+		auth = &email.AuthResults{}
+	}
+	authChecks := []struct {
+		pattern *regexp.Regexp
+		result  string
+	}{
+		{r.Match.SPF, auth.SPF},
+		{r.Match.DKIM, auth.DKIM},
+		{r.Match.DMARC, auth.DMARC},
+		{r.Match.ARC, auth.ARC},
+	}
+	for _, c := range authChecks {
+		if c.pattern != nil && !c.pattern.MatchString(c.result) {
+			return false
+		}
+	}
+
+	// Check the message signature (unsigned mail has status "none")
+	if r.Match.Signature != nil && !r.Match.Signature.MatchString(e.SignatureStatus()) {
+		return false
+	}
+	if r.Match.Signer != nil {
+		// Only the signer of a valid signature counts
+		signer := e.ValidSigner()
+		if signer == "" || !r.Match.Signer.MatchString(signer) {
+			return false
+		}
+	}
+
+	// Check the virus scan result
+	if r.Match.Infected != nil && e.Infected() != *r.Match.Infected {
+		return false
+	}
+
+	// Check attachments and attached messages
+	if r.Match.Attachment != nil && !anyAttachment(e, r.Match.Attachment) {
+		return false
+	}
+	if r.Match.AttachedFrom != nil || r.Match.AttachedSubject != nil {
+		if !anyAttachedMessage(e, r.Match.AttachedFrom, r.Match.AttachedSubject) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// anyAttachment reports whether an attachment of the email or of a message
+// attached to it has a matching filename
+func anyAttachment(e *email.InboundEmail, pattern *regexp.Regexp) bool {
+	for _, att := range e.Attachments {
+		if pattern.MatchString(att.Filename) {
+			return true
+		}
+	}
+	for _, attached := range e.AttachedMessages {
+		if anyAttachment(attached, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyAttachedMessage reports whether an attached message, at any depth,
+// matches both the from and subject patterns (nil matches anything)
+func anyAttachedMessage(e *email.InboundEmail, from, subject *regexp.Regexp) bool {
+	for _, attached := range e.AttachedMessages {
+		if (from == nil || from.MatchString(attached.From.Address)) &&
+			(subject == nil || subject.MatchString(attached.Subject)) {
+			return true
+		}
+		if anyAttachedMessage(attached, from, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerValue looks up a header by case-insensitive name
+func headerValue(headers map[string]string, name string) string {
+	if v, ok := headers[name]; ok {
+		return v
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// MayMatchRecipient reports whether mail for an envelope recipient could match
+// this rule. Only the To and AuthUser conditions are known at RCPT time; the
+// others are assumed to match.
+func (r *Rule) MayMatchRecipient(rcpt, authUser string) bool {
+	if r.Match.To != nil && !r.Match.To.MatchString(rcpt) {
+		return false
+	}
+	if r.Match.AuthUser != nil && !r.Match.AuthUser.MatchString(authUser) {
+		return false
+	}
 	return true
 }
 
@@ -63,10 +200,16 @@ func NewRuleSet(mailboxes []config.MailboxConfig) (*RuleSet, error) {
 			return nil, err
 		}
 
+		policy, err := tools.NewOutboundPolicy(&mb.Processor.Outbound)
+		if err != nil {
+			return nil, fmt.Errorf("mailbox %s: %w", mb.Name, err)
+		}
+
 		rule := &Rule{
 			Name:      mb.Name,
 			Match:     compiled,
 			Processor: &mailboxes[i].Processor,
+			Policy:    policy,
 			Priority:  i, // Earlier rules have higher priority
 		}
 		rs.rules = append(rs.rules, rule)
@@ -0,0 +1,327 @@
+// Package secmail decrypts S/MIME and PGP mail and verifies its signatures.
+// A Handler is set on the email parser with SetSecureMail.
+package secmail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"go.mozilla.org/pkcs7"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// defaultMaxSize caps decrypted and decompressed content, like the default
+// server max_message_bytes
+const defaultMaxSize = 25 * 1024 * 1024
+
+// oidEmailAddress is the PKCS #9 emailAddress attribute of older certificates
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// Handler holds the keys used to decrypt mail and the trust anchors used to
+// check signatures
+type Handler struct {
+	smimeCert *x509.Certificate
+	smimeKey  crypto.PrivateKey
+	roots     *x509.CertPool
+	pgpKeys   openpgp.EntityList // Our private keys and the trusted signers
+	maxSize   int64              // Largest input or opened content accepted
+}
+
+// NewHandler loads the configured S/MIME and PGP keys. Either may be left
+// unset; signatures are still checked against the system roots.
+func NewHandler(smime *config.SMIMEConfig, pgp *config.PGPConfig) (*Handler, error) {
+	h := &Handler{maxSize: defaultMaxSize}
+
+	if smime.Certificate != "" || smime.Key != "" {
+		pair, err := tls.LoadX509KeyPair(smime.Certificate, smime.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load S/MIME key: %w", err)
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse S/MIME certificate: %w", err)
+		}
+		h.smimeCert, h.smimeKey = cert, pair.PrivateKey
+	}
+
+	if smime.TrustedCAs != "" {
+		data, err := os.ReadFile(smime.TrustedCAs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read trusted CAs: %w", err)
+		}
+		h.roots = x509.NewCertPool()
+		if !h.roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", smime.TrustedCAs)
+		}
+	} else if roots, err := x509.SystemCertPool(); err == nil {
+		h.roots = roots
+	} else {
+		h.roots = x509.NewCertPool()
+	}
+
+	if pgp.PrivateKey != "" {
+		keys, err := readKeyRing(pgp.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		for _, entity := range keys {
+			if entity.PrivateKey == nil {
+				return nil, fmt.Errorf("%s holds a public key, not a private key", pgp.PrivateKey)
+			}
+			if pgp.Passphrase != "" {
+				if err := entity.DecryptPrivateKeys([]byte(pgp.Passphrase)); err != nil {
+					return nil, fmt.Errorf("failed to unlock PGP private key: %w", err)
+				}
+			}
+		}
+		h.pgpKeys = append(h.pgpKeys, keys...)
+	}
+	if pgp.PublicKeys != "" {
+		keys, err := readKeyRing(pgp.PublicKeys)
+		if err != nil {
+			return nil, err
+		}
+		h.pgpKeys = append(h.pgpKeys, keys...)
+	}
+
+	return h, nil
+}
+
+// SetMaxSize caps the size of the data opened and of the content it holds.
+// PGP messages can be compressed, so a small message could otherwise inflate
+// to gigabytes.
+func (h *Handler) SetMaxSize(n int64) {
+	if n > 0 {
+		h.maxSize = n
+	}
+}
+
+func readKeyRing(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PGP keys: %w", err)
+	}
+	defer f.Close()
+
+	keys, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PGP keys from %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// Open decrypts an encrypted part or unwraps opaque signed content
+func (h *Handler) Open(format string, data []byte, from string) (*email.Opened, error) {
+	if int64(len(data)) > h.maxSize {
+		return nil, fmt.Errorf("%s data exceeds %d bytes", format, h.maxSize)
+	}
+	switch format {
+	case email.FormatSMIME:
+		return h.openSMIME(data, from)
+	case email.FormatPGP:
+		return h.openPGP(data, from)
+	}
+	return nil, fmt.Errorf("unknown format: %s", format)
+}
+
+// Verify checks a detached multipart/signed signature
+func (h *Handler) Verify(format string, signed, signature []byte, from string) *email.Signature {
+	switch format {
+	case email.FormatSMIME:
+		p7, err := pkcs7.Parse(signature)
+		if err != nil {
+			return &email.Signature{Format: format, Status: email.SignatureInvalid, Error: err.Error()}
+		}
+		p7.Content = signed
+		return h.verifySMIME(p7, from)
+	case email.FormatPGP:
+		var signer *openpgp.Entity
+		var err error
+		if bytes.HasPrefix(bytes.TrimSpace(signature), []byte("-----BEGIN")) {
+			signer, err = openpgp.CheckArmoredDetachedSignature(h.pgpKeys, bytes.NewReader(signed), bytes.NewReader(signature), nil)
+		} else {
+			signer, err = openpgp.CheckDetachedSignature(h.pgpKeys, bytes.NewReader(signed), bytes.NewReader(signature), nil)
+		}
+		return pgpSignature(signer, err, from)
+	}
+	return &email.Signature{Format: format, Status: email.SignatureInvalid, Error: "unknown signature format"}
+}
+
+func (h *Handler) openSMIME(data []byte, from string) (*email.Opened, error) {
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse S/MIME data: %w", err)
+	}
+
+	if len(p7.Signers) > 0 {
+		return &email.Opened{Content: p7.Content, Signature: h.verifySMIME(p7, from)}, nil
+	}
+
+	if h.smimeCert == nil {
+		return nil, errors.New("no S/MIME key configured")
+	}
+	content, err := p7.Decrypt(h.smimeCert, h.smimeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt S/MIME data: %w", err)
+	}
+	return &email.Opened{Content: content, Encrypted: true}, nil
+}
+
+// verifySMIME checks the signature of a PKCS #7 signed-data object whose
+// content is set
+func (h *Handler) verifySMIME(p7 *pkcs7.PKCS7, from string) *email.Signature {
+	sig := &email.Signature{Format: email.FormatSMIME}
+
+	var addresses []string
+	cert := p7.GetOnlySigner()
+	if cert == nil && len(p7.Certificates) > 0 {
+		cert = p7.Certificates[0]
+	}
+	if cert != nil {
+		addresses = certAddresses(cert)
+		sig.Signer = pickAddress(addresses, from)
+		sig.SignerName = cert.Subject.CommonName
+		sum := sha256.Sum256(cert.Raw)
+		sig.Fingerprint = hex.EncodeToString(sum[:])
+	}
+
+	if err := p7.Verify(); err != nil {
+		sig.Status, sig.Error = email.SignatureInvalid, err.Error()
+		return sig
+	}
+	if err := p7.VerifyWithChain(h.roots); err != nil {
+		sig.Status, sig.Error = email.SignatureUntrusted, err.Error()
+		return sig
+	}
+	checkSigner(sig, addresses, from)
+	return sig
+}
+
+// certAddresses returns the email addresses a certificate is issued to
+func certAddresses(cert *x509.Certificate) []string {
+	addresses := append([]string{}, cert.EmailAddresses...)
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(oidEmailAddress) {
+			if addr, ok := name.Value.(string); ok {
+				addresses = append(addresses, addr)
+			}
+		}
+	}
+	return addresses
+}
+
+func (h *Handler) openPGP(data []byte, from string) (*email.Opened, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP SIGNED MESSAGE-----")) {
+		block, _ := clearsign.Decode(data)
+		if block == nil {
+			return nil, errors.New("failed to decode clear-signed message")
+		}
+		signer, err := block.VerifySignature(h.pgpKeys, nil)
+		return &email.Opened{Content: block.Plaintext, Signature: pgpSignature(signer, err, from)}, nil
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		block, err := armor.Decode(bytes.NewReader(bytes.TrimSpace(data)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode PGP armor: %w", err)
+		}
+		r = block.Body
+	}
+
+	md, err := openpgp.ReadMessage(r, h.pgpKeys, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt PGP message: %w", err)
+	}
+	content, err := io.ReadAll(io.LimitReader(md.UnverifiedBody, h.maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PGP message: %w", err)
+	}
+	if int64(len(content)) > h.maxSize {
+		return nil, fmt.Errorf("PGP message content exceeds %d bytes", h.maxSize)
+	}
+
+	opened := &email.Opened{Content: content, Encrypted: md.IsEncrypted}
+	if md.IsSigned {
+		var signer *openpgp.Entity
+		err := md.SignatureError
+		if md.SignedBy != nil {
+			signer = md.SignedBy.Entity
+		} else if err == nil {
+			err = pgperrors.ErrUnknownIssuer
+		}
+		opened.Signature = pgpSignature(signer, err, from)
+	}
+	return opened, nil
+}
+
+// pgpSignature describes the result of checking a PGP signature
+func pgpSignature(signer *openpgp.Entity, err error, from string) *email.Signature {
+	sig := &email.Signature{Format: email.FormatPGP}
+
+	var addresses []string
+	if signer != nil {
+		sig.Fingerprint = fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+		names := make(map[string]string)
+		for _, id := range signer.Identities {
+			if id.UserId != nil && id.UserId.Email != "" {
+				addresses = append(addresses, id.UserId.Email)
+				names[id.UserId.Email] = id.UserId.Name
+			}
+		}
+		sig.Signer = pickAddress(addresses, from)
+		sig.SignerName = names[sig.Signer]
+	}
+
+	switch {
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		sig.Status, sig.Error = email.SignatureUntrusted, "signed by an unknown key"
+	case err != nil:
+		sig.Status, sig.Error = email.SignatureInvalid, err.Error()
+	default:
+		checkSigner(sig, addresses, from)
+	}
+	return sig
+}
+
+// pickAddress returns the signer address matching the From address, or the
+// first one
+func pickAddress(addresses []string, from string) string {
+	for _, addr := range addresses {
+		if strings.EqualFold(addr, from) {
+			return addr
+		}
+	}
+	if len(addresses) > 0 {
+		return addresses[0]
+	}
+	return ""
+}
+
+// checkSigner marks an intact signature valid if it is by the From address
+func checkSigner(sig *email.Signature, addresses []string, from string) {
+	for _, addr := range addresses {
+		if strings.EqualFold(addr, from) {
+			sig.Status = email.SignatureValid
+			return
+		}
+	}
+	sig.Status = email.SignatureUntrusted
+	sig.Error = fmt.Sprintf("signer is not the sender %s", from)
+}
@@ -0,0 +1,362 @@
+package secmail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"go.mozilla.org/pkcs7"
+
+	"github.com/emitt/emitt/internal/email"
+)
+
+// testCert issues a certificate for addr, signed by parent or self-signed
+func testCert(t *testing.T, addr string, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: addr},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	} else {
+		tmpl.EmailAddresses = []string{addr}
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// smimeHandler returns a handler trusting a new CA, and a certificate for
+// alice@example.org issued by it
+func smimeHandler(t *testing.T) (*Handler, *x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	ca, caKey := testCert(t, "Test CA", nil, nil)
+	cert, key := testCert(t, "alice@example.org", ca, caKey)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return &Handler{roots: roots, maxSize: defaultMaxSize}, cert, key
+}
+
+func smimeSign(t *testing.T, content []byte, cert *x509.Certificate, key *rsa.PrivateKey, detached bool) []byte {
+	t.Helper()
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if detached {
+		sd.Detach()
+	}
+	der, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestVerifySMIMEDetached(t *testing.T) {
+	h, cert, key := smimeHandler(t)
+	content := []byte("Content-Type: text/plain\r\n\r\nPay invoice 42\r\n")
+	signature := smimeSign(t, content, cert, key, true)
+
+	sig := h.Verify(email.FormatSMIME, content, signature, "alice@example.org")
+	if sig.Status != email.SignatureValid || sig.Signer != "alice@example.org" || sig.Fingerprint == "" {
+		t.Errorf("signature = %+v, want valid by alice", sig)
+	}
+
+	sig = h.Verify(email.FormatSMIME, []byte("Content-Type: text/plain\r\n\r\nPay invoice 43\r\n"), signature, "alice@example.org")
+	if sig.Status != email.SignatureInvalid {
+		t.Errorf("signature over changed content = %+v, want invalid", sig)
+	}
+}
+
+func TestOpenSMIME(t *testing.T) {
+	h, cert, key := smimeHandler(t)
+	content := []byte("Content-Type: text/plain\r\n\r\nopaque\r\n")
+
+	// Opaque signed-data
+	opened, err := h.Open(email.FormatSMIME, smimeSign(t, content, cert, key, false), "alice@example.org")
+	if err != nil {
+		t.Fatalf("Open signed-data: %v", err)
+	}
+	if !bytes.Equal(opened.Content, content) || opened.Encrypted || opened.Signature.Status != email.SignatureValid {
+		t.Errorf("opened = %q encrypted %v signature %+v", opened.Content, opened.Encrypted, opened.Signature)
+	}
+
+	// Enveloped-data needs our key
+	encrypted, err := pkcs7.Encrypt(content, []*x509.Certificate{cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Open(email.FormatSMIME, encrypted, "bob@example.org"); err == nil {
+		t.Error("Open of encrypted data without a key succeeded")
+	}
+	h.smimeCert, h.smimeKey = cert, key
+	opened, err = h.Open(email.FormatSMIME, encrypted, "bob@example.org")
+	if err != nil {
+		t.Fatalf("Open enveloped-data: %v", err)
+	}
+	if !bytes.Equal(opened.Content, content) || !opened.Encrypted || opened.Signature != nil {
+		t.Errorf("opened = %q encrypted %v signature %+v", opened.Content, opened.Encrypted, opened.Signature)
+	}
+}
+
+func TestVerifySMIMEUntrusted(t *testing.T) {
+	h, cert, key := smimeHandler(t)
+	content := []byte("hello\r\n")
+	signature := smimeSign(t, content, cert, key, true)
+
+	// Intact, but by someone other than the sender
+	sig := h.Verify(email.FormatSMIME, content, signature, "mallory@example.org")
+	if sig.Status != email.SignatureUntrusted || !strings.Contains(sig.Error, "not the sender") {
+		t.Errorf("wrong signer = %+v, want untrusted", sig)
+	}
+
+	// Issued by a CA we do not trust
+	h.roots = x509.NewCertPool()
+	sig = h.Verify(email.FormatSMIME, content, signature, "alice@example.org")
+	if sig.Status != email.SignatureUntrusted || sig.Signer != "alice@example.org" {
+		t.Errorf("unknown issuer = %+v, want untrusted", sig)
+	}
+}
+
+// pgpEntity creates a key that accepts zlib compressed messages
+func pgpEntity(t *testing.T, name, addr string) *openpgp.Entity {
+	t.Helper()
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA, DefaultCompressionAlgo: packet.CompressionZLIB}
+	entity, err := openpgp.NewEntity(name, "", addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entity
+}
+
+// pgpEncrypt encrypts content to recipient, signed by signer if set, and
+// returns it armored
+func pgpEncrypt(t *testing.T, content []byte, recipient, signer *openpgp.Entity, config *packet.Config) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	aw, err := armor.Encode(&b, "PGP MESSAGE", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := openpgp.Encrypt(aw, []*openpgp.Entity{recipient}, signer, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(content)
+	w.Close()
+	aw.Close()
+	return b.Bytes()
+}
+
+func TestOpenPGPEncrypted(t *testing.T) {
+	alice := pgpEntity(t, "Alice", "alice@example.org")
+	bob := pgpEntity(t, "Bob", "bob@example.com")
+	h := &Handler{pgpKeys: openpgp.EntityList{bob, alice}, maxSize: defaultMaxSize}
+	content := []byte("Content-Type: text/plain\r\n\r\nsecret\r\n")
+
+	opened, err := h.Open(email.FormatPGP, pgpEncrypt(t, content, bob, nil, nil), "alice@example.org")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !bytes.Equal(opened.Content, content) || !opened.Encrypted || opened.Signature != nil {
+		t.Errorf("opened = %q encrypted %v signature %+v", opened.Content, opened.Encrypted, opened.Signature)
+	}
+
+	opened, err = h.Open(email.FormatPGP, pgpEncrypt(t, content, bob, alice, nil), "alice@example.org")
+	if err != nil {
+		t.Fatalf("Open signed: %v", err)
+	}
+	if sig := opened.Signature; sig == nil || sig.Status != email.SignatureValid || sig.Signer != "alice@example.org" || sig.SignerName != "Alice" {
+		t.Errorf("signature = %+v, want valid by alice", opened.Signature)
+	}
+
+	// Encrypted to a key we do not hold
+	carol := pgpEntity(t, "Carol", "carol@example.net")
+	if _, err := h.Open(email.FormatPGP, pgpEncrypt(t, content, carol, nil, nil), "alice@example.org"); err == nil {
+		t.Error("Open of a message for another key succeeded")
+	}
+}
+
+func TestVerifyPGPDetached(t *testing.T) {
+	alice := pgpEntity(t, "Alice", "alice@example.org")
+	mallory := pgpEntity(t, "Mallory", "mallory@example.org")
+	h := &Handler{pgpKeys: openpgp.EntityList{alice}, maxSize: defaultMaxSize}
+	content := []byte("Content-Type: text/plain\r\n\r\nsigned\r\n")
+
+	sign := func(signer *openpgp.Entity) []byte {
+		var b bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&b, signer, bytes.NewReader(content), nil); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	tests := []struct {
+		name      string
+		content   []byte
+		signature []byte
+		from      string
+		want      string
+	}{
+		{"valid", content, sign(alice), "alice@example.org", email.SignatureValid},
+		{"changed", []byte("tampered"), sign(alice), "alice@example.org", email.SignatureInvalid},
+		{"wrong signer", content, sign(alice), "ceo@example.org", email.SignatureUntrusted},
+		{"unknown issuer", content, sign(mallory), "mallory@example.org", email.SignatureUntrusted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sig := h.Verify(email.FormatPGP, tt.content, tt.signature, tt.from)
+			if sig.Status != tt.want {
+				t.Errorf("status = %s (%s), want %s", sig.Status, sig.Error, tt.want)
+			}
+		})
+	}
+}
+
+func clearSign(t *testing.T, text string, signer *openpgp.Entity) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := clearsign.Encode(&b, signer.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(text))
+	w.Close()
+	return b.Bytes()
+}
+
+func TestOpenPGPClearSigned(t *testing.T) {
+	alice := pgpEntity(t, "Alice", "alice@example.org")
+	h := &Handler{pgpKeys: openpgp.EntityList{alice}, maxSize: defaultMaxSize}
+	signed := clearSign(t, "Ship order 7\n", alice)
+
+	opened, err := h.Open(email.FormatPGP, signed, "alice@example.org")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if string(opened.Content) != "Ship order 7\n" || opened.Encrypted || opened.Signature.Status != email.SignatureValid {
+		t.Errorf("opened = %q encrypted %v signature %+v", opened.Content, opened.Encrypted, opened.Signature)
+	}
+
+	tampered := bytes.Replace(signed, []byte("order 7"), []byte("order 8"), 1)
+	opened, err = h.Open(email.FormatPGP, tampered, "alice@example.org")
+	if err != nil || opened.Signature.Status != email.SignatureInvalid {
+		t.Errorf("tampered = %+v, %v; want invalid", opened, err)
+	}
+
+	h.pgpKeys = nil
+	opened, err = h.Open(email.FormatPGP, signed, "alice@example.org")
+	if err != nil || opened.Signature.Status != email.SignatureUntrusted {
+		t.Errorf("unknown key = %+v, %v; want untrusted", opened, err)
+	}
+}
+
+func TestOpenPGPCompressionBomb(t *testing.T) {
+	bob := pgpEntity(t, "Bob", "bob@example.com")
+	h := &Handler{pgpKeys: openpgp.EntityList{bob}, maxSize: 1 << 20}
+
+	config := &packet.Config{DefaultCompressionAlgo: packet.CompressionZLIB, CompressionConfig: &packet.CompressionConfig{Level: 9}}
+	bomb := pgpEncrypt(t, make([]byte, 64<<20), bob, nil, config)
+	if len(bomb) > 1<<20 {
+		t.Fatalf("bomb is %d bytes, want it under the limit", len(bomb))
+	}
+	_, err := h.Open(email.FormatPGP, bomb, "")
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("Open of a compression bomb = %v, want the size limit", err)
+	}
+
+	// Input over the limit is refused before it is decoded
+	h.SetMaxSize(100)
+	if _, err := h.Open(email.FormatPGP, clearSign(t, strings.Repeat("x", 200), bob), ""); err == nil {
+		t.Error("Open of input over the limit succeeded")
+	}
+}
+
+// signedPart returns a PGP/MIME multipart/signed entity over content
+func signedPart(t *testing.T, content string, signer *openpgp.Entity) string {
+	t.Helper()
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, signer, strings.NewReader(content), nil); err != nil {
+		t.Fatal(err)
+	}
+	return "Content-Type: multipart/signed; protocol=\"application/pgp-signature\"; boundary=\"sig\"\r\n\r\n" +
+		"--sig\r\n" + content + "\r\n--sig\r\n" +
+		"Content-Type: application/pgp-signature\r\n\r\n" + sig.String() + "\r\n--sig--\r\n"
+}
+
+func TestParsePartiallySigned(t *testing.T) {
+	alice := pgpEntity(t, "Alice", "alice@example.org")
+	h := &Handler{pgpKeys: openpgp.EntityList{alice}, maxSize: defaultMaxSize}
+	p := email.NewParser()
+	p.SetSecureMail(h)
+
+	header := "From: alice@example.org\r\nTo: bob@example.com\r\nSubject: order\r\n"
+	signed := signedPart(t, "Content-Type: text/plain\r\n\r\nOld, genuinely signed text", alice)
+	mixed := func(parts ...string) string {
+		body := "Content-Type: multipart/mixed; boundary=\"mix\"\r\n\r\n"
+		for _, part := range parts {
+			body += "--mix\r\n" + part + "\r\n"
+		}
+		return body + "--mix--\r\n"
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"signed root", signed, email.SignatureValid},
+		{"only part", mixed(signed), email.SignatureValid},
+		{"unsigned text beside", mixed("Content-Type: text/plain\r\n\r\nWire the money to me", signed), email.SignaturePartial},
+		{"unsigned attachment beside", mixed(signed, "Content-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"a.pdf\"\r\n\r\n%PDF"), email.SignaturePartial},
+		{"two signed parts", mixed(signed, signed), email.SignaturePartial},
+		{"clear-signed root", "Content-Type: text/plain\r\n\r\n" + string(clearSign(t, "Ship order 7\n", alice)), email.SignatureValid},
+		{"clear-signed beside", mixed("Content-Type: text/plain\r\n\r\n"+string(clearSign(t, "Ship order 7\n", alice)), "Content-Type: text/plain\r\n\r\nand also order 8"), email.SignaturePartial},
+		{"unsigned", "Content-Type: text/plain\r\n\r\nhello", email.SignatureNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := p.Parse([]byte(header + tt.body))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if got := e.SignatureStatus(); got != tt.want {
+				t.Errorf("status = %s, want %s", got, tt.want)
+			}
+			if tt.want != email.SignatureValid && e.ValidSigner() != "" {
+				t.Errorf("ValidSigner = %q, want none", e.ValidSigner())
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// ErrInvalidCredentials is returned when a username or password does not match
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// dummyHash is compared against for unknown users so lookups take the same time
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("emitt-unknown-user"), bcrypt.DefaultCost)
+	return hash
+})
+
+// Authenticator checks SMTP AUTH credentials
+type Authenticator interface {
+	Authenticate(ctx context.Context, username, password string) error
+}
+
+// ConfigAuthenticator checks credentials against users listed in the config file
+type ConfigAuthenticator struct {
+	users map[string]string // username -> bcrypt hash
+}
+
+// NewConfigAuthenticator creates an authenticator from configured users
+func NewConfigAuthenticator(users []config.SMTPUserConfig) (*ConfigAuthenticator, error) {
+	a := &ConfigAuthenticator{users: make(map[string]string, len(users))}
+	for _, u := range users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("smtp auth user without username")
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("smtp auth user %s: password_hash is not a bcrypt hash", u.Username)
+		}
+		a.users[strings.ToLower(u.Username)] = u.PasswordHash
+	}
+	return a, nil
+}
+
+// Authenticate implements Authenticator
+func (a *ConfigAuthenticator) Authenticate(_ context.Context, username, password string) error {
+	hash, ok := a.users[strings.ToLower(username)]
+	return checkPassword(hash, ok, password)
+}
+
+// StoreAuthenticator checks credentials against the smtp_users table
+type StoreAuthenticator struct {
+	store *storage.Store
+}
+
+// NewStoreAuthenticator creates an authenticator backed by the SQLite store
+func NewStoreAuthenticator(store *storage.Store) *StoreAuthenticator {
+	return &StoreAuthenticator{store: store}
+}
+
+// Authenticate implements Authenticator
+func (a *StoreAuthenticator) Authenticate(ctx context.Context, username, password string) error {
+	user, err := a.store.GetSMTPUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return checkPassword("", false, password)
+	}
+	return checkPassword(user.PasswordHash, true, password)
+}
+
+// HashPassword returns a bcrypt hash suitable for password_hash or SaveSMTPUser
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// checkPassword compares a password with a hash, doing equal work for unknown users
+func checkPassword(hash string, known bool, password string) error {
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// serveTestServer serves the first listener of cfg on a local port and
+// returns its address
+func serveTestServer(t *testing.T, cfg *config.ServerConfig) (*Server, string) {
+	t.Helper()
+	s := NewServer(cfg, nil, zerolog.Nop())
+	if len(s.listeners) == 0 {
+		t.Fatal("listener was not configured")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.listeners[0].server.Serve(ln)
+	t.Cleanup(func() { s.listeners[0].server.Close() })
+	return s, ln.Addr().String()
+}
+
+// authTestConfig has a STARTTLS submission listener that requires AUTH
+func authTestConfig(t *testing.T, users []config.SMTPUserConfig) *config.ServerConfig {
+	t.Helper()
+	certFile, keyFile := writeTestCert(t)
+	return &config.ServerConfig{
+		Hostname: "mx.test",
+		TLS:      config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile},
+		SMTPAuth: config.SMTPAuthConfig{Users: users},
+		Listeners: []config.ListenerConfig{{
+			Name:           "submission",
+			TLSMode:        config.TLSModeSTARTTLS,
+			RequireAuth:    true,
+			AllowedDomains: []string{"mx.test"},
+		}},
+	}
+}
+
+func hashTestPassword(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := HashPassword(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// dialTLS opens a session and upgrades it with STARTTLS
+func dialTLS(t *testing.T, addr string) *netsmtp.Client {
+	t.Helper()
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("client.test"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("STARTTLS: %v", err)
+	}
+	return c
+}
+
+// wantCode checks that a command failed with an SMTP reply code
+func wantCode(t *testing.T, what string, err error, code int) {
+	t.Helper()
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != code {
+		t.Errorf("%s = %v, want %d", what, err, code)
+	}
+}
+
+// checkSubmission authenticates as relay, covering the refusals on the way
+func checkSubmission(t *testing.T, addr string) {
+	t.Helper()
+
+	// net/smtp quits after a failed AUTH, so each attempt has its own session
+	for _, bad := range []struct{ what, identity, username, password string }{
+		{"AUTH with a wrong password", "", "relay", "wrong"},
+		{"AUTH as an unknown user", "", "nobody", "secret"},
+		{"AUTH for another identity", "admin", "relay", "secret"},
+	} {
+		c := dialTLS(t, addr)
+		wantCode(t, bad.what, c.Auth(netsmtp.PlainAuth(bad.identity, bad.username, bad.password, "127.0.0.1")), 535)
+	}
+
+	c := dialTLS(t, addr)
+	wantCode(t, "MAIL before AUTH", c.Mail("relay@mx.test"), 530)
+	if err := c.Auth(netsmtp.PlainAuth("", "Relay", "secret", "127.0.0.1")); err != nil {
+		t.Fatalf("AUTH: %v", err)
+	}
+	if err := c.Mail("relay@mx.test"); err != nil {
+		t.Fatalf("MAIL after AUTH: %v", err)
+	}
+	// Authenticated clients may relay beyond the allowed domains
+	if err := c.Rcpt("bob@example.org"); err != nil {
+		t.Errorf("RCPT to another domain after AUTH: %v", err)
+	}
+}
+
+func TestAuthConfigBackend(t *testing.T) {
+	cfg := authTestConfig(t, []config.SMTPUserConfig{{Username: "relay", PasswordHash: hashTestPassword(t, "secret")}})
+	_, addr := serveTestServer(t, cfg)
+	checkSubmission(t, addr)
+}
+
+func TestAuthStoreBackend(t *testing.T) {
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "emitt.db"))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	defer store.Close()
+	if err := store.SaveSMTPUser(context.Background(), "relay", hashTestPassword(t, "secret")); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := authTestConfig(t, nil)
+	cfg.SMTPAuth.Backend = "sqlite"
+	s, addr := serveTestServer(t, cfg)
+
+	// Without a backend AUTH is not offered at all
+	c := dialTLS(t, addr)
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH advertised before the store was attached")
+	}
+	wantCode(t, "MAIL without a backend", c.Mail("relay@mx.test"), 530)
+
+	s.SetAuthenticator(NewStoreAuthenticator(store))
+	checkSubmission(t, addr)
+}
+
+func TestAuthRequiresTLS(t *testing.T) {
+	plain := base64.StdEncoding.EncodeToString([]byte("\x00relay\x00secret"))
+	users := []config.SMTPUserConfig{{Username: "relay", PasswordHash: hashTestPassword(t, "secret")}}
+
+	tests := []struct {
+		name          string
+		allowInsecure bool
+		want          int
+	}{
+		{"refused", false, 523},
+		{"allow_insecure", true, 235},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ServerConfig{
+				Hostname:  "mx.test",
+				SMTPAuth:  config.SMTPAuthConfig{Users: users, AllowInsecure: tt.allowInsecure},
+				Listeners: []config.ListenerConfig{{Name: "submission", TLSMode: config.TLSModeNone, RequireAuth: true}},
+			}
+			_, addr := serveTestServer(t, cfg)
+
+			c, err := netsmtp.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if err := c.Hello("client.test"); err != nil {
+				t.Fatalf("EHLO: %v", err)
+			}
+			if ok, _ := c.Extension("AUTH"); ok != tt.allowInsecure {
+				t.Errorf("AUTH advertised = %v over plaintext", ok)
+			}
+
+			// Send the credentials regardless, as a careless client would
+			id, err := c.Text.Cmd("AUTH PLAIN %s", plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Text.StartResponse(id)
+			code, msg, _ := c.Text.ReadResponse(0)
+			c.Text.EndResponse(id)
+			if code != tt.want {
+				t.Errorf("AUTH over plaintext = %d %s, want %d", code, msg, tt.want)
+			}
+			if tt.want != 235 {
+				wantCode(t, "MAIL after refused AUTH", c.Mail("relay@mx.test"), 530)
+			}
+		})
+	}
+}
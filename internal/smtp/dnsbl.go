@@ -0,0 +1,100 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DNSBLHeader is added to received mail with the blocklist result: "none", or
+// the listing zones and return codes ("zen.spamhaus.org=127.0.0.2")
+const DNSBLHeader = "X-DNSBL"
+
+// RejectDNSBL is the rejection reason for listed clients
+const RejectDNSBL = "dnsbl"
+
+// DNSBLResolver is the DNS interface used for blocklist queries. *net.Resolver
+// satisfies it.
+type DNSBLResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// dnsblListing is a positive answer from one zone
+type dnsblListing struct {
+	zone  string
+	codes []string
+}
+
+// checkDNSBL queries all zones in parallel and returns the zones listing ip
+func checkDNSBL(ctx context.Context, resolver DNSBLResolver, zones []string, ip net.IP) []dnsblListing {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		listings []dnsblListing
+	)
+
+	for _, zone := range zones {
+		wg.Add(1)
+		go func(zone string) {
+			defer wg.Done()
+
+			addrs, err := resolver.LookupHost(ctx, dnsblQuery(ip, zone))
+			if err != nil {
+				return // NXDOMAIN means not listed; other errors are treated the same
+			}
+
+			// Only 127.0.0.0/8 answers are listings; 127.255.255.0/24 signals a
+			// refused or rate limited query (Spamhaus and others)
+			var codes []string
+			for _, a := range addrs {
+				parsed := net.ParseIP(a).To4()
+				if parsed == nil || parsed[0] != 127 || (parsed[1] == 255 && parsed[2] == 255) {
+					continue
+				}
+				codes = append(codes, a)
+			}
+			if len(codes) == 0 {
+				return
+			}
+
+			sort.Strings(codes)
+			mu.Lock()
+			listings = append(listings, dnsblListing{zone: zone, codes: codes})
+			mu.Unlock()
+		}(zone)
+	}
+	wg.Wait()
+
+	sort.Slice(listings, func(i, j int) bool { return listings[i].zone < listings[j].zone })
+	return listings
+}
+
+// dnsblQuery builds the query name: reversed octets for IPv4, reversed nibbles for IPv6
+func dnsblQuery(ip net.IP, zone string) string {
+	zone = strings.TrimSuffix(zone, ".")
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], zone)
+	}
+
+	ip16 := ip.To16()
+	var b strings.Builder
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip16[i]&0xf, ip16[i]>>4)
+	}
+	return b.String() + zone
+}
+
+// formatDNSBL renders listings as the X-DNSBL header value
+func formatDNSBL(listings []dnsblListing) string {
+	if len(listings) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(listings))
+	for i, l := range listings {
+		parts[i] = l.zone + "=" + strings.Join(l.codes, ",")
+	}
+	return strings.Join(parts, "; ")
+}
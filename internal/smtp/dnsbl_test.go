@@ -0,0 +1,163 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	netsmtp "net/smtp"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+// countingResolver lists every client and counts the queries it answers
+type countingResolver struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (r *countingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queries = append(r.queries, host)
+	return []string{"127.0.0.2"}, nil
+}
+
+func (r *countingResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.queries)
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1
+func writeTestCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// startTestServer serves a STARTTLS listener on a local port and returns its address
+func startTestServer(t *testing.T, protection config.ProtectionConfig, resolver DNSBLResolver) (*Server, string) {
+	t.Helper()
+	certFile, keyFile := writeTestCert(t)
+	cfg := &config.ServerConfig{
+		Hostname:   "mx.test",
+		TLS:        config.TLSConfig{Enabled: true, CertFile: certFile, KeyFile: keyFile},
+		DNSBL:      config.DNSBLConfig{Zones: []string{"bl.test"}, Action: "tag", Timeout: time.Second},
+		Protection: protection,
+		Listeners:  []config.ListenerConfig{{Name: "mx", TLSMode: config.TLSModeSTARTTLS}},
+	}
+	s, addr := serveTestServer(t, cfg)
+	s.SetDNSBLResolver(resolver)
+	return s, addr
+}
+
+func TestDNSBLCarriedAcrossSTARTTLS(t *testing.T) {
+	resolver := &countingResolver{}
+	s, addr := startTestServer(t, config.ProtectionConfig{}, resolver)
+
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.test"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("STARTTLS: %v", err)
+	}
+	if err := c.Mail("a@client.test"); err != nil {
+		t.Fatalf("MAIL after STARTTLS: %v", err)
+	}
+	c.Quit()
+
+	if n := resolver.count(); n != 1 {
+		t.Errorf("DNSBL queried %d times, want once per connection", n)
+	}
+	s.mu.Lock()
+	kept := len(s.renewals)
+	s.mu.Unlock()
+	if kept != 0 {
+		t.Errorf("%d DNSBL results kept after the connection closed", kept)
+	}
+}
+
+func TestDNSBLSkippedForGuardRejections(t *testing.T) {
+	resolver := &countingResolver{}
+	s, addr := startTestServer(t, config.ProtectionConfig{DenyCIDRs: []string{"127.0.0.0/8"}}, resolver)
+
+	c, err := netsmtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.test"); err == nil {
+		t.Fatal("EHLO from a denied client succeeded")
+	}
+
+	if n := resolver.count(); n != 0 {
+		t.Errorf("DNSBL queried %d times for a denied client", n)
+	}
+	// net/smtp retries a refused EHLO with HELO, so each attempt opens a session
+	if counts := s.RejectionCounts(); counts[RejectDenied] == 0 || counts[RejectDNSBL] != 0 {
+		t.Errorf("rejections = %v", counts)
+	}
+}
+
+func TestDNSBLRejectReleasesSession(t *testing.T) {
+	resolver := &countingResolver{}
+	s, addr := startTestServer(t, config.ProtectionConfig{MaxSessionsPerIP: 1}, resolver)
+	s.cfg.DNSBL.Action = "reject"
+
+	for i := 0; i < 2; i++ {
+		c, err := netsmtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("client.test"); err == nil { // EHLO, then HELO
+			t.Fatal("EHLO from a listed client succeeded")
+		}
+		c.Close()
+	}
+
+	// Every attempt is refused for the listing, not for a session leaked by
+	// an earlier one
+	if counts := s.RejectionCounts(); counts[RejectDNSBL] != 4 || counts[RejectSessionsIP] != 0 {
+		t.Errorf("rejections = %v", counts)
+	}
+}
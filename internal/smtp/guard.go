@@ -0,0 +1,330 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// Rejection reasons counted by the guard
+const (
+	RejectDenied      = "denied"
+	RejectSessions    = "max_sessions"
+	RejectSessionsIP  = "max_sessions_per_ip"
+	RejectConnections = "connection_rate"
+	RejectMessages    = "message_rate"
+	RejectGreylisted  = "greylisted"
+)
+
+var (
+	errAccessDenied = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Access denied",
+	}
+	errTooManySessions = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many connections, try again later",
+	}
+	errMessageRate = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Message rate limit exceeded, try again later",
+	}
+	errGreylisted = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Greylisted, please try again later",
+	}
+)
+
+// guard enforces connection-level limits for all listeners of a Server
+type guard struct {
+	cfg   *config.ProtectionConfig
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	now   func() time.Time
+
+	mu          sync.Mutex
+	sessions    map[string]int
+	total       int
+	connections map[string][]time.Time
+	messages    map[string][]time.Time
+	rejections  map[string]int64
+}
+
+// newGuard parses the CIDR lists of a protection config
+func newGuard(cfg *config.ProtectionConfig) (*guard, error) {
+	g := &guard{
+		cfg:         cfg,
+		now:         time.Now,
+		sessions:    make(map[string]int),
+		connections: make(map[string][]time.Time),
+		messages:    make(map[string][]time.Time),
+		rejections:  make(map[string]int64),
+	}
+
+	var err error
+	if g.allow, err = parseCIDRs(cfg.AllowCIDRs); err != nil {
+		return nil, fmt.Errorf("allow_cidrs: %w", err)
+	}
+	if g.deny, err = parseCIDRs(cfg.DenyCIDRs); err != nil {
+		return nil, fmt.Errorf("deny_cidrs: %w", err)
+	}
+	return g, nil
+}
+
+// parseCIDRs parses networks, accepting bare addresses as single hosts
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP reports whether any network contains ip
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// trusted reports whether ip is on the allow list
+func (g *guard) trusted(ip net.IP) bool {
+	return ip != nil && containsIP(g.allow, ip)
+}
+
+// openSession admits a new session from ip. countConnection is false when the
+// session is renewed on the same connection after STARTTLS.
+func (g *guard) openSession(ip net.IP, countConnection bool) (string, error) {
+	if ip == nil || g.trusted(ip) {
+		g.mu.Lock()
+		g.total++
+		g.mu.Unlock()
+		return "", nil
+	}
+	if containsIP(g.deny, ip) {
+		return g.reject(RejectDenied, errAccessDenied)
+	}
+
+	key := ip.String()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.cfg.MaxSessions > 0 && g.total >= g.cfg.MaxSessions {
+		return g.rejectLocked(RejectSessions, errTooManySessions)
+	}
+	if g.cfg.MaxSessionsPerIP > 0 && g.sessions[key] >= g.cfg.MaxSessionsPerIP {
+		return g.rejectLocked(RejectSessionsIP, errTooManySessions)
+	}
+	if countConnection && g.cfg.MaxConnectionsPerIPPerMinute > 0 {
+		now := g.now()
+		times := pruneBefore(g.connections[key], now.Add(-time.Minute))
+		if len(times) >= g.cfg.MaxConnectionsPerIPPerMinute {
+			g.connections[key] = times
+			return g.rejectLocked(RejectConnections, errTooManySessions)
+		}
+		g.connections[key] = append(times, now)
+	}
+
+	g.total++
+	g.sessions[key]++
+	return "", nil
+}
+
+// closeSession releases a session admitted by openSession
+func (g *guard) closeSession(ip net.IP) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.total--
+	if ip == nil || g.trusted(ip) {
+		return
+	}
+	key := ip.String()
+	if g.sessions[key] <= 1 {
+		delete(g.sessions, key)
+	} else {
+		g.sessions[key]--
+	}
+}
+
+// checkMessage enforces the per-IP message rate before a transaction starts
+func (g *guard) checkMessage(ip net.IP) (string, error) {
+	if g.cfg.MaxMessagesPerIPPerHour <= 0 || ip == nil || g.trusted(ip) {
+		return "", nil
+	}
+
+	key := ip.String()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	times := pruneBefore(g.messages[key], g.now().Add(-time.Hour))
+	if len(times) == 0 {
+		delete(g.messages, key)
+	} else {
+		g.messages[key] = times
+	}
+	if len(times) >= g.cfg.MaxMessagesPerIPPerHour {
+		return g.rejectLocked(RejectMessages, errMessageRate)
+	}
+	return "", nil
+}
+
+// recordMessage counts an accepted message against the per-IP rate
+func (g *guard) recordMessage(ip net.IP) {
+	if g.cfg.MaxMessagesPerIPPerHour <= 0 || ip == nil || g.trusted(ip) {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	key := ip.String()
+	g.messages[key] = append(g.messages[key], g.now())
+}
+
+// reject counts a rejection and returns its reason and SMTP error
+func (g *guard) reject(reason string, err error) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rejectLocked(reason, err)
+}
+
+func (g *guard) rejectLocked(reason string, err error) (string, error) {
+	g.rejections[reason]++
+	return reason, err
+}
+
+// counts returns a copy of the rejection counters
+func (g *guard) counts() map[string]int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	counts := make(map[string]int64, len(g.rejections))
+	for k, v := range g.rejections {
+		counts[k] = v
+	}
+	return counts
+}
+
+// sweep drops rate-limit history older than the longest window
+func (g *guard) sweep() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := g.now()
+	for key, times := range g.connections {
+		if times = pruneBefore(times, now.Add(-time.Minute)); len(times) == 0 {
+			delete(g.connections, key)
+		} else {
+			g.connections[key] = times
+		}
+	}
+	for key, times := range g.messages {
+		if times = pruneBefore(times, now.Add(-time.Hour)); len(times) == 0 {
+			delete(g.messages, key)
+		} else {
+			g.messages[key] = times
+		}
+	}
+}
+
+// greylist checks a (client network, sender, recipient) triplet. The first
+// attempt and retries within the delay are deferred with a 451.
+func (g *guard) greylist(ctx context.Context, store *storage.Store, ip net.IP, sender, rcpt string) (string, error) {
+	cfg := g.cfg.Greylisting
+	if !cfg.Enabled || store == nil || ip == nil || g.trusted(ip) {
+		return "", nil
+	}
+
+	clientNet := greylistNet(ip)
+	sender = strings.ToLower(sender)
+	rcpt = strings.ToLower(rcpt)
+	now := g.now()
+
+	entry, err := store.GetGreylistEntry(ctx, clientNet, sender, rcpt)
+	if err != nil {
+		// Fail open rather than defer all mail on a storage error
+		return "", err
+	}
+
+	switch {
+	case entry == nil,
+		entry.PassedAt == nil && now.Sub(entry.FirstSeen) > cfg.Window,
+		entry.PassedAt != nil && now.Sub(entry.LastSeen) > cfg.Lifetime:
+		entry = &storage.GreylistEntry{
+			ClientNet: clientNet,
+			Sender:    sender,
+			Recipient: rcpt,
+			FirstSeen: now,
+		}
+	case entry.PassedAt == nil && now.Sub(entry.FirstSeen) >= cfg.Delay:
+		entry.PassedAt = &now
+	}
+
+	entry.LastSeen = now
+	entry.Attempts++
+	if err := store.SaveGreylistEntry(ctx, entry); err != nil {
+		return "", err
+	}
+
+	if entry.PassedAt == nil {
+		return g.reject(RejectGreylisted, errGreylisted)
+	}
+	return "", nil
+}
+
+// greylistNet groups client addresses so retries from a sending pool match
+func greylistNet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// pruneBefore drops timestamps older than the cutoff
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
+
+// remoteIP returns the client address of a connection
+func remoteIP(conn *smtp.Conn) net.IP {
+	if conn == nil {
+		return nil
+	}
+	if addr, ok := conn.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
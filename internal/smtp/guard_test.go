@@ -0,0 +1,234 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// testClock is a settable clock for the guard
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time          { return c.t }
+func (c *testClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestGuard(t *testing.T, cfg *config.ProtectionConfig) (*guard, *testClock) {
+	t.Helper()
+	g, err := newGuard(cfg)
+	if err != nil {
+		t.Fatalf("newGuard: %v", err)
+	}
+	clock := &testClock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	g.now = clock.now
+	return g, clock
+}
+
+func wantReason(t *testing.T, what, reason string, err error, want string) {
+	t.Helper()
+	if reason != want {
+		t.Errorf("%s: reason = %q (%v), want %q", what, reason, err, want)
+	}
+	if (want == "") != (err == nil) {
+		t.Errorf("%s: err = %v, want rejection %v", what, err, want != "")
+	}
+}
+
+func TestGuardCIDRs(t *testing.T) {
+	g, _ := newTestGuard(t, &config.ProtectionConfig{
+		AllowCIDRs:       []string{"10.0.0.0/8", "2001:db8:1::1"},
+		DenyCIDRs:        []string{"192.0.2.0/24", "10.1.2.3", "2001:db8::/32"},
+		MaxSessionsPerIP: 1,
+	})
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"198.51.100.1", ""},
+		{"192.0.2.77", RejectDenied},
+		{"2001:db8:ffff::1", RejectDenied},
+		{"10.1.2.3", ""},      // The allow list wins over the deny list
+		{"2001:db8:1::1", ""}, // A bare address is a single host
+	}
+	for _, tt := range tests {
+		reason, err := g.openSession(net.ParseIP(tt.ip), true)
+		wantReason(t, tt.ip, reason, err, tt.want)
+	}
+
+	// Trusted clients are exempt from the per-IP limit
+	for i := 0; i < 3; i++ {
+		reason, err := g.openSession(net.ParseIP("10.9.9.9"), true)
+		wantReason(t, "trusted session", reason, err, "")
+	}
+
+	if counts := g.counts(); counts[RejectDenied] != 2 {
+		t.Errorf("denied count = %d, want 2", counts[RejectDenied])
+	}
+
+	if _, err := newGuard(&config.ProtectionConfig{DenyCIDRs: []string{"not-an-ip"}}); err == nil {
+		t.Error("invalid deny_cidrs accepted")
+	}
+}
+
+func TestGuardSessionLimits(t *testing.T) {
+	g, _ := newTestGuard(t, &config.ProtectionConfig{MaxSessions: 3, MaxSessionsPerIP: 2})
+	a, b, c := net.ParseIP("198.51.100.1"), net.ParseIP("198.51.100.2"), net.ParseIP("198.51.100.3")
+
+	for i := 0; i < 2; i++ {
+		reason, err := g.openSession(a, true)
+		wantReason(t, "session from a", reason, err, "")
+	}
+	reason, err := g.openSession(a, true)
+	wantReason(t, "third session from a", reason, err, RejectSessionsIP)
+
+	reason, err = g.openSession(b, true)
+	wantReason(t, "session from b", reason, err, "")
+	reason, err = g.openSession(c, true)
+	wantReason(t, "session over the total", reason, err, RejectSessions)
+
+	// Closing a session frees both limits
+	g.closeSession(a)
+	reason, err = g.openSession(c, true)
+	wantReason(t, "session after close", reason, err, "")
+	reason, err = g.openSession(a, true)
+	wantReason(t, "a over the total", reason, err, RejectSessions)
+
+	g.closeSession(a)
+	g.closeSession(b)
+	g.closeSession(c)
+	if g.total != 0 || len(g.sessions) != 0 {
+		t.Errorf("total = %d, sessions = %v after closing all", g.total, g.sessions)
+	}
+}
+
+func TestGuardConnectionRate(t *testing.T) {
+	g, clock := newTestGuard(t, &config.ProtectionConfig{MaxConnectionsPerIPPerMinute: 2})
+	ip := net.ParseIP("198.51.100.1")
+
+	for i := 0; i < 2; i++ {
+		reason, err := g.openSession(ip, true)
+		wantReason(t, "connection", reason, err, "")
+		g.closeSession(ip)
+		clock.advance(10 * time.Second)
+	}
+	reason, err := g.openSession(ip, true)
+	wantReason(t, "third connection in a minute", reason, err, RejectConnections)
+
+	// A session renewed after STARTTLS is not a new connection
+	reason, err = g.openSession(ip, false)
+	wantReason(t, "renewed session", reason, err, "")
+	g.closeSession(ip)
+
+	// Another client has its own budget
+	reason, err = g.openSession(net.ParseIP("198.51.100.2"), true)
+	wantReason(t, "other client", reason, err, "")
+
+	clock.advance(41 * time.Second) // The first connection is now over a minute old
+	reason, err = g.openSession(ip, true)
+	wantReason(t, "connection after the window", reason, err, "")
+}
+
+func TestGuardMessageRate(t *testing.T) {
+	g, clock := newTestGuard(t, &config.ProtectionConfig{
+		AllowCIDRs:              []string{"10.0.0.0/8"},
+		MaxMessagesPerIPPerHour: 2,
+	})
+	ip := net.ParseIP("198.51.100.1")
+
+	for i := 0; i < 2; i++ {
+		reason, err := g.checkMessage(ip)
+		wantReason(t, "message", reason, err, "")
+		g.recordMessage(ip)
+		clock.advance(20 * time.Minute)
+	}
+	reason, err := g.checkMessage(ip)
+	wantReason(t, "third message in an hour", reason, err, RejectMessages)
+
+	trusted := net.ParseIP("10.0.0.1")
+	for i := 0; i < 5; i++ {
+		g.recordMessage(trusted)
+		reason, err := g.checkMessage(trusted)
+		wantReason(t, "trusted message", reason, err, "")
+	}
+
+	clock.advance(21 * time.Minute)
+	reason, err = g.checkMessage(ip)
+	wantReason(t, "message after the window", reason, err, "")
+
+	clock.advance(time.Hour)
+	g.sweep()
+	if len(g.messages) != 0 || len(g.connections) != 0 {
+		t.Errorf("sweep left %d message and %d connection histories", len(g.messages), len(g.connections))
+	}
+}
+
+func TestGuardGreylist(t *testing.T) {
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "emitt.db"))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	defer store.Close()
+
+	g, clock := newTestGuard(t, &config.ProtectionConfig{
+		AllowCIDRs: []string{"10.0.0.0/8"},
+		Greylisting: config.GreylistConfig{
+			Enabled:  true,
+			Delay:    5 * time.Minute,
+			Window:   4 * time.Hour,
+			Lifetime: 36 * 24 * time.Hour,
+		},
+	})
+	ctx := context.Background()
+	attempt := func(what, ip, sender, rcpt, want string) {
+		t.Helper()
+		reason, err := g.greylist(ctx, store, net.ParseIP(ip), sender, rcpt)
+		wantReason(t, what, reason, err, want)
+	}
+
+	attempt("first attempt", "192.0.2.10", "a@sender.example", "b@example.com", RejectGreylisted)
+	clock.advance(time.Minute)
+	attempt("retry within the delay", "192.0.2.10", "a@sender.example", "b@example.com", RejectGreylisted)
+	clock.advance(5 * time.Minute)
+	// Retries from elsewhere in the sender's /24 and with other case match
+	attempt("retry after the delay", "192.0.2.200", "A@Sender.Example", "b@example.com", "")
+	attempt("passed triplet", "192.0.2.10", "a@sender.example", "b@example.com", "")
+
+	attempt("other /24", "192.0.3.10", "a@sender.example", "b@example.com", RejectGreylisted)
+	attempt("other recipient", "192.0.2.10", "a@sender.example", "c@example.com", RejectGreylisted)
+	attempt("trusted client", "10.0.0.1", "x@sender.example", "b@example.com", "")
+
+	// IPv6 clients are grouped by /64
+	attempt("ipv6 first attempt", "2001:db8:1:2::10", "a@sender.example", "b@example.com", RejectGreylisted)
+	clock.advance(6 * time.Minute)
+	attempt("ipv6 retry from the same /64", "2001:db8:1:2:ffff::1", "a@sender.example", "b@example.com", "")
+	attempt("ipv6 other /64", "2001:db8:1:3::10", "a@sender.example", "b@example.com", RejectGreylisted)
+
+	// A retry after the window starts over
+	attempt("late first attempt", "198.51.100.1", "late@sender.example", "b@example.com", RejectGreylisted)
+	clock.advance(5 * time.Hour)
+	attempt("retry after the window", "198.51.100.1", "late@sender.example", "b@example.com", RejectGreylisted)
+
+	// A passed triplet is forgotten after its lifetime without mail
+	clock.advance(37 * 24 * time.Hour)
+	attempt("passed triplet after its lifetime", "192.0.2.10", "a@sender.example", "b@example.com", RejectGreylisted)
+}
+
+func TestGreylistNet(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.77":           "192.0.2.0/24",
+		"::ffff:192.0.2.77":    "192.0.2.0/24",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::/64",
+	}
+	for ip, want := range tests {
+		if got := greylistNet(net.ParseIP(ip)); got != want {
+			t.Errorf("greylistNet(%s) = %s, want %s", ip, got, want)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"context"
+	"sync"
+)
+
+// memoryBudget caps the message bytes held in memory across all sessions
+type memoryBudget struct {
+	limit int64 // <= 0 disables the cap
+
+	mu   sync.Mutex
+	used int64
+	wake chan struct{} // Closed and replaced whenever bytes are released
+}
+
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{limit: limit, wake: make(chan struct{})}
+}
+
+// acquire reserves n bytes, waiting until they are free. Requests above the
+// limit reserve the whole budget so oversized messages are handled one at a time.
+// The returned func releases the reservation.
+func (b *memoryBudget) acquire(ctx context.Context, n int64) (func(), error) {
+	if b.limit <= 0 {
+		return func() {}, nil
+	}
+	if n > b.limit {
+		n = b.limit
+	}
+
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return func() { b.release(n) }, nil
+		}
+		wake := b.wake
+		b.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
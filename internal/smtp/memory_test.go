@@ -0,0 +1,66 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	netsmtp "net/smtp"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+func (b *memoryBudget) inUse() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+func TestMemoryHeldUntilHandlerFinishes(t *testing.T) {
+	handling := make(chan struct{})
+	finish := make(chan struct{})
+	handler := func(ctx context.Context, e *email.InboundEmail) error {
+		close(handling)
+		<-finish
+		return nil
+	}
+
+	cfg := &config.ServerConfig{
+		Hostname:    "mx.test",
+		MemoryLimit: 1 << 20,
+		Listeners:   []config.ListenerConfig{{Name: "mx", TLSMode: config.TLSModeNone, MaxMessageBytes: 64 << 10}},
+	}
+	s := NewServer(cfg, handler, zerolog.Nop())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.listeners[0].server.Serve(ln)
+	t.Cleanup(func() { s.listeners[0].server.Close() })
+
+	msg := "From: a@client.test\r\nTo: b@mx.test\r\nSubject: hi\r\n\r\nhello\r\n"
+	if err := netsmtp.SendMail(ln.Addr().String(), nil, "a@client.test", []string{"b@mx.test"}, []byte(msg)); err != nil {
+		t.Fatalf("SendMail: %v", err)
+	}
+
+	select {
+	case <-handling:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+	if used := s.memory.inUse(); used != 64<<10 {
+		t.Errorf("reservation while handling = %d, want %d", used, 64<<10)
+	}
+
+	close(finish)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.memory.inUse() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("reservation of %d bytes not released after the handler finished", s.memory.inUse())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,74 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emitt/emitt/internal/email"
+)
+
+// envelope describes the current transaction and its connection
+func (s *smtpSession) envelope() *email.Envelope {
+	env := &email.Envelope{
+		MailFrom: s.from,
+		RcptTo:   append([]string(nil), s.to...),
+	}
+	if s.ip != nil {
+		env.RemoteIP = s.ip.String()
+	}
+	if s.conn != nil {
+		env.Helo = s.conn.Hostname()
+		if state, ok := s.conn.TLSConnectionState(); ok {
+			env.TLSVersion = tls.VersionName(state.Version)
+			env.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+		}
+	}
+	return env
+}
+
+// receivedHeader builds the trace field added to the top of every message
+// (RFC 5321 section 4.4, protocol names from RFC 3848)
+func receivedHeader(env *email.Envelope, hostname string, authenticated bool, now time.Time) string {
+	protocol := "ESMTP"
+	if env.TLSVersion != "" {
+		protocol += "S"
+	}
+	if authenticated {
+		protocol += "A"
+	}
+
+	helo := env.Helo
+	if helo == "" {
+		helo = "unknown"
+	}
+	from := "from " + helo
+	if env.RemoteIP != "" {
+		from += " ([" + env.RemoteIP + "])"
+	}
+
+	id := make([]byte, 6)
+	rand.Read(id)
+
+	lines := []string{
+		from,
+		fmt.Sprintf("by %s (eMitt) with %s id %s", hostname, protocol, hex.EncodeToString(id)),
+	}
+	if env.TLSVersion != "" {
+		lines = append(lines, fmt.Sprintf("(version=%s cipher=%s)", strings.ReplaceAll(env.TLSVersion, " ", ""), env.TLSCipher))
+	}
+
+	// Only name the recipient when there is one, so Bcc recipients stay hidden
+	last := "; " + now.Format(time.RFC1123Z)
+	if len(env.RcptTo) == 1 {
+		last = "for <" + env.RcptTo[0] + ">" + last
+		lines = append(lines, last)
+	} else {
+		lines[len(lines)-1] += last
+	}
+
+	return "Received: " + strings.Join(lines, "\r\n\t") + "\r\n"
+}
@@ -0,0 +1,132 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	netsmtp "net/smtp"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// receivedID matches the random id of a Received header
+var receivedID = regexp.MustCompile(`id [0-9a-f]{12}`)
+
+func TestReceivedHeader(t *testing.T) {
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	plain := &email.Envelope{RemoteIP: "192.0.2.1", Helo: "client.example", RcptTo: []string{"bob@mx.test"}}
+	withTLS := &email.Envelope{
+		RemoteIP:   "192.0.2.1",
+		Helo:       "client.example",
+		RcptTo:     []string{"bob@mx.test"},
+		TLSVersion: "TLS 1.3",
+		TLSCipher:  "TLS_AES_128_GCM_SHA256",
+	}
+
+	tests := []struct {
+		name          string
+		env           *email.Envelope
+		authenticated bool
+		want          string
+	}{
+		{"plain", plain, false, "Received: from client.example ([192.0.2.1])\r\n" +
+			"\tby mx.test (eMitt) with ESMTP id ID\r\n" +
+			"\tfor <bob@mx.test>; Tue, 02 Jan 2024 15:04:05 +0000\r\n"},
+		{"tls", withTLS, false, "Received: from client.example ([192.0.2.1])\r\n" +
+			"\tby mx.test (eMitt) with ESMTPS id ID\r\n" +
+			"\t(version=TLS1.3 cipher=TLS_AES_128_GCM_SHA256)\r\n" +
+			"\tfor <bob@mx.test>; Tue, 02 Jan 2024 15:04:05 +0000\r\n"},
+		{"tls and auth", withTLS, true, "Received: from client.example ([192.0.2.1])\r\n" +
+			"\tby mx.test (eMitt) with ESMTPSA id ID\r\n" +
+			"\t(version=TLS1.3 cipher=TLS_AES_128_GCM_SHA256)\r\n" +
+			"\tfor <bob@mx.test>; Tue, 02 Jan 2024 15:04:05 +0000\r\n"},
+		{"auth without tls", plain, true, "Received: from client.example ([192.0.2.1])\r\n" +
+			"\tby mx.test (eMitt) with ESMTPA id ID\r\n" +
+			"\tfor <bob@mx.test>; Tue, 02 Jan 2024 15:04:05 +0000\r\n"},
+		// Several recipients are not named, so none learns of the others
+		{"several recipients", &email.Envelope{
+			RemoteIP: "2001:db8::1", Helo: "client.example", RcptTo: []string{"bob@mx.test", "carol@mx.test"},
+		}, false, "Received: from client.example ([2001:db8::1])\r\n" +
+			"\tby mx.test (eMitt) with ESMTP id ID; Tue, 02 Jan 2024 15:04:05 +0000\r\n"},
+		{"several recipients with tls", &email.Envelope{
+			Helo: "client.example", RcptTo: []string{"bob@mx.test", "carol@mx.test"}, TLSVersion: "TLS 1.2", TLSCipher: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		}, false, "Received: from client.example\r\n" +
+			"\tby mx.test (eMitt) with ESMTPS id ID\r\n" +
+			"\t(version=TLS1.2 cipher=TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256); Tue, 02 Jan 2024 15:04:05 +0000\r\n"},
+		{"no helo", &email.Envelope{}, false, "Received: from unknown\r\n" +
+			"\tby mx.test (eMitt) with ESMTP id ID; Tue, 02 Jan 2024 15:04:05 +0000\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := receivedHeader(tt.env, "mx.test", tt.authenticated, now)
+			if got := receivedID.ReplaceAllString(got, "id ID"); got != tt.want {
+				t.Errorf("receivedHeader =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+
+	// Each message gets its own id
+	a, b := receivedHeader(plain, "mx.test", false, now), receivedHeader(plain, "mx.test", false, now)
+	if receivedID.FindString(a) == receivedID.FindString(b) {
+		t.Errorf("two messages got the same id: %s", receivedID.FindString(a))
+	}
+}
+
+func TestReceivedHeaderOnDelivery(t *testing.T) {
+	received := make(chan *email.InboundEmail, 1)
+	handler := func(ctx context.Context, e *email.InboundEmail) error {
+		received <- e
+		return nil
+	}
+
+	cfg := authTestConfig(t, []config.SMTPUserConfig{{Username: "relay", PasswordHash: hashTestPassword(t, "secret")}})
+	s := NewServer(cfg, handler, zerolog.Nop())
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.listeners[0].server.Serve(ln)
+	t.Cleanup(func() { s.listeners[0].server.Close() })
+
+	c := dialTLS(t, ln.Addr().String())
+	if err := c.Auth(netsmtp.PlainAuth("", "relay", "secret", "127.0.0.1")); err != nil {
+		t.Fatalf("AUTH: %v", err)
+	}
+	if err := c.Mail("relay@mx.test"); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if err := c.Rcpt("bob@example.org"); err != nil {
+		t.Fatalf("RCPT: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA: %v", err)
+	}
+	w.Write([]byte("From: relay@mx.test\r\nTo: bob@example.org\r\nSubject: hi\r\n\r\nhello\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("end of DATA: %v", err)
+	}
+
+	var e *email.InboundEmail
+	select {
+	case e = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+
+	want := regexp.MustCompile(`^Received: from client\.test \(\[127\.0\.0\.1\]\)\r\n` +
+		`\tby mx\.test \(eMitt\) with ESMTPSA id [0-9a-f]{12}\r\n` +
+		`\t\(version=TLS1\.3 cipher=TLS_\w+\)\r\n` +
+		`\tfor <bob@example\.org>; [^\r\n]+\r\nFrom: relay@mx\.test\r\n`)
+	if !want.Match(e.RawMessage) {
+		t.Errorf("message starts with %q", e.RawMessage[:min(len(e.RawMessage), 250)])
+	}
+	if e.Envelope == nil || e.Envelope.TLSVersion != "TLS 1.3" {
+		t.Errorf("envelope = %+v, want TLS 1.3", e.Envelope)
+	}
+}
@@ -4,84 +4,546 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/rs/zerolog"
 
+	"github.com/emitt/emitt/internal/blobstore"
 	"github.com/emitt/emitt/internal/config"
 	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/mailauth"
+	"github.com/emitt/emitt/internal/storage"
 )
 
 // EmailHandler is called when a new email is received
 type EmailHandler func(ctx context.Context, email *email.InboundEmail) error
 
+// EmailSpool durably stores a received email before DATA is acknowledged and
+// sets email.ID, so the handler processes the stored copy and mail accepted
+// before a crash can be recovered. It returns storage.ErrDuplicateEmail for a
+// message that is already stored, which is acknowledged without handling it.
+type EmailSpool func(ctx context.Context, email *email.InboundEmail) error
+
+// spoolTimeout bounds how long a client waits for its message to be stored
+const spoolTimeout = 30 * time.Second
+
+// RecipientValidator reports whether mail for a recipient would be routed to a
+// mailbox. authUser is the SMTP AUTH identity, empty for unauthenticated sessions.
+type RecipientValidator func(rcpt, authUser string) bool
+
+// errAuthRequired is returned when a listener requires AUTH before MAIL (RFC 4954)
+var errAuthRequired = &smtp.SMTPError{
+	Code:         530,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+	Message:      "Authentication required",
+}
+
+// errSpoolFailed asks the client to retry when the message could not be stored
+var errSpoolFailed = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Temporary failure storing message, try again later",
+}
+
+// errServerBusy defers a message when the memory budget stays exhausted
+var errServerBusy = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Server busy, try again later",
+}
+
+// errAuthFailed is returned for rejected credentials
+var errAuthFailed = &smtp.SMTPError{
+	Code:         535,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+	Message:      "Authentication credentials invalid",
+}
+
 // Server is an SMTP server for receiving inbound emails
 type Server struct {
-	cfg     *config.ServerConfig
-	server  *smtp.Server
-	handler EmailHandler
-	parser  *email.Parser
-	logger  zerolog.Logger
-	mu      sync.RWMutex
+	cfg       *config.ServerConfig
+	listeners []*listener
+	handler   EmailHandler
+	spool     EmailSpool
+	parser    *email.Parser
+	blobs     *blobstore.Store
+	memory    *memoryBudget
+	verifier  *mailauth.Verifier
+	auth      Authenticator
+	validator RecipientValidator
+	guard     *guard
+	dnsbl     DNSBLResolver
+	renewals  map[*smtp.Conn]dnsblRenewal
+	store     *storage.Store
+	done      chan struct{}
+	logger    zerolog.Logger
+	mu        sync.RWMutex
+}
+
+// listener is one SMTP endpoint served by the Server
+type listener struct {
+	cfg    *config.ListenerConfig
+	server *smtp.Server
+	ln     net.Listener // Bound by Start; guarded by Server.mu
 }
 
 // NewServer creates a new SMTP server
 func NewServer(cfg *config.ServerConfig, handler EmailHandler, logger zerolog.Logger) *Server {
 	s := &Server{
-		cfg:     cfg,
-		handler: handler,
-		parser:  email.NewParser(),
-		logger:  logger.With().Str("component", "smtp").Logger(),
+		cfg:      cfg,
+		handler:  handler,
+		parser:   email.NewParser(),
+		memory:   newMemoryBudget(cfg.MemoryLimit),
+		renewals: make(map[*smtp.Conn]dnsblRenewal),
+		done:     make(chan struct{}),
+		logger:   logger.With().Str("component", "smtp").Logger(),
 	}
 
-	backend := &smtpBackend{server: s}
+	g, err := newGuard(&cfg.Protection)
+	if err != nil {
+		logger.Error().Err(err).Msg("Invalid protection settings, CIDR lists ignored")
+		g, _ = newGuard(&config.ProtectionConfig{
+			MaxSessions:                  cfg.Protection.MaxSessions,
+			MaxSessionsPerIP:             cfg.Protection.MaxSessionsPerIP,
+			MaxConnectionsPerIPPerMinute: cfg.Protection.MaxConnectionsPerIPPerMinute,
+			MaxMessagesPerIPPerHour:      cfg.Protection.MaxMessagesPerIPPerHour,
+			Greylisting:                  cfg.Protection.Greylisting,
+		})
+	}
+	s.guard = g
 
-	s.server = smtp.NewServer(backend)
-	s.server.Addr = fmt.Sprintf("%s:%d", cfg.SMTPHost, cfg.SMTPPort)
-	s.server.Domain = "localhost"
-	s.server.ReadTimeout = 60 * time.Second
-	s.server.WriteTimeout = 60 * time.Second
-	s.server.MaxMessageBytes = 25 * 1024 * 1024 // 25MB
-	s.server.MaxRecipients = 100
-	s.server.AllowInsecureAuth = true
+	if len(cfg.DNSBL.Zones) > 0 {
+		s.dnsbl = net.DefaultResolver
+	}
 
+	if cfg.Authentication.Enabled {
+		s.verifier = mailauth.NewVerifier(nil)
+	}
+
+	// The sqlite backend is attached with SetAuthenticator once the store is open
+	if cfg.SMTPAuth.Backend == "" || cfg.SMTPAuth.Backend == "config" {
+		auth, err := NewConfigAuthenticator(cfg.SMTPAuth.Users)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed to load SMTP users")
+		} else if len(cfg.SMTPAuth.Users) > 0 {
+			s.auth = auth
+		}
+	}
+
+	var tlsConfig *tls.Config
 	if cfg.TLS.Enabled {
 		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
 		if err != nil {
 			logger.Error().Err(err).Msg("Failed to load TLS certificate")
 		} else {
-			s.server.TLSConfig = &tls.Config{
+			tlsConfig = &tls.Config{
 				Certificates: []tls.Certificate{cert},
 			}
 		}
 	}
 
+	for i := range cfg.Listeners {
+		lc := &cfg.Listeners[i]
+		if err := s.addListener(lc, tlsConfig); err != nil {
+			s.logger.Error().
+				Err(err).
+				Str("listener", lc.Name).
+				Msg("Skipping SMTP listener")
+			continue
+		}
+		if lc.RequireAuth && lc.TLSMode == config.TLSModeNone && !cfg.SMTPAuth.AllowInsecure {
+			s.logger.Warn().
+				Str("listener", lc.Name).
+				Msg("Listener requires AUTH but has no TLS; clients cannot authenticate")
+		}
+	}
+
 	return s
 }
 
-// Start starts the SMTP server
+// addListener configures a go-smtp server for one endpoint
+func (s *Server) addListener(cfg *config.ListenerConfig, tlsConfig *tls.Config) error {
+	l := &listener{cfg: cfg}
+
+	backend := &smtpBackend{server: s, listener: l}
+
+	l.server = smtp.NewServer(backend)
+	l.server.Addr = fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	l.server.Domain = s.cfg.Hostname
+	l.server.ReadTimeout = s.cfg.ReadTimeout
+	l.server.WriteTimeout = s.cfg.WriteTimeout
+	l.server.MaxMessageBytes = cfg.MaxMessageBytes
+	l.server.MaxRecipients = cfg.MaxRecipients
+	l.server.AllowInsecureAuth = s.cfg.SMTPAuth.AllowInsecure
+
+	switch cfg.TLSMode {
+	case config.TLSModeNone:
+	case config.TLSModeSTARTTLS, config.TLSModeImplicit:
+		if tlsConfig == nil {
+			return fmt.Errorf("tls_mode %q requires a TLS certificate", cfg.TLSMode)
+		}
+		l.server.TLSConfig = tlsConfig
+	default:
+		return fmt.Errorf("unknown tls_mode %q", cfg.TLSMode)
+	}
+
+	s.listeners = append(s.listeners, l)
+	return nil
+}
+
+// listen binds the listener's address, wrapping connections in TLS for implicit mode
+func (l *listener) listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", l.server.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if l.cfg.TLSMode == config.TLSModeImplicit {
+		return tls.NewListener(ln, l.server.TLSConfig), nil
+	}
+	return ln, nil
+}
+
+// SetAuthenticator sets the credential backend for SMTP AUTH (nil disables AUTH)
+func (s *Server) SetAuthenticator(a Authenticator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = a
+}
+
+// SetRecipientValidator sets the check used by reject_unknown_recipients
+func (s *Server) SetRecipientValidator(v RecipientValidator) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.validator = v
+}
+
+// isKnownRecipient applies the recipient validator when reject_unknown_recipients is enabled
+func (s *Server) isKnownRecipient(rcpt, authUser string) bool {
+	if !s.cfg.RejectUnknownRecipients {
+		return true
+	}
+	s.mu.RLock()
+	validator := s.validator
+	s.mu.RUnlock()
+	if validator == nil {
+		return true
+	}
+	return validator(rcpt, authUser)
+}
+
+// SetSpool sets where messages are stored before they are acknowledged. Without
+// a spool, mail is acknowledged before the handler has stored it.
+func (s *Server) SetSpool(spool EmailSpool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.spool = spool
+}
+
+// SetSecureMail decrypts S/MIME and PGP mail and verifies its signatures
+// when messages are parsed
+func (s *Server) SetSecureMail(secure email.SecureMail) {
+	s.parser.SetSecureMail(secure)
+}
+
+// SetBlobStore streams message data and attachments to disk instead of
+// buffering them in memory. Call it before Start.
+func (s *Server) SetBlobStore(blobs *blobstore.Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs = blobs
+	s.parser.SetBlobStore(blobs)
+}
+
+// SetGreylistStore sets the store holding greylisting triplets (required for greylisting)
+func (s *Server) SetGreylistStore(store *storage.Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.store = store
+}
+
+// SetDNSBLResolver replaces the resolver used for blocklist queries
+func (s *Server) SetDNSBLResolver(r DNSBLResolver) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dnsbl = r
+}
+
+// lookupDNSBL checks a client against the configured blocklists. It returns the
+// X-DNSBL header value ("" when no check applies) and whether the client is listed.
+func (s *Server) lookupDNSBL(l *listener, ip net.IP) (string, bool) {
+	s.mu.RLock()
+	resolver := s.dnsbl
+	s.mu.RUnlock()
+	if resolver == nil || len(s.cfg.DNSBL.Zones) == 0 || ip == nil || l.cfg.RequireAuth || s.guard.trusted(ip) {
+		return "", false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.DNSBL.Timeout)
+	defer cancel()
+
+	listings := checkDNSBL(ctx, resolver, s.cfg.DNSBL.Zones, ip)
+	result := formatDNSBL(listings)
+	if len(listings) > 0 {
+		s.logger.Info().
+			Str("remote_ip", ip.String()).
+			Str("dnsbl", result).
+			Msg("Client is listed on DNSBL")
+	}
+	return result, len(listings) > 0
+}
+
+// dnsblRenewal is the DNSBL result of a connection between STARTTLS and the
+// session go-smtp opens after it
+type dnsblRenewal struct {
+	dnsbl string
+	at    time.Time
+}
+
+// keepDNSBL holds a connection's DNSBL result for the session renewed after
+// STARTTLS, so the client is not looked up twice
+func (s *Server) keepDNSBL(c *smtp.Conn, dnsbl string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.renewals[c] = dnsblRenewal{dnsbl: dnsbl, at: time.Now()}
+}
+
+// takeDNSBL returns and forgets the result kept by keepDNSBL
+func (s *Server) takeDNSBL(c *smtp.Conn) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.renewals[c]
+	delete(s.renewals, c)
+	return r.dnsbl, ok
+}
+
+// pruneRenewals drops results of clients that disconnected after STARTTLS
+// without starting a new session
+func (s *Server) pruneRenewals(cutoff time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c, r := range s.renewals {
+		if r.at.Before(cutoff) {
+			delete(s.renewals, c)
+		}
+	}
+}
+
+// RejectionCounts returns the number of connections and commands rejected by
+// the protection checks, keyed by reason
+func (s *Server) RejectionCounts() map[string]int64 {
+	return s.guard.counts()
+}
+
+// janitor periodically expires rate-limit history and stale greylist triplets
+func (s *Server) janitor() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.guard.sweep()
+			s.pruneRenewals(time.Now().Add(-10 * time.Minute))
+
+			s.mu.RLock()
+			store := s.store
+			s.mu.RUnlock()
+			if store == nil || !s.cfg.Protection.Greylisting.Enabled {
+				continue
+			}
+			cutoff := time.Now().Add(-s.cfg.Protection.Greylisting.Lifetime)
+			if n, err := store.PruneGreylist(context.Background(), cutoff); err != nil {
+				s.logger.Error().Err(err).Msg("Failed to prune greylist")
+			} else if n > 0 {
+				s.logger.Debug().Int64("entries", n).Msg("Pruned greylist")
+			}
+		}
+	}
+}
+
+// logRejection logs a protection rejection
+func (s *Server) logRejection(ip net.IP, reason string) {
+	s.logger.Warn().
+		Str("remote_ip", ip.String()).
+		Str("reason", reason).
+		Msg("Rejected by protection rules")
+}
+
+// authenticator returns the current credential backend
+func (s *Server) authenticator() Authenticator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.auth
+}
+
+// SetVerifier replaces the sender authentication verifier (nil disables checks)
+func (s *Server) SetVerifier(v *mailauth.Verifier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.verifier = v
+}
+
+// authenticate runs SPF, DKIM, DMARC and ARC checks for a received message
+func (s *Server) authenticate(conn *smtp.Conn, from string, parsed *email.InboundEmail) *email.AuthResults {
+	s.mu.RLock()
+	verifier := s.verifier
+	s.mu.RUnlock()
+	if verifier == nil {
+		return nil
+	}
+
+	// Signature checks need the whole message; its memory reservation is held
+	// until the handler finishes
+	raw := parsed.RawMessage
+	if raw == nil {
+		r, err := parsed.OpenRaw()
+		if err != nil {
+			s.logger.Error().Err(err).Msg("Failed to read message for authentication")
+			return nil
+		}
+		raw, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			s.logger.Error().Err(err).Msg("Failed to read message for authentication")
+			return nil
+		}
+	}
+
+	in := &mailauth.Input{
+		MailFrom: from,
+		Raw:      raw,
+	}
+	if parts := strings.Split(parsed.From.Address, "@"); len(parts) == 2 {
+		in.FromDomain = parts[1]
+	}
+	if conn != nil {
+		in.Helo = conn.Hostname()
+		in.RemoteIP = remoteIP(conn)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Authentication.Timeout)
+	defer cancel()
+
+	results := verifier.Verify(ctx, in)
+	s.logger.Debug().
+		Str("spf", results.SPF).
+		Str("dkim", results.DKIM).
+		Str("dmarc", results.DMARC).
+		Str("arc", results.ARC).
+		Msg("Sender authentication")
+
+	return results
+}
+
+// Start serves all SMTP listeners and blocks until they stop. Every address
+// is bound before any is served, so a listener that cannot start fails Start
+// at once. If a listener fails later, the others are closed and its error is
+// returned; after Stop, Start returns nil.
 func (s *Server) Start() error {
-	s.logger.Info().
-		Str("addr", s.server.Addr).
-		Msg("Starting SMTP server")
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("no SMTP listeners configured")
+	}
+
+	s.mu.RLock()
+	spooled := s.spool != nil
+	s.mu.RUnlock()
+	if !spooled {
+		s.logger.Warn().Msg("No spool set; mail is acknowledged before it is stored")
+	}
+
+	bound := make([]net.Listener, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		ln, err := l.listen()
+		if err != nil {
+			for _, ln := range bound {
+				ln.Close()
+			}
+			return fmt.Errorf("%s listener: %w", l.cfg.Name, err)
+		}
+		bound = append(bound, ln)
+	}
+	s.mu.Lock()
+	for i, l := range s.listeners {
+		l.ln = bound[i]
+	}
+	s.mu.Unlock()
+
+	go s.janitor()
+
+	errCh := make(chan error, len(s.listeners))
+	for i, l := range s.listeners {
+		s.logger.Info().
+			Str("listener", l.cfg.Name).
+			Str("addr", l.server.Addr).
+			Str("tls_mode", l.cfg.TLSMode).
+			Bool("require_auth", l.cfg.RequireAuth).
+			Msg("Starting SMTP server")
+
+		go func(l *listener, ln net.Listener) {
+			if err := l.server.Serve(ln); err != nil {
+				errCh <- fmt.Errorf("%s listener: %w", l.cfg.Name, err)
+				return
+			}
+			errCh <- nil
+		}(l, bound[i])
+	}
 
-	return s.server.ListenAndServe()
+	// Serve returns nil once Stop shuts its listener down. A listener that
+	// fails would leave the server half up, so the others are closed too;
+	// their sockets are closed directly in case Serve has not registered them.
+	var failed error
+	for range s.listeners {
+		if err := <-errCh; err != nil && failed == nil {
+			failed = err
+			s.logger.Error().Err(err).Msg("SMTP listener failed, closing the others")
+			for i, l := range s.listeners {
+				l.server.Close()
+				bound[i].Close()
+			}
+		}
+	}
+	return failed
 }
 
-// Stop gracefully stops the SMTP server
+// Stop gracefully stops all SMTP listeners
 func (s *Server) Stop(ctx context.Context) error {
 	s.logger.Info().Msg("Stopping SMTP server")
-	return s.server.Shutdown(ctx)
+
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+
+	var errs []error
+	for _, l := range s.listeners {
+		if err := l.server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s listener: %w", l.cfg.Name, err))
+		}
+		// Shutdown only closes sockets Serve has registered
+		s.mu.RLock()
+		ln := l.ln
+		s.mu.RUnlock()
+		if ln != nil {
+			ln.Close()
+		}
+	}
+	return errors.Join(errs...)
 }
 
-// isAllowedDomain checks if the recipient domain is allowed
-func (s *Server) isAllowedDomain(addr string) bool {
-	if len(s.cfg.AllowedDomains) == 0 {
+// isAllowedDomain checks if the recipient domain is allowed on a listener
+func (l *listener) isAllowedDomain(addr string) bool {
+	if len(l.cfg.AllowedDomains) == 0 {
 		return true
 	}
 
@@ -91,7 +553,7 @@ func (s *Server) isAllowedDomain(addr string) bool {
 	}
 	domain := strings.ToLower(parts[1])
 
-	for _, allowed := range s.cfg.AllowedDomains {
+	for _, allowed := range l.cfg.AllowedDomains {
 		if strings.ToLower(allowed) == domain {
 			return true
 		}
@@ -101,29 +563,118 @@ func (s *Server) isAllowedDomain(addr string) bool {
 
 // smtpBackend implements smtp.Backend
 type smtpBackend struct {
-	server *Server
+	server   *Server
+	listener *listener
 }
 
-func (b *smtpBackend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+func (b *smtpBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	ip := remoteIP(c)
+
+	// After STARTTLS go-smtp opens a new session on the same connection
+	_, isTLS := c.TLSConnectionState()
+	renewed := isTLS && b.listener.cfg.TLSMode == config.TLSModeSTARTTLS
+
+	// Clients the guard refuses are turned away before any DNS query
+	if reason, err := b.server.guard.openSession(ip, !renewed); reason != "" {
+		b.server.logRejection(ip, reason)
+		return nil, err
+	}
+
+	dnsbl, checked := "", false
+	if renewed {
+		dnsbl, checked = b.server.takeDNSBL(c)
+	}
+	if !checked {
+		var listed bool
+		dnsbl, listed = b.server.lookupDNSBL(b.listener, ip)
+		if listed && strings.EqualFold(b.server.cfg.DNSBL.Action, "reject") {
+			b.server.guard.closeSession(ip)
+			reason, _ := b.server.guard.reject(RejectDNSBL, nil)
+			b.server.logRejection(ip, reason)
+			return nil, &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      fmt.Sprintf("Client host [%s] blocked by DNSBL", ip),
+			}
+		}
+	}
+
 	return &smtpSession{
-		server: b.server,
+		server:    b.server,
+		listener:  b.listener,
+		conn:      c,
+		ip:        ip,
+		dnsbl:     dnsbl,
+		plaintext: !isTLS,
 	}, nil
 }
 
-// smtpSession implements smtp.Session
+// smtpSession implements smtp.Session and smtp.AuthSession
 type smtpSession struct {
-	server *Server
-	from   string
-	to     []string
+	server    *Server
+	listener  *listener
+	conn      *smtp.Conn
+	ip        net.IP
+	dnsbl     string // X-DNSBL header value
+	plaintext bool   // Opened before TLS, so STARTTLS may renew it
+	authUser  string
+	from      string
+	to        []string
 }
 
-func (s *smtpSession) AuthPlain(username, password string) error {
-	// Accept any auth for inbound emails
-	return nil
+// AuthMechanisms advertises PLAIN when a credential backend is configured
+func (s *smtpSession) AuthMechanisms() []string {
+	if s.server.authenticator() == nil {
+		return nil
+	}
+	return []string{sasl.Plain}
+}
+
+// Auth checks PLAIN credentials against the configured backend
+func (s *smtpSession) Auth(mech string) (sasl.Server, error) {
+	auth := s.server.authenticator()
+	if auth == nil || mech != sasl.Plain {
+		return nil, smtp.ErrAuthUnsupported
+	}
+
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return errAuthFailed
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := auth.Authenticate(ctx, username, password); err != nil {
+			s.server.logger.Warn().
+				Err(err).
+				Str("listener", s.listener.cfg.Name).
+				Str("username", username).
+				Str("remote_addr", s.conn.Conn().RemoteAddr().String()).
+				Msg("SMTP AUTH failed")
+			return errAuthFailed
+		}
+
+		s.server.logger.Debug().Str("username", username).Msg("SMTP AUTH succeeded")
+		s.authUser = username
+		return nil
+	}), nil
 }
 
 func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
 	s.server.logger.Debug().Str("from", from).Msg("MAIL FROM")
+
+	if s.listener.cfg.RequireAuth && s.authUser == "" {
+		return errAuthRequired
+	}
+
+	if s.authUser == "" {
+		if reason, err := s.server.guard.checkMessage(s.ip); reason != "" {
+			s.server.logRejection(s.ip, reason)
+			return err
+		}
+	}
+
 	s.from = from
 	return nil
 }
@@ -131,7 +682,8 @@ func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
 func (s *smtpSession) Rcpt(to string, opts *smtp.RcptOptions) error {
 	s.server.logger.Debug().Str("to", to).Msg("RCPT TO")
 
-	if !s.server.isAllowedDomain(to) {
+	// Authenticated clients may address any recipient
+	if s.authUser == "" && !s.listener.isAllowedDomain(to) {
 		s.server.logger.Warn().
 			Str("to", to).
 			Msg("Rejected: domain not allowed")
@@ -142,31 +694,110 @@ func (s *smtpSession) Rcpt(to string, opts *smtp.RcptOptions) error {
 		}
 	}
 
+	if !s.server.isKnownRecipient(to, s.authUser) {
+		s.server.logger.Warn().
+			Str("to", to).
+			Msg("Rejected: no mailbox for recipient")
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such user here",
+		}
+	}
+
+	if s.authUser == "" {
+		s.server.mu.RLock()
+		store := s.server.store
+		s.server.mu.RUnlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reason, err := s.server.guard.greylist(ctx, store, s.ip, s.from, to)
+		cancel()
+		if reason != "" {
+			s.server.logRejection(s.ip, reason)
+			return err
+		}
+		if err != nil {
+			s.server.logger.Error().Err(err).Msg("Greylist check failed, accepting recipient")
+		}
+	}
+
 	s.to = append(s.to, to)
 	return nil
 }
 
 func (s *smtpSession) Data(r io.Reader) error {
-	var buf bytes.Buffer
-	if _, err := buf.ReadFrom(r); err != nil {
-		s.server.logger.Error().Err(err).Msg("Failed to read message data")
-		return err
+	s.server.mu.RLock()
+	blobs := s.server.blobs
+	s.server.mu.RUnlock()
+
+	var (
+		parsedEmail *email.InboundEmail
+		size        int64
+		release     func()
+		handedOff   bool
+		err         error
+	)
+
+	// The reservation covers the parsed message until the handler is done
+	// with it; it is released here only if the handler never runs
+	defer func() {
+		if release != nil && !handedOff {
+			release()
+		}
+	}()
+
+	// Prepend a trace header as the message is read, as an MTA would
+	env := s.envelope()
+	r = io.MultiReader(strings.NewReader(receivedHeader(env, s.server.cfg.Hostname, s.authUser != "", time.Now())), r)
+
+	if blobs != nil {
+		// Stream the message to disk, then reserve memory for parsing it
+		sum, n, err := blobs.Put(r)
+		if err != nil {
+			s.server.logger.Error().Err(err).Msg("Failed to read message data")
+			return err
+		}
+		size = n
+		if release, err = s.reserveMemory(size); err != nil {
+			return err
+		}
+		parsedEmail, err = s.server.parser.ParseBlob(sum)
+		if err != nil {
+			return s.parseFailed(err)
+		}
+	} else {
+		// Without a blob store the whole message is buffered, so reserve the
+		// largest message this listener accepts before reading it
+		if release, err = s.reserveMemory(s.listener.cfg.MaxMessageBytes); err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		if _, err := buf.ReadFrom(r); err != nil {
+			s.server.logger.Error().Err(err).Msg("Failed to read message data")
+			return err
+		}
+		size = int64(buf.Len())
+		parsedEmail, err = s.server.parser.Parse(buf.Bytes())
+		if err != nil {
+			return s.parseFailed(err)
+		}
 	}
 
-	rawMessage := buf.Bytes()
 	s.server.logger.Debug().
-		Int("size", len(rawMessage)).
+		Int64("size", size).
 		Msg("Received message data")
 
-	// Parse the email
-	parsedEmail, err := s.server.parser.Parse(rawMessage)
-	if err != nil {
-		s.server.logger.Error().Err(err).Msg("Failed to parse email")
-		return &smtp.SMTPError{
-			Code:         554,
-			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
-			Message:      "Failed to parse message",
-		}
+	// Verify the sender before envelope defaults are applied
+	parsedEmail.Auth = s.server.authenticate(s.conn, s.from, parsedEmail)
+	parsedEmail.AuthUser = s.authUser
+	parsedEmail.Envelope = env
+	// Senders must not be able to supply our own headers
+	if s.dnsbl != "" {
+		parsedEmail.SetHeader(DNSBLHeader, s.dnsbl)
+	} else {
+		parsedEmail.DelHeader(DNSBLHeader)
 	}
 
 	// Set envelope information if not in headers
@@ -182,12 +813,44 @@ func (s *smtpSession) Data(r io.Reader) error {
 	s.server.logger.Info().
 		Str("from", parsedEmail.From.Address).
 		Strs("to", parsedEmail.GetToAddresses()).
+		Strs("rcpt_to", env.RcptTo).
 		Str("subject", parsedEmail.Subject).
 		Str("message_id", parsedEmail.MessageID).
+		Str("auth_user", parsedEmail.AuthUser).
+		Str("listener", s.listener.cfg.Name).
 		Msg("Received email")
 
+	// Store the message before replying 250 so accepted mail survives a crash
+	s.server.mu.RLock()
+	spool := s.server.spool
+	s.server.mu.RUnlock()
+	if spool != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), spoolTimeout)
+		err := spool(ctx, parsedEmail)
+		cancel()
+		if errors.Is(err, storage.ErrDuplicateEmail) {
+			s.server.logger.Info().
+				Str("message_id", parsedEmail.MessageID).
+				Msg("Email already stored, accepting redelivery")
+			return nil
+		}
+		if err != nil {
+			s.server.logger.Error().
+				Err(err).
+				Str("message_id", parsedEmail.MessageID).
+				Msg("Failed to spool email")
+			return errSpoolFailed
+		}
+	}
+
+	if s.authUser == "" {
+		s.server.guard.recordMessage(s.ip)
+	}
+
 	// Handle the email asynchronously
+	handedOff = true
 	go func() {
+		defer release()
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 		defer cancel()
 
@@ -202,11 +865,41 @@ func (s *smtpSession) Data(r io.Reader) error {
 	return nil
 }
 
+// reserveMemory waits for n bytes of the server memory budget
+func (s *smtpSession) reserveMemory(n int64) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), spoolTimeout)
+	defer cancel()
+
+	release, err := s.server.memory.acquire(ctx, n)
+	if err != nil {
+		s.server.logger.Warn().Int64("size", n).Msg("Memory limit reached, deferring message")
+		return nil, errServerBusy
+	}
+	return release, nil
+}
+
+// parseFailed logs a parse error and returns the permanent rejection
+func (s *smtpSession) parseFailed(err error) error {
+	s.server.logger.Error().Err(err).Msg("Failed to parse email")
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Failed to parse message",
+	}
+}
+
 func (s *smtpSession) Reset() {
 	s.from = ""
 	s.to = nil
 }
 
 func (s *smtpSession) Logout() error {
+	s.server.guard.closeSession(s.ip)
+
+	// go-smtp logs the session out after STARTTLS and opens a new one on
+	// the same connection
+	if _, isTLS := s.conn.TLSConnectionState(); isTLS && s.plaintext {
+		s.server.keepDNSBL(s.conn, s.dnsbl)
+	}
 	return nil
 }
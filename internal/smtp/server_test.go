@@ -0,0 +1,173 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	netsmtp "net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+func TestRcptRejectsUnknownRecipients(t *testing.T) {
+	cfg := authTestConfig(t, []config.SMTPUserConfig{{Username: "app", PasswordHash: hashTestPassword(t, "secret")}})
+	cfg.RejectUnknownRecipients = true
+	cfg.Listeners[0].RequireAuth = false
+	s, addr := serveTestServer(t, cfg)
+
+	var mu sync.Mutex
+	var asked []string
+	s.SetRecipientValidator(func(rcpt, authUser string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		asked = append(asked, rcpt+"/"+authUser)
+		return strings.HasPrefix(rcpt, "support@") || authUser == "app"
+	})
+
+	c := dialTLS(t, addr)
+	if err := c.Mail("alice@example.org"); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if err := c.Rcpt("support@mx.test"); err != nil {
+		t.Errorf("RCPT for a known recipient: %v", err)
+	}
+	wantCode(t, "RCPT for an unknown recipient", c.Rcpt("nobody@mx.test"), 550)
+	// The domain check comes first and needs no validator
+	wantCode(t, "RCPT for another domain", c.Rcpt("support@example.org"), 550)
+
+	// The validator sees the AUTH identity
+	c = dialTLS(t, addr)
+	if err := c.Auth(netsmtp.PlainAuth("", "app", "secret", "127.0.0.1")); err != nil {
+		t.Fatalf("AUTH: %v", err)
+	}
+	if err := c.Mail("app@mx.test"); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if err := c.Rcpt("nobody@mx.test"); err != nil {
+		t.Errorf("RCPT accepted by the validator for app: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(asked, ","); got != "support@mx.test/,nobody@mx.test/,nobody@mx.test/app" {
+		t.Errorf("validator asked %s", got)
+	}
+}
+
+func TestIsKnownRecipient(t *testing.T) {
+	reject := func(rcpt, authUser string) bool { return false }
+
+	tests := []struct {
+		name      string
+		enabled   bool
+		validator RecipientValidator
+		want      bool
+	}{
+		{"disabled", false, reject, true},
+		{"no validator", true, nil, true},
+		{"rejected", true, reject, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(&config.ServerConfig{RejectUnknownRecipients: tt.enabled}, nil, zerolog.Nop())
+			s.SetRecipientValidator(tt.validator)
+			if got := s.isKnownRecipient("bob@example.com", ""); got != tt.want {
+				t.Errorf("isKnownRecipient = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// freePort returns a local port nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestStartFailsWhenAListenerCannotBind(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	free := freePort(t)
+	s := NewServer(&config.ServerConfig{
+		Listeners: []config.ListenerConfig{
+			{Name: "mx", Host: "127.0.0.1", Port: free, TLSMode: config.TLSModeNone},
+			{Name: "submission", Host: "127.0.0.1", Port: taken.Addr().(*net.TCPAddr).Port, TLSMode: config.TLSModeNone},
+		},
+	}, nil, zerolog.Nop())
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "submission listener") {
+			t.Errorf("Start = %v, want the submission listener's error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start kept serving the other listener")
+	}
+
+	// The listener that did bind was released
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(free)))
+	if err != nil {
+		t.Errorf("mx port still bound: %v", err)
+	} else {
+		ln.Close()
+	}
+}
+
+func TestStartReturnsAfterStop(t *testing.T) {
+	s := NewServer(&config.ServerConfig{
+		Listeners: []config.ListenerConfig{
+			{Name: "mx", Host: "127.0.0.1", Port: freePort(t), TLSMode: config.TLSModeNone},
+			{Name: "submission", Host: "127.0.0.1", Port: freePort(t), TLSMode: config.TLSModeNone},
+		},
+	}, nil, zerolog.Nop())
+
+	done := make(chan error, 1)
+	go func() { done <- s.Start() }()
+
+	// Wait until both listeners accept connections
+	for _, l := range s.listeners {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			c, err := net.Dial("tcp", l.server.Addr)
+			if err == nil {
+				c.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s listener never started: %v", l.cfg.Name, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start after Stop = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after Stop")
+	}
+}
@@ -0,0 +1,147 @@
+package spam
+
+import (
+	"context"
+	"html"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxTokens       = 2000 // Unique tokens taken from one message
+	maxClues        = 150  // Strongest tokens used for classification
+	minClueStrength = 0.1  // Tokens closer than this to 0.5 are ignored
+	unknownStrength = 0.45 // Weight of the 0.5 prior for rarely seen tokens
+)
+
+var (
+	tagPattern = regexp.MustCompile(`(?s)<[^>]*>`)
+	urlPattern = regexp.MustCompile(`(?i)https?://[^\s"'<>()]+`)
+)
+
+// tokenize returns the unique tokens of a message used by the Bayes model
+func tokenize(subject, text, htmlBody string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(t string) {
+		if len(tokens) < maxTokens && !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+
+	for _, w := range words(subject) {
+		add("subject:" + w)
+	}
+
+	body := text
+	if strings.TrimSpace(body) == "" {
+		body = html.UnescapeString(tagPattern.ReplaceAllString(htmlBody, " "))
+	}
+
+	for _, raw := range urlPattern.FindAllString(text+" "+htmlBody, -1) {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			add("url:" + strings.ToLower(u.Hostname()))
+		}
+	}
+	for _, w := range words(urlPattern.ReplaceAllString(body, " ")) {
+		add(w)
+	}
+
+	return tokens
+}
+
+// words splits text into lowercased words of 3 to 20 characters
+func words(s string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '\'' && r != '!'
+	})
+
+	out := fields[:0]
+	for _, f := range fields {
+		f = strings.Trim(f, "'")
+		n := len([]rune(f))
+		if n < 3 {
+			continue
+		}
+		if n > 20 {
+			f = "skip:" + string([]rune(f)[:1])
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// classify returns the spam probability of a token set, or nil when the model
+// has not seen enough training mail (Robinson-Fisher combining, as in SpamBayes)
+func (s *Scorer) classify(ctx context.Context, tokens []string) (*float64, error) {
+	nSpam, nHam, err := s.trainingCounts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// At least one email of each class is needed, as the token ratios below
+	// divide by the class counts
+	minTraining := max(int64(s.cfg.BayesMinTraining), 1)
+	if nSpam < minTraining || nHam < minTraining {
+		return nil, nil
+	}
+
+	counts, err := s.store.GetSpamTokens(ctx, tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	var clues []float64
+	for _, c := range counts {
+		if c.Spam == 0 && c.Ham == 0 {
+			continue
+		}
+		spamRatio := float64(c.Spam) / float64(nSpam)
+		hamRatio := float64(c.Ham) / float64(nHam)
+		p := spamRatio / (spamRatio + hamRatio)
+		n := float64(c.Spam + c.Ham)
+		f := (unknownStrength*0.5 + n*p) / (unknownStrength + n)
+		if math.Abs(f-0.5) >= minClueStrength {
+			clues = append(clues, f)
+		}
+	}
+
+	prob := 0.5
+	if len(clues) > 0 {
+		sort.Slice(clues, func(i, j int) bool {
+			return math.Abs(clues[i]-0.5) > math.Abs(clues[j]-0.5)
+		})
+		if len(clues) > maxClues {
+			clues = clues[:maxClues]
+		}
+
+		var hamSum, spamSum float64
+		for _, f := range clues {
+			spamSum += math.Log(1 - f)
+			hamSum += math.Log(f)
+		}
+		n := 2 * len(clues)
+		spamminess := 1 - chi2Q(-2*spamSum, n)
+		hamminess := 1 - chi2Q(-2*hamSum, n)
+		prob = (spamminess - hamminess + 1) / 2
+	}
+
+	prob = math.Round(prob*1000) / 1000
+	return &prob, nil
+}
+
+// chi2Q is the upper tail of the chi-squared distribution for even degrees of freedom
+func chi2Q(x2 float64, v int) float64 {
+	m := x2 / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	return math.Min(sum, 1)
+}
@@ -0,0 +1,246 @@
+package spam
+
+import (
+	"html"
+	"net"
+	"net/mail"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/mailauth"
+)
+
+// dnsblHeader mirrors smtp.DNSBLHeader, set by the server on received mail
+const dnsblHeader = "X-DNSBL"
+
+// manyURLs is the link count above which MANY_URLS matches
+const manyURLs = 20
+
+var (
+	anchorPattern = regexp.MustCompile(`(?is)<a\s[^>]*href\s*=\s*["']?([^"'\s>]+)[^>]*>(.*?)</a>`)
+	domainPattern = regexp.MustCompile(`(?i)^(https?://)?([a-z0-9-]+\.)+[a-z]{2,}(/\S*)?$`)
+	addrPattern   = regexp.MustCompile(`[^\s<>"@]+@[^\s<>"@]+\.[a-z]{2,}`)
+)
+
+var shorteners = map[string]bool{
+	"bit.ly": true, "tinyurl.com": true, "t.co": true, "goo.gl": true,
+	"ow.ly": true, "is.gd": true, "buff.ly": true, "rebrand.ly": true,
+	"cutt.ly": true, "shorturl.at": true, "rb.gy": true, "tiny.cc": true,
+}
+
+var executableExts = map[string]bool{
+	".exe": true, ".scr": true, ".com": true, ".pif": true, ".bat": true,
+	".cmd": true, ".vbs": true, ".vbe": true, ".js": true, ".jse": true,
+	".wsf": true, ".wsh": true, ".hta": true, ".msi": true, ".jar": true,
+	".ps1": true, ".lnk": true, ".cpl": true, ".reg": true, ".iso": true,
+	".img": true,
+}
+
+var macroExts = map[string]bool{
+	".docm": true, ".dotm": true, ".xlsm": true, ".xltm": true,
+	".xlam": true, ".pptm": true, ".potm": true, ".ppsm": true,
+}
+
+var documentExts = map[string]bool{
+	".pdf": true, ".doc": true, ".docx": true, ".xls": true, ".xlsx": true,
+	".ppt": true, ".pptx": true, ".txt": true, ".jpg": true, ".jpeg": true,
+	".png": true, ".gif": true, ".zip": true, ".rtf": true, ".csv": true,
+}
+
+// message holds the parts of an email the rules inspect
+type message struct {
+	email   *email.InboundEmail
+	header  mail.Header // Raw headers, nil if the raw message is unavailable
+	urls    []*url.URL
+	anchors [][2]string // href, visible text
+}
+
+// analyze extracts headers and links from an email
+func analyze(e *email.InboundEmail) *message {
+	m := &message{email: e}
+
+	if raw, err := e.OpenRaw(); err == nil {
+		if parsed, err := mail.ReadMessage(raw); err == nil {
+			m.header = parsed.Header
+		}
+		raw.Close()
+	}
+
+	for _, raw := range urlPattern.FindAllString(e.TextBody+" "+e.HTMLBody, -1) {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			m.urls = append(m.urls, u)
+		}
+	}
+	for _, match := range anchorPattern.FindAllStringSubmatch(e.HTMLBody, -1) {
+		text := strings.TrimSpace(html.UnescapeString(tagPattern.ReplaceAllString(match[2], "")))
+		m.anchors = append(m.anchors, [2]string{html.UnescapeString(match[1]), text})
+	}
+	return m
+}
+
+// rule is a heuristic with its default score
+type rule struct {
+	name        string
+	score       float64
+	description string
+	test        func(m *message) bool
+}
+
+// rules lists every heuristic; scores can be overridden in spam.rules
+var rules = []rule{
+	{"MISSING_DATE", 1.0, "Message has no Date header", func(m *message) bool {
+		return m.header != nil && m.header.Get("Date") == ""
+	}},
+	{"MISSING_MESSAGE_ID", 1.0, "Message has no Message-ID header", func(m *message) bool {
+		return m.header != nil && m.header.Get("Message-Id") == ""
+	}},
+	{"FUTURE_DATE", 1.5, "Date header is more than a day in the future", func(m *message) bool {
+		return !m.email.Date.IsZero() && m.email.Date.After(time.Now().Add(24*time.Hour))
+	}},
+	{"EMPTY_SUBJECT", 0.5, "Subject is empty", func(m *message) bool {
+		return strings.TrimSpace(m.email.Subject) == ""
+	}},
+	{"SUBJECT_ALL_CAPS", 1.5, "Subject is written in capitals", func(m *message) bool {
+		return allCaps(m.email.Subject)
+	}},
+	{"SUBJECT_EXCLAIM", 0.5, "Subject contains repeated exclamation marks", func(m *message) bool {
+		return strings.Contains(m.email.Subject, "!!")
+	}},
+	{"FROM_NAME_HAS_ADDRESS", 1.5, "From display name contains a different address", func(m *message) bool {
+		for _, a := range addrPattern.FindAllString(strings.ToLower(m.email.From.Name), -1) {
+			if !strings.EqualFold(a, m.email.From.Address) {
+				return true
+			}
+		}
+		return false
+	}},
+	{"REPLY_TO_DIFFERS", 1.0, "Reply-To domain differs from the From domain", func(m *message) bool {
+		if m.email.ReplyTo == nil {
+			return false
+		}
+		return orgDomain(addressDomain(m.email.ReplyTo.Address)) != orgDomain(addressDomain(m.email.From.Address))
+	}},
+	{"HTML_ONLY", 0.8, "Message has an HTML body but no text part", func(m *message) bool {
+		return strings.TrimSpace(m.email.TextBody) == "" && strings.TrimSpace(m.email.HTMLBody) != ""
+	}},
+	{"SPF_FAIL", 2.0, "SPF check failed", func(m *message) bool {
+		return m.email.Auth != nil && m.email.Auth.SPF == "fail"
+	}},
+	{"SPF_SOFTFAIL", 1.0, "SPF check soft-failed", func(m *message) bool {
+		return m.email.Auth != nil && m.email.Auth.SPF == "softfail"
+	}},
+	{"DKIM_FAIL", 1.5, "DKIM signature is invalid", func(m *message) bool {
+		return m.email.Auth != nil && m.email.Auth.DKIM == "fail"
+	}},
+	{"DMARC_FAIL", 3.0, "DMARC check failed", func(m *message) bool {
+		return m.email.Auth != nil && m.email.Auth.DMARC == "fail"
+	}},
+	{"DMARC_PASS", -1.0, "DMARC check passed", func(m *message) bool {
+		return m.email.Auth != nil && m.email.Auth.DMARC == "pass"
+	}},
+	{"DNSBL_LISTED", 3.0, "Sending host is on a DNS blocklist", func(m *message) bool {
+		v := strings.TrimSpace(m.email.Header(dnsblHeader))
+		return v != "" && v != "none"
+	}},
+	{"URL_IP_HOST", 2.0, "Link points at a bare IP address", func(m *message) bool {
+		for _, u := range m.urls {
+			if net.ParseIP(u.Hostname()) != nil {
+				return true
+			}
+		}
+		return false
+	}},
+	{"URL_SHORTENER", 1.0, "Link uses a URL shortener", func(m *message) bool {
+		for _, u := range m.urls {
+			if shorteners[strings.ToLower(u.Hostname())] {
+				return true
+			}
+		}
+		return false
+	}},
+	{"URL_MISMATCH", 2.5, "Link text shows a different domain than its target", func(m *message) bool {
+		for _, a := range m.anchors {
+			if linkMismatch(a[0], a[1]) {
+				return true
+			}
+		}
+		return false
+	}},
+	{"MANY_URLS", 1.0, "Message contains many links", func(m *message) bool {
+		return len(m.urls) > manyURLs
+	}},
+	{"ATTACH_EXECUTABLE", 5.0, "Attachment is an executable or script", func(m *message) bool {
+		return anyAttachment(m, func(name string) bool { return executableExts[path.Ext(name)] })
+	}},
+	{"ATTACH_DOUBLE_EXT", 3.0, "Attachment hides an executable behind a document extension", func(m *message) bool {
+		return anyAttachment(m, func(name string) bool {
+			ext := path.Ext(name)
+			return executableExts[ext] && documentExts[path.Ext(strings.TrimSuffix(name, ext))]
+		})
+	}},
+	{"ATTACH_MACRO", 2.0, "Attachment is a macro-enabled Office document", func(m *message) bool {
+		return anyAttachment(m, func(name string) bool { return macroExts[path.Ext(name)] })
+	}},
+}
+
+// allCaps reports whether a subject has at least five letters, all upper case
+func allCaps(s string) bool {
+	letters := 0
+	for _, r := range s {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters >= 5
+}
+
+// anyAttachment reports whether test matches any lowercased attachment filename
+func anyAttachment(m *message, test func(name string) bool) bool {
+	for _, a := range m.email.Attachments {
+		if name := strings.ToLower(strings.TrimSpace(a.Filename)); name != "" && test(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkMismatch reports whether anchor text that looks like a URL or domain
+// names a different organizational domain than the link target
+func linkMismatch(href, text string) bool {
+	if !domainPattern.MatchString(text) {
+		return false
+	}
+	target, err := url.Parse(href)
+	if err != nil || target.Hostname() == "" {
+		return false
+	}
+	if !strings.Contains(text, "://") {
+		text = "http://" + text
+	}
+	shown, err := url.Parse(text)
+	if err != nil || shown.Hostname() == "" {
+		return false
+	}
+	return orgDomain(shown.Hostname()) != orgDomain(target.Hostname())
+}
+
+// addressDomain returns the lowercased domain of an email address
+func addressDomain(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return strings.ToLower(addr[i+1:])
+	}
+	return ""
+}
+
+// orgDomain returns the organizational domain of a host
+func orgDomain(host string) string {
+	return mailauth.OrganizationalDomain(strings.ToLower(strings.TrimSuffix(host, ".")))
+}
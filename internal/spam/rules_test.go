@@ -0,0 +1,181 @@
+package spam
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+const cleanRaw = "Date: Mon, 1 Jan 2024 10:00:00 +0000\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"From: Alice <alice@example.com>\r\n" +
+	"Subject: Quarterly report\r\n" +
+	"\r\n" +
+	"Numbers attached.\r\n"
+
+// cleanEmail returns a message that matches no rule
+func cleanEmail() *email.InboundEmail {
+	return &email.InboundEmail{
+		From:       email.Address{Name: "Alice", Address: "alice@example.com"},
+		Subject:    "Quarterly report",
+		Date:       time.Now().Add(-time.Hour),
+		TextBody:   "Numbers attached, see https://example.com/report for details.",
+		RawMessage: []byte(cleanRaw),
+	}
+}
+
+// matchedRules returns the names of the rules an email matches
+func matchedRules(e *email.InboundEmail) []string {
+	m := analyze(e)
+	var names []string
+	for _, r := range rules {
+		if r.test(m) {
+			names = append(names, r.name)
+		}
+	}
+	return names
+}
+
+func TestRules(t *testing.T) {
+	manyLinks := strings.Repeat("https://example.com/a ", manyURLs+1)
+
+	tests := []struct {
+		name   string
+		modify func(e *email.InboundEmail)
+		want   string
+	}{
+		{"clean", func(e *email.InboundEmail) {}, ""},
+		{"no raw message", func(e *email.InboundEmail) { e.RawMessage = nil }, ""},
+		{"missing date", func(e *email.InboundEmail) {
+			e.RawMessage = []byte(strings.Replace(cleanRaw, "Date: Mon, 1 Jan 2024 10:00:00 +0000\r\n", "", 1))
+		}, "MISSING_DATE"},
+		{"missing message id", func(e *email.InboundEmail) {
+			e.RawMessage = []byte(strings.Replace(cleanRaw, "Message-ID: <1@example.com>\r\n", "", 1))
+		}, "MISSING_MESSAGE_ID"},
+		{"future date", func(e *email.InboundEmail) { e.Date = time.Now().Add(48 * time.Hour) }, "FUTURE_DATE"},
+		{"clock skew", func(e *email.InboundEmail) { e.Date = time.Now().Add(time.Hour) }, ""},
+		{"empty subject", func(e *email.InboundEmail) { e.Subject = "  " }, "EMPTY_SUBJECT"},
+		{"all caps subject", func(e *email.InboundEmail) { e.Subject = "ACT NOW: FREE OFFER" }, "SUBJECT_ALL_CAPS"},
+		{"short caps subject", func(e *email.InboundEmail) { e.Subject = "RE: PO" }, ""},
+		{"exclamation marks", func(e *email.InboundEmail) { e.Subject = "You won!!" }, "SUBJECT_EXCLAIM"},
+		{"address in from name", func(e *email.InboundEmail) {
+			e.From = email.Address{Name: "support@bank.example", Address: "x@spam.example"}
+		}, "FROM_NAME_HAS_ADDRESS"},
+		{"own address in from name", func(e *email.InboundEmail) {
+			e.From = email.Address{Name: "Alice@Example.com", Address: "alice@example.com"}
+		}, ""},
+		{"reply-to elsewhere", func(e *email.InboundEmail) {
+			e.ReplyTo = &email.Address{Address: "claims@spam.example"}
+		}, "REPLY_TO_DIFFERS"},
+		{"reply-to same organization", func(e *email.InboundEmail) {
+			e.ReplyTo = &email.Address{Address: "support@help.example.com"}
+		}, ""},
+		{"html only", func(e *email.InboundEmail) {
+			e.TextBody = ""
+			e.HTMLBody = "<p>Numbers attached.</p>"
+		}, "HTML_ONLY"},
+		{"spf fail", func(e *email.InboundEmail) { e.Auth = &email.AuthResults{SPF: "fail"} }, "SPF_FAIL"},
+		{"spf softfail", func(e *email.InboundEmail) { e.Auth = &email.AuthResults{SPF: "softfail"} }, "SPF_SOFTFAIL"},
+		{"dkim fail", func(e *email.InboundEmail) { e.Auth = &email.AuthResults{DKIM: "fail"} }, "DKIM_FAIL"},
+		{"dmarc fail", func(e *email.InboundEmail) {
+			e.Auth = &email.AuthResults{SPF: "pass", DMARC: "fail"}
+		}, "DMARC_FAIL"},
+		{"dmarc pass", func(e *email.InboundEmail) {
+			e.Auth = &email.AuthResults{SPF: "pass", DKIM: "pass", DMARC: "pass"}
+		}, "DMARC_PASS"},
+		{"dnsbl listed", func(e *email.InboundEmail) {
+			e.SetHeader(dnsblHeader, "zen.spamhaus.org=127.0.0.2")
+		}, "DNSBL_LISTED"},
+		{"dnsbl clean", func(e *email.InboundEmail) { e.SetHeader(dnsblHeader, "none") }, ""},
+		{"ip link", func(e *email.InboundEmail) { e.TextBody = "Log in at http://192.0.2.1/login" }, "URL_IP_HOST"},
+		{"shortener", func(e *email.InboundEmail) { e.HTMLBody = `<a href="https://bit.ly/x">here</a>` }, "URL_SHORTENER"},
+		{"link text mismatch", func(e *email.InboundEmail) {
+			e.HTMLBody = `<a href="https://phish.example/login">www.<b>bank.example</b></a>`
+		}, "URL_MISMATCH"},
+		{"link text on a subdomain", func(e *email.InboundEmail) {
+			e.HTMLBody = `<a href="https://track.example.com/c/1">https://example.com/report</a>`
+		}, ""},
+		{"link text that is not a domain", func(e *email.InboundEmail) {
+			e.HTMLBody = `<a href="https://example.com/report">View the report</a>`
+		}, ""},
+		{"many links", func(e *email.InboundEmail) { e.TextBody = manyLinks }, "MANY_URLS"},
+		{"executable", func(e *email.InboundEmail) {
+			e.Attachments = []email.Attachment{{Filename: "Setup.EXE"}}
+		}, "ATTACH_EXECUTABLE"},
+		{"double extension", func(e *email.InboundEmail) {
+			e.Attachments = []email.Attachment{{Filename: "invoice.pdf.js"}}
+		}, "ATTACH_EXECUTABLE,ATTACH_DOUBLE_EXT"},
+		{"macro document", func(e *email.InboundEmail) {
+			e.Attachments = []email.Attachment{{Filename: "report.xlsm"}}
+		}, "ATTACH_MACRO"},
+		{"plain document", func(e *email.InboundEmail) {
+			e.Attachments = []email.Attachment{{Filename: "report.v2.pdf"}, {Filename: ""}}
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := cleanEmail()
+			tt.modify(e)
+			if got := strings.Join(matchedRules(e), ","); got != tt.want {
+				t.Errorf("matched %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScoreRuleOverrides(t *testing.T) {
+	e := cleanEmail()
+	e.Subject = ""
+	e.TextBody = ""
+	e.HTMLBody = "<p>Hi</p>"
+
+	tests := []struct {
+		name      string
+		overrides map[string]float64
+		want      string
+	}{
+		{"defaults", nil, "EMPTY_SUBJECT=0.5,HTML_ONLY=0.8 total=1.3"},
+		{"raised", map[string]float64{"HTML_ONLY": 2}, "EMPTY_SUBJECT=0.5,HTML_ONLY=2 total=2.5"},
+		{"disabled", map[string]float64{"EMPTY_SUBJECT": 0}, "HTML_ONLY=0.8 total=0.8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scorer := NewScorer(&config.SpamConfig{Rules: tt.overrides}, nil, zerolog.Nop())
+			result := scorer.Score(context.Background(), e)
+			var parts []string
+			for _, r := range result.Rules {
+				parts = append(parts, fmt.Sprintf("%s=%g", r.Name, r.Score))
+			}
+			if got := fmt.Sprintf("%s total=%g", strings.Join(parts, ","), result.Score); got != tt.want {
+				t.Errorf("Score = %s, want %s", got, tt.want)
+			}
+			if result.Bayes != nil {
+				t.Error("Bayes ran without a store")
+			}
+		})
+	}
+}
+
+func TestAllCaps(t *testing.T) {
+	tests := map[string]bool{
+		"URGENT PAYMENT":      true,
+		"URGENT: 50% OFF!!!":  true,
+		"Urgent payment":      false,
+		"RE: PO":              false,
+		"12345 67890":         false,
+		"ÜBERWEISUNG FÄLLIG":  true,
+		"Invoice INV-2024-01": false,
+	}
+	for s, want := range tests {
+		if got := allCaps(s); got != want {
+			t.Errorf("allCaps(%q) = %v, want %v", s, got, want)
+		}
+	}
+}
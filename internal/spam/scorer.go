@@ -0,0 +1,181 @@
+// Package spam implements a lightweight spam scorer combining header,
+// authentication, URL and attachment heuristics with a Bayesian token model
+// trained from emails marked spam or ham in the store.
+package spam
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// trainBatch is the number of labelled emails learned per query
+const trainBatch = 100
+
+// Scorer scores inbound email
+type Scorer struct {
+	cfg    *config.SpamConfig
+	store  *storage.Store
+	done   chan struct{}
+	logger zerolog.Logger
+
+	// Emails per class the model was trained with, cached between training runs
+	mu           sync.Mutex
+	countsLoaded bool
+	nSpam, nHam  int64
+}
+
+// NewScorer creates a scorer. store may be nil, which disables the Bayes model.
+func NewScorer(cfg *config.SpamConfig, store *storage.Store, logger zerolog.Logger) *Scorer {
+	return &Scorer{
+		cfg:    cfg,
+		store:  store,
+		done:   make(chan struct{}),
+		logger: logger.With().Str("component", "spam").Logger(),
+	}
+}
+
+// Start trains the Bayes model in the background, now and then once per
+// train interval, so scoring never waits for training
+func (s *Scorer) Start() {
+	if s.store == nil {
+		return
+	}
+	go s.trainLoop()
+}
+
+// Stop ends background training
+func (s *Scorer) Stop() {
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+}
+
+func (s *Scorer) trainLoop() {
+	interval := s.cfg.TrainInterval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := s.Train(context.Background()); err != nil {
+			s.logger.Warn().Err(err).Msg("Bayes training failed")
+		} else if n > 0 {
+			s.logger.Info().Int("emails", n).Msg("Bayes model trained")
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Score runs all rules and the Bayes model against an email
+func (s *Scorer) Score(ctx context.Context, e *email.InboundEmail) *email.SpamResult {
+	result := &email.SpamResult{}
+	msg := analyze(e)
+
+	for _, r := range rules {
+		score := r.score
+		if override, ok := s.cfg.Rules[r.name]; ok {
+			score = override
+		}
+		if score == 0 || !r.test(msg) {
+			continue
+		}
+		result.Rules = append(result.Rules, email.SpamRule{
+			Name:        r.name,
+			Score:       score,
+			Description: r.description,
+		})
+		result.Score += score
+	}
+
+	if s.store != nil {
+		prob, err := s.classify(ctx, tokenize(e.Subject, e.TextBody, e.HTMLBody))
+		if err != nil {
+			s.logger.Warn().Err(err).Msg("Bayes classification failed")
+		} else if prob != nil {
+			result.Bayes = prob
+			score := math.Round(s.cfg.BayesWeight*(*prob-0.5)*2*100) / 100
+			if score != 0 {
+				result.Rules = append(result.Rules, email.SpamRule{
+					Name:        "BAYES",
+					Score:       score,
+					Description: "Bayesian spam probability",
+				})
+				result.Score += score
+			}
+		}
+	}
+
+	result.Score = math.Round(result.Score*100) / 100
+	return result
+}
+
+// Train updates the Bayes model with every email whose spam label changed
+// since it was last learned, returning the number of emails processed
+func (s *Scorer) Train(ctx context.Context) (int, error) {
+	if s.store == nil {
+		return 0, nil
+	}
+
+	total := 0
+	for {
+		emails, err := s.store.GetUntrainedEmails(ctx, trainBatch)
+		if err != nil {
+			return total, err
+		}
+		for _, e := range emails {
+			tokens := tokenize(e.Subject, e.TextBody, e.HTMLBody)
+			if err := s.store.ApplySpamTraining(ctx, e.ID, tokens, e.SpamTrained, e.SpamLabel); err != nil {
+				s.refreshCounts(ctx)
+				return total, err
+			}
+		}
+		total += len(emails)
+		if len(emails) < trainBatch {
+			if _, _, err := s.refreshCounts(ctx); err != nil {
+				return total, err
+			}
+			return total, nil
+		}
+	}
+}
+
+// trainingCounts returns the number of emails per class the model was
+// trained with, reading the store only until the first training run
+func (s *Scorer) trainingCounts(ctx context.Context) (int64, int64, error) {
+	s.mu.Lock()
+	loaded, nSpam, nHam := s.countsLoaded, s.nSpam, s.nHam
+	s.mu.Unlock()
+	if loaded {
+		return nSpam, nHam, nil
+	}
+	return s.refreshCounts(ctx)
+}
+
+// refreshCounts reloads the cached training counts
+func (s *Scorer) refreshCounts(ctx context.Context) (int64, int64, error) {
+	nSpam, nHam, err := s.store.GetSpamTrainingCounts(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	s.mu.Lock()
+	s.countsLoaded, s.nSpam, s.nHam = true, nSpam, nHam
+	s.mu.Unlock()
+	return nSpam, nHam, nil
+}
@@ -0,0 +1,140 @@
+package spam
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+func newTestStore(t *testing.T) *storage.Store {
+	t.Helper()
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "emitt.db"))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// labelEmails stores n emails with the given label
+func labelEmails(t *testing.T, store *storage.Store, label, subject, body string, n int) {
+	t.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		e := &storage.Email{
+			MessageID:  fmt.Sprintf("<%s-%d@test>", label, i),
+			From:       "sender@example.org",
+			Subject:    subject,
+			TextBody:   body,
+			ReceivedAt: time.Now(),
+			Status:     storage.EmailStatusCompleted,
+		}
+		if err := store.SaveEmail(ctx, e); err != nil {
+			t.Fatalf("SaveEmail: %v", err)
+		}
+		if err := store.SetSpamLabel(ctx, e.ID, label); err != nil {
+			t.Fatalf("SetSpamLabel: %v", err)
+		}
+	}
+}
+
+func TestScoreDoesNotTrain(t *testing.T) {
+	store := newTestStore(t)
+	labelEmails(t, store, storage.SpamLabelSpam, "Cheap pills", "buy cheap pills viagra casino winner", 3)
+	labelEmails(t, store, storage.SpamLabelHam, "Meeting notes", "agenda minutes project review budget", 3)
+
+	cfg := &config.SpamConfig{BayesWeight: 4, BayesMinTraining: 3, TrainInterval: time.Hour}
+	scorer := NewScorer(cfg, store, zerolog.Nop())
+	ctx := context.Background()
+	spammy := &email.InboundEmail{Subject: "Cheap pills", TextBody: "cheap pills casino winner"}
+
+	result := scorer.Score(ctx, spammy)
+	if result.Bayes != nil {
+		t.Errorf("Bayes = %v before training, want nil", *result.Bayes)
+	}
+	if untrained, _ := store.GetUntrainedEmails(ctx, 100); len(untrained) != 6 {
+		t.Fatalf("Score trained the model: %d emails left untrained, want 6", len(untrained))
+	}
+
+	n, err := scorer.Train(ctx)
+	if err != nil || n != 6 {
+		t.Fatalf("Train = %d, %v; want 6 emails", n, err)
+	}
+
+	// Training refreshes the cached counts, so Bayes applies at once
+	result = scorer.Score(ctx, spammy)
+	if result.Bayes == nil || *result.Bayes < 0.9 {
+		t.Errorf("Bayes = %v after training, want spam", result.Bayes)
+	}
+	ham := scorer.Score(ctx, &email.InboundEmail{Subject: "Meeting notes", TextBody: "project review agenda"})
+	if ham.Bayes == nil || *ham.Bayes > 0.1 {
+		t.Errorf("Bayes = %v for ham, want ham", ham.Bayes)
+	}
+}
+
+func TestScorerBackgroundTraining(t *testing.T) {
+	store := newTestStore(t)
+	labelEmails(t, store, storage.SpamLabelSpam, "Winner", "claim your prize now", 2)
+
+	scorer := NewScorer(&config.SpamConfig{TrainInterval: time.Hour}, store, zerolog.Nop())
+	scorer.Start()
+	defer scorer.Stop()
+
+	// The first run starts immediately
+	ctx := context.Background()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		untrained, err := store.GetUntrainedEmails(ctx, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(untrained) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d emails still untrained", len(untrained))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	scorer.Stop()
+	scorer.Stop() // Stopping twice is harmless
+}
+
+func TestScoreWithoutMinTraining(t *testing.T) {
+	for _, minTraining := range []int{0, -1} {
+		t.Run(fmt.Sprint(minTraining), func(t *testing.T) {
+			store := newTestStore(t)
+			labelEmails(t, store, storage.SpamLabelSpam, "Cheap pills", "buy cheap pills casino winner", 2)
+
+			cfg := &config.SpamConfig{BayesWeight: 4, BayesMinTraining: minTraining, TrainInterval: time.Hour}
+			scorer := NewScorer(cfg, store, zerolog.Nop())
+			ctx := context.Background()
+			if _, err := scorer.Train(ctx); err != nil {
+				t.Fatal(err)
+			}
+			spammy := &email.InboundEmail{Subject: "Cheap pills", TextBody: "cheap pills casino winner"}
+
+			// Without any ham there is nothing to compare against
+			if result := scorer.Score(ctx, spammy); result.Bayes != nil {
+				t.Errorf("Bayes = %v without ham, want nil", *result.Bayes)
+			}
+
+			labelEmails(t, store, storage.SpamLabelHam, "Meeting notes", "agenda minutes project review budget", 1)
+			if _, err := scorer.Train(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if result := scorer.Score(ctx, spammy); result.Bayes == nil || *result.Bayes < 0.9 {
+				t.Errorf("Bayes = %v after one ham, want spam", result.Bayes)
+			}
+		})
+	}
+}
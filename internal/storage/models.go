@@ -16,22 +16,60 @@ type Email struct {
 	TextBody    string          `json:"text_body"`
 	HTMLBody    string          `json:"html_body"`
 	RawMessage  []byte          `json:"raw_message"`
+	RawSHA256   string          `json:"raw_sha256,omitempty"` // Blob holding the raw message when it is not stored inline
 	Headers     json.RawMessage `json:"headers"`
 	Attachments json.RawMessage `json:"attachments"`
 	ReceivedAt  time.Time       `json:"received_at"`
 	ProcessedAt *time.Time      `json:"processed_at"`
 	MailboxName string          `json:"mailbox_name"`
 	Status      EmailStatus     `json:"status"`
+	AuthResults json.RawMessage `json:"auth_results,omitempty"`
+	AuthUser    string          `json:"auth_user,omitempty"`
+	SpamScore   *float64        `json:"spam_score,omitempty"`
+	SpamReport  json.RawMessage `json:"spam_report,omitempty"`
+	SpamLabel   string          `json:"spam_label,omitempty"`   // "spam" or "ham" when marked for training
+	SpamTrained string          `json:"spam_trained,omitempty"` // Label the Bayes model was last trained with
+
+	// SMTP envelope and connection the email was received on
+	EnvelopeFrom string   `json:"envelope_from,omitempty"`
+	EnvelopeTo   []string `json:"envelope_to,omitempty"`
+	RemoteIP     string   `json:"remote_ip,omitempty"`
+	Helo         string   `json:"helo,omitempty"`
+	TLSVersion   string   `json:"tls_version,omitempty"`
+	TLSCipher    string   `json:"tls_cipher,omitempty"`
+
+	// S/MIME or PGP encryption and signature of the message
+	Security        json.RawMessage `json:"security,omitempty"`
+	SignatureStatus string          `json:"signature_status,omitempty"` // "valid", "invalid", "untrusted" or "none"
+	Signer          string          `json:"signer,omitempty"`           // Address of the signing certificate or key
+
+	// Per-recipient runs of a split delivery share the parent's raw message
+	ParentID  *int64 `json:"parent_id,omitempty"`
+	Recipient string `json:"recipient,omitempty"` // Envelope recipient this run was routed for
+}
+
+// Spam training labels
+const (
+	SpamLabelSpam = "spam"
+	SpamLabelHam  = "ham"
+)
+
+// SpamTokenCounts holds the Bayes training counts for a token
+type SpamTokenCounts struct {
+	Spam int64 `json:"spam"`
+	Ham  int64 `json:"ham"`
 }
 
 // EmailStatus represents the processing status of an email
 type EmailStatus string
 
 const (
-	EmailStatusPending    EmailStatus = "pending"
-	EmailStatusProcessing EmailStatus = "processing"
-	EmailStatusCompleted  EmailStatus = "completed"
-	EmailStatusFailed     EmailStatus = "failed"
+	EmailStatusPending     EmailStatus = "pending"
+	EmailStatusProcessing  EmailStatus = "processing"
+	EmailStatusCompleted   EmailStatus = "completed"
+	EmailStatusFailed      EmailStatus = "failed"
+	EmailStatusSplit       EmailStatus = "split"       // Processed as one child email per recipient
+	EmailStatusQuarantined EmailStatus = "quarantined" // Held by a quarantine rule and not processed
 )
 
 // ProcessingLog represents a log entry for email processing
@@ -60,11 +98,99 @@ type ToolCall struct {
 
 // Attachment represents an email attachment metadata
 type Attachment struct {
+	ID          int64  `json:"id"`
 	Filename    string `json:"filename"`
 	ContentType string `json:"content_type"`
 	Size        int64  `json:"size"`
 	ContentID   string `json:"content_id"`
-	Data        []byte `json:"-"` // Not stored in JSON, loaded separately
+	Inline      bool   `json:"inline,omitempty"` // Shown in the HTML body via cid:<content_id>
+	SHA256      string `json:"sha256,omitempty"` // Blob holding the content; empty for rows stored inline
+	Data        []byte `json:"-"`                // Not stored in JSON, loaded separately
+	// Cached text extraction; ExtractedAt is nil until extraction is attempted
+	ExtractedText string     `json:"extracted_text,omitempty"`
+	ExtractError  string     `json:"extract_error,omitempty"`
+	ExtractedAt   *time.Time `json:"extracted_at,omitempty"`
+	// Malware scan; ScanResult is empty until the attachment is scanned
+	ScanResult string `json:"scan_result,omitempty"`
+	Virus      string `json:"virus,omitempty"` // Signature name when infected
+}
+
+// Attachment scan results
+const (
+	ScanResultClean    = "clean"
+	ScanResultInfected = "infected"
+	ScanResultSkipped  = "skipped" // Too large to scan
+	ScanResultError    = "error"
+)
+
+// Withheld returns why the attachment's content must not be read, or "" if
+// it may be. Content the virus scan failed on or skipped is withheld like
+// infected content, so a scanner outage never lets unscanned files through.
+func (a *Attachment) Withheld() string {
+	switch {
+	case a.Virus != "":
+		return "infected with " + a.Virus
+	case a.ScanResult == ScanResultError:
+		return "the virus scan failed"
+	case a.ScanResult == ScanResultSkipped:
+		return "too large to scan for viruses"
+	}
+	return ""
+}
+
+// SMTPUser is a submission account checked by SMTP AUTH
+type SMTPUser struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// GreylistEntry is a greylisting triplet
+type GreylistEntry struct {
+	ClientNet string     `json:"client_net"` // Client network (IPv4 /24 or IPv6 /64)
+	Sender    string     `json:"sender"`
+	Recipient string     `json:"recipient"`
+	FirstSeen time.Time  `json:"first_seen"`
+	LastSeen  time.Time  `json:"last_seen"`
+	PassedAt  *time.Time `json:"passed_at"`
+	Attempts  int        `json:"attempts"`
+}
+
+// Thread directions
+const (
+	ThreadDirectionInbound  = "inbound"
+	ThreadDirectionOutbound = "outbound"
+)
+
+// Thread groups the messages of a conversation
+type Thread struct {
+	ID        int64     `json:"id"`
+	Subject   string    `json:"subject"` // Normalized, for matching replies without references
+	Mailbox   string    `json:"mailbox"` // Mailbox of the messages; threads never span mailboxes
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ThreadMessage is an inbound email or a message we sent, within a thread
+type ThreadMessage struct {
+	ID        int64     `json:"id"`
+	ThreadID  int64     `json:"thread_id"`
+	EmailID   *int64    `json:"email_id,omitempty"` // Inbound email row; nil for outbound mail
+	Direction string    `json:"direction"`
+	MessageID string    `json:"message_id"`
+	From      string    `json:"from"`
+	To        []string  `json:"to"`
+	Subject   string    `json:"subject"`
+	TextBody  string    `json:"text_body"` // Inbound bodies are read from the email row
+	HTMLBody  string    `json:"html_body,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	LLMOutput string    `json:"llm_output,omitempty"` // Latest llm_complete output of an inbound email
+
+	// Used to find the thread when the message is added; not stored
+	References   []string `json:"-"` // Message-IDs the message replies to
+	SubjectKey   string   `json:"-"` // Normalized subject, stored on a new thread
+	MatchSubject bool     `json:"-"` // Without a known reference, join a recent thread with the same subject and a shared address
+	Mailbox      string   `json:"-"` // Mailbox whose threads the message may join, stored on a new thread
 }
 
 // EmailListFilter defines filter options for listing emails
@@ -1,19 +1,29 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
+
+	"github.com/emitt/emitt/internal/blobstore"
 )
 
+// ErrDuplicateEmail is returned by SaveEmail when a delivery with the same
+// Message-ID is already stored
+var ErrDuplicateEmail = errors.New("email already stored")
+
 // Store provides database operations
 type Store struct {
-	db *sql.DB
+	db    *sql.DB
+	blobs *blobstore.Store
 }
 
 // NewStore creates a new Store with the given database path
@@ -41,6 +51,17 @@ func NewStore(dbPath string) (*Store, error) {
 	return store, nil
 }
 
+// SetBlobStore moves raw messages and attachment content out of SQLite into a
+// content-addressed file store. Rows written before it was set stay readable.
+func (s *Store) SetBlobStore(blobs *blobstore.Store) {
+	s.blobs = blobs
+}
+
+// Blobs returns the blob store, or nil if content is stored inline
+func (s *Store) Blobs() *blobstore.Store {
+	return s.blobs
+}
+
 // Close closes the database connection
 func (s *Store) Close() error {
 	return s.db.Close()
@@ -51,7 +72,7 @@ func (s *Store) migrate() error {
 	migrations := []string{
 		`CREATE TABLE IF NOT EXISTS emails (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			message_id TEXT UNIQUE,
+			message_id TEXT,
 			from_addr TEXT NOT NULL,
 			to_addrs TEXT NOT NULL,
 			cc_addrs TEXT,
@@ -69,6 +90,7 @@ func (s *Store) migrate() error {
 		`CREATE INDEX IF NOT EXISTS idx_emails_status ON emails(status)`,
 		`CREATE INDEX IF NOT EXISTS idx_emails_mailbox ON emails(mailbox_name)`,
 		`CREATE INDEX IF NOT EXISTS idx_emails_received ON emails(received_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_emails_message_id ON emails(message_id)`,
 
 		`CREATE TABLE IF NOT EXISTS processing_logs (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
@@ -107,6 +129,57 @@ func (s *Store) migrate() error {
 			FOREIGN KEY (email_id) REFERENCES emails(id) ON DELETE CASCADE
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_attachments_email ON attachments(email_id)`,
+
+		`CREATE TABLE IF NOT EXISTS smtp_users (
+			username TEXT PRIMARY KEY COLLATE NOCASE,
+			password_hash TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+
+		`CREATE TABLE IF NOT EXISTS greylist (
+			client_net TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			recipient TEXT NOT NULL,
+			first_seen DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL,
+			passed_at DATETIME,
+			attempts INTEGER DEFAULT 1,
+			PRIMARY KEY (client_net, sender, recipient)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_greylist_last_seen ON greylist(last_seen)`,
+
+		`CREATE TABLE IF NOT EXISTS threads (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			subject TEXT,
+			created_at DATETIME NOT NULL,
+			updated_at DATETIME NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_threads_subject ON threads(subject, updated_at)`,
+
+		`CREATE TABLE IF NOT EXISTS thread_messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			thread_id INTEGER NOT NULL,
+			email_id INTEGER,
+			direction TEXT NOT NULL,
+			message_id TEXT,
+			from_addr TEXT,
+			to_addrs TEXT,
+			subject TEXT,
+			text_body TEXT,
+			html_body TEXT,
+			created_at DATETIME NOT NULL,
+			FOREIGN KEY (thread_id) REFERENCES threads(id) ON DELETE CASCADE,
+			FOREIGN KEY (email_id) REFERENCES emails(id) ON DELETE CASCADE
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_thread_messages_thread ON thread_messages(thread_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_thread_messages_email ON thread_messages(email_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_thread_messages_message_id ON thread_messages(message_id)`,
+
+		`CREATE TABLE IF NOT EXISTS spam_tokens (
+			token TEXT PRIMARY KEY,
+			spam_count INTEGER NOT NULL DEFAULT 0,
+			ham_count INTEGER NOT NULL DEFAULT 0
+		)`,
 	}
 
 	for _, m := range migrations {
@@ -115,30 +188,227 @@ func (s *Store) migrate() error {
 		}
 	}
 
+	// Columns added after the initial schema
+	columns := []struct {
+		table, name, definition string
+	}{
+		{"emails", "auth_results", "TEXT"},
+		{"emails", "auth_user", "TEXT"},
+		{"emails", "spam_score", "REAL"},
+		{"emails", "spam_report", "TEXT"},
+		{"emails", "spam_label", "TEXT"},
+		{"emails", "spam_trained", "TEXT"},
+		{"emails", "raw_sha256", "TEXT"},
+		{"attachments", "sha256", "TEXT"},
+		{"emails", "envelope_from", "TEXT"},
+		{"emails", "envelope_to", "TEXT"},
+		{"emails", "remote_ip", "TEXT"},
+		{"emails", "helo", "TEXT"},
+		{"emails", "tls_version", "TEXT"},
+		{"emails", "tls_cipher", "TEXT"},
+		{"emails", "parent_id", "INTEGER REFERENCES emails(id) ON DELETE CASCADE"},
+		{"emails", "recipient", "TEXT"},
+		{"attachments", "inline", "INTEGER NOT NULL DEFAULT 0"},
+		{"attachments", "extracted_text", "TEXT"},
+		{"attachments", "extract_error", "TEXT"},
+		{"attachments", "extracted_at", "DATETIME"},
+		{"emails", "security", "TEXT"},
+		{"emails", "signature_status", "TEXT"},
+		{"emails", "signer", "TEXT"},
+		{"attachments", "scan_result", "TEXT"},
+		{"attachments", "virus", "TEXT"},
+		{"emails", "claimed_at", "DATETIME"},
+		{"threads", "mailbox", "TEXT"},
+	}
+
+	for _, c := range columns {
+		if err := s.addColumn(c.table, c.name, c.definition); err != nil {
+			return fmt.Errorf("migration failed: %w", err)
+		}
+	}
+
+	if err := s.dropMessageIDUnique(); err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	if _, err := s.db.Exec(`CREATE INDEX IF NOT EXISTS idx_emails_parent ON emails(parent_id)`); err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	if err := s.uniqueMessageID(); err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+
 	return nil
 }
 
-// SaveEmail stores a new email record
+// dropMessageIDUnique rebuilds the emails table of older databases without the
+// UNIQUE constraint on message_id, which also applied to the per-recipient runs
+// split from a delivery. SQLite cannot drop a constraint in place; deliveries
+// stay unique through uniqueMessageID.
+func (s *Store) dropMessageIDUnique() error {
+	var ddl string
+	if err := s.db.QueryRow(`SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'emails'`).Scan(&ddl); err != nil {
+		return err
+	}
+	if !strings.Contains(ddl, "message_id TEXT UNIQUE") {
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Dropping the old table must not cascade to attachments and logs
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys=OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys=ON")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var indexes []string
+	rows, err := tx.Query(`SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = 'emails' AND sql IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var sql string
+		if err := rows.Scan(&sql); err != nil {
+			rows.Close()
+			return err
+		}
+		indexes = append(indexes, sql)
+	}
+	rows.Close()
+
+	ddl = strings.Replace(ddl, "message_id TEXT UNIQUE", "message_id TEXT", 1)
+	ddl = strings.Replace(ddl, "CREATE TABLE emails", "CREATE TABLE emails_rebuild", 1)
+	statements := []string{
+		ddl,
+		`INSERT INTO emails_rebuild SELECT * FROM emails`,
+		`DROP TABLE emails`,
+		`ALTER TABLE emails_rebuild RENAME TO emails`,
+	}
+	for _, stmt := range append(statements, indexes...) {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// uniqueMessageID keeps one delivery per Message-ID. Split runs share their
+// parent's Message-ID and messages without one are never deduplicated.
+// Redeliveries stored before the index existed keep their rows but lose the
+// Message-ID.
+func (s *Store) uniqueMessageID() error {
+	statements := []string{
+		`UPDATE emails SET message_id = ''
+		WHERE parent_id IS NULL AND message_id != '' AND id NOT IN (
+			SELECT MIN(id) FROM emails WHERE parent_id IS NULL AND message_id != '' GROUP BY message_id
+		)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_emails_message_id_unique
+		ON emails(message_id) WHERE parent_id IS NULL AND message_id != ''`,
+	}
+	for _, stmt := range statements {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to an existing table if it is missing
+func (s *Store) addColumn(table, name, definition string) error {
+	rows, err := s.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var colName, colType string
+		var dflt interface{}
+		if err := rows.Scan(&cid, &colName, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if strings.EqualFold(colName, name) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = s.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, name, definition))
+	return err
+}
+
+// SaveEmail stores a new email record. If a delivery with the same Message-ID
+// is already stored, it sets email.ID to that row and returns ErrDuplicateEmail.
 func (s *Store) SaveEmail(ctx context.Context, email *Email) error {
+	if s.blobs != nil && email.RawSHA256 == "" && len(email.RawMessage) > 0 {
+		sum, _, err := s.blobs.Put(bytes.NewReader(email.RawMessage))
+		if err != nil {
+			return fmt.Errorf("failed to save email: %w", err)
+		}
+		email.RawSHA256 = sum
+	}
+	raw := email.RawMessage
+	if email.RawSHA256 != "" {
+		raw = nil
+	}
+
 	toJSON, _ := json.Marshal(email.To)
 	ccJSON, _ := json.Marshal(email.Cc)
+	var envelopeTo sql.NullString
+	if len(email.EnvelopeTo) > 0 {
+		b, _ := json.Marshal(email.EnvelopeTo)
+		envelopeTo = nullString(string(b))
+	}
 
 	result, err := s.db.ExecContext(ctx, `
 		INSERT INTO emails (
 			message_id, from_addr, to_addrs, cc_addrs, subject,
 			text_body, html_body, raw_message, headers, attachments,
-			received_at, processed_at, mailbox_name, status
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			received_at, processed_at, mailbox_name, status, auth_results,
+			auth_user, spam_score, spam_report, raw_sha256,
+			envelope_from, envelope_to, remote_ip, helo, tls_version, tls_cipher,
+			security, signature_status, signer
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT DO NOTHING
 	`,
 		email.MessageID, email.From, string(toJSON), string(ccJSON),
-		email.Subject, email.TextBody, email.HTMLBody, email.RawMessage,
+		email.Subject, email.TextBody, email.HTMLBody, raw,
 		string(email.Headers), string(email.Attachments),
 		email.ReceivedAt, email.ProcessedAt, email.MailboxName, email.Status,
+		string(email.AuthResults), email.AuthUser, email.SpamScore, string(email.SpamReport),
+		nullString(email.RawSHA256),
+		email.EnvelopeFrom, envelopeTo, nullString(email.RemoteIP), nullString(email.Helo),
+		nullString(email.TLSVersion), nullString(email.TLSCipher),
+		nullString(string(email.Security)), nullString(email.SignatureStatus), nullString(email.Signer),
 	)
 	if err != nil {
 		return fmt.Errorf("failed to save email: %w", err)
 	}
 
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		if err := s.db.QueryRowContext(ctx, `
+			SELECT id FROM emails WHERE message_id = ? AND parent_id IS NULL
+		`, email.MessageID).Scan(&email.ID); err != nil {
+			return fmt.Errorf("failed to find stored email: %w", err)
+		}
+		return ErrDuplicateEmail
+	}
+
 	id, err := result.LastInsertId()
 	if err != nil {
 		return fmt.Errorf("failed to get last insert id: %w", err)
@@ -153,17 +423,31 @@ func (s *Store) GetEmail(ctx context.Context, id int64) (*Email, error) {
 	var email Email
 	var toJSON, ccJSON string
 	var processedAt sql.NullTime
+	var headers, attachments, rawSHA256 sql.NullString
+	var authResults, authUser sql.NullString
+	var spamScore sql.NullFloat64
+	var spamReport, spamLabel, spamTrained sql.NullString
+	var env envelopeColumns
+	var sec securityColumns
 
 	err := s.db.QueryRowContext(ctx, `
 		SELECT id, message_id, from_addr, to_addrs, cc_addrs, subject,
-			   text_body, html_body, raw_message, headers, attachments,
-			   received_at, processed_at, mailbox_name, status
+			   text_body, html_body,
+			   COALESCE(raw_message, (SELECT p.raw_message FROM emails p WHERE p.id = emails.parent_id)),
+			   headers, attachments,
+			   received_at, processed_at, mailbox_name, status, auth_results,
+			   auth_user, spam_score, spam_report, spam_label, spam_trained, raw_sha256,
+			   envelope_from, envelope_to, remote_ip, helo, tls_version, tls_cipher,
+			   parent_id, recipient, security, signature_status, signer
 		FROM emails WHERE id = ?
 	`, id).Scan(
 		&email.ID, &email.MessageID, &email.From, &toJSON, &ccJSON,
 		&email.Subject, &email.TextBody, &email.HTMLBody, &email.RawMessage,
-		&email.Headers, &email.Attachments,
+		&headers, &attachments,
 		&email.ReceivedAt, &processedAt, &email.MailboxName, &email.Status,
+		&authResults, &authUser, &spamScore, &spamReport, &spamLabel, &spamTrained, &rawSHA256,
+		&env.from, &env.to, &env.remoteIP, &env.helo, &env.tlsVersion, &env.tlsCipher,
+		&env.parentID, &env.recipient, &sec.security, &sec.status, &sec.signer,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -177,10 +461,73 @@ func (s *Store) GetEmail(ctx context.Context, id int64) (*Email, error) {
 	if processedAt.Valid {
 		email.ProcessedAt = &processedAt.Time
 	}
+	if headers.String != "" {
+		email.Headers = json.RawMessage(headers.String)
+	}
+	if attachments.String != "" {
+		email.Attachments = json.RawMessage(attachments.String)
+	}
+	if authResults.Valid && authResults.String != "" {
+		email.AuthResults = json.RawMessage(authResults.String)
+	}
+	email.AuthUser = authUser.String
+	email.RawSHA256 = rawSHA256.String
+	setSpamFields(&email, spamScore, spamReport, spamLabel, spamTrained)
+	env.apply(&email)
+	sec.apply(&email)
 
 	return &email, nil
 }
 
+// envelopeColumns holds the nullable envelope columns of an email row
+type envelopeColumns struct {
+	from, to, remoteIP, helo, tlsVersion, tlsCipher sql.NullString
+	parentID                                        sql.NullInt64
+	recipient                                       sql.NullString
+}
+
+// apply copies the envelope columns onto an email
+func (c *envelopeColumns) apply(email *Email) {
+	email.EnvelopeFrom = c.from.String
+	if c.to.String != "" {
+		json.Unmarshal([]byte(c.to.String), &email.EnvelopeTo)
+	}
+	email.RemoteIP = c.remoteIP.String
+	email.Helo = c.helo.String
+	email.TLSVersion = c.tlsVersion.String
+	email.TLSCipher = c.tlsCipher.String
+	if c.parentID.Valid {
+		email.ParentID = &c.parentID.Int64
+	}
+	email.Recipient = c.recipient.String
+}
+
+// securityColumns holds the nullable signature columns of an email row
+type securityColumns struct {
+	security, status, signer sql.NullString
+}
+
+// apply copies the signature columns onto an email
+func (c *securityColumns) apply(email *Email) {
+	if c.security.String != "" {
+		email.Security = json.RawMessage(c.security.String)
+	}
+	email.SignatureStatus = c.status.String
+	email.Signer = c.signer.String
+}
+
+// setSpamFields copies nullable spam columns onto an email
+func setSpamFields(email *Email, score sql.NullFloat64, report, label, trained sql.NullString) {
+	if score.Valid {
+		email.SpamScore = &score.Float64
+	}
+	if report.Valid && report.String != "" {
+		email.SpamReport = json.RawMessage(report.String)
+	}
+	email.SpamLabel = label.String
+	email.SpamTrained = trained.String
+}
+
 // UpdateEmailStatus updates the status of an email
 func (s *Store) UpdateEmailStatus(ctx context.Context, id int64, status EmailStatus) error {
 	var processedAt *time.Time
@@ -199,6 +546,116 @@ func (s *Store) UpdateEmailStatus(ctx context.Context, id int64, status EmailSta
 	return nil
 }
 
+// ClaimEmail moves a pending email to processing, returning false if another
+// worker already claimed it
+func (s *Store) ClaimEmail(ctx context.Context, id int64) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE emails SET status = ?, claimed_at = ? WHERE id = ? AND status = ?
+	`, EmailStatusProcessing, time.Now(), id, EmailStatusPending)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim email: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim email: %w", err)
+	}
+	return n == 1, nil
+}
+
+// RequeueStaleEmails resets emails claimed as processing before the given time
+// back to pending, so mail claimed just before a crash is processed again.
+// It returns the number of requeued emails.
+func (s *Store) RequeueStaleEmails(ctx context.Context, claimedBefore time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE emails SET status = ?, claimed_at = NULL
+		WHERE status = ? AND (claimed_at IS NULL OR claimed_at < ?)
+	`, EmailStatusPending, EmailStatusProcessing, claimedBefore)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue stale emails: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue stale emails: %w", err)
+	}
+	return n, nil
+}
+
+// SplitEmail marks an email as split and creates a pending child email for each
+// recipient. Children reference the parent's raw message instead of copying it
+// and carry its metadata, spam result and attachments with their scan results.
+func (s *Store) SplitEmail(ctx context.Context, parentID int64, recipients []string) ([]int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split email: %w", err)
+	}
+	defer tx.Rollback()
+
+	ids := make([]int64, 0, len(recipients))
+	for _, rcpt := range recipients {
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO emails (
+				message_id, from_addr, to_addrs, cc_addrs, subject,
+				text_body, html_body, headers, attachments,
+				received_at, mailbox_name, status, auth_results,
+				auth_user, spam_score, spam_report, raw_sha256,
+				envelope_from, envelope_to, remote_ip, helo, tls_version, tls_cipher,
+				parent_id, recipient, security, signature_status, signer
+			)
+			SELECT message_id, from_addr, to_addrs, cc_addrs, subject,
+				   text_body, html_body, headers, attachments,
+				   received_at, mailbox_name, ?, auth_results,
+				   auth_user, spam_score, spam_report, raw_sha256,
+				   envelope_from, envelope_to, remote_ip, helo, tls_version, tls_cipher,
+				   id, ?, security, signature_status, signer
+			FROM emails WHERE id = ?
+		`, EmailStatusPending, rcpt, parentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split email: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get last insert id: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO attachments (email_id, filename, content_type, size, content_id, inline, data, sha256,
+				scan_result, virus)
+			SELECT ?, filename, content_type, size, content_id, inline, data, sha256,
+				   scan_result, virus
+			FROM attachments WHERE email_id = ?
+		`, id, parentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy attachments: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE emails SET status = ?, processed_at = ? WHERE id = ?
+	`, EmailStatusSplit, time.Now(), parentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split email: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to split email: %w", err)
+	}
+	return ids, nil
+}
+
+// UpdateEmailSpam stores the spam score and report of an email
+func (s *Store) UpdateEmailSpam(ctx context.Context, id int64, score float64, report json.RawMessage) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE emails SET spam_score = ?, spam_report = ? WHERE id = ?
+	`, score, string(report), id)
+	if err != nil {
+		return fmt.Errorf("failed to update spam score: %w", err)
+	}
+	return nil
+}
+
 // ListEmails returns emails matching the filter criteria
 func (s *Store) ListEmails(ctx context.Context, filter EmailListFilter) ([]*Email, error) {
 	var conditions []string
@@ -224,7 +681,10 @@ func (s *Store) ListEmails(ctx context.Context, filter EmailListFilter) ([]*Emai
 	query := `
 		SELECT id, message_id, from_addr, to_addrs, cc_addrs, subject,
 			   text_body, html_body, headers, attachments,
-			   received_at, processed_at, mailbox_name, status
+			   received_at, processed_at, mailbox_name, status, auth_results,
+			   auth_user, spam_score, spam_report, spam_label, spam_trained,
+			   envelope_from, envelope_to, remote_ip, helo, tls_version, tls_cipher,
+			   parent_id, recipient, security, signature_status, signer
 		FROM emails
 	`
 
@@ -252,12 +712,21 @@ func (s *Store) ListEmails(ctx context.Context, filter EmailListFilter) ([]*Emai
 		var email Email
 		var toJSON, ccJSON string
 		var processedAt sql.NullTime
+		var headers, attachments sql.NullString
+		var authResults, authUser sql.NullString
+		var spamScore sql.NullFloat64
+		var spamReport, spamLabel, spamTrained sql.NullString
+		var env envelopeColumns
+		var sec securityColumns
 
 		if err := rows.Scan(
 			&email.ID, &email.MessageID, &email.From, &toJSON, &ccJSON,
 			&email.Subject, &email.TextBody, &email.HTMLBody,
-			&email.Headers, &email.Attachments,
+			&headers, &attachments,
 			&email.ReceivedAt, &processedAt, &email.MailboxName, &email.Status,
+			&authResults, &authUser, &spamScore, &spamReport, &spamLabel, &spamTrained,
+			&env.from, &env.to, &env.remoteIP, &env.helo, &env.tlsVersion, &env.tlsCipher,
+			&env.parentID, &env.recipient, &sec.security, &sec.status, &sec.signer,
 		); err != nil {
 			return nil, fmt.Errorf("failed to scan email: %w", err)
 		}
@@ -267,6 +736,19 @@ func (s *Store) ListEmails(ctx context.Context, filter EmailListFilter) ([]*Emai
 		if processedAt.Valid {
 			email.ProcessedAt = &processedAt.Time
 		}
+		if headers.String != "" {
+			email.Headers = json.RawMessage(headers.String)
+		}
+		if attachments.String != "" {
+			email.Attachments = json.RawMessage(attachments.String)
+		}
+		if authResults.Valid && authResults.String != "" {
+			email.AuthResults = json.RawMessage(authResults.String)
+		}
+		email.AuthUser = authUser.String
+		setSpamFields(&email, spamScore, spamReport, spamLabel, spamTrained)
+		env.apply(&email)
+		sec.apply(&email)
 
 		emails = append(emails, &email)
 	}
@@ -409,21 +891,36 @@ func (s *Store) GetStats(ctx context.Context) (*EmailStats, error) {
 
 // SaveAttachment stores an attachment
 func (s *Store) SaveAttachment(ctx context.Context, emailID int64, att *Attachment) error {
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO attachments (email_id, filename, content_type, size, content_id, data)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, emailID, att.Filename, att.ContentType, att.Size, att.ContentID, att.Data)
+	if s.blobs != nil && att.SHA256 == "" && len(att.Data) > 0 {
+		sum, _, err := s.blobs.Put(bytes.NewReader(att.Data))
+		if err != nil {
+			return fmt.Errorf("failed to save attachment: %w", err)
+		}
+		att.SHA256 = sum
+	}
+	data := att.Data
+	if att.SHA256 != "" {
+		data = nil
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		INSERT INTO attachments (email_id, filename, content_type, size, content_id, inline, data, sha256)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, emailID, att.Filename, att.ContentType, att.Size, nullString(att.ContentID), att.Inline, data, nullString(att.SHA256))
 	if err != nil {
 		return fmt.Errorf("failed to save attachment: %w", err)
 	}
+	att.ID, _ = result.LastInsertId()
 	return nil
 }
 
-// GetAttachments returns all attachments for an email
+// GetAttachments returns all attachments for an email. Content kept in the
+// blob store is not loaded; read it with OpenAttachment.
 func (s *Store) GetAttachments(ctx context.Context, emailID int64) ([]*Attachment, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT filename, content_type, size, content_id, data
-		FROM attachments WHERE email_id = ?
+		SELECT id, filename, content_type, size, content_id, inline, data, sha256,
+			extracted_text, extract_error, extracted_at, scan_result, virus
+		FROM attachments WHERE email_id = ? ORDER BY id
 	`, emailID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get attachments: %w", err)
@@ -433,15 +930,463 @@ func (s *Store) GetAttachments(ctx context.Context, emailID int64) ([]*Attachmen
 	var attachments []*Attachment
 	for rows.Next() {
 		var att Attachment
-		if err := rows.Scan(&att.Filename, &att.ContentType, &att.Size, &att.ContentID, &att.Data); err != nil {
+		var contentType, contentID, sum, text, extractErr, scanResult, virus sql.NullString
+		var extractedAt sql.NullTime
+		if err := rows.Scan(&att.ID, &att.Filename, &contentType, &att.Size, &contentID, &att.Inline, &att.Data, &sum,
+			&text, &extractErr, &extractedAt, &scanResult, &virus); err != nil {
 			return nil, fmt.Errorf("failed to scan attachment: %w", err)
 		}
+		att.ContentType = contentType.String
+		att.ContentID = contentID.String
+		att.SHA256 = sum.String
+		att.ExtractedText = text.String
+		att.ExtractError = extractErr.String
+		if extractedAt.Valid {
+			att.ExtractedAt = &extractedAt.Time
+		}
+		att.ScanResult = scanResult.String
+		att.Virus = virus.String
 		attachments = append(attachments, &att)
 	}
 
 	return attachments, nil
 }
 
+// UpdateAttachmentText caches the result of extracting an attachment's text
+func (s *Store) UpdateAttachmentText(ctx context.Context, id int64, text, extractErr string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE attachments SET extracted_text = ?, extract_error = ?, extracted_at = ?
+		WHERE id = ?
+	`, nullString(text), nullString(extractErr), time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update attachment text: %w", err)
+	}
+	return nil
+}
+
+// UpdateAttachmentScan records the result of scanning an attachment for malware
+func (s *Store) UpdateAttachmentScan(ctx context.Context, id int64, result, virus string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE attachments SET scan_result = ?, virus = ? WHERE id = ?
+	`, result, nullString(virus), id)
+	if err != nil {
+		return fmt.Errorf("failed to update attachment scan: %w", err)
+	}
+	return nil
+}
+
+// OpenAttachment returns a reader for an attachment's content
+func (s *Store) OpenAttachment(att *Attachment) (io.ReadCloser, error) {
+	return s.openContent(att.SHA256, att.Data)
+}
+
+// OpenRawMessage returns a reader for an email's raw message
+func (s *Store) OpenRawMessage(email *Email) (io.ReadCloser, error) {
+	return s.openContent(email.RawSHA256, email.RawMessage)
+}
+
+// openContent reads a blob reference, falling back to inline data
+func (s *Store) openContent(sum string, data []byte) (io.ReadCloser, error) {
+	if sum == "" {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if s.blobs == nil {
+		return nil, fmt.Errorf("blob %s referenced but no blob store is set", sum)
+	}
+	return s.blobs.Open(sum)
+}
+
+// nullString stores empty strings as NULL
+func nullString(v string) sql.NullString {
+	return sql.NullString{String: v, Valid: v != ""}
+}
+
+// GetSMTPUser returns a submission account, or nil if it does not exist
+func (s *Store) GetSMTPUser(ctx context.Context, username string) (*SMTPUser, error) {
+	var user SMTPUser
+	err := s.db.QueryRowContext(ctx, `
+		SELECT username, password_hash, created_at
+		FROM smtp_users WHERE username = ?
+	`, username).Scan(&user.Username, &user.PasswordHash, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get smtp user: %w", err)
+	}
+	return &user, nil
+}
+
+// SaveSMTPUser creates or updates a submission account
+func (s *Store) SaveSMTPUser(ctx context.Context, username, passwordHash string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO smtp_users (username, password_hash) VALUES (?, ?)
+		ON CONFLICT(username) DO UPDATE SET password_hash = excluded.password_hash
+	`, username, passwordHash)
+	if err != nil {
+		return fmt.Errorf("failed to save smtp user: %w", err)
+	}
+	return nil
+}
+
+// DeleteSMTPUser removes a submission account
+func (s *Store) DeleteSMTPUser(ctx context.Context, username string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM smtp_users WHERE username = ?`, username)
+	if err != nil {
+		return fmt.Errorf("failed to delete smtp user: %w", err)
+	}
+	return nil
+}
+
+// GetGreylistEntry returns a greylisting triplet, or nil if it has not been seen
+func (s *Store) GetGreylistEntry(ctx context.Context, clientNet, sender, recipient string) (*GreylistEntry, error) {
+	var entry GreylistEntry
+	var passedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+		SELECT client_net, sender, recipient, first_seen, last_seen, passed_at, attempts
+		FROM greylist WHERE client_net = ? AND sender = ? AND recipient = ?
+	`, clientNet, sender, recipient).Scan(
+		&entry.ClientNet, &entry.Sender, &entry.Recipient,
+		&entry.FirstSeen, &entry.LastSeen, &passedAt, &entry.Attempts,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get greylist entry: %w", err)
+	}
+	if passedAt.Valid {
+		entry.PassedAt = &passedAt.Time
+	}
+	return &entry, nil
+}
+
+// SaveGreylistEntry creates or updates a greylisting triplet
+func (s *Store) SaveGreylistEntry(ctx context.Context, entry *GreylistEntry) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO greylist (client_net, sender, recipient, first_seen, last_seen, passed_at, attempts)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(client_net, sender, recipient) DO UPDATE SET
+			first_seen = excluded.first_seen,
+			last_seen = excluded.last_seen,
+			passed_at = excluded.passed_at,
+			attempts = excluded.attempts
+	`, entry.ClientNet, entry.Sender, entry.Recipient,
+		entry.FirstSeen, entry.LastSeen, entry.PassedAt, entry.Attempts)
+	if err != nil {
+		return fmt.Errorf("failed to save greylist entry: %w", err)
+	}
+	return nil
+}
+
+// PruneGreylist deletes triplets not seen since the cutoff
+func (s *Store) PruneGreylist(ctx context.Context, before time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM greylist WHERE last_seen < ?`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune greylist: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// SetSpamLabel marks an email as spam or ham for Bayes training ("" clears the mark)
+func (s *Store) SetSpamLabel(ctx context.Context, id int64, label string) error {
+	if label != "" && label != SpamLabelSpam && label != SpamLabelHam {
+		return fmt.Errorf("invalid spam label %q", label)
+	}
+	_, err := s.db.ExecContext(ctx, `UPDATE emails SET spam_label = ? WHERE id = ?`, label, id)
+	if err != nil {
+		return fmt.Errorf("failed to set spam label: %w", err)
+	}
+	return nil
+}
+
+// GetUntrainedEmails returns emails whose spam label differs from the label they were trained with
+func (s *Store) GetUntrainedEmails(ctx context.Context, limit int) ([]*Email, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, subject, text_body, html_body, spam_label, spam_trained
+		FROM emails
+		WHERE COALESCE(spam_label, '') != COALESCE(spam_trained, '')
+		ORDER BY id LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get untrained emails: %w", err)
+	}
+	defer rows.Close()
+
+	var emails []*Email
+	for rows.Next() {
+		var email Email
+		var label, trained sql.NullString
+		if err := rows.Scan(&email.ID, &email.Subject, &email.TextBody, &email.HTMLBody, &label, &trained); err != nil {
+			return nil, fmt.Errorf("failed to scan email: %w", err)
+		}
+		email.SpamLabel = label.String
+		email.SpamTrained = trained.String
+		emails = append(emails, &email)
+	}
+
+	return emails, rows.Err()
+}
+
+// ApplySpamTraining moves an email's tokens from one class to another in a
+// single transaction and records the label it is now trained with. An empty
+// from or to means the email was or will be untrained.
+func (s *Store) ApplySpamTraining(ctx context.Context, emailID int64, tokens []string, from, to string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, token := range tokens {
+		var spamDelta, hamDelta int
+		switch from {
+		case SpamLabelSpam:
+			spamDelta--
+		case SpamLabelHam:
+			hamDelta--
+		}
+		switch to {
+		case SpamLabelSpam:
+			spamDelta++
+		case SpamLabelHam:
+			hamDelta++
+		}
+		if spamDelta == 0 && hamDelta == 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO spam_tokens (token, spam_count, ham_count) VALUES (?, MAX(?, 0), MAX(?, 0))
+			ON CONFLICT(token) DO UPDATE SET
+				spam_count = MAX(spam_count + ?, 0),
+				ham_count = MAX(ham_count + ?, 0)
+		`, token, spamDelta, hamDelta, spamDelta, hamDelta); err != nil {
+			return fmt.Errorf("failed to update spam token: %w", err)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE emails SET spam_trained = ? WHERE id = ?`, to, emailID); err != nil {
+		return fmt.Errorf("failed to mark email trained: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// GetSpamTokens returns the training counts for the given tokens
+func (s *Store) GetSpamTokens(ctx context.Context, tokens []string) (map[string]SpamTokenCounts, error) {
+	counts := make(map[string]SpamTokenCounts, len(tokens))
+
+	// Query in batches to stay under SQLite's variable limit
+	const batch = 500
+	for start := 0; start < len(tokens); start += batch {
+		end := start + batch
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		chunk := tokens[start:end]
+
+		args := make([]interface{}, len(chunk))
+		for i, t := range chunk {
+			args[i] = t
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(chunk)), ",")
+
+		rows, err := s.db.QueryContext(ctx,
+			`SELECT token, spam_count, ham_count FROM spam_tokens WHERE token IN (`+placeholders+`)`, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get spam tokens: %w", err)
+		}
+		for rows.Next() {
+			var token string
+			var c SpamTokenCounts
+			if err := rows.Scan(&token, &c.Spam, &c.Ham); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan spam token: %w", err)
+			}
+			counts[token] = c
+		}
+		rows.Close()
+	}
+
+	return counts, nil
+}
+
+// GetSpamTrainingCounts returns how many emails the Bayes model was trained with per class
+func (s *Store) GetSpamTrainingCounts(ctx context.Context) (spam, ham int64, err error) {
+	err = s.db.QueryRowContext(ctx, `
+		SELECT
+			COALESCE(SUM(CASE WHEN spam_trained = 'spam' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN spam_trained = 'ham' THEN 1 ELSE 0 END), 0)
+		FROM emails
+	`).Scan(&spam, &ham)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get spam training counts: %w", err)
+	}
+	return spam, ham, nil
+}
+
+// threadSubjectWindow is how recent a thread must be to be matched by subject
+const threadSubjectWindow = 30 * 24 * time.Hour
+
+// AddThreadMessage adds a message to the thread it belongs to, setting
+// msg.ThreadID. The thread is found from the message's references, then by
+// subject if allowed, among the threads of its mailbox that the sender took
+// part in; otherwise a new thread is started. Adding an email or
+// outbound Message-ID that is already threaded returns its existing thread.
+func (s *Store) AddThreadMessage(ctx context.Context, msg *ThreadMessage) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Already threaded, e.g. an email processed again after a restart
+	var existing *sql.Row
+	switch {
+	case msg.EmailID != nil:
+		existing = tx.QueryRowContext(ctx, `SELECT id, thread_id FROM thread_messages WHERE email_id = ?`, *msg.EmailID)
+	case msg.MessageID != "":
+		existing = tx.QueryRowContext(ctx, `
+			SELECT id, thread_id FROM thread_messages WHERE message_id = ? AND direction = ?
+		`, msg.MessageID, ThreadDirectionOutbound)
+	}
+	if existing != nil {
+		err := existing.Scan(&msg.ID, &msg.ThreadID)
+		if err == nil {
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to look up thread message: %w", err)
+		}
+	}
+
+	now := time.Now()
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = now
+	}
+
+	// Only threads of the same mailbox in which the sender took part can be
+	// joined; references are chosen by the sender, so knowing a Message-ID
+	// must not be enough to join someone else's conversation. Mail we send
+	// references only messages we replied to.
+	participant := `1`
+	args := []interface{}{msg.Mailbox}
+	if msg.Direction != ThreadDirectionOutbound {
+		participant = `EXISTS (
+			SELECT 1 FROM thread_messages p
+			WHERE p.thread_id = t.id AND (p.from_addr = ? COLLATE NOCASE OR p.to_addrs LIKE ?)
+		)`
+		args = append(args, msg.From, `%"`+msg.From+`"%`)
+	}
+
+	// The most recent reference wins
+	var threadID int64
+	for i := len(msg.References) - 1; i >= 0 && threadID == 0; i-- {
+		err := tx.QueryRowContext(ctx, `
+			SELECT m.thread_id FROM thread_messages m
+			JOIN threads t ON t.id = m.thread_id
+			WHERE m.message_id = ? AND COALESCE(t.mailbox, '') = ? AND `+participant+`
+			ORDER BY m.id DESC LIMIT 1
+		`, append([]interface{}{msg.References[i]}, args...)...).Scan(&threadID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to look up thread: %w", err)
+		}
+	}
+
+	if threadID == 0 && msg.MatchSubject && msg.SubjectKey != "" && msg.From != "" {
+		err := tx.QueryRowContext(ctx, `
+			SELECT t.id FROM threads t
+			WHERE t.subject = ? AND t.updated_at > ? AND COALESCE(t.mailbox, '') = ? AND `+participant+`
+			ORDER BY t.updated_at DESC LIMIT 1
+		`, append([]interface{}{msg.SubjectKey, now.Add(-threadSubjectWindow)}, args...)...).Scan(&threadID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("failed to look up thread by subject: %w", err)
+		}
+	}
+
+	if threadID == 0 {
+		result, err := tx.ExecContext(ctx, `
+			INSERT INTO threads (subject, mailbox, created_at, updated_at) VALUES (?, ?, ?, ?)
+		`, msg.SubjectKey, nullString(msg.Mailbox), msg.CreatedAt, msg.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("failed to create thread: %w", err)
+		}
+		threadID, _ = result.LastInsertId()
+	} else {
+		if _, err := tx.ExecContext(ctx, `UPDATE threads SET updated_at = ? WHERE id = ?`, msg.CreatedAt, threadID); err != nil {
+			return fmt.Errorf("failed to update thread: %w", err)
+		}
+	}
+
+	toJSON, _ := json.Marshal(msg.To)
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO thread_messages (thread_id, email_id, direction, message_id, from_addr, to_addrs,
+			subject, text_body, html_body, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, threadID, msg.EmailID, msg.Direction, nullString(msg.MessageID), msg.From, string(toJSON),
+		msg.Subject, nullString(msg.TextBody), nullString(msg.HTMLBody), msg.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save thread message: %w", err)
+	}
+	msg.ID, _ = result.LastInsertId()
+	msg.ThreadID = threadID
+
+	return tx.Commit()
+}
+
+// GetThreadHistory returns up to limit messages of an email's thread that were
+// added before it, oldest first. Inbound messages carry their email's body and
+// latest LLM output.
+func (s *Store) GetThreadHistory(ctx context.Context, emailID int64, limit int) ([]*ThreadMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT m.id, m.thread_id, m.email_id, m.direction, m.message_id, m.from_addr, m.to_addrs, m.subject,
+			COALESCE(m.text_body, e.text_body), COALESCE(m.html_body, e.html_body), m.created_at,
+			(SELECT l.output FROM processing_logs l
+				WHERE l.email_id = m.email_id AND l.step = 'llm_complete'
+				ORDER BY l.id DESC LIMIT 1)
+		FROM thread_messages m
+		LEFT JOIN emails e ON e.id = m.email_id
+		JOIN thread_messages cur ON cur.email_id = ? AND cur.thread_id = m.thread_id
+		WHERE m.id < cur.id
+		ORDER BY m.id DESC LIMIT ?
+	`, emailID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get thread history: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*ThreadMessage
+	for rows.Next() {
+		var msg ThreadMessage
+		var msgEmailID sql.NullInt64
+		var messageID, from, toJSON, subject, textBody, htmlBody, output sql.NullString
+		if err := rows.Scan(&msg.ID, &msg.ThreadID, &msgEmailID, &msg.Direction, &messageID, &from, &toJSON,
+			&subject, &textBody, &htmlBody, &msg.CreatedAt, &output); err != nil {
+			return nil, fmt.Errorf("failed to scan thread message: %w", err)
+		}
+		if msgEmailID.Valid {
+			msg.EmailID = &msgEmailID.Int64
+		}
+		msg.MessageID = messageID.String
+		msg.From = from.String
+		json.Unmarshal([]byte(toJSON.String), &msg.To)
+		msg.Subject = subject.String
+		msg.TextBody = textBody.String
+		msg.HTMLBody = htmlBody.String
+		msg.LLMOutput = output.String
+		messages = append(messages, &msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get thread history: %w", err)
+	}
+
+	// Oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
 // DB returns the underlying database connection for custom queries
 func (s *Store) DB() *sql.DB {
 	return s.db
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	store, err := NewStore(filepath.Join(t.TempDir(), "emitt.db"))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// saveTestEmail stores a pending email and returns its ID
+func saveTestEmail(t *testing.T, store *Store, n int) int64 {
+	t.Helper()
+	e := &Email{
+		MessageID:  fmt.Sprintf("<msg-%d@test>", n),
+		From:       "sender@example.org",
+		To:         []string{"inbox@example.com"},
+		Subject:    "hello",
+		TextBody:   "body",
+		ReceivedAt: time.Now(),
+		Status:     EmailStatusPending,
+	}
+	if err := store.SaveEmail(context.Background(), e); err != nil {
+		t.Fatalf("SaveEmail: %v", err)
+	}
+	return e.ID
+}
+
+func pendingIDs(t *testing.T, store *Store) map[int64]bool {
+	t.Helper()
+	emails, err := store.GetPendingEmails(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("GetPendingEmails: %v", err)
+	}
+	ids := make(map[int64]bool)
+	for _, e := range emails {
+		ids[e.ID] = true
+	}
+	return ids
+}
+
+func TestClaimEmail(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	id := saveTestEmail(t, store, 1)
+
+	claimed, err := store.ClaimEmail(ctx, id)
+	if err != nil || !claimed {
+		t.Fatalf("first claim = %v, %v; want true", claimed, err)
+	}
+	claimed, err = store.ClaimEmail(ctx, id)
+	if err != nil || claimed {
+		t.Fatalf("second claim = %v, %v; want false", claimed, err)
+	}
+	if pendingIDs(t, store)[id] {
+		t.Error("claimed email still listed as pending")
+	}
+}
+
+func TestRequeueStaleEmails(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+
+	stale := saveTestEmail(t, store, 1)
+	if _, err := store.ClaimEmail(ctx, stale); err != nil {
+		t.Fatalf("ClaimEmail: %v", err)
+	}
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	fresh := saveTestEmail(t, store, 2)
+	if _, err := store.ClaimEmail(ctx, fresh); err != nil {
+		t.Fatalf("ClaimEmail: %v", err)
+	}
+	done := saveTestEmail(t, store, 3)
+	if _, err := store.ClaimEmail(ctx, done); err != nil {
+		t.Fatalf("ClaimEmail: %v", err)
+	}
+	if err := store.UpdateEmailStatus(ctx, done, EmailStatusCompleted); err != nil {
+		t.Fatalf("UpdateEmailStatus: %v", err)
+	}
+
+	n, err := store.RequeueStaleEmails(ctx, cutoff)
+	if err != nil {
+		t.Fatalf("RequeueStaleEmails: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("requeued %d emails, want 1", n)
+	}
+
+	pending := pendingIDs(t, store)
+	if !pending[stale] {
+		t.Error("email claimed before the cutoff was not requeued")
+	}
+	if pending[fresh] {
+		t.Error("email claimed after the cutoff was requeued")
+	}
+	if pending[done] {
+		t.Error("completed email was requeued")
+	}
+
+	// The requeued email can be claimed again
+	claimed, err := store.ClaimEmail(ctx, stale)
+	if err != nil || !claimed {
+		t.Errorf("claim after requeue = %v, %v; want true", claimed, err)
+	}
+}
+
+func TestSaveEmailDuplicateMessageID(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	first := saveTestEmail(t, store, 1)
+
+	dup := &Email{
+		MessageID:  "<msg-1@test>",
+		From:       "sender@example.org",
+		ReceivedAt: time.Now(),
+		Status:     EmailStatusPending,
+	}
+	if err := store.SaveEmail(ctx, dup); !errors.Is(err, ErrDuplicateEmail) {
+		t.Fatalf("SaveEmail of a redelivery = %v, want ErrDuplicateEmail", err)
+	}
+	if dup.ID != first {
+		t.Errorf("duplicate ID = %d, want the stored row %d", dup.ID, first)
+	}
+
+	// Messages without a Message-ID are never deduplicated
+	for i := 0; i < 2; i++ {
+		e := &Email{From: "sender@example.org", ReceivedAt: time.Now(), Status: EmailStatusPending}
+		if err := store.SaveEmail(ctx, e); err != nil {
+			t.Fatalf("SaveEmail without Message-ID: %v", err)
+		}
+	}
+
+	// Split runs share their parent's Message-ID
+	children, err := store.SplitEmail(ctx, first, []string{"a@example.com", "b@example.com"})
+	if err != nil {
+		t.Fatalf("SplitEmail: %v", err)
+	}
+	if len(children) != 2 {
+		t.Errorf("got %d split runs, want 2", len(children))
+	}
+}
+
+func TestMigrateDeduplicatesMessageIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "emitt.db")
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	first := saveTestEmail(t, store, 1)
+
+	// Redeliveries stored while the unique index was missing
+	ctx := context.Background()
+	if _, err := store.db.ExecContext(ctx, `DROP INDEX idx_emails_message_id_unique`); err != nil {
+		t.Fatal(err)
+	}
+	second := saveTestEmail(t, store, 1)
+	store.Close()
+
+	store, err = NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore after duplicates: %v", err)
+	}
+	defer store.Close()
+
+	kept, err := store.GetEmail(ctx, first)
+	if err != nil || kept.MessageID != "<msg-1@test>" {
+		t.Errorf("first delivery = %+v, %v; want its Message-ID kept", kept, err)
+	}
+	cleared, err := store.GetEmail(ctx, second)
+	if err != nil || cleared.MessageID != "" {
+		t.Errorf("redelivery = %+v, %v; want its Message-ID cleared", cleared, err)
+	}
+	if err := store.SaveEmail(ctx, &Email{MessageID: "<msg-1@test>", From: "x", ReceivedAt: time.Now()}); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("SaveEmail after migration = %v, want ErrDuplicateEmail", err)
+	}
+}
+
+// addThreadMessage threads an inbound email from sender and returns its thread
+func addThreadMessage(t *testing.T, store *Store, n int, from, mailbox string, refs ...string) *ThreadMessage {
+	t.Helper()
+	id := saveTestEmail(t, store, n)
+	msg := &ThreadMessage{
+		EmailID:      &id,
+		Direction:    ThreadDirectionInbound,
+		MessageID:    fmt.Sprintf("<msg-%d@test>", n),
+		From:         from,
+		To:           []string{"support@example.com"},
+		Subject:      "Re: order 7",
+		References:   refs,
+		SubjectKey:   "order 7",
+		MatchSubject: len(refs) > 0 || n > 1,
+		Mailbox:      mailbox,
+	}
+	if err := store.AddThreadMessage(context.Background(), msg); err != nil {
+		t.Fatalf("AddThreadMessage: %v", err)
+	}
+	return msg
+}
+
+func TestAddThreadMessageByReference(t *testing.T) {
+	store := newTestStore(t)
+	first := addThreadMessage(t, store, 1, "alice@example.org", "support")
+
+	// Our reply to alice, then her answer referencing it
+	reply := &ThreadMessage{
+		Direction:  ThreadDirectionOutbound,
+		MessageID:  "<reply-1@example.com>",
+		From:       "support@example.com",
+		To:         []string{"alice@example.org"},
+		References: []string{"<msg-1@test>"},
+		SubjectKey: "something else",
+		Mailbox:    "support",
+	}
+	if err := store.AddThreadMessage(context.Background(), reply); err != nil {
+		t.Fatalf("AddThreadMessage: %v", err)
+	}
+	if reply.ThreadID != first.ThreadID {
+		t.Errorf("reply thread = %d, want %d", reply.ThreadID, first.ThreadID)
+	}
+	answer := addThreadMessage(t, store, 2, "Alice@example.org", "support", "<reply-1@example.com>")
+	if answer.ThreadID != first.ThreadID {
+		t.Errorf("answer thread = %d, want %d", answer.ThreadID, first.ThreadID)
+	}
+
+	history, err := store.GetThreadHistory(context.Background(), *answer.EmailID, 10)
+	if err != nil {
+		t.Fatalf("GetThreadHistory: %v", err)
+	}
+	if len(history) != 2 || history[0].MessageID != "<msg-1@test>" || history[1].MessageID != "<reply-1@example.com>" {
+		t.Errorf("history = %+v, want the first email and our reply", history)
+	}
+}
+
+func TestAddThreadMessageBySubject(t *testing.T) {
+	store := newTestStore(t)
+	first := addThreadMessage(t, store, 1, "alice@example.org", "support")
+
+	// Unknown references fall back to the subject
+	second := addThreadMessage(t, store, 2, "alice@example.org", "support", "<unknown@elsewhere>")
+	if second.ThreadID != first.ThreadID {
+		t.Errorf("thread = %d, want %d", second.ThreadID, first.ThreadID)
+	}
+
+	// The same subject from someone else starts a new thread
+	other := addThreadMessage(t, store, 3, "bob@example.org", "support")
+	if other.ThreadID == first.ThreadID {
+		t.Error("email from another sender joined the thread by subject")
+	}
+}
+
+func TestAddThreadMessageRejectsOutsiders(t *testing.T) {
+	store := newTestStore(t)
+	first := addThreadMessage(t, store, 1, "alice@example.org", "support")
+
+	// Mallory learned alice's Message-ID
+	outsider := addThreadMessage(t, store, 2, "mallory@example.net", "support", "<msg-1@test>")
+	if outsider.ThreadID == first.ThreadID {
+		t.Fatal("non-participant joined the thread by reference")
+	}
+	history, err := store.GetThreadHistory(context.Background(), *outsider.EmailID, 10)
+	if err != nil {
+		t.Fatalf("GetThreadHistory: %v", err)
+	}
+	if len(history) != 0 {
+		t.Errorf("non-participant sees %d earlier messages", len(history))
+	}
+
+	// Threads never span mailboxes, even for a participant
+	elsewhere := addThreadMessage(t, store, 3, "alice@example.org", "billing", "<msg-1@test>")
+	if elsewhere.ThreadID == first.ThreadID {
+		t.Error("email routed to another mailbox joined the thread")
+	}
+}
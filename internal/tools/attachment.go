@@ -0,0 +1,221 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emitt/emitt/internal/extract"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+// Page sizes for read_attachment, in characters
+const (
+	defaultAttachmentReadLength = 10000
+	maxAttachmentReadLength     = 50000
+)
+
+// AttachmentTool lets the model list the attachments of the email its run
+// carries and read their text a page at a time
+type AttachmentTool struct {
+	store     *storage.Store
+	extractor *extract.Registry
+}
+
+// NewAttachmentTool creates a new attachment tool. Without an extractor only
+// text extracted earlier can be read.
+func NewAttachmentTool(store *storage.Store, extractor *extract.Registry) *AttachmentTool {
+	return &AttachmentTool{
+		store:     store,
+		extractor: extractor,
+	}
+}
+
+func (t *AttachmentTool) Name() string {
+	return "read_attachment"
+}
+
+func (t *AttachmentTool) Description() string {
+	return "Reads the attachments of the current email. Use 'list' to see the attachments, then 'read' with an index to get an attachment's text. Long text is returned in pages; pass next_offset as offset to continue."
+}
+
+func (t *AttachmentTool) Parameters() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"action": map[string]interface{}{
+				"type":        "string",
+				"enum":        []string{"list", "read"},
+				"description": "List the attachments or read one",
+			},
+			"index": map[string]interface{}{
+				"type":        "integer",
+				"description": "Index of the attachment to read, from list",
+			},
+			"filename": map[string]interface{}{
+				"type":        "string",
+				"description": "Filename of the attachment to read, instead of index",
+			},
+			"offset": map[string]interface{}{
+				"type":        "integer",
+				"description": "Character offset to start reading at (default: 0)",
+			},
+			"length": map[string]interface{}{
+				"type":        "integer",
+				"description": fmt.Sprintf("Characters to read (default: %d, max: %d)", defaultAttachmentReadLength, maxAttachmentReadLength),
+			},
+		},
+		"required": []string{"action"},
+	}
+}
+
+// AttachmentArgs represents the arguments for the attachment tool
+type AttachmentArgs struct {
+	Action   string `json:"action"`
+	Index    *int   `json:"index"`
+	Filename string `json:"filename"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+}
+
+// AttachmentSummary describes an attachment in a list result
+type AttachmentSummary struct {
+	Index       int    `json:"index"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Inline      bool   `json:"inline,omitempty"`
+	TextChars   *int   `json:"text_chars,omitempty"`  // Known once the text has been extracted
+	Virus       string `json:"virus,omitempty"`       // Set when a virus scan found malware; the content cannot be read
+	ScanResult  string `json:"scan_result,omitempty"` // Virus scan result; only clean or unscanned content can be read
+}
+
+// AttachmentPage is a page of an attachment's text
+type AttachmentPage struct {
+	Index      int    `json:"index"`
+	Filename   string `json:"filename"`
+	Offset     int    `json:"offset"`
+	TotalChars int    `json:"total_chars"`
+	Text       string `json:"text"`
+	NextOffset *int   `json:"next_offset,omitempty"` // Set when more text follows
+}
+
+func (t *AttachmentTool) Execute(ctx context.Context, args json.RawMessage) (json.RawMessage, error) {
+	var params AttachmentArgs
+	if err := json.Unmarshal(args, &params); err != nil {
+		return NewErrorResult(fmt.Errorf("invalid arguments: %w", err))
+	}
+
+	current := RunFrom(ctx).Email
+	if current == nil || current.ID == 0 {
+		return NewErrorResult(fmt.Errorf("no current email"))
+	}
+
+	attachments, err := t.store.GetAttachments(ctx, current.ID)
+	if err != nil {
+		return NewErrorResult(err)
+	}
+
+	switch params.Action {
+	case "list":
+		return t.executeList(attachments)
+	case "read":
+		return t.executeRead(ctx, attachments, params)
+	default:
+		return NewErrorResult(fmt.Errorf("unknown action: %s", params.Action))
+	}
+}
+
+func (t *AttachmentTool) executeList(attachments []*storage.Attachment) (json.RawMessage, error) {
+	list := make([]AttachmentSummary, len(attachments))
+	for i, att := range attachments {
+		list[i] = AttachmentSummary{
+			Index:       i,
+			Filename:    att.Filename,
+			ContentType: att.ContentType,
+			Size:        att.Size,
+			Inline:      att.Inline,
+			Virus:       att.Virus,
+			ScanResult:  att.ScanResult,
+		}
+		if att.ExtractedAt != nil && att.Withheld() == "" {
+			n := utf8.RuneCountInString(att.ExtractedText)
+			list[i].TextChars = &n
+		}
+	}
+	return NewSuccessResult(list)
+}
+
+func (t *AttachmentTool) executeRead(ctx context.Context, attachments []*storage.Attachment, params AttachmentArgs) (json.RawMessage, error) {
+	index := -1
+	switch {
+	case params.Index != nil:
+		index = *params.Index
+	case params.Filename != "":
+		for i, att := range attachments {
+			if strings.EqualFold(att.Filename, params.Filename) {
+				index = i
+				break
+			}
+		}
+		if index < 0 {
+			return NewErrorResult(fmt.Errorf("no attachment named %q", params.Filename))
+		}
+	default:
+		return NewErrorResult(fmt.Errorf("index or filename is required"))
+	}
+	if index < 0 || index >= len(attachments) {
+		return NewErrorResult(fmt.Errorf("attachment index %d out of range (email has %d attachments)", index, len(attachments)))
+	}
+	att := attachments[index]
+	if reason := att.Withheld(); reason != "" {
+		return NewErrorResult(fmt.Errorf("%s cannot be read: %s", att.Filename, reason))
+	}
+
+	if att.ExtractedAt == nil {
+		if t.extractor == nil {
+			return NewErrorResult(fmt.Errorf("text extraction is not enabled"))
+		}
+		if err := t.extractor.ExtractAttachment(ctx, t.store, att); err != nil {
+			return NewErrorResult(fmt.Errorf("failed to extract text: %w", err))
+		}
+	}
+	if att.ExtractError != "" {
+		return NewErrorResult(fmt.Errorf("failed to extract text from %s: %s", att.Filename, att.ExtractError))
+	}
+	if att.ExtractedText == "" {
+		return NewErrorResult(fmt.Errorf("%s (%s) has no readable text", att.Filename, att.ContentType))
+	}
+
+	length := params.Length
+	if length <= 0 {
+		length = defaultAttachmentReadLength
+	}
+	if length > maxAttachmentReadLength {
+		length = maxAttachmentReadLength
+	}
+
+	text := []rune(att.ExtractedText)
+	offset := params.Offset
+	if offset < 0 || offset > len(text) {
+		return NewErrorResult(fmt.Errorf("offset %d out of range (text has %d characters)", offset, len(text)))
+	}
+	end := offset + length
+	if end > len(text) {
+		end = len(text)
+	}
+
+	page := AttachmentPage{
+		Index:      index,
+		Filename:   att.Filename,
+		Offset:     offset,
+		TotalChars: len(text),
+		Text:       string(text[offset:end]),
+	}
+	if end < len(text) {
+		page.NextOffset = &end
+	}
+	return NewSuccessResult(page)
+}
@@ -0,0 +1,196 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+	"github.com/emitt/emitt/internal/extract"
+	"github.com/emitt/emitt/internal/storage"
+)
+
+func newTestStore(t *testing.T) *storage.Store {
+	t.Helper()
+	store, err := storage.NewStore(filepath.Join(t.TempDir(), "emitt.db"))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// saveEmailWithAttachment stores an email with one text attachment and
+// returns the run for it
+func saveEmailWithAttachment(t *testing.T, store *storage.Store, name, content string) *Run {
+	t.Helper()
+	ctx := context.Background()
+	e := &storage.Email{
+		MessageID:  fmt.Sprintf("<%s@test>", name),
+		From:       "sender@example.org",
+		ReceivedAt: time.Now(),
+		Status:     storage.EmailStatusProcessing,
+	}
+	if err := store.SaveEmail(ctx, e); err != nil {
+		t.Fatalf("SaveEmail: %v", err)
+	}
+	att := &storage.Attachment{
+		Filename:    name + ".txt",
+		ContentType: "text/plain",
+		Size:        int64(len(content)),
+		Data:        []byte(content),
+	}
+	if err := store.SaveAttachment(ctx, e.ID, att); err != nil {
+		t.Fatalf("SaveAttachment: %v", err)
+	}
+	return &Run{Email: &email.InboundEmail{ID: e.ID}}
+}
+
+func executeAttachment(t *testing.T, tool *AttachmentTool, ctx context.Context, args map[string]interface{}) ToolResult {
+	t.Helper()
+	argsJSON, _ := json.Marshal(args)
+	resultJSON, err := tool.Execute(ctx, argsJSON)
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	var result ToolResult
+	if err := json.Unmarshal(resultJSON, &result); err != nil {
+		t.Fatalf("invalid result: %v", err)
+	}
+	return result
+}
+
+func TestAttachmentToolReadsRunEmail(t *testing.T) {
+	store := newTestStore(t)
+	tool := NewAttachmentTool(store, extract.NewRegistry(&config.ExtractionConfig{}))
+
+	result := executeAttachment(t, tool, context.Background(), map[string]interface{}{"action": "list"})
+	if result.Success {
+		t.Fatal("list without a run succeeded")
+	}
+
+	run := saveEmailWithAttachment(t, store, "invoice", "Total: 42 EUR")
+	ctx := WithRun(context.Background(), run)
+	result = executeAttachment(t, tool, ctx, map[string]interface{}{"action": "read", "filename": "invoice.txt", "length": 5})
+	if !result.Success {
+		t.Fatalf("read failed: %s", result.Error)
+	}
+	var page AttachmentPage
+	json.Unmarshal(result.Data, &page)
+	if page.Text != "Total" || page.TotalChars != 13 || page.NextOffset == nil || *page.NextOffset != 5 {
+		t.Errorf("page = %+v", page)
+	}
+}
+
+// TestAttachmentToolConcurrentRuns checks that a shared tool never lists the
+// attachments of another run's email
+func TestAttachmentToolConcurrentRuns(t *testing.T) {
+	store := newTestStore(t)
+	tool := NewAttachmentTool(store, nil)
+
+	runs := make([]*Run, 10)
+	for i := range runs {
+		runs[i] = saveEmailWithAttachment(t, store, fmt.Sprintf("email%d", i), "text")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := WithRun(context.Background(), runs[i%len(runs)])
+			resultJSON, err := tool.Execute(ctx, json.RawMessage(`{"action": "list"}`))
+			if err != nil {
+				errs <- err
+				return
+			}
+			var result ToolResult
+			json.Unmarshal(resultJSON, &result)
+			var list []AttachmentSummary
+			json.Unmarshal(result.Data, &list)
+			want := fmt.Sprintf("email%d.txt", i%len(runs))
+			if !result.Success || len(list) != 1 || list[0].Filename != want {
+				errs <- fmt.Errorf("run %d listed %+v (%s), want %s", i, list, result.Error, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestAttachmentToolWithoutExtractor(t *testing.T) {
+	store := newTestStore(t)
+	tool := NewAttachmentTool(store, nil)
+	run := saveEmailWithAttachment(t, store, "notes", "cached text")
+	ctx := WithRun(context.Background(), run)
+	read := map[string]interface{}{"action": "read", "index": 0}
+
+	result := executeAttachment(t, tool, ctx, read)
+	if result.Success || result.Error != "text extraction is not enabled" {
+		t.Fatalf("read without an extractor = %+v", result)
+	}
+
+	// Text extracted earlier is still served
+	atts, err := store.GetAttachments(context.Background(), run.Email.ID)
+	if err != nil || len(atts) != 1 {
+		t.Fatalf("GetAttachments: %v", err)
+	}
+	if err := store.UpdateAttachmentText(context.Background(), atts[0].ID, "cached text", ""); err != nil {
+		t.Fatalf("UpdateAttachmentText: %v", err)
+	}
+	result = executeAttachment(t, tool, ctx, read)
+	var page AttachmentPage
+	json.Unmarshal(result.Data, &page)
+	if !result.Success || page.Text != "cached text" {
+		t.Errorf("read of extracted text = %+v", result)
+	}
+}
+
+func TestAttachmentToolWithholdsUnscanned(t *testing.T) {
+	store := newTestStore(t)
+	tool := NewAttachmentTool(store, extract.NewRegistry(&config.ExtractionConfig{}))
+	run := saveEmailWithAttachment(t, store, "report", "text")
+	ctx := WithRun(context.Background(), run)
+	atts, err := store.GetAttachments(context.Background(), run.Email.ID)
+	if err != nil || len(atts) != 1 {
+		t.Fatalf("GetAttachments: %v", err)
+	}
+
+	tests := []struct {
+		result, virus, want string
+	}{
+		{storage.ScanResultInfected, "Eicar-Signature", "report.txt cannot be read: infected with Eicar-Signature"},
+		{storage.ScanResultError, "", "report.txt cannot be read: the virus scan failed"},
+		{storage.ScanResultSkipped, "", "report.txt cannot be read: too large to scan for viruses"},
+		{storage.ScanResultClean, "", ""},
+	}
+	for _, tt := range tests {
+		if err := store.UpdateAttachmentScan(context.Background(), atts[0].ID, tt.result, tt.virus); err != nil {
+			t.Fatalf("UpdateAttachmentScan: %v", err)
+		}
+		result := executeAttachment(t, tool, ctx, map[string]interface{}{"action": "read", "index": 0})
+		if tt.want == "" {
+			if !result.Success {
+				t.Errorf("read of a %s attachment failed: %s", tt.result, result.Error)
+			}
+		} else if result.Success || result.Error != tt.want {
+			t.Errorf("read of a %s attachment = %+v, want %q", tt.result, result, tt.want)
+		}
+
+		result = executeAttachment(t, tool, ctx, map[string]interface{}{"action": "list"})
+		var list []AttachmentSummary
+		json.Unmarshal(result.Data, &list)
+		if len(list) != 1 || list[0].ScanResult != tt.result {
+			t.Errorf("list = %+v, want scan result %s", list, tt.result)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package tools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+const dkimTestMessage = "From: Support <support@example.com>\r\n" +
+	"To: bob@example.org\r\n" +
+	"Subject: Hello\r\n" +
+	"Date: Thu, 01 Jan 2026 12:00:00 +0000\r\n" +
+	"Message-ID: <m1@example.com>\r\n" +
+	"\r\n" +
+	"Hello Bob,\r\n" +
+	"\r\n" +
+	"See you soon.\r\n"
+
+// writePEM writes a PEM block to a file in the test's temp directory
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// dkimRecord returns the DNS TXT record publishing the public half of a key
+func dkimRecord(t *testing.T, key crypto.Signer) string {
+	t.Helper()
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	default:
+		t.Fatalf("unexpected key type %T", pub)
+		return ""
+	}
+}
+
+// verifyDKIM checks a signed message against the given TXT record of s1._domainkey.example.com
+func verifyDKIM(t *testing.T, signed []byte, record string) *dkim.Verification {
+	t.Helper()
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(signed), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "s1._domainkey.example.com" {
+				return nil, fmt.Errorf("unexpected lookup of %s", domain)
+			}
+			return []string{record}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(verifications) != 1 {
+		t.Fatalf("got %d signatures, want 1", len(verifications))
+	}
+	return verifications[0]
+}
+
+func TestDKIMSignerRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPKCS8, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPKCS8, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		blockType string
+		der       []byte
+		key       crypto.Signer
+	}{
+		{"rsa pkcs1", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), rsaKey},
+		{"rsa pkcs8", "PRIVATE KEY", rsaPKCS8, rsaKey},
+		{"ed25519 pkcs8", "PRIVATE KEY", edPKCS8, edKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewDKIMSigner(&config.DKIMConfig{
+				Domain:   "example.com",
+				Selector: "s1",
+				KeyFile:  writePEM(t, tt.blockType, tt.der),
+			})
+			if err != nil {
+				t.Fatalf("NewDKIMSigner: %v", err)
+			}
+			signed, err := signer.Sign([]byte(dkimTestMessage))
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			record := dkimRecord(t, tt.key)
+
+			v := verifyDKIM(t, signed, record)
+			if v.Err != nil {
+				t.Fatalf("signature did not verify: %v", v.Err)
+			}
+			if v.Domain != "example.com" {
+				t.Errorf("signing domain = %q", v.Domain)
+			}
+
+			// A changed body must break the signature
+			tampered := bytes.Replace(signed, []byte("See you soon."), []byte("Send money."), 1)
+			if v := verifyDKIM(t, tampered, record); v.Err == nil {
+				t.Error("tampered message verified")
+			}
+		})
+	}
+}
+
+func TestDKIMSignerAlwaysSignsFrom(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewDKIMSigner(&config.DKIMConfig{
+		Domain:   "example.com",
+		Selector: "s1",
+		KeyFile:  writePEM(t, "PRIVATE KEY", der),
+		Headers:  []string{"Subject"},
+	})
+	if err != nil {
+		t.Fatalf("NewDKIMSigner: %v", err)
+	}
+	signed, err := signer.Sign([]byte(dkimTestMessage))
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	v := verifyDKIM(t, signed, dkimRecord(t, key))
+	if v.Err != nil {
+		t.Fatalf("signature did not verify: %v", v.Err)
+	}
+	signsFrom := false
+	for _, h := range v.HeaderKeys {
+		if strings.EqualFold(h, "From") {
+			signsFrom = true
+		}
+	}
+	if !signsFrom {
+		t.Errorf("signed headers = %v, want From included", v.HeaderKeys)
+	}
+}
+
+func TestNewDKIMSignerErrors(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKCS8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noPEM := filepath.Join(t.TempDir(), "key.txt")
+	if err := os.WriteFile(noPEM, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	withKey := func(path string) config.DKIMConfig {
+		return config.DKIMConfig{Domain: "example.com", Selector: "s1", KeyFile: path}
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.DKIMConfig
+		want string
+	}{
+		{"no domain", config.DKIMConfig{Selector: "s1", KeyFile: noPEM}, "domain and selector"},
+		{"no selector", config.DKIMConfig{Domain: "example.com", KeyFile: noPEM}, "domain and selector"},
+		{"missing file", withKey(filepath.Join(t.TempDir(), "missing.pem")), "failed to read key"},
+		{"no pem", withKey(noPEM), "no PEM data"},
+		{"bad pkcs1", withKey(writePEM(t, "RSA PRIVATE KEY", []byte("garbage"))), "invalid RSA key"},
+		{"bad pkcs8", withKey(writePEM(t, "PRIVATE KEY", []byte("garbage"))), "invalid private key"},
+		{"ecdsa", withKey(writePEM(t, "PRIVATE KEY", ecPKCS8)), "unsupported key type"},
+		{"certificate", withKey(writePEM(t, "CERTIFICATE", []byte("cert"))), "unsupported PEM block"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDKIMSigner(&tt.cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("NewDKIMSigner = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	htmltemplate "html/template"
 	"net/smtp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/emitt/emitt/internal/email"
 )
@@ -15,12 +18,21 @@ type EmailSender interface {
 	Send(ctx context.Context, email *email.OutboundEmail) error
 }
 
-// EmailTool handles email operations (reply, forward, send)
+// SentRecorder is notified of every email the tool sends, e.g. to thread it
+// with the conversation it belongs to
+type SentRecorder interface {
+	RecordSent(ctx context.Context, email *email.OutboundEmail)
+}
+
+// EmailTool handles email operations (reply, forward, send). The email being
+// replied to and its mailbox's policy and template come from the Run in the
+// context of each call.
 type EmailTool struct {
-	sender       EmailSender
-	fromAddress  string
-	fromName     string
-	currentEmail *email.InboundEmail
+	sender      EmailSender
+	fromAddress string
+	fromName    string
+	templates   *TemplateSet
+	recorder    SentRecorder
 }
 
 // NewEmailTool creates a new email tool
@@ -32,9 +44,14 @@ func NewEmailTool(sender EmailSender, fromAddress, fromName string) *EmailTool {
 	}
 }
 
-// SetCurrentEmail sets the current email context for replies
-func (t *EmailTool) SetCurrentEmail(e *email.InboundEmail) {
-	t.currentEmail = e
+// SetTemplates sets the outbound templates available to send_email
+func (t *EmailTool) SetTemplates(templates *TemplateSet) {
+	t.templates = templates
+}
+
+// SetRecorder sets the recorder notified of sent mail (nil for none)
+func (t *EmailTool) SetRecorder(recorder SentRecorder) {
+	t.recorder = recorder
 }
 
 func (t *EmailTool) Name() string {
@@ -84,20 +101,43 @@ func (t *EmailTool) Parameters() map[string]interface{} {
 				"type":        "boolean",
 				"description": "Include original email in reply/forward (default: true for forward)",
 			},
+			"template": map[string]interface{}{
+				"type":        "string",
+				"description": t.templateDescription(),
+			},
+			"variables": map[string]interface{}{
+				"type":        "object",
+				"description": "Variables for the template, available as {{.Vars.name}}",
+			},
 		},
-		"required": []string{"action", "body"},
+		"required": []string{"action"},
 	}
 }
 
+func (t *EmailTool) templateDescription() string {
+	desc := "Name of a configured template to wrap the body in (the body is available to it as {{.Body}})"
+	if t.templates != nil && len(t.templates.templates) > 0 {
+		names := make([]string, 0, len(t.templates.templates))
+		for name := range t.templates.templates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		desc += ". Available templates: " + strings.Join(names, ", ")
+	}
+	return desc
+}
+
 // EmailArgs represents the arguments for the email tool
 type EmailArgs struct {
-	Action          string   `json:"action"`
-	To              []string `json:"to"`
-	Cc              []string `json:"cc"`
-	Subject         string   `json:"subject"`
-	Body            string   `json:"body"`
-	HTMLBody        string   `json:"html_body"`
-	IncludeOriginal *bool    `json:"include_original"`
+	Action          string                 `json:"action"`
+	To              []string               `json:"to"`
+	Cc              []string               `json:"cc"`
+	Subject         string                 `json:"subject"`
+	Body            string                 `json:"body"`
+	HTMLBody        string                 `json:"html_body"`
+	IncludeOriginal *bool                  `json:"include_original"`
+	Template        string                 `json:"template"`
+	Variables       map[string]interface{} `json:"variables"`
 }
 
 // EmailResult represents the result of an email operation
@@ -114,70 +154,84 @@ func (t *EmailTool) Execute(ctx context.Context, args json.RawMessage) (json.Raw
 		return NewErrorResult(fmt.Errorf("invalid arguments: %w", err))
 	}
 
+	run := RunFrom(ctx)
+	if params.Body == "" && params.HTMLBody == "" && templateName(run, params) == "" {
+		return NewErrorResult(fmt.Errorf("body is required"))
+	}
+
 	switch params.Action {
 	case "reply":
-		return t.executeReply(ctx, params)
+		return t.executeReply(ctx, run, params)
 	case "forward":
-		return t.executeForward(ctx, params)
+		return t.executeForward(ctx, run, params)
 	case "send":
-		return t.executeSend(ctx, params)
+		return t.executeSend(ctx, run, params)
 	default:
 		return NewErrorResult(fmt.Errorf("unknown action: %s", params.Action))
 	}
 }
 
-func (t *EmailTool) executeReply(ctx context.Context, params EmailArgs) (json.RawMessage, error) {
-	if t.currentEmail == nil {
+func (t *EmailTool) executeReply(ctx context.Context, run *Run, params EmailArgs) (json.RawMessage, error) {
+	if run.Email == nil {
 		return NewErrorResult(fmt.Errorf("no current email to reply to"))
 	}
 
+	// Never auto-reply to auto-responders, mailing lists or our own mail
+	if reason := run.Email.AutoSubmittedReason(); reason != "" {
+		return NewErrorResult(fmt.Errorf("reply suppressed to prevent mail loops (%s)", reason))
+	}
+
 	// Determine recipient (reply to sender or reply-to address)
 	var toAddr email.Address
-	if t.currentEmail.ReplyTo != nil {
-		toAddr = *t.currentEmail.ReplyTo
+	if run.Email.ReplyTo != nil {
+		toAddr = *run.Email.ReplyTo
 	} else {
-		toAddr = t.currentEmail.From
+		toAddr = run.Email.From
 	}
 
 	// Build subject
 	subject := params.Subject
 	if subject == "" {
-		if !strings.HasPrefix(strings.ToLower(t.currentEmail.Subject), "re:") {
-			subject = "Re: " + t.currentEmail.Subject
+		if !strings.HasPrefix(strings.ToLower(run.Email.Subject), "re:") {
+			subject = "Re: " + run.Email.Subject
 		} else {
-			subject = t.currentEmail.Subject
+			subject = run.Email.Subject
 		}
 	}
 
 	// Build body with original message if requested
 	body := params.Body
 	if params.IncludeOriginal != nil && *params.IncludeOriginal {
-		body = t.appendOriginalMessage(body)
+		body = appendOriginalMessage(run.Email, body)
 	}
 
 	outbound := &email.OutboundEmail{
-		From:      email.Address{Name: t.fromName, Address: t.fromAddress},
-		To:        []email.Address{toAddr},
-		Subject:   subject,
-		TextBody:  body,
-		HTMLBody:  params.HTMLBody,
-		InReplyTo: t.currentEmail.MessageID,
+		From:       email.Address{Name: t.fromName, Address: t.fromAddress},
+		To:         []email.Address{toAddr},
+		Subject:    subject,
+		TextBody:   body,
+		HTMLBody:   params.HTMLBody,
+		InReplyTo:  run.Email.MessageID,
+		References: run.Email.ReplyReferences(),
+	}
+	if err := t.applyTemplate(run, params, outbound); err != nil {
+		return NewErrorResult(err)
 	}
 
-	if err := t.sender.Send(ctx, outbound); err != nil {
+	if err := t.deliver(ctx, run, outbound); err != nil {
 		return NewErrorResult(fmt.Errorf("failed to send reply: %w", err))
 	}
 
 	return NewSuccessResult(EmailResult{
 		Sent:    true,
 		To:      []string{toAddr.Address},
-		Subject: subject,
+		Subject: outbound.Subject,
 		Message: "Reply sent successfully",
 	})
 }
 
-func (t *EmailTool) executeForward(ctx context.Context, params EmailArgs) (json.RawMessage, error) {
-	if t.currentEmail == nil {
+func (t *EmailTool) executeForward(ctx context.Context, run *Run, params EmailArgs) (json.RawMessage, error) {
+	if run.Email == nil {
 		return NewErrorResult(fmt.Errorf("no current email to forward"))
 	}
 
@@ -188,10 +242,10 @@ func (t *EmailTool) executeForward(ctx context.Context, params EmailArgs) (json.
 	// Build subject
 	subject := params.Subject
 	if subject == "" {
-		if !strings.HasPrefix(strings.ToLower(t.currentEmail.Subject), "fwd:") {
-			subject = "Fwd: " + t.currentEmail.Subject
+		if !strings.HasPrefix(strings.ToLower(run.Email.Subject), "fwd:") {
+			subject = "Fwd: " + run.Email.Subject
 		} else {
-			subject = t.currentEmail.Subject
+			subject = run.Email.Subject
 		}
 	}
 
@@ -199,7 +253,7 @@ func (t *EmailTool) executeForward(ctx context.Context, params EmailArgs) (json.
 	includeOriginal := params.IncludeOriginal == nil || *params.IncludeOriginal
 	body := params.Body
 	if includeOriginal {
-		body = t.appendOriginalMessage(body)
+		body = appendOriginalMessage(run.Email, body)
 	}
 
 	// Convert to addresses
@@ -221,28 +275,27 @@ func (t *EmailTool) executeForward(ctx context.Context, params EmailArgs) (json.
 		TextBody: body,
 		HTMLBody: params.HTMLBody,
 	}
+	if err := t.applyTemplate(run, params, outbound); err != nil {
+		return NewErrorResult(err)
+	}
 
-	if err := t.sender.Send(ctx, outbound); err != nil {
+	if err := t.deliver(ctx, run, outbound); err != nil {
 		return NewErrorResult(fmt.Errorf("failed to forward email: %w", err))
 	}
 
 	return NewSuccessResult(EmailResult{
 		Sent:    true,
 		To:      params.To,
-		Subject: subject,
+		Subject: outbound.Subject,
 		Message: "Email forwarded successfully",
 	})
 }
 
-func (t *EmailTool) executeSend(ctx context.Context, params EmailArgs) (json.RawMessage, error) {
+func (t *EmailTool) executeSend(ctx context.Context, run *Run, params EmailArgs) (json.RawMessage, error) {
 	if len(params.To) == 0 {
 		return NewErrorResult(fmt.Errorf("recipients required"))
 	}
 
-	if params.Subject == "" {
-		return NewErrorResult(fmt.Errorf("subject required for new email"))
-	}
-
 	toAddrs := make([]email.Address, len(params.To))
 	for i, addr := range params.To {
 		toAddrs[i] = email.Address{Address: addr}
@@ -261,21 +314,127 @@ func (t *EmailTool) executeSend(ctx context.Context, params EmailArgs) (json.Raw
 		TextBody: params.Body,
 		HTMLBody: params.HTMLBody,
 	}
+	if err := t.applyTemplate(run, params, outbound); err != nil {
+		return NewErrorResult(err)
+	}
+	if outbound.Subject == "" {
+		return NewErrorResult(fmt.Errorf("subject required for new email"))
+	}
 
-	if err := t.sender.Send(ctx, outbound); err != nil {
+	if err := t.deliver(ctx, run, outbound); err != nil {
 		return NewErrorResult(fmt.Errorf("failed to send email: %w", err))
 	}
 
 	return NewSuccessResult(EmailResult{
 		Sent:    true,
 		To:      params.To,
-		Subject: params.Subject,
+		Subject: outbound.Subject,
 		Message: "Email sent successfully",
 	})
 }
 
-func (t *EmailTool) appendOriginalMessage(body string) string {
-	if t.currentEmail == nil {
+// templateName returns the template requested by the call, or the default
+// template of the run's mailbox
+func templateName(run *Run, params EmailArgs) string {
+	if params.Template != "" {
+		return params.Template
+	}
+	return run.Template
+}
+
+// applyTemplate renders the requested (or mailbox default) template over the
+// assembled email, so a quoted original comes before the template's footer.
+// A template that defines only one body part defines both: the HTML body is
+// dropped for a text-only template, and the text body of an HTML-only one is
+// derived from its HTML.
+func (t *EmailTool) applyTemplate(run *Run, params EmailArgs, outbound *email.OutboundEmail) error {
+	if name := templateName(run, params); name != "" {
+		if t.templates == nil {
+			return fmt.Errorf("unknown template: %s", name)
+		}
+		rendered, err := t.templates.Render(name, TemplateData{
+			Body:     outbound.TextBody,
+			HTMLBody: htmltemplate.HTML(outbound.HTMLBody),
+			Vars:     params.Variables,
+			Email:    run.Email,
+		})
+		if err != nil {
+			return err
+		}
+
+		if rendered.Subject != "" && params.Subject == "" {
+			outbound.Subject = rendered.Subject
+		}
+		switch {
+		case rendered.Text != "" && rendered.HTML != "":
+			outbound.TextBody, outbound.HTMLBody = rendered.Text, rendered.HTML
+		case rendered.Text != "":
+			outbound.TextBody, outbound.HTMLBody = rendered.Text, ""
+		case rendered.HTML != "":
+			outbound.TextBody, outbound.HTMLBody = email.HTMLToText(rendered.HTML), rendered.HTML
+		}
+	}
+
+	if outbound.TextBody == "" && outbound.HTMLBody == "" {
+		return fmt.Errorf("body is required")
+	}
+	return nil
+}
+
+// deliver applies loop prevention and the outbound policy, then sends the
+// email
+func (t *EmailTool) deliver(ctx context.Context, run *Run, outbound *email.OutboundEmail) error {
+	var recipients []string
+	for _, addr := range outbound.To {
+		recipients = append(recipients, addr.Address)
+	}
+	for _, addr := range outbound.Cc {
+		recipients = append(recipients, addr.Address)
+	}
+	for _, addr := range outbound.Bcc {
+		recipients = append(recipients, addr.Address)
+	}
+
+	// Mail back to the sender of an automated message would loop just like a reply
+	if run.Email != nil {
+		if reason := run.Email.AutoSubmittedReason(); reason != "" {
+			for _, addr := range recipients {
+				if isSender(run.Email, addr) {
+					return fmt.Errorf("send to %s suppressed to prevent mail loops (%s)", addr, reason)
+				}
+			}
+		}
+	}
+
+	if run.Policy != nil {
+		if err := run.Policy.Reserve(recipients); err != nil {
+			return err
+		}
+	}
+
+	if outbound.MessageID == "" {
+		outbound.MessageID = email.NewOutboundMessageID(outbound.From.Address)
+	}
+
+	if err := t.sender.Send(ctx, outbound); err != nil {
+		return err
+	}
+	if t.recorder != nil {
+		t.recorder.RecordSent(ctx, outbound)
+	}
+	return nil
+}
+
+// isSender reports whether addr is the sender of an email
+func isSender(e *email.InboundEmail, addr string) bool {
+	if strings.EqualFold(addr, e.From.Address) {
+		return true
+	}
+	return e.ReplyTo != nil && strings.EqualFold(addr, e.ReplyTo.Address)
+}
+
+func appendOriginalMessage(e *email.InboundEmail, body string) string {
+	if e == nil {
 		return body
 	}
 
@@ -287,10 +446,10 @@ Date: %s
 Subject: %s
 
 %s`,
-		t.currentEmail.From.String(),
-		t.currentEmail.Date.Format("Mon, 02 Jan 2006 15:04:05 -0700"),
-		t.currentEmail.Subject,
-		t.currentEmail.Body(),
+		e.From.String(),
+		e.Date.Format("Mon, 02 Jan 2006 15:04:05 -0700"),
+		e.Subject,
+		e.Body(),
 	)
 
 	return body + original
@@ -302,6 +461,7 @@ type SMTPSender struct {
 	port     int
 	username string
 	password string
+	dkim     *DKIMSigner
 }
 
 // NewSMTPSender creates a new SMTP sender
@@ -314,6 +474,11 @@ func NewSMTPSender(host string, port int, username, password string) *SMTPSender
 	}
 }
 
+// SetDKIMSigner enables DKIM signing of outgoing messages
+func (s *SMTPSender) SetDKIMSigner(signer *DKIMSigner) {
+	s.dkim = signer
+}
+
 func (s *SMTPSender) Send(ctx context.Context, e *email.OutboundEmail) error {
 	// Build recipient list
 	var recipients []string
@@ -335,13 +500,30 @@ func (s *SMTPSender) Send(ctx context.Context, e *email.OutboundEmail) error {
 		msg.WriteString(fmt.Sprintf("Cc: %s\r\n", formatAddresses(e.Cc)))
 	}
 	msg.WriteString(fmt.Sprintf("Subject: %s\r\n", e.Subject))
-	if e.InReplyTo != "" {
-		msg.WriteString(fmt.Sprintf("In-Reply-To: %s\r\n", e.InReplyTo))
+	msg.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	headers := outboundHeaders(e)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msg.WriteString(fmt.Sprintf("%s: %s\r\n", name, headers[name]))
 	}
 	msg.WriteString("MIME-Version: 1.0\r\n")
 	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
 	msg.WriteString("\r\n")
-	msg.WriteString(e.TextBody)
+	// Normalize to CRLF so the signed body matches what goes on the wire
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(e.TextBody, "\r\n", "\n"), "\n", "\r\n"))
+
+	data := []byte(msg.String())
+	if s.dkim != nil {
+		signed, err := s.dkim.Sign(data)
+		if err != nil {
+			return err
+		}
+		data = signed
+	}
 
 	// Send via SMTP
 	addr := fmt.Sprintf("%s:%d", s.host, s.port)
@@ -350,7 +532,7 @@ func (s *SMTPSender) Send(ctx context.Context, e *email.OutboundEmail) error {
 		auth = smtp.PlainAuth("", s.username, s.password, s.host)
 	}
 
-	return smtp.SendMail(addr, auth, e.From.Address, recipients, []byte(msg.String()))
+	return smtp.SendMail(addr, auth, e.From.Address, recipients, data)
 }
 
 func formatAddresses(addrs []email.Address) string {
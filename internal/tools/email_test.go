@@ -0,0 +1,221 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// recordingSender keeps every email it is asked to send
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []*email.OutboundEmail
+}
+
+func (s *recordingSender) Send(ctx context.Context, e *email.OutboundEmail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, e)
+	return nil
+}
+
+func executeEmail(t *testing.T, tool *EmailTool, ctx context.Context, args map[string]interface{}) ToolResult {
+	t.Helper()
+	argsJSON, _ := json.Marshal(args)
+	resultJSON, err := tool.Execute(ctx, argsJSON)
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	var result ToolResult
+	if err := json.Unmarshal(resultJSON, &result); err != nil {
+		t.Fatalf("invalid result: %v", err)
+	}
+	return result
+}
+
+func TestEmailToolReplyUsesRun(t *testing.T) {
+	sender := &recordingSender{}
+	tool := NewEmailTool(sender, "support@example.com", "Support")
+
+	// Without a run there is nothing to reply to
+	result := executeEmail(t, tool, context.Background(), map[string]interface{}{"action": "reply", "body": "Hi"})
+	if result.Success {
+		t.Fatal("reply without a run succeeded")
+	}
+
+	inbound := &email.InboundEmail{
+		MessageID: "<q1@example.org>",
+		From:      email.Address{Address: "alice@example.org"},
+		Subject:   "Question",
+	}
+	ctx := WithRun(context.Background(), &Run{Email: inbound})
+	result = executeEmail(t, tool, ctx, map[string]interface{}{"action": "reply", "body": "Hi"})
+	if !result.Success {
+		t.Fatalf("reply failed: %s", result.Error)
+	}
+	got := sender.sent[0]
+	if got.To[0].Address != "alice@example.org" || got.Subject != "Re: Question" || got.InReplyTo != "<q1@example.org>" {
+		t.Errorf("reply = %+v", got)
+	}
+}
+
+// TestEmailToolConcurrentRuns checks that the policy of one mailbox is never
+// applied to mail sent for another run of the shared tool
+func TestEmailToolConcurrentRuns(t *testing.T) {
+	sender := &recordingSender{}
+	tool := NewEmailTool(sender, "support@example.com", "Support")
+
+	strict, err := NewOutboundPolicy(&config.OutboundConfig{AllowRecipients: []string{`@example\.com$`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			ctx := WithRun(context.Background(), &Run{
+				Email: &email.InboundEmail{From: email.Address{Address: fmt.Sprintf("open%d@example.org", i)}, Subject: "Open"},
+			})
+			if r := executeEmail(t, tool, ctx, map[string]interface{}{"action": "reply", "body": "ok"}); !r.Success {
+				errs <- fmt.Errorf("unrestricted reply %d failed: %s", i, r.Error)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			ctx := WithRun(context.Background(), &Run{
+				Email:  &email.InboundEmail{From: email.Address{Address: fmt.Sprintf("strict%d@example.org", i)}, Subject: "Strict"},
+				Policy: strict,
+			})
+			if r := executeEmail(t, tool, ctx, map[string]interface{}{"action": "reply", "body": "no"}); r.Success {
+				errs <- fmt.Errorf("reply %d was sent despite its mailbox policy", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	for _, e := range sender.sent {
+		if e.Subject != "Re: Open" {
+			t.Errorf("sent %q, which its mailbox policy denies", e.Subject)
+		}
+	}
+}
+
+func TestEmailToolRunTemplate(t *testing.T) {
+	sender := &recordingSender{}
+	tool := NewEmailTool(sender, "support@example.com", "Support")
+
+	ctx := WithRun(context.Background(), &Run{Template: "missing"})
+	result := executeEmail(t, tool, ctx, map[string]interface{}{
+		"action": "send", "to": []string{"bob@example.com"}, "subject": "Hi", "body": "Hello",
+	})
+	if result.Success || result.Error != "unknown template: missing" {
+		t.Errorf("result = %+v, want the run's default template applied", result)
+	}
+}
+
+func newTemplateTool(t *testing.T, cfgs ...config.TemplateConfig) (*EmailTool, *recordingSender) {
+	t.Helper()
+	templates, err := NewTemplateSet(cfgs)
+	if err != nil {
+		t.Fatalf("NewTemplateSet: %v", err)
+	}
+	sender := &recordingSender{}
+	tool := NewEmailTool(sender, "support@example.com", "Support")
+	tool.SetTemplates(templates)
+	return tool, sender
+}
+
+func TestEmailToolTemplate(t *testing.T) {
+	tool, sender := newTemplateTool(t, config.TemplateConfig{
+		Name:    "ticket",
+		Subject: "[Ticket {{.Vars.ticket}}] {{.Email.Subject}}",
+		Text:    "Hi {{.Email.From.Name}},\n\n{{.Body}}\n--\nTicket {{.Vars.ticket}}",
+		HTML:    "<p>{{.HTMLBody}}</p><p>{{.Body}}</p><footer>Ticket {{.Vars.ticket}}</footer>",
+	})
+	inbound := &email.InboundEmail{
+		MessageID: "<q1@example.org>",
+		From:      email.Address{Name: "Alice", Address: "alice@example.org"},
+		Subject:   "Broken <widget>",
+	}
+	ctx := WithRun(context.Background(), &Run{Email: inbound})
+
+	result := executeEmail(t, tool, ctx, map[string]interface{}{
+		"action": "reply", "body": "We are on it.", "html_body": "<b>We are on it.</b>",
+		"template": "ticket", "variables": map[string]interface{}{"ticket": "T-1"},
+	})
+	if !result.Success {
+		t.Fatalf("reply failed: %s", result.Error)
+	}
+	got := sender.sent[0]
+	if got.Subject != "[Ticket T-1] Broken <widget>" {
+		t.Errorf("subject = %q", got.Subject)
+	}
+	if want := "Hi Alice,\n\nWe are on it.\n--\nTicket T-1"; got.TextBody != want {
+		t.Errorf("text = %q, want %q", got.TextBody, want)
+	}
+	if want := "<p><b>We are on it.</b></p><p>We are on it.</p><footer>Ticket T-1</footer>"; got.HTMLBody != want {
+		t.Errorf("html = %q, want %q", got.HTMLBody, want)
+	}
+}
+
+func TestEmailToolTemplateAfterOriginal(t *testing.T) {
+	tool, sender := newTemplateTool(t, config.TemplateConfig{Name: "footer", Text: "{{.Body}}\n--\nConfidential"})
+	inbound := &email.InboundEmail{
+		From:     email.Address{Address: "alice@example.org"},
+		Subject:  "Invoice",
+		TextBody: "Please pay.",
+	}
+	ctx := WithRun(context.Background(), &Run{Email: inbound, Template: "footer"})
+
+	result := executeEmail(t, tool, ctx, map[string]interface{}{
+		"action": "forward", "to": []string{"billing@example.com"}, "body": "FYI",
+	})
+	if !result.Success {
+		t.Fatalf("forward failed: %s", result.Error)
+	}
+	body := sender.sent[0].TextBody
+	original := strings.Index(body, "Please pay.")
+	footer := strings.Index(body, "Confidential")
+	if original < 0 || footer < original || !strings.HasPrefix(body, "FYI") {
+		t.Errorf("body = %q, want the footer after the quoted original", body)
+	}
+}
+
+func TestEmailToolTemplateBodyParts(t *testing.T) {
+	tool, sender := newTemplateTool(t,
+		config.TemplateConfig{Name: "text", Text: "{{.Body}}\n--\nDisclaimer"},
+		config.TemplateConfig{Name: "html", HTML: "<div>{{.HTMLBody}}</div><p>Disclaimer</p>"},
+	)
+	send := func(template string, args map[string]interface{}) *email.OutboundEmail {
+		t.Helper()
+		args["action"], args["to"], args["subject"], args["template"] = "send", []string{"bob@example.com"}, "Hi", template
+		if result := executeEmail(t, tool, context.Background(), args); !result.Success {
+			t.Fatalf("send failed: %s", result.Error)
+		}
+		return sender.sent[len(sender.sent)-1]
+	}
+
+	// The model's HTML would skip a text-only template's disclaimer
+	got := send("text", map[string]interface{}{"body": "Hello", "html_body": "<p>Hello, no disclaimer</p>"})
+	if got.TextBody != "Hello\n--\nDisclaimer" || got.HTMLBody != "" {
+		t.Errorf("text template = %q / %q, want the HTML body dropped", got.TextBody, got.HTMLBody)
+	}
+
+	got = send("html", map[string]interface{}{"body": "Hello, no disclaimer", "html_body": "<b>Hello</b>"})
+	if got.HTMLBody != "<div><b>Hello</b></div><p>Disclaimer</p>" || !strings.Contains(got.TextBody, "Disclaimer") {
+		t.Errorf("html template = %q / %q, want the text derived from the HTML", got.TextBody, got.HTMLBody)
+	}
+}
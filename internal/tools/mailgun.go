@@ -0,0 +1,78 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// MailgunSender sends emails via the Mailgun Messages API
+type MailgunSender struct {
+	apiKey  string
+	domain  string
+	baseURL string
+	client  *http.Client
+}
+
+// NewMailgunSender creates a new Mailgun sender
+func NewMailgunSender(cfg *config.MailgunConfig) *MailgunSender {
+	baseURL := cfg.Endpoint
+	if baseURL == "" {
+		baseURL = "https://api.mailgun.net"
+		if strings.EqualFold(cfg.Region, "eu") {
+			baseURL = "https://api.eu.mailgun.net"
+		}
+	}
+	return &MailgunSender{
+		apiKey:  cfg.APIKey,
+		domain:  cfg.Domain,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  newProviderClient(),
+	}
+}
+
+func (s *MailgunSender) Send(ctx context.Context, e *email.OutboundEmail) error {
+	form := url.Values{}
+	form.Set("from", e.From.String())
+	for _, addr := range e.To {
+		form.Add("to", addr.String())
+	}
+	for _, addr := range e.Cc {
+		form.Add("cc", addr.String())
+	}
+	for _, addr := range e.Bcc {
+		form.Add("bcc", addr.String())
+	}
+	form.Set("subject", e.Subject)
+
+	if e.TextBody != "" {
+		form.Set("text", e.TextBody)
+	}
+	if e.HTMLBody != "" {
+		form.Set("html", e.HTMLBody)
+	}
+	if e.ReplyTo != nil {
+		form.Set("h:Reply-To", e.ReplyTo.String())
+	}
+
+	// Custom headers are passed as h:<Header-Name> fields
+	for name, value := range outboundHeaders(e) {
+		form.Set("h:"+name, value)
+	}
+
+	endpoint := fmt.Sprintf("%s/v3/%s/messages", s.baseURL, url.PathEscape(s.domain))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("mailgun: failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", s.apiKey)
+
+	_, err = doProviderRequest(s.client, req, "mailgun")
+	return err
+}
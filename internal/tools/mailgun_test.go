@@ -0,0 +1,72 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+func TestMailgunSend(t *testing.T) {
+	srv, got := newProviderServer(t, http.StatusOK, `{"id":"<x@mg>","message":"Queued"}`)
+	sender := NewMailgunSender(&config.MailgunConfig{APIKey: "key-123", Domain: "mg.example.com", Endpoint: srv.URL})
+
+	if err := sender.Send(context.Background(), testOutbound()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if got.method != "POST" || got.path != "/v3/mg.example.com/messages" {
+		t.Errorf("request = %s %s", got.method, got.path)
+	}
+	user, pass, ok := (&http.Request{Header: got.header}).BasicAuth()
+	if !ok || user != "api" || pass != "key-123" {
+		t.Errorf("basic auth = %q/%q (%v), want api/key-123", user, pass, ok)
+	}
+	if ct := got.header.Get("Content-Type"); ct != "application/x-www-form-urlencoded" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	form, err := url.ParseQuery(string(got.body))
+	if err != nil {
+		t.Fatalf("invalid form body: %v", err)
+	}
+	want := map[string]string{
+		"from":          "Support <support@example.com>",
+		"to":            "Alice <alice@example.org>",
+		"cc":            "carol@example.org",
+		"bcc":           "audit@example.com",
+		"subject":       "Re: Order 42",
+		"text":          "Your order has shipped.",
+		"html":          "<p>Your order has shipped.</p>",
+		"h:Reply-To":    "help@example.com",
+		"h:Message-ID":  "<emitt-out.1234@example.com>",
+		"h:In-Reply-To": "<orig@example.org>",
+		"h:References":  "<first@example.org> <orig@example.org>",
+		"h:X-Ticket":    "42",
+	}
+	for field, value := range want {
+		if form.Get(field) != value {
+			t.Errorf("%s = %q, want %q", field, form.Get(field), value)
+		}
+	}
+}
+
+func TestMailgunRegion(t *testing.T) {
+	sender := NewMailgunSender(&config.MailgunConfig{APIKey: "k", Domain: "d", Region: "EU"})
+	if sender.baseURL != "https://api.eu.mailgun.net" {
+		t.Errorf("baseURL = %q, want the EU endpoint", sender.baseURL)
+	}
+}
+
+func TestMailgunSendError(t *testing.T) {
+	srv, _ := newProviderServer(t, http.StatusUnauthorized, "Forbidden")
+	sender := NewMailgunSender(&config.MailgunConfig{APIKey: "bad", Domain: "mg.example.com", Endpoint: srv.URL})
+
+	err := sender.Send(context.Background(), testOutbound())
+	if err == nil || !strings.Contains(err.Error(), "mailgun: API error 401: Forbidden") {
+		t.Errorf("err = %v, want the API error", err)
+	}
+}
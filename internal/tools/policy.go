@@ -0,0 +1,149 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+// rateWindow is the sliding window used for outbound rate limits
+const rateWindow = time.Hour
+
+// OutboundPolicy enforces recipient restrictions and send rate limits for a mailbox
+type OutboundPolicy struct {
+	allow           []*regexp.Regexp
+	deny            []*regexp.Regexp
+	maxPerHour      int
+	maxPerRecipient int
+
+	mu          sync.Mutex
+	mailboxSent []time.Time
+	rcptSent    map[string][]time.Time
+	swept       time.Time // Last time expired recipients were dropped from rcptSent
+	now         func() time.Time
+}
+
+// NewOutboundPolicy compiles an outbound policy from mailbox configuration
+func NewOutboundPolicy(cfg *config.OutboundConfig) (*OutboundPolicy, error) {
+	p := &OutboundPolicy{
+		maxPerHour:      cfg.MaxPerHour,
+		maxPerRecipient: cfg.MaxPerRecipientPerHour,
+		rcptSent:        make(map[string][]time.Time),
+		now:             time.Now,
+	}
+
+	for _, pattern := range cfg.AllowRecipients {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow_recipients pattern %q: %w", pattern, err)
+		}
+		p.allow = append(p.allow, re)
+	}
+
+	for _, pattern := range cfg.DenyRecipients {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny_recipients pattern %q: %w", pattern, err)
+		}
+		p.deny = append(p.deny, re)
+	}
+
+	return p, nil
+}
+
+// CheckRecipient returns an error if the address may not be mailed
+func (p *OutboundPolicy) CheckRecipient(addr string) error {
+	addr = strings.ToLower(addr)
+
+	for _, re := range p.deny {
+		if re.MatchString(addr) {
+			return fmt.Errorf("recipient %s is denied by outbound policy", addr)
+		}
+	}
+
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, re := range p.allow {
+		if re.MatchString(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("recipient %s is not in the outbound allowlist", addr)
+}
+
+// Reserve checks recipient rules and rate limits for a send to the given
+// addresses, and records the send if it is allowed
+func (p *OutboundPolicy) Reserve(addrs []string) error {
+	for _, addr := range addrs {
+		if err := p.CheckRecipient(addr); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	cutoff := now.Add(-rateWindow)
+
+	p.mailboxSent = pruneBefore(p.mailboxSent, cutoff)
+	if p.maxPerHour > 0 && len(p.mailboxSent) >= p.maxPerHour {
+		return fmt.Errorf("outbound rate limit reached (%d per hour)", p.maxPerHour)
+	}
+
+	if p.maxPerRecipient > 0 {
+		p.sweepRecipients(now, cutoff)
+		for _, addr := range addrs {
+			key := strings.ToLower(addr)
+			times := pruneBefore(p.rcptSent[key], cutoff)
+			if len(times) == 0 {
+				delete(p.rcptSent, key)
+				continue
+			}
+			p.rcptSent[key] = times
+			if len(times) >= p.maxPerRecipient {
+				return fmt.Errorf("rate limit reached for %s (%d per hour)", addr, p.maxPerRecipient)
+			}
+		}
+	}
+
+	p.mailboxSent = append(p.mailboxSent, now)
+	if p.maxPerRecipient > 0 {
+		for _, addr := range addrs {
+			key := strings.ToLower(addr)
+			p.rcptSent[key] = append(p.rcptSent[key], now)
+		}
+	}
+
+	return nil
+}
+
+// sweepRecipients drops recipients with no sends in the window, at most once
+// per window, so addresses mailed once do not stay in memory forever
+func (p *OutboundPolicy) sweepRecipients(now, cutoff time.Time) {
+	if now.Sub(p.swept) < rateWindow {
+		return
+	}
+	for key, times := range p.rcptSent {
+		if times = pruneBefore(times, cutoff); len(times) == 0 {
+			delete(p.rcptSent, key)
+		} else {
+			p.rcptSent[key] = times
+		}
+	}
+	p.swept = now
+}
+
+// pruneBefore drops timestamps older than the cutoff
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
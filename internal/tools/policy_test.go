@@ -0,0 +1,177 @@
+package tools
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// testPolicy returns a policy whose clock is advanced by the returned func
+func testPolicy(t *testing.T, cfg *config.OutboundConfig) (*OutboundPolicy, func(time.Duration)) {
+	t.Helper()
+	p, err := NewOutboundPolicy(cfg)
+	if err != nil {
+		t.Fatalf("NewOutboundPolicy: %v", err)
+	}
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+	return p, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestOutboundPolicyRecipients(t *testing.T) {
+	p, _ := testPolicy(t, &config.OutboundConfig{
+		AllowRecipients: []string{`@example\.com$`},
+		DenyRecipients:  []string{`^ceo@example\.com$`},
+	})
+
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"bob@example.com", ""},
+		{"Bob@Example.COM", ""},
+		{"bob@example.org", "not in the outbound allowlist"},
+		// Deny wins over a matching allow pattern
+		{"ceo@example.com", "denied by outbound policy"},
+		{"CEO@example.com", "denied by outbound policy"},
+	}
+	for _, tt := range tests {
+		err := p.Reserve([]string{tt.addr})
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("Reserve(%s) = %v, want allowed", tt.addr, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("Reserve(%s) = %v, want %q", tt.addr, err, tt.want)
+		}
+	}
+
+	// One denied recipient blocks the whole send
+	if err := p.Reserve([]string{"bob@example.com", "ceo@example.com"}); err == nil {
+		t.Error("send including a denied recipient was allowed")
+	}
+
+	if _, err := NewOutboundPolicy(&config.OutboundConfig{DenyRecipients: []string{"("}}); err == nil {
+		t.Error("invalid deny pattern compiled")
+	}
+}
+
+func TestOutboundPolicyMailboxRate(t *testing.T) {
+	p, advance := testPolicy(t, &config.OutboundConfig{MaxPerHour: 2})
+
+	for i := 0; i < 2; i++ {
+		if err := p.Reserve([]string{"a@example.com"}); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+		advance(10 * time.Minute)
+	}
+	if err := p.Reserve([]string{"b@example.com"}); err == nil || !strings.Contains(err.Error(), "2 per hour") {
+		t.Fatalf("third send in an hour = %v, want the rate limit", err)
+	}
+
+	// The first send leaves the window after an hour
+	advance(41 * time.Minute)
+	if err := p.Reserve([]string{"b@example.com"}); err != nil {
+		t.Errorf("send after the window moved = %v", err)
+	}
+}
+
+func TestOutboundPolicyRecipientRate(t *testing.T) {
+	p, advance := testPolicy(t, &config.OutboundConfig{MaxPerRecipientPerHour: 1})
+
+	if err := p.Reserve([]string{"a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reserve([]string{"A@example.com"}); err == nil {
+		t.Error("second send to the same recipient was allowed")
+	}
+	// A refused send is not counted for its other recipients
+	if err := p.Reserve([]string{"b@example.com", "a@example.com"}); err == nil {
+		t.Error("send including a limited recipient was allowed")
+	}
+	if err := p.Reserve([]string{"b@example.com"}); err != nil {
+		t.Errorf("send to another recipient = %v", err)
+	}
+
+	advance(rateWindow + time.Second)
+	if err := p.Reserve([]string{"a@example.com"}); err != nil {
+		t.Errorf("send after the window = %v", err)
+	}
+}
+
+func TestOutboundPolicyForgetsRecipients(t *testing.T) {
+	p, advance := testPolicy(t, &config.OutboundConfig{MaxPerRecipientPerHour: 5})
+
+	for i := 0; i < 100; i++ {
+		if err := p.Reserve([]string{strings.Repeat("x", i) + "@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	advance(2 * rateWindow)
+	if err := p.Reserve([]string{"last@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.rcptSent) != 1 {
+		t.Errorf("policy remembers %d recipients, want only the one mailed this hour", len(p.rcptSent))
+	}
+}
+
+func TestEmailToolLoopSuppression(t *testing.T) {
+	tests := []struct {
+		name      string
+		messageID string
+		headers   map[string]string
+		want      string
+	}{
+		{"auto-submitted", "<a@example.org>", map[string]string{"Auto-Submitted": "auto-replied"}, "Auto-Submitted: auto-replied"},
+		{"bulk", "<a@example.org>", map[string]string{"Precedence": "Bulk"}, "Precedence: bulk"},
+		{"list", "<a@example.org>", map[string]string{"List-Id": "<news.example.org>"}, "mailing list message"},
+		{"our own mail", email.NewOutboundMessageID("support@example.com"), nil, "message was sent by eMitt"},
+		{"human", "<a@example.org>", map[string]string{"Auto-Submitted": "no", "Precedence": "first-class"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &recordingSender{}
+			tool := NewEmailTool(sender, "support@example.com", "Support")
+			inbound := &email.InboundEmail{
+				MessageID: tt.messageID,
+				From:      email.Address{Address: "alice@example.org"},
+				Subject:   "Hello",
+				Headers:   tt.headers,
+			}
+			ctx := WithRun(context.Background(), &Run{Email: inbound})
+
+			reply := executeEmail(t, tool, ctx, map[string]interface{}{"action": "reply", "body": "Thanks"})
+			// Sending to the sender directly loops just the same
+			send := executeEmail(t, tool, ctx, map[string]interface{}{
+				"action": "send", "to": []string{"Alice@example.org"}, "subject": "Hi", "body": "Thanks",
+			})
+			if tt.want == "" {
+				if !reply.Success || !send.Success {
+					t.Errorf("mail to a human was suppressed: %s %s", reply.Error, send.Error)
+				}
+				return
+			}
+			if reply.Success || !strings.Contains(reply.Error, tt.want) {
+				t.Errorf("reply = %+v, want suppressed for %q", reply, tt.want)
+			}
+			if send.Success || !strings.Contains(send.Error, tt.want) {
+				t.Errorf("send to the sender = %+v, want suppressed for %q", send, tt.want)
+			}
+
+			// Other recipients can still be mailed, e.g. to alert staff
+			other := executeEmail(t, tool, ctx, map[string]interface{}{
+				"action": "forward", "to": []string{"staff@example.com"}, "body": "FYI",
+			})
+			if !other.Success {
+				t.Errorf("forward to staff = %s", other.Error)
+			}
+		})
+	}
+}
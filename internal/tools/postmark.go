@@ -0,0 +1,108 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// PostmarkSender sends emails via the Postmark Email API
+type PostmarkSender struct {
+	serverToken   string
+	messageStream string
+	baseURL       string
+	client        *http.Client
+}
+
+// NewPostmarkSender creates a new Postmark sender
+func NewPostmarkSender(cfg *config.PostmarkConfig) *PostmarkSender {
+	baseURL := cfg.Endpoint
+	if baseURL == "" {
+		baseURL = "https://api.postmarkapp.com"
+	}
+	stream := cfg.MessageStream
+	if stream == "" {
+		stream = "outbound"
+	}
+	return &PostmarkSender{
+		serverToken:   cfg.ServerToken,
+		messageStream: stream,
+		baseURL:       strings.TrimRight(baseURL, "/"),
+		client:        newProviderClient(),
+	}
+}
+
+type postmarkHeader struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type postmarkRequest struct {
+	From          string           `json:"From"`
+	To            string           `json:"To"`
+	Cc            string           `json:"Cc,omitempty"`
+	Bcc           string           `json:"Bcc,omitempty"`
+	ReplyTo       string           `json:"ReplyTo,omitempty"`
+	Subject       string           `json:"Subject"`
+	TextBody      string           `json:"TextBody,omitempty"`
+	HtmlBody      string           `json:"HtmlBody,omitempty"`
+	Headers       []postmarkHeader `json:"Headers,omitempty"`
+	MessageStream string           `json:"MessageStream"`
+}
+
+type postmarkResponse struct {
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+	MessageID string `json:"MessageID"`
+}
+
+func (s *PostmarkSender) Send(ctx context.Context, e *email.OutboundEmail) error {
+	params := postmarkRequest{
+		From:          e.From.String(),
+		To:            formatAddresses(e.To),
+		Cc:            formatAddresses(e.Cc),
+		Bcc:           formatAddresses(e.Bcc),
+		Subject:       e.Subject,
+		TextBody:      e.TextBody,
+		HtmlBody:      e.HTMLBody,
+		MessageStream: s.messageStream,
+	}
+	if e.ReplyTo != nil {
+		params.ReplyTo = e.ReplyTo.String()
+	}
+	for name, value := range outboundHeaders(e) {
+		params.Headers = append(params.Headers, postmarkHeader{Name: name, Value: value})
+	}
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("postmark: failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.baseURL+"/email", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("postmark: failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Postmark-Server-Token", s.serverToken)
+
+	respBody, err := doProviderRequest(s.client, req, "postmark")
+	if err != nil {
+		return err
+	}
+
+	// Postmark reports some failures with a 200 and a non-zero ErrorCode
+	var result postmarkResponse
+	if err := json.Unmarshal(respBody, &result); err == nil && result.ErrorCode != 0 {
+		return fmt.Errorf("postmark: error %d: %s", result.ErrorCode, result.Message)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+func TestPostmarkSend(t *testing.T) {
+	srv, got := newProviderServer(t, http.StatusOK, `{"ErrorCode":0,"Message":"OK","MessageID":"abc"}`)
+	sender := NewPostmarkSender(&config.PostmarkConfig{ServerToken: "pm-token", Endpoint: srv.URL})
+
+	if err := sender.Send(context.Background(), testOutbound()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if got.method != "POST" || got.path != "/email" {
+		t.Errorf("request = %s %s, want POST /email", got.method, got.path)
+	}
+	if token := got.header.Get("X-Postmark-Server-Token"); token != "pm-token" {
+		t.Errorf("X-Postmark-Server-Token = %q", token)
+	}
+	if accept := got.header.Get("Accept"); accept != "application/json" {
+		t.Errorf("Accept = %q", accept)
+	}
+
+	var req postmarkRequest
+	if err := json.Unmarshal(got.body, &req); err != nil {
+		t.Fatalf("invalid JSON body: %v", err)
+	}
+	if req.From != "Support <support@example.com>" || req.To != "Alice <alice@example.org>" ||
+		req.Cc != "carol@example.org" || req.Bcc != "audit@example.com" || req.ReplyTo != "help@example.com" {
+		t.Errorf("addresses = %+v", req)
+	}
+	if req.MessageStream != "outbound" {
+		t.Errorf("MessageStream = %q, want the default", req.MessageStream)
+	}
+	headers := make(map[string]string)
+	for _, h := range req.Headers {
+		headers[h.Name] = h.Value
+	}
+	if headers["Message-ID"] != "<emitt-out.1234@example.com>" || headers["References"] != "<first@example.org> <orig@example.org>" {
+		t.Errorf("headers = %v", headers)
+	}
+}
+
+func TestPostmarkSendError(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+		want     string
+	}{
+		{"http status", http.StatusUnprocessableEntity, `{"ErrorCode":300,"Message":"Invalid email request"}`, "postmark: API error 422"},
+		{"error code with 200", http.StatusOK, `{"ErrorCode":406,"Message":"Inactive recipient"}`, "postmark: error 406: Inactive recipient"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newProviderServer(t, tt.status, tt.response)
+			sender := NewPostmarkSender(&config.PostmarkConfig{ServerToken: "pm-token", Endpoint: srv.URL})
+
+			err := sender.Send(context.Background(), testOutbound())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
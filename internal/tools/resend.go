@@ -3,7 +3,6 @@ package tools
 import (
 	"context"
 	"fmt"
-	"strings"
 
 	"github.com/resend/resend-go/v2"
 
@@ -69,15 +68,8 @@ func (s *ResendSender) Send(ctx context.Context, e *email.OutboundEmail) error {
 		params.Text = e.TextBody
 	}
 
-	// Set reply headers
-	if e.InReplyTo != "" {
-		params.Headers = map[string]string{
-			"In-Reply-To": e.InReplyTo,
-		}
-		if len(e.References) > 0 {
-			params.Headers["References"] = strings.Join(e.References, " ")
-		}
-	}
+	// Set threading and auto-submitted headers
+	params.Headers = outboundHeaders(e)
 
 	// Send
 	_, err := s.client.Emails.Send(params)
@@ -0,0 +1,32 @@
+package tools
+
+import (
+	"context"
+
+	"github.com/emitt/emitt/internal/email"
+)
+
+// Run is the state of the email being processed. Tools are shared by
+// concurrent runs, so it travels with the context of each run rather than
+// being set on the tools.
+type Run struct {
+	Email    *email.InboundEmail // The email being processed (nil for none)
+	Mailbox  string              // Name of the mailbox it was routed to
+	Policy   *OutboundPolicy     // Outbound policy of its mailbox (nil for none)
+	Template string              // Default template of its mailbox ("" for none)
+}
+
+type runKey struct{}
+
+// WithRun returns a context carrying the state of an email run
+func WithRun(ctx context.Context, run *Run) context.Context {
+	return context.WithValue(ctx, runKey{}, run)
+}
+
+// RunFrom returns the run carried by the context, or an empty run
+func RunFrom(ctx context.Context) *Run {
+	if run, ok := ctx.Value(runKey{}).(*Run); ok && run != nil {
+		return run
+	}
+	return &Run{}
+}
@@ -0,0 +1,116 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// NewSender creates the EmailSender selected by the outbound provider name
+func NewSender(cfg *config.SMTPOutConfig) (EmailSender, error) {
+	switch strings.ToLower(cfg.Provider) {
+	case "":
+		return &NoopSender{}, nil
+	case "resend":
+		if cfg.ResendKey == "" {
+			return nil, fmt.Errorf("resend_key not configured")
+		}
+		return NewResendSender(cfg.ResendKey), nil
+	case "smtp":
+		if cfg.Host == "" {
+			return nil, fmt.Errorf("smtp host not configured")
+		}
+		sender := NewSMTPSender(cfg.Host, cfg.Port, cfg.Username, cfg.Password)
+		if cfg.DKIM.KeyFile != "" {
+			signer, err := NewDKIMSigner(&cfg.DKIM)
+			if err != nil {
+				return nil, err
+			}
+			sender.SetDKIMSigner(signer)
+		}
+		return sender, nil
+	case "sendgrid":
+		if cfg.SendGrid.APIKey == "" {
+			return nil, fmt.Errorf("sendgrid api_key not configured")
+		}
+		return NewSendGridSender(&cfg.SendGrid), nil
+	case "mailgun":
+		if cfg.Mailgun.APIKey == "" || cfg.Mailgun.Domain == "" {
+			return nil, fmt.Errorf("mailgun api_key and domain must be configured")
+		}
+		return NewMailgunSender(&cfg.Mailgun), nil
+	case "postmark":
+		if cfg.Postmark.ServerToken == "" {
+			return nil, fmt.Errorf("postmark server_token not configured")
+		}
+		return NewPostmarkSender(&cfg.Postmark), nil
+	case "ses":
+		return NewSESSender(&cfg.SES)
+	default:
+		return nil, fmt.Errorf("unknown email provider: %s", cfg.Provider)
+	}
+}
+
+// newProviderClient returns the HTTP client used by API-based senders
+func newProviderClient() *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+	}
+}
+
+// doProviderRequest executes a provider API request and returns the response body,
+// treating any non-2xx status as an error
+func doProviderRequest(client *http.Client, req *http.Request, provider string) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: request failed: %w", provider, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to read response: %w", provider, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: API error %d: %s", provider, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+// outboundHeaders returns the extra headers to set on an outbound email
+func outboundHeaders(e *email.OutboundEmail) map[string]string {
+	headers := make(map[string]string)
+	for name, value := range e.Headers {
+		headers[name] = value
+	}
+	if e.MessageID != "" {
+		headers["Message-ID"] = e.MessageID
+	}
+	if e.InReplyTo != "" {
+		headers["In-Reply-To"] = e.InReplyTo
+	}
+	if len(e.References) > 0 {
+		headers["References"] = strings.Join(e.References, " ")
+	}
+	// Mark everything we send as automated so other responders don't reply (RFC 3834)
+	if _, ok := headers["Auto-Submitted"]; !ok {
+		headers["Auto-Submitted"] = "auto-replied"
+	}
+	return headers
+}
+
+// addressList returns just the email addresses from a list
+func addressList(addrs []email.Address) []string {
+	result := make([]string, len(addrs))
+	for i, a := range addrs {
+		result[i] = a.Address
+	}
+	return result
+}
@@ -0,0 +1,95 @@
+package tools
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emitt/emitt/internal/email"
+)
+
+// capturedRequest is what a fake provider API received
+type capturedRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// newProviderServer starts a fake provider API that records each request
+// and answers with the given status and body
+func newProviderServer(t *testing.T, status int, response string) (*httptest.Server, *capturedRequest) {
+	t.Helper()
+	captured := &capturedRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request body: %v", err)
+		}
+		captured.method = r.Method
+		captured.path = r.URL.EscapedPath()
+		captured.header = r.Header.Clone()
+		captured.header.Set("Host", r.Host)
+		captured.body = body
+		w.WriteHeader(status)
+		io.WriteString(w, response)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, captured
+}
+
+// testOutbound returns a reply with every field a provider maps
+func testOutbound() *email.OutboundEmail {
+	return &email.OutboundEmail{
+		From:       email.Address{Name: "Support", Address: "support@example.com"},
+		To:         []email.Address{{Name: "Alice", Address: "alice@example.org"}},
+		Cc:         []email.Address{{Address: "carol@example.org"}},
+		Bcc:        []email.Address{{Address: "audit@example.com"}},
+		ReplyTo:    &email.Address{Address: "help@example.com"},
+		Subject:    "Re: Order 42",
+		TextBody:   "Your order has shipped.",
+		HTMLBody:   "<p>Your order has shipped.</p>",
+		MessageID:  "<emitt-out.1234@example.com>",
+		InReplyTo:  "<orig@example.org>",
+		References: []string{"<first@example.org>", "<orig@example.org>"},
+		Headers:    map[string]string{"X-Ticket": "42"},
+	}
+}
+
+func TestOutboundHeaders(t *testing.T) {
+	headers := outboundHeaders(testOutbound())
+
+	want := map[string]string{
+		"Message-ID":     "<emitt-out.1234@example.com>",
+		"In-Reply-To":    "<orig@example.org>",
+		"References":     "<first@example.org> <orig@example.org>",
+		"Auto-Submitted": "auto-replied",
+		"X-Ticket":       "42",
+	}
+	for name, value := range want {
+		if headers[name] != value {
+			t.Errorf("%s = %q, want %q", name, headers[name], value)
+		}
+	}
+
+	e := testOutbound()
+	e.Headers["Auto-Submitted"] = "auto-generated"
+	if got := outboundHeaders(e)["Auto-Submitted"]; got != "auto-generated" {
+		t.Errorf("Auto-Submitted = %q, want the caller's value kept", got)
+	}
+}
+
+func TestDoProviderRequestError(t *testing.T) {
+	srv, _ := newProviderServer(t, http.StatusUnauthorized, "bad key\n")
+
+	req, _ := http.NewRequest("POST", srv.URL, nil)
+	_, err := doProviderRequest(srv.Client(), req, "test")
+	if err == nil {
+		t.Fatal("expected an error for a 401 response")
+	}
+	if !strings.Contains(err.Error(), "test: API error 401: bad key") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
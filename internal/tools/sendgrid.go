@@ -0,0 +1,112 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// SendGridSender sends emails via the SendGrid v3 Mail Send API
+type SendGridSender struct {
+	apiKey  string
+	baseURL string
+	client  *http.Client
+}
+
+// NewSendGridSender creates a new SendGrid sender
+func NewSendGridSender(cfg *config.SendGridConfig) *SendGridSender {
+	baseURL := cfg.Endpoint
+	if baseURL == "" {
+		baseURL = "https://api.sendgrid.com"
+	}
+	return &SendGridSender{
+		apiKey:  cfg.APIKey,
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  newProviderClient(),
+	}
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendGridPersonalization struct {
+	To  []sendGridAddress `json:"to"`
+	Cc  []sendGridAddress `json:"cc,omitempty"`
+	Bcc []sendGridAddress `json:"bcc,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+}
+
+func toSendGridAddresses(addrs []email.Address) []sendGridAddress {
+	if len(addrs) == 0 {
+		return nil
+	}
+	result := make([]sendGridAddress, len(addrs))
+	for i, a := range addrs {
+		result[i] = sendGridAddress{Email: a.Address, Name: a.Name}
+	}
+	return result
+}
+
+func (s *SendGridSender) Send(ctx context.Context, e *email.OutboundEmail) error {
+	params := sendGridRequest{
+		Personalizations: []sendGridPersonalization{{
+			To:  toSendGridAddresses(e.To),
+			Cc:  toSendGridAddresses(e.Cc),
+			Bcc: toSendGridAddresses(e.Bcc),
+		}},
+		From:    sendGridAddress{Email: e.From.Address, Name: e.From.Name},
+		Subject: e.Subject,
+	}
+
+	if e.ReplyTo != nil {
+		params.ReplyTo = &sendGridAddress{Email: e.ReplyTo.Address, Name: e.ReplyTo.Name}
+	}
+
+	// SendGrid requires text/plain to come before text/html
+	if e.TextBody != "" {
+		params.Content = append(params.Content, sendGridContent{Type: "text/plain", Value: e.TextBody})
+	}
+	if e.HTMLBody != "" {
+		params.Content = append(params.Content, sendGridContent{Type: "text/html", Value: e.HTMLBody})
+	}
+
+	if headers := outboundHeaders(e); len(headers) > 0 {
+		params.Headers = headers
+	}
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("sendgrid: failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.baseURL+"/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("sendgrid: failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+
+	_, err = doProviderRequest(s.client, req, "sendgrid")
+	return err
+}
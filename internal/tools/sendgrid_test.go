@@ -0,0 +1,61 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+func TestSendGridSend(t *testing.T) {
+	srv, got := newProviderServer(t, http.StatusAccepted, "")
+	sender := NewSendGridSender(&config.SendGridConfig{APIKey: "SG.key", Endpoint: srv.URL + "/"})
+
+	if err := sender.Send(context.Background(), testOutbound()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if got.method != "POST" || got.path != "/v3/mail/send" {
+		t.Errorf("request = %s %s, want POST /v3/mail/send", got.method, got.path)
+	}
+	if auth := got.header.Get("Authorization"); auth != "Bearer SG.key" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	if ct := got.header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	var req sendGridRequest
+	if err := json.Unmarshal(got.body, &req); err != nil {
+		t.Fatalf("invalid JSON body: %v", err)
+	}
+	p := req.Personalizations[0]
+	if len(p.To) != 1 || p.To[0] != (sendGridAddress{Email: "alice@example.org", Name: "Alice"}) {
+		t.Errorf("to = %+v", p.To)
+	}
+	if len(p.Cc) != 1 || len(p.Bcc) != 1 || p.Bcc[0].Email != "audit@example.com" {
+		t.Errorf("cc = %+v, bcc = %+v", p.Cc, p.Bcc)
+	}
+	if req.From.Email != "support@example.com" || req.ReplyTo == nil || req.ReplyTo.Email != "help@example.com" {
+		t.Errorf("from = %+v, reply_to = %+v", req.From, req.ReplyTo)
+	}
+	if len(req.Content) != 2 || req.Content[0].Type != "text/plain" || req.Content[1].Type != "text/html" {
+		t.Errorf("content = %+v, want text/plain then text/html", req.Content)
+	}
+	if req.Headers["Message-ID"] != "<emitt-out.1234@example.com>" || req.Headers["In-Reply-To"] != "<orig@example.org>" {
+		t.Errorf("headers = %v", req.Headers)
+	}
+}
+
+func TestSendGridSendError(t *testing.T) {
+	srv, _ := newProviderServer(t, http.StatusBadRequest, `{"errors":[{"message":"invalid from"}]}`)
+	sender := NewSendGridSender(&config.SendGridConfig{APIKey: "SG.key", Endpoint: srv.URL})
+
+	err := sender.Send(context.Background(), testOutbound())
+	if err == nil || !strings.Contains(err.Error(), "sendgrid: API error 400") || !strings.Contains(err.Error(), "invalid from") {
+		t.Errorf("err = %v, want the API error", err)
+	}
+}
@@ -0,0 +1,304 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// SESSender sends emails via the Amazon SES v2 SendEmail API
+type SESSender struct {
+	region           string
+	accessKeyID      string
+	secretAccessKey  string
+	sessionToken     string
+	configurationSet string
+	baseURL          string
+	client           *http.Client
+	now              func() time.Time
+}
+
+// NewSESSender creates a new Amazon SES sender
+func NewSESSender(cfg *config.SESConfig) (*SESSender, error) {
+	region := cfg.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("ses region not configured")
+	}
+
+	s := &SESSender{
+		region:           region,
+		accessKeyID:      cfg.AccessKeyID,
+		secretAccessKey:  cfg.SecretAccessKey,
+		sessionToken:     cfg.SessionToken,
+		configurationSet: cfg.ConfigurationSet,
+		baseURL:          strings.TrimRight(cfg.Endpoint, "/"),
+		client:           newProviderClient(),
+		now:              time.Now,
+	}
+
+	// Fall back to the standard AWS environment variables
+	if s.accessKeyID == "" {
+		s.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if s.accessKeyID == "" || s.secretAccessKey == "" {
+		return nil, fmt.Errorf("ses credentials not configured")
+	}
+
+	if s.baseURL == "" {
+		s.baseURL = fmt.Sprintf("https://email.%s.amazonaws.com", region)
+	}
+
+	return s, nil
+}
+
+type sesDestination struct {
+	ToAddresses  []string `json:"ToAddresses,omitempty"`
+	CcAddresses  []string `json:"CcAddresses,omitempty"`
+	BccAddresses []string `json:"BccAddresses,omitempty"`
+}
+
+type sesRaw struct {
+	Data []byte `json:"Data"` // Encoded as base64 by encoding/json
+}
+
+type sesRequest struct {
+	FromEmailAddress string         `json:"FromEmailAddress"`
+	Destination      sesDestination `json:"Destination"`
+	ReplyToAddresses []string       `json:"ReplyToAddresses,omitempty"`
+	Content          struct {
+		Raw sesRaw `json:"Raw"`
+	} `json:"Content"`
+	ConfigurationSetName string `json:"ConfigurationSetName,omitempty"`
+}
+
+// Send submits the message as raw MIME. Simple content cannot carry a
+// Message-ID header, and without ours replies would not thread.
+func (s *SESSender) Send(ctx context.Context, e *email.OutboundEmail) error {
+	params := sesRequest{
+		FromEmailAddress: e.From.String(),
+		Destination: sesDestination{
+			ToAddresses:  addressList(e.To),
+			CcAddresses:  addressList(e.Cc),
+			BccAddresses: addressList(e.Bcc),
+		},
+		ConfigurationSetName: s.configurationSet,
+	}
+	if e.ReplyTo != nil {
+		params.ReplyToAddresses = []string{e.ReplyTo.String()}
+	}
+
+	raw, err := buildRawMessage(e, s.now())
+	if err != nil {
+		return fmt.Errorf("ses: failed to build message: %w", err)
+	}
+	params.Content.Raw.Data = raw
+
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("ses: failed to marshal request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.baseURL+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("ses: failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, body)
+
+	_, err = doProviderRequest(s.client, req, "ses")
+	return err
+}
+
+// buildRawMessage renders an outbound email as a MIME message. Bcc
+// recipients are left out of the headers.
+func buildRawMessage(e *email.OutboundEmail, date time.Time) ([]byte, error) {
+	var msg bytes.Buffer
+	writeHeader := func(name, value string) {
+		msg.WriteString(name + ": " + value + "\r\n")
+	}
+
+	writeHeader("From", encodeAddress(e.From))
+	to := make([]string, len(e.To))
+	for i, a := range e.To {
+		to[i] = encodeAddress(a)
+	}
+	writeHeader("To", strings.Join(to, ", "))
+	if len(e.Cc) > 0 {
+		cc := make([]string, len(e.Cc))
+		for i, a := range e.Cc {
+			cc[i] = encodeAddress(a)
+		}
+		writeHeader("Cc", strings.Join(cc, ", "))
+	}
+	if e.ReplyTo != nil {
+		writeHeader("Reply-To", encodeAddress(*e.ReplyTo))
+	}
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", e.Subject))
+	writeHeader("Date", date.Format(time.RFC1123Z))
+
+	headers := outboundHeaders(e)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeHeader(name, headers[name])
+	}
+	writeHeader("MIME-Version", "1.0")
+
+	if e.HTMLBody == "" {
+		writeHeader("Content-Type", "text/plain; charset=utf-8")
+		writeHeader("Content-Transfer-Encoding", "quoted-printable")
+		msg.WriteString("\r\n")
+		if err := writeQuotedPrintable(&msg, e.TextBody); err != nil {
+			return nil, err
+		}
+		return msg.Bytes(), nil
+	}
+
+	var parts bytes.Buffer
+	mw := multipart.NewWriter(&parts)
+	writeHeader("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	msg.WriteString("\r\n")
+
+	bodies := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", e.TextBody},
+		{"text/html; charset=utf-8", e.HTMLBody},
+	}
+	for _, b := range bodies {
+		if b.body == "" {
+			continue
+		}
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {b.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(part, b.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	msg.Write(parts.Bytes())
+	return msg.Bytes(), nil
+}
+
+// encodeAddress formats an address for a header, encoding a non-ASCII
+// display name
+func encodeAddress(a email.Address) string {
+	if a.Name == "" {
+		return a.Address
+	}
+	return (&mail.Address{Name: a.Name, Address: a.Address}).String()
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// sign adds AWS Signature Version 4 headers to the request
+func (s *SESSender) sign(req *http.Request, payload []byte) {
+	now := s.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// Canonical headers must be lowercase and sorted
+	var names []string
+	canonical := make(map[string]string)
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		names = append(names, lower)
+		canonical[lower] = strings.TrimSpace(req.Header.Get(name))
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + canonical[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/ses/aws4_request", dateStamp, s.region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), dateStamp)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "ses")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
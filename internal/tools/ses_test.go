@@ -0,0 +1,232 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emitt/emitt/internal/config"
+)
+
+func newTestSESSender(t *testing.T, endpoint string) *SESSender {
+	t.Helper()
+	sender, err := NewSESSender(&config.SESConfig{
+		Region:           "eu-west-1",
+		AccessKeyID:      "AKIDEXAMPLE",
+		SecretAccessKey:  "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:     "session-token",
+		ConfigurationSet: "replies",
+		Endpoint:         endpoint,
+	})
+	if err != nil {
+		t.Fatalf("NewSESSender: %v", err)
+	}
+	sender.now = func() time.Time { return time.Date(2024, 3, 9, 14, 5, 7, 0, time.UTC) }
+	return sender
+}
+
+func TestSESSend(t *testing.T) {
+	srv, got := newProviderServer(t, http.StatusOK, `{"MessageId":"0100018e"}`)
+	sender := newTestSESSender(t, srv.URL)
+
+	if err := sender.Send(context.Background(), testOutbound()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if got.method != "POST" || got.path != "/v2/email/outbound-emails" {
+		t.Errorf("request = %s %s", got.method, got.path)
+	}
+
+	var req sesRequest
+	if err := json.Unmarshal(got.body, &req); err != nil {
+		t.Fatalf("invalid JSON body: %v", err)
+	}
+	if req.FromEmailAddress != "Support <support@example.com>" || req.ConfigurationSetName != "replies" {
+		t.Errorf("from = %q, configuration set = %q", req.FromEmailAddress, req.ConfigurationSetName)
+	}
+	dest := req.Destination
+	if strings.Join(dest.ToAddresses, ",") != "alice@example.org" ||
+		strings.Join(dest.CcAddresses, ",") != "carol@example.org" ||
+		strings.Join(dest.BccAddresses, ",") != "audit@example.com" {
+		t.Errorf("destination = %+v", dest)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(req.Content.Raw.Data))
+	if err != nil {
+		t.Fatalf("raw content is not a message: %v", err)
+	}
+	want := map[string]string{
+		"Message-ID":     "<emitt-out.1234@example.com>",
+		"In-Reply-To":    "<orig@example.org>",
+		"References":     "<first@example.org> <orig@example.org>",
+		"Auto-Submitted": "auto-replied",
+		"X-Ticket":       "42",
+		"Subject":        "Re: Order 42",
+		"Reply-To":       "help@example.com",
+		"Cc":             "carol@example.org",
+		"Date":           "Sat, 09 Mar 2024 14:05:07 +0000",
+	}
+	for name, value := range want {
+		if msg.Header.Get(name) != value {
+			t.Errorf("%s = %q, want %q", name, msg.Header.Get(name), value)
+		}
+	}
+	if msg.Header.Get("Bcc") != "" {
+		t.Error("Bcc must not appear in the message headers")
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", msg.Header.Get("Content-Type"))
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var bodies []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read part: %v", err)
+		}
+		data, _ := io.ReadAll(part) // Quoted-printable is decoded by the reader
+		bodies = append(bodies, part.Header.Get("Content-Type")+": "+string(data))
+	}
+	wantBodies := []string{
+		"text/plain; charset=utf-8: Your order has shipped.",
+		"text/html; charset=utf-8: <p>Your order has shipped.</p>",
+	}
+	if strings.Join(bodies, "\n") != strings.Join(wantBodies, "\n") {
+		t.Errorf("parts = %q, want %q", bodies, wantBodies)
+	}
+}
+
+func TestSESRawMessageEncoding(t *testing.T) {
+	e := testOutbound()
+	e.From.Name = "Équipe Support"
+	e.Subject = "Re: Café order"
+	e.HTMLBody = ""
+
+	raw, err := buildRawMessage(e, time.Now())
+	if err != nil {
+		t.Fatalf("buildRawMessage: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("invalid message: %v", err)
+	}
+
+	subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if subject != "Re: Café order" {
+		t.Errorf("Subject = %q", subject)
+	}
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Équipe Support" {
+		t.Errorf("From = %q (%v)", msg.Header.Get("From"), err)
+	}
+	if ct := msg.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want text/plain for a text-only reply", ct)
+	}
+	if bytes.Contains(raw, []byte("Café")) {
+		t.Error("raw message must be 7-bit")
+	}
+}
+
+// TestSESSignature checks the SigV4 signature by recomputing it from the
+// request the server received
+func TestSESSignature(t *testing.T) {
+	srv, got := newProviderServer(t, http.StatusOK, `{}`)
+	sender := newTestSESSender(t, srv.URL)
+
+	if err := sender.Send(context.Background(), testOutbound()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if d := got.header.Get("X-Amz-Date"); d != "20240309T140507Z" {
+		t.Errorf("X-Amz-Date = %q", d)
+	}
+	if tok := got.header.Get("X-Amz-Security-Token"); tok != "session-token" {
+		t.Errorf("X-Amz-Security-Token = %q", tok)
+	}
+	payloadHash := sha256Hex(got.body)
+	if h := got.header.Get("X-Amz-Content-Sha256"); h != payloadHash {
+		t.Errorf("X-Amz-Content-Sha256 = %q, want the body hash %q", h, payloadHash)
+	}
+
+	auth := got.header.Get("Authorization")
+	const prefix = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240309/eu-west-1/ses/aws4_request, SignedHeaders="
+	if !strings.HasPrefix(auth, prefix) {
+		t.Fatalf("Authorization = %q", auth)
+	}
+	fields := strings.SplitN(strings.TrimPrefix(auth, prefix), ", Signature=", 2)
+	if len(fields) != 2 {
+		t.Fatalf("Authorization = %q", auth)
+	}
+	signedHeaders, signature := fields[0], fields[1]
+	for _, name := range []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date", "x-amz-security-token"} {
+		if !strings.Contains(";"+signedHeaders+";", ";"+name+";") {
+			t.Errorf("SignedHeaders %q is missing %s", signedHeaders, name)
+		}
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(got.header.Get(name)) + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		got.method, got.path, "", canonicalHeaders.String(), signedHeaders, payloadHash,
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n20240309T140507Z\n20240309/eu-west-1/ses/aws4_request\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY")
+	for _, part := range []string{"20240309", "eu-west-1", "ses", "aws4_request"} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	if want := hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("Signature = %s, want %s", signature, want)
+	}
+}
+
+func TestSESSendError(t *testing.T) {
+	srv, _ := newProviderServer(t, http.StatusForbidden, `{"message":"The security token included in the request is invalid."}`)
+	sender := newTestSESSender(t, srv.URL)
+
+	err := sender.Send(context.Background(), testOutbound())
+	if err == nil || !strings.Contains(err.Error(), "ses: API error 403") || !strings.Contains(err.Error(), "security token") {
+		t.Errorf("err = %v, want the API error", err)
+	}
+}
+
+func TestNewSESSenderCredentials(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if _, err := NewSESSender(&config.SESConfig{}); err == nil {
+		t.Error("expected an error without credentials")
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	sender, err := NewSESSender(&config.SESConfig{})
+	if err != nil {
+		t.Fatalf("NewSESSender: %v", err)
+	}
+	if sender.region != "us-east-1" || sender.accessKeyID != "AKIDENV" || sender.baseURL != "https://email.us-east-1.amazonaws.com" {
+		t.Errorf("sender = %+v, want the environment settings", sender)
+	}
+}
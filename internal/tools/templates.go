@@ -0,0 +1,152 @@
+package tools
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	texttemplate "text/template"
+
+	"github.com/emitt/emitt/internal/config"
+	"github.com/emitt/emitt/internal/email"
+)
+
+// TemplateData is the data available to outbound templates
+type TemplateData struct {
+	// Body is the plain text body written by the model (or processor)
+	Body string
+	// HTMLBody is the HTML body written by the model, if any
+	HTMLBody htmltemplate.HTML
+	// Vars holds the variables passed to send_email
+	Vars map[string]interface{}
+	// Email is the inbound email being processed (may be nil)
+	Email *email.InboundEmail
+}
+
+// RenderedTemplate is the output of rendering an outbound template
+type RenderedTemplate struct {
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// OutboundTemplate is a compiled named template
+type OutboundTemplate struct {
+	Name    string
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// TemplateSet holds the configured outbound templates
+type TemplateSet struct {
+	templates map[string]*OutboundTemplate
+}
+
+// NewTemplateSet compiles outbound templates from configuration
+func NewTemplateSet(cfgs []config.TemplateConfig) (*TemplateSet, error) {
+	ts := &TemplateSet{
+		templates: make(map[string]*OutboundTemplate),
+	}
+
+	for _, cfg := range cfgs {
+		if cfg.Name == "" {
+			return nil, fmt.Errorf("template name is required")
+		}
+		if _, exists := ts.templates[cfg.Name]; exists {
+			return nil, fmt.Errorf("duplicate template: %s", cfg.Name)
+		}
+
+		tmpl, err := compileTemplate(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %w", cfg.Name, err)
+		}
+		ts.templates[cfg.Name] = tmpl
+	}
+
+	return ts, nil
+}
+
+func compileTemplate(cfg config.TemplateConfig) (*OutboundTemplate, error) {
+	tmpl := &OutboundTemplate{Name: cfg.Name}
+
+	textSrc, err := templateSource(cfg.Text, cfg.TextFile)
+	if err != nil {
+		return nil, err
+	}
+	htmlSrc, err := templateSource(cfg.HTML, cfg.HTMLFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Subject != "" {
+		if tmpl.subject, err = texttemplate.New("subject").Option("missingkey=zero").Parse(cfg.Subject); err != nil {
+			return nil, fmt.Errorf("invalid subject: %w", err)
+		}
+	}
+	if textSrc != "" {
+		if tmpl.text, err = texttemplate.New("text").Option("missingkey=zero").Parse(textSrc); err != nil {
+			return nil, fmt.Errorf("invalid text: %w", err)
+		}
+	}
+	if htmlSrc != "" {
+		if tmpl.html, err = htmltemplate.New("html").Option("missingkey=zero").Parse(htmlSrc); err != nil {
+			return nil, fmt.Errorf("invalid html: %w", err)
+		}
+	}
+
+	return tmpl, nil
+}
+
+// templateSource returns the inline source, or the contents of the file if set
+func templateSource(inline, path string) (string, error) {
+	if path == "" {
+		return inline, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return string(data), nil
+}
+
+// Has reports whether a template with the given name exists
+func (ts *TemplateSet) Has(name string) bool {
+	_, ok := ts.templates[name]
+	return ok
+}
+
+// Render renders the named template. Parts the template does not define are
+// returned empty so the caller can keep its own values.
+func (ts *TemplateSet) Render(name string, data TemplateData) (*RenderedTemplate, error) {
+	tmpl, ok := ts.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template: %s", name)
+	}
+
+	var out RenderedTemplate
+	var buf bytes.Buffer
+
+	if tmpl.subject != nil {
+		if err := tmpl.subject.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("template %s subject: %w", name, err)
+		}
+		out.Subject = buf.String()
+		buf.Reset()
+	}
+	if tmpl.text != nil {
+		if err := tmpl.text.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("template %s text: %w", name, err)
+		}
+		out.Text = buf.String()
+		buf.Reset()
+	}
+	if tmpl.html != nil {
+		if err := tmpl.html.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("template %s html: %w", name, err)
+		}
+		out.HTML = buf.String()
+	}
+
+	return &out, nil
+}